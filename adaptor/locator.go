@@ -0,0 +1,37 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package adaptor
+
+import (
+	"net"
+)
+
+// Locator defines the interface for modules providing geolocation information
+// for IP addresses. It is used to enrich nodes and records with the country,
+// city and autonomous system of the remote peer. Unknown values are returned
+// as empty strings and zero.
+type Locator interface {
+	SetLog(Log)
+	Locate(net.IP) (country string, city string, asn uint32)
+	Reload() error
+	Start()
+	Stop()
+}
@@ -20,6 +20,12 @@
 
 package adaptor
 
+import (
+	"net"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
 // Manager defines the interface used by peers to communicate with their
 // manager. It is notified of peer state, keeps track of shared state and
 // decides on actions depending on state. Different managers can implement
@@ -29,11 +35,13 @@ type Manager interface {
 	SetRepository(Repository)
 	SetTracker(Tracker)
 	AddProcessor(Processor)
-	Incoming(Peer)
+	Incoming(*net.TCPConn)
 	Outgoing(Peer)
 	Connected(Peer)
 	Ready(Peer)
 	Stopped(Peer)
+	Listening(*net.TCPAddr)
+	Relay(Peer, []*wire.NetAddress)
 	Start()
 	Stop()
 }
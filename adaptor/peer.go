@@ -22,6 +22,9 @@ package adaptor
 
 import (
 	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
 )
 
 // Peer defines a common interface for managers to communicate with peers. It
@@ -29,9 +32,13 @@ import (
 type Peer interface {
 	String() string
 	Addr() *net.TCPAddr
+	Version() *wire.MsgVersion
+	Latency() time.Duration
 	Start()
 	Stop()
+	Disconnect(string)
 	Connect()
 	Greet()
 	Poll()
+	Announce([]*wire.NetAddress)
 }
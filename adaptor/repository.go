@@ -22,6 +22,9 @@ package adaptor
 
 import (
 	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
 )
 
 // Repository defines a common interface for a node repository. It keeps track
@@ -29,11 +32,14 @@ import (
 // provides clients with a stream of addresses ordered by favourability.
 type Repository interface {
 	SetLog(Log)
+	SetLocator(Locator)
 	Discovered(*net.TCPAddr)
 	Attempted(*net.TCPAddr)
 	Connected(*net.TCPAddr)
 	Succeeded(*net.TCPAddr)
+	Measured(*net.TCPAddr, time.Duration, time.Duration, time.Duration)
 	Retrieve(chan<- *net.TCPAddr)
+	Sample(int) []*wire.NetAddress
 	Start()
 	Stop()
 }
@@ -26,10 +26,15 @@ import (
 
 type Tracker interface {
 	SetLog(Log)
+	Network() wire.BitcoinNet
 	AddTx(hash wire.ShaHash)
 	KnowsTx(hash wire.ShaHash) bool
 	AddBlock(hash wire.ShaHash)
 	KnowsBlock(hash wire.ShaHash) bool
+	AddHeader(hdr *wire.BlockHeader) bool
+	Locator() []*wire.ShaHash
+	Headers(locator []*wire.ShaHash, stop *wire.ShaHash,
+		max int) []*wire.BlockHeader
 	Start()
 	Stop()
 }
@@ -0,0 +1,280 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package capture implements the binary format we use to store raw messages
+// of the Bitcoin network, as they were sent on the wire.
+//
+// A capture file starts with an eight byte magic and holds one entry per
+// message. Every entry starts with its length as a little-endian uint32,
+// followed by the timestamp in nanoseconds since the Unix epoch as int64, the
+// remote and the local address, each as a 16 byte IP address and a uint16
+// port, a flags byte and finally the complete message with its header. The
+// lowest bit of the flags is set for messages we sent to the remote peer. The
+// message can be decoded again with wire.ReadMessage.
+//
+// An index file starts with its own eight byte magic and holds one fixed-size
+// entry per message: the timestamp, the offset of the entry in the capture
+// file as int64 and the command of the message, padded with zeros to twelve
+// bytes.
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// Magic is written at the start of every capture file.
+	Magic = "PBTCCAP\x01"
+
+	// IndexMagic is written at the start of every index file.
+	IndexMagic = "PBTCIDX\x01"
+)
+
+const (
+	headerSize   = 8 + 18 + 18 + 1
+	commandSize  = 12
+	indexSize    = 8 + 8 + commandSize
+	flagOutbound = 0x01
+)
+
+// Entry is one captured message with the time and connection it was seen on.
+type Entry struct {
+	Stamp    time.Time
+	Remote   *net.TCPAddr
+	Local    *net.TCPAddr
+	Outbound bool
+	Raw      []byte
+}
+
+// Command returns the command of the message, as given in its header.
+func (entry *Entry) Command() string {
+	if len(entry.Raw) < 4+commandSize {
+		return ""
+	}
+
+	cmd := entry.Raw[4 : 4+commandSize]
+	return string(bytes.TrimRight(cmd, "\x00"))
+}
+
+// IndexEntry is the index entry for one captured message.
+type IndexEntry struct {
+	Stamp   time.Time
+	Offset  int64
+	Command string
+}
+
+// Writer writes entries to a capture file and, optionally, an index file.
+type Writer struct {
+	w      io.Writer
+	idx    io.Writer
+	offset int64
+}
+
+// NewWriter creates a writer and writes the file headers. The index writer
+// can be nil.
+func NewWriter(w io.Writer, idx io.Writer) (*Writer, error) {
+	_, err := io.WriteString(w, Magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if idx != nil {
+		_, err = io.WriteString(idx, IndexMagic)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writer := &Writer{
+		w:      w,
+		idx:    idx,
+		offset: int64(len(Magic)),
+	}
+
+	return writer, nil
+}
+
+// Offset returns the number of bytes written to the capture file so far.
+func (writer *Writer) Offset() int64 {
+	return writer.offset
+}
+
+// Write appends an entry to the capture file and the index.
+func (writer *Writer) Write(entry *Entry) error {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(headerSize+len(entry.Raw)))
+	binary.Write(buf, binary.LittleEndian, entry.Stamp.UnixNano())
+	writeAddress(buf, entry.Remote)
+	writeAddress(buf, entry.Local)
+	var flags byte
+	if entry.Outbound {
+		flags |= flagOutbound
+	}
+	buf.WriteByte(flags)
+	buf.Write(entry.Raw)
+
+	n, err := writer.w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	offset := writer.offset
+	writer.offset += int64(n)
+
+	if writer.idx == nil {
+		return nil
+	}
+
+	ibuf := new(bytes.Buffer)
+	binary.Write(ibuf, binary.LittleEndian, entry.Stamp.UnixNano())
+	binary.Write(ibuf, binary.LittleEndian, offset)
+	cmd := make([]byte, commandSize)
+	copy(cmd, entry.Command())
+	ibuf.Write(cmd)
+
+	_, err = writer.idx.Write(ibuf.Bytes())
+
+	return err
+}
+
+// Reader reads entries from a capture file.
+type Reader struct {
+	r io.Reader
+}
+
+// NewReader creates a reader and checks the file header.
+func NewReader(r io.Reader) (*Reader, error) {
+	magic := make([]byte, len(Magic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(magic) != Magic {
+		return nil, errors.New("invalid capture file")
+	}
+
+	reader := &Reader{r: r}
+
+	return reader, nil
+}
+
+// Next reads the next entry. It returns io.EOF when there are no more entries.
+func (reader *Reader) Next() (*Entry, error) {
+	var length uint32
+	err := binary.Read(reader.r, binary.LittleEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+
+	if length < headerSize {
+		return nil, errors.New("invalid capture entry")
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(reader.r, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		Stamp:    time.Unix(0, int64(binary.LittleEndian.Uint64(buf[0:8]))),
+		Remote:   readAddress(buf[8:26]),
+		Local:    readAddress(buf[26:44]),
+		Outbound: buf[44]&flagOutbound != 0,
+		Raw:      buf[headerSize:],
+	}
+
+	return entry, nil
+}
+
+// ReadIndex reads all entries of an index file.
+func ReadIndex(r io.Reader) ([]*IndexEntry, error) {
+	magic := make([]byte, len(IndexMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(magic) != IndexMagic {
+		return nil, errors.New("invalid index file")
+	}
+
+	entries := make([]*IndexEntry, 0)
+	buf := make([]byte, indexSize)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &IndexEntry{
+			Stamp:   time.Unix(0, int64(binary.LittleEndian.Uint64(buf[0:8]))),
+			Offset:  int64(binary.LittleEndian.Uint64(buf[8:16])),
+			Command: string(bytes.TrimRight(buf[16:], "\x00")),
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// ReadAt reads the entry at the given offset of a capture file, as found in
+// the index.
+func ReadAt(r io.ReaderAt, offset int64) (*Entry, error) {
+	reader := &Reader{r: io.NewSectionReader(r, offset, 1<<62)}
+
+	return reader.Next()
+}
+
+// writeAddress writes an address as 16 byte IP address and port.
+func writeAddress(buf *bytes.Buffer, addr *net.TCPAddr) {
+	ip := make([]byte, net.IPv6len)
+	port := uint16(0)
+	if addr != nil {
+		copy(ip, addr.IP.To16())
+		port = uint16(addr.Port)
+	}
+
+	buf.Write(ip)
+	binary.Write(buf, binary.LittleEndian, port)
+}
+
+// readAddress reads an address written by writeAddress.
+func readAddress(buf []byte) *net.TCPAddr {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, buf[:16])
+
+	addr := &net.TCPAddr{
+		IP:   ip,
+		Port: int(binary.LittleEndian.Uint16(buf[16:18])),
+	}
+
+	return addr
+}
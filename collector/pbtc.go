@@ -84,6 +84,7 @@ SigLoop:
 			break SigLoop
 
 		case syscall.SIGHUP:
+			supervisor.Reload()
 			continue
 		}
 	}
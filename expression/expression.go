@@ -0,0 +1,77 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package expression implements boolean filter expressions over the fields of
+// records, for example:
+//
+//	command in (TX, BLOCK) and (ip in 1.2.3.0/24 or address == "1dice...")
+//
+// Comparisons take the form 'field operator value' or 'field [not] in (value,
+// ...)', with the operators ==, !=, <, <=, > and >=; the parentheses can be
+// left out for a single value after in. They can be combined with and, or,
+// not and parentheses. Values are checked against the type of the field when
+// compiling. IP fields match networks in CIDR notation as well as single
+// addresses. A comparison is true if any value of the field satisfies it; !=
+// and not in are true if none does.
+package expression
+
+import (
+	"github.com/CIRCL/pbtc/adaptor"
+)
+
+// matcher is the compiled form of an expression.
+type matcher func(adaptor.Record) bool
+
+// Expression is a compiled filter expression.
+type Expression struct {
+	src   string
+	match matcher
+}
+
+// Compile parses and type checks an expression.
+func Compile(src string) (*Expression, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	match, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	expr := &Expression{
+		src:   src,
+		match: match,
+	}
+
+	return expr, nil
+}
+
+// Match evaluates the expression for the given record.
+func (expr *Expression) Match(record adaptor.Record) bool {
+	return expr.match(record)
+}
+
+// String returns the source of the expression.
+func (expr *Expression) String() string {
+	return expr.src
+}
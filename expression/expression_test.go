@@ -0,0 +1,304 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package expression
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testRecord is a minimal record carrying the peer, direction and location
+// fields that expressions can match on.
+type testRecord struct {
+	cmd     string
+	ra      *net.TCPAddr
+	la      *net.TCPAddr
+	dir     string
+	country string
+	city    string
+	asn     uint32
+}
+
+func (r *testRecord) Timestamp() time.Time        { return time.Time{} }
+func (r *testRecord) RemoteAddress() *net.TCPAddr { return r.ra }
+func (r *testRecord) LocalAddress() *net.TCPAddr  { return r.la }
+func (r *testRecord) Command() string             { return r.cmd }
+func (r *testRecord) String() string              { return r.cmd }
+func (r *testRecord) Direction() string           { return r.dir }
+func (r *testRecord) Country() string             { return r.country }
+func (r *testRecord) City() string                { return r.city }
+func (r *testRecord) ASN() uint32                 { return r.asn }
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		src    string
+		kinds  []tokenKind
+		values []string
+	}{
+		{"", []tokenKind{tokenEOF}, []string{""}},
+		{
+			"command == tx",
+			[]tokenKind{tokenWord, tokenOperator, tokenWord, tokenEOF},
+			[]string{"command", "==", "tx", ""},
+		},
+		{
+			"ip in (1.2.3.0/24,2001:db8::/32)",
+			[]tokenKind{tokenWord, tokenWord, tokenLeft, tokenWord, tokenComma,
+				tokenWord, tokenRight, tokenEOF},
+			[]string{"ip", "in", "(", "1.2.3.0/24", ",", "2001:db8::/32", ")",
+				""},
+		},
+		{
+			"port>=8333",
+			[]tokenKind{tokenWord, tokenOperator, tokenWord, tokenEOF},
+			[]string{"port", ">=", "8333", ""},
+		},
+		{
+			`agent != "/Satoshi:0.11.0/ \"x\""`,
+			[]tokenKind{tokenWord, tokenOperator, tokenString, tokenEOF},
+			[]string{"agent", "!=", `/Satoshi:0.11.0/ "x"`, ""},
+		},
+	}
+
+	for _, test := range tests {
+		tokens, err := lex(test.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error (%v)", test.src, err)
+			continue
+		}
+
+		if len(tokens) != len(test.kinds) {
+			t.Errorf("%q: got %v tokens, want %v", test.src, len(tokens),
+				len(test.kinds))
+			continue
+		}
+
+		for i, tok := range tokens {
+			if tok.kind != test.kinds[i] || tok.value != test.values[i] {
+				t.Errorf("%q: token %v is %v (%v), want %q (%v)", test.src, i,
+					tok, tok.kind, test.values[i], test.kinds[i])
+			}
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	for _, src := range []string{
+		"port <> 8333",
+		"port ! 8333",
+		"port === 8333",
+		`agent == "unterminated`,
+		`agent == "\q"`,
+	} {
+		_, err := lex(src)
+		if err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"command",
+		"command ==",
+		"command tx",
+		"unknown == tx",
+		"command < tx",
+		"command not == tx",
+		"port == abc",
+		"port in (8333, abc)",
+		"ip == 1.2.3",
+		"ip > 1.2.3.4",
+		"command in",
+		"command in ,",
+		"command in )",
+		"command in tx, block",
+		"command in (tx",
+		"command in (tx block)",
+		"command in ()",
+		"(command == tx",
+		"command == tx)",
+		"command == tx and",
+		"command == tx or or command == block",
+		"not",
+	} {
+		_, err := Compile(src)
+		if err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	record := &testRecord{
+		cmd:     "tx",
+		ra:      &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333},
+		la:      &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 45000},
+		dir:     "out",
+		country: "LU",
+		city:    "Luxembourg",
+		asn:     6661,
+	}
+
+	tests := []struct {
+		src   string
+		match bool
+	}{
+		{"command == tx", true},
+		{"COMMAND = TX", true},
+		{"command != tx", false},
+		{"command in (block, tx)", true},
+		{"command not in (block, tx)", false},
+		{"command not in (block, inv)", true},
+		{"ip == 1.2.3.4", true},
+		{"ip in (1.2.3.0/24)", true},
+		{"ip in 1.2.3.0/24", true},
+		{"ip not in 1.2.3.0/24", false},
+		{"command in TX", true},
+		{"port in 8333", true},
+		{"ip in (1.2.4.0/24, 2001:db8::/32)", false},
+		{"remote_ip != 1.2.3.0/24", false},
+		{"local_ip == 10.0.0.0/8", true},
+		{"port == 8333", true},
+		{"port < 8333", false},
+		{"port <= 8333", true},
+		{"port > 1024", true},
+		{"port >= 8334", false},
+		{"local_port in (45000, 45001)", true},
+		{"remote_port in (18333, 18444)", false},
+		{"direction == out", true},
+		{"country == lu and city == \"luxembourg\"", true},
+		{"asn == 6661", true},
+		{"agent == x", false},
+		{"agent != x", true},
+		{"height > 0", false},
+		{"command == block or port == 8333", true},
+		{"command == block or port == 18333", false},
+		{"command == tx and not port == 8333", false},
+		{"not command == block and port == 8333", true},
+		{"command == block and port == 8333 or asn == 6661", true},
+		{"command == block and (port == 8333 or asn == 6661)", false},
+		{"not (command == block or ip == 5.6.7.8)", true},
+	}
+
+	for _, test := range tests {
+		expr, err := Compile(test.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error (%v)", test.src, err)
+			continue
+		}
+
+		if expr.Match(record) != test.match {
+			t.Errorf("%q: match is %v, want %v", test.src, !test.match,
+				test.match)
+		}
+
+		if expr.String() != test.src {
+			t.Errorf("%q: source is %q", test.src, expr.String())
+		}
+	}
+}
+
+func TestMatchMissingFields(t *testing.T) {
+	record := &testRecord{cmd: "ping"}
+
+	tests := []struct {
+		src   string
+		match bool
+	}{
+		{"ip in (0.0.0.0/0, ::/0)", false},
+		{"port >= 0", false},
+		{"direction == in", false},
+		{"country != lu", true},
+		{"asn not in (1, 2)", true},
+	}
+
+	for _, test := range tests {
+		expr, err := Compile(test.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error (%v)", test.src, err)
+			continue
+		}
+
+		if expr.Match(record) != test.match {
+			t.Errorf("%q: match is %v, want %v", test.src, !test.match,
+				test.match)
+		}
+	}
+}
+
+func TestExamples(t *testing.T) {
+	tx := &testRecord{
+		cmd: "tx",
+		ra:  &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333},
+	}
+
+	block := &testRecord{
+		cmd: "block",
+		ra:  &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 8333},
+	}
+
+	ping := &testRecord{
+		cmd: "ping",
+		ra:  &net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 8333},
+	}
+
+	tests := []struct {
+		src     string
+		matches []*testRecord
+	}{
+		{
+			"command in (TX, BLOCK) and (ip in 1.2.3.0/24 or " +
+				"address == \"1dice...\")",
+			[]*testRecord{tx},
+		},
+		{
+			"command in (tx, block) and (ip in (1.2.3.0/24) or " +
+				"address == \"1dice8EMZmqKvrGE4Qc9bUFf9PX3xaYDp\")",
+			[]*testRecord{tx},
+		},
+		{"ip in 1.2.3.0/24", []*testRecord{tx, ping}},
+		{"ip not in 1.2.3.0/24", []*testRecord{block}},
+		{"command in block or ip == 1.2.3.5", []*testRecord{block, ping}},
+	}
+
+	for _, test := range tests {
+		expr, err := Compile(test.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error (%v)", test.src, err)
+			continue
+		}
+
+		for _, record := range []*testRecord{tx, block, ping} {
+			want := false
+			for _, match := range test.matches {
+				want = want || match == record
+			}
+
+			if expr.Match(record) != want {
+				t.Errorf("%q: match for %v is %v, want %v", test.src,
+					record.cmd, !want, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOperator
+	tokenLeft
+	tokenRight
+	tokenComma
+)
+
+// token is a lexical element of an expression, with its position in the
+// source for error messages.
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+
+	case tokenString:
+		return strconv.Quote(t.value)
+
+	default:
+		return "'" + t.value + "'"
+	}
+}
+
+// is checks whether the token is the given keyword, ignoring case.
+func (t token) is(keyword string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.value, keyword)
+}
+
+// lex splits an expression into tokens. Bare words run until whitespace, a
+// parenthesis, a comma, a quote or an operator character, which allows IP
+// addresses and networks to be written without quotes.
+func lex(src string) ([]token, error) {
+	tokens := make([]token, 0)
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLeft, value: "(", pos: i})
+			i++
+
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRight, value: ")", pos: i})
+			i++
+
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, value: ",", pos: i})
+			i++
+
+		case isOperator(c):
+			start := i
+			for i < len(src) && isOperator(src[i]) {
+				i++
+			}
+
+			op := src[start:i]
+			switch op {
+			case "=", "==", "!=", "<", "<=", ">", ">=":
+
+			default:
+				return nil, fmt.Errorf("expression: invalid operator '%v' at %v",
+					op, start)
+			}
+
+			tokens = append(tokens, token{kind: tokenOperator, value: op,
+				pos: start})
+
+		case c == '"':
+			start := i
+			i++
+			for i < len(src) && src[i] != '"' {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+
+			if i >= len(src) {
+				return nil, fmt.Errorf("expression: unterminated string at %v",
+					start)
+			}
+
+			i++
+			value, err := strconv.Unquote(src[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("expression: invalid string at %v (%v)",
+					start, err)
+			}
+
+			tokens = append(tokens, token{kind: tokenString, value: value,
+				pos: start})
+
+		default:
+			start := i
+			for i < len(src) && !isDelimiter(src[i]) {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenWord, value: src[start:i],
+				pos: start})
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(src)})
+
+	return tokens, nil
+}
+
+func isOperator(c byte) bool {
+	return c == '=' || c == '!' || c == '<' || c == '>'
+}
+
+func isDelimiter(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '(' ||
+		c == ')' || c == ',' || c == '"' || isOperator(c)
+}
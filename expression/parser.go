@@ -0,0 +1,410 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/iptree"
+)
+
+// parser is a recursive descent parser that compiles expressions directly
+// into matchers. The grammar is:
+//
+//	or         = and { "or" and }
+//	and        = unary { "and" unary }
+//	unary      = "not" unary | "(" or ")" | comparison
+//	comparison = field operator value | field [ "not" ] "in" list
+//	list       = "(" value { "," value } ")" | value
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expression: expected %v at %v, got %v", what,
+			t.pos, t)
+	}
+
+	return t, nil
+}
+
+// parse compiles the whole expression.
+func (p *parser) parse() (matcher, error) {
+	match, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind != tokenEOF {
+		return nil, fmt.Errorf("expression: unexpected %v at %v", t, t.pos)
+	}
+
+	return match, nil
+}
+
+func (p *parser) parseOr() (matcher, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		a, b := left, right
+		left = func(r adaptor.Record) bool {
+			return a(r) || b(r)
+		}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (matcher, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		a, b := left, right
+		left = func(r adaptor.Record) bool {
+			return a(r) && b(r)
+		}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (matcher, error) {
+	t := p.peek()
+	switch {
+	case t.is("not"):
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(r adaptor.Record) bool {
+			return !inner(r)
+		}, nil
+
+	case t.kind == tokenLeft:
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = p.expect(tokenRight, "')'")
+		if err != nil {
+			return nil, err
+		}
+
+		return inner, nil
+
+	default:
+		return p.parseComparison()
+	}
+}
+
+func (p *parser) parseComparison() (matcher, error) {
+	t, err := p.expect(tokenWord, "field name")
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := schema[strings.ToLower(t.value)]
+	if !ok {
+		return nil, fmt.Errorf("expression: unknown field '%v' at %v", t.value,
+			t.pos)
+	}
+
+	negate := false
+	if p.peek().is("not") {
+		p.next()
+		negate = true
+		if !p.peek().is("in") {
+			t := p.peek()
+			return nil, fmt.Errorf("expression: expected 'in' at %v, got %v",
+				t.pos, t)
+		}
+	}
+
+	op := p.next()
+	var values []token
+	switch {
+	case op.is("in"):
+		values, err = p.parseList()
+		if err != nil {
+			return nil, err
+		}
+
+	case op.kind == tokenOperator:
+		value := p.next()
+		if value.kind != tokenWord && value.kind != tokenString {
+			return nil, fmt.Errorf("expression: expected value at %v, got %v",
+				value.pos, value)
+		}
+
+		values = []token{value}
+
+	default:
+		return nil, fmt.Errorf("expression: expected operator at %v, got %v",
+			op.pos, op)
+	}
+
+	operator := op.value
+	if op.is("in") || operator == "=" {
+		operator = "=="
+	}
+
+	if operator == "!=" {
+		operator = "=="
+		negate = true
+	}
+
+	var match matcher
+	switch f.typ {
+	case StringType:
+		match, err = compileString(f, operator, values)
+
+	case IntType:
+		match, err = compileInt(f, operator, values)
+
+	case IPType:
+		match, err = compileIP(f, operator, values)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if negate {
+		inner := match
+		match = func(r adaptor.Record) bool {
+			return !inner(r)
+		}
+	}
+
+	return match, nil
+}
+
+// parseList parses a parenthesized, comma separated list of values. A single
+// value without parentheses is a list of one.
+func (p *parser) parseList() ([]token, error) {
+	if p.peek().kind != tokenLeft {
+		value := p.next()
+		if value.kind != tokenWord && value.kind != tokenString {
+			return nil, fmt.Errorf("expression: expected value or '(' at %v, "+
+				"got %v", value.pos, value)
+		}
+
+		return []token{value}, nil
+	}
+
+	p.next()
+
+	values := make([]token, 0)
+	for {
+		value := p.next()
+		if value.kind != tokenWord && value.kind != tokenString {
+			return nil, fmt.Errorf("expression: expected value at %v, got %v",
+				value.pos, value)
+		}
+
+		values = append(values, value)
+
+		t := p.next()
+		if t.kind == tokenRight {
+			break
+		}
+
+		if t.kind != tokenComma {
+			return nil, fmt.Errorf("expression: expected ',' or ')' at %v, got %v",
+				t.pos, t)
+		}
+	}
+
+	return values, nil
+}
+
+// compileString compiles a comparison on a string field. Only equality is
+// supported; a list of values is compiled into a set.
+func compileString(f *field, operator string, values []token) (matcher,
+	error) {
+	if operator != "==" {
+		return nil, fmt.Errorf("expression: operator '%v' not valid for %v",
+			operator, f.typ)
+	}
+
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		s := value.value
+		if f.fold {
+			s = strings.ToLower(s)
+		}
+
+		set[s] = true
+	}
+
+	fold := f.fold
+	extract := f.strings
+
+	return func(r adaptor.Record) bool {
+		for _, s := range extract(r) {
+			if fold {
+				s = strings.ToLower(s)
+			}
+
+			if set[s] {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// compileInt compiles a comparison on an integer field.
+func compileInt(f *field, operator string, values []token) (matcher, error) {
+	ints := make([]int64, len(values))
+	for i, value := range values {
+		n, err := strconv.ParseInt(value.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expression: invalid %v value %v at %v",
+				f.typ, value, value.pos)
+		}
+
+		ints[i] = n
+	}
+
+	extract := f.ints
+
+	if len(ints) > 1 {
+		set := make(map[int64]bool, len(ints))
+		for _, n := range ints {
+			set[n] = true
+		}
+
+		return func(r adaptor.Record) bool {
+			for _, n := range extract(r) {
+				if set[n] {
+					return true
+				}
+			}
+
+			return false
+		}, nil
+	}
+
+	var compare func(int64) bool
+	limit := ints[0]
+	switch operator {
+	case "==":
+		compare = func(n int64) bool { return n == limit }
+
+	case "<":
+		compare = func(n int64) bool { return n < limit }
+
+	case "<=":
+		compare = func(n int64) bool { return n <= limit }
+
+	case ">":
+		compare = func(n int64) bool { return n > limit }
+
+	case ">=":
+		compare = func(n int64) bool { return n >= limit }
+	}
+
+	return func(r adaptor.Record) bool {
+		for _, n := range extract(r) {
+			if compare(n) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// compileIP compiles a comparison on an IP field. Values can be addresses or
+// networks in CIDR notation and are compiled into a prefix tree.
+func compileIP(f *field, operator string, values []token) (matcher, error) {
+	if operator != "==" {
+		return nil, fmt.Errorf("expression: operator '%v' not valid for %v",
+			operator, f.typ)
+	}
+
+	tree := iptree.New()
+	for _, value := range values {
+		network, err := iptree.ParseNetwork(value.value)
+		if err != nil {
+			return nil, fmt.Errorf("expression: invalid %v value %v at %v",
+				f.typ, value, value.pos)
+		}
+
+		tree.Insert(network, true)
+	}
+
+	extract := f.ips
+
+	return func(r adaptor.Record) bool {
+		for _, ip := range extract(r) {
+			if tree.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package expression
+
+import (
+	"net"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// Type is the type of a record field in an expression.
+type Type int
+
+const (
+	StringType Type = iota
+	IntType
+	IPType
+)
+
+func (t Type) String() string {
+	switch t {
+	case StringType:
+		return "string"
+
+	case IntType:
+		return "int"
+
+	case IPType:
+		return "ip"
+
+	default:
+		return "invalid"
+	}
+}
+
+// field describes a record field that can be used in expressions. Fields can
+// have several values, like the output addresses of a transaction, and have
+// none if the record doesn't carry them. Only the extractor matching the type
+// is set. String fields can be compared without regard to case.
+type field struct {
+	typ     Type
+	fold    bool
+	strings func(adaptor.Record) []string
+	ints    func(adaptor.Record) []int64
+	ips     func(adaptor.Record) []net.IP
+}
+
+// located is implemented by records that carry the geolocation of the peer.
+type located interface {
+	Country() string
+	City() string
+	ASN() uint32
+}
+
+// directed is implemented by records that know whether their message was
+// received or sent.
+type directed interface {
+	Direction() string
+}
+
+// schema lists the fields available in expressions.
+var schema = map[string]*field{
+	"command": {
+		typ:  StringType,
+		fold: true,
+		strings: func(r adaptor.Record) []string {
+			return []string{r.Command()}
+		},
+	},
+	"direction": {
+		typ:  StringType,
+		fold: true,
+		strings: func(r adaptor.Record) []string {
+			d, ok := r.(directed)
+			if !ok || d.Direction() == "" {
+				return nil
+			}
+
+			return []string{d.Direction()}
+		},
+	},
+	"ip": {
+		typ: IPType,
+		ips: remoteIP,
+	},
+	"remote_ip": {
+		typ: IPType,
+		ips: remoteIP,
+	},
+	"port": {
+		typ:  IntType,
+		ints: remotePort,
+	},
+	"remote_port": {
+		typ:  IntType,
+		ints: remotePort,
+	},
+	"local_ip": {
+		typ: IPType,
+		ips: func(r adaptor.Record) []net.IP {
+			la := r.LocalAddress()
+			if la == nil {
+				return nil
+			}
+
+			return []net.IP{la.IP}
+		},
+	},
+	"local_port": {
+		typ: IntType,
+		ints: func(r adaptor.Record) []int64 {
+			la := r.LocalAddress()
+			if la == nil {
+				return nil
+			}
+
+			return []int64{int64(la.Port)}
+		},
+	},
+	"country": {
+		typ:  StringType,
+		fold: true,
+		strings: func(r adaptor.Record) []string {
+			l, ok := r.(located)
+			if !ok || l.Country() == "" {
+				return nil
+			}
+
+			return []string{l.Country()}
+		},
+	},
+	"city": {
+		typ:  StringType,
+		fold: true,
+		strings: func(r adaptor.Record) []string {
+			l, ok := r.(located)
+			if !ok || l.City() == "" {
+				return nil
+			}
+
+			return []string{l.City()}
+		},
+	},
+	"asn": {
+		typ: IntType,
+		ints: func(r adaptor.Record) []int64 {
+			l, ok := r.(located)
+			if !ok || l.ASN() == 0 {
+				return nil
+			}
+
+			return []int64{int64(l.ASN())}
+		},
+	},
+	"address": {
+		typ:     StringType,
+		strings: addresses,
+	},
+	"value": {
+		typ:  IntType,
+		ints: value,
+	},
+	"agent": {
+		typ: StringType,
+		strings: func(r adaptor.Record) []string {
+			vr, ok := r.(*records.VersionRecord)
+			if !ok {
+				return nil
+			}
+
+			return []string{vr.Agent()}
+		},
+	},
+	"version": {
+		typ: IntType,
+		ints: func(r adaptor.Record) []int64 {
+			vr, ok := r.(*records.VersionRecord)
+			if !ok {
+				return nil
+			}
+
+			return []int64{int64(vr.Version())}
+		},
+	},
+	"height": {
+		typ:  IntType,
+		ints: height,
+	},
+}
+
+func remoteIP(r adaptor.Record) []net.IP {
+	ra := r.RemoteAddress()
+	if ra == nil {
+		return nil
+	}
+
+	return []net.IP{ra.IP}
+}
+
+func remotePort(r adaptor.Record) []int64 {
+	ra := r.RemoteAddress()
+	if ra == nil {
+		return nil
+	}
+
+	return []int64{int64(ra.Port)}
+}
+
+// details returns the transactions carried by a record.
+func details(r adaptor.Record) []*records.DetailsRecord {
+	switch rec := r.(type) {
+	case *records.TransactionRecord:
+		return []*records.DetailsRecord{rec.Details()}
+
+	case *records.LargeTxRecord:
+		return []*records.DetailsRecord{rec.Details()}
+
+	case *records.BlockRecord:
+		return rec.Details()
+
+	default:
+		return nil
+	}
+}
+
+// addresses returns the output addresses of transactions, or the address of
+// a watch hit.
+func addresses(r adaptor.Record) []string {
+	wr, ok := r.(*records.WatchHitRecord)
+	if ok {
+		return []string{wr.Address()}
+	}
+
+	values := make([]string, 0)
+	for _, tx := range details(r) {
+		for _, output := range tx.Outputs() {
+			for _, addr := range output.Addresses() {
+				values = append(values, addr.EncodeAddress())
+			}
+		}
+	}
+
+	return values
+}
+
+// value returns the total output value of each transaction, or the amount of
+// a watch hit.
+func value(r adaptor.Record) []int64 {
+	wr, ok := r.(*records.WatchHitRecord)
+	if ok {
+		return []int64{wr.Amount()}
+	}
+
+	values := make([]int64, 0)
+	for _, tx := range details(r) {
+		total := int64(0)
+		for _, output := range tx.Outputs() {
+			total += output.Value()
+		}
+
+		values = append(values, total)
+	}
+
+	return values
+}
+
+// height returns the start height of a version or the height of a block.
+func height(r adaptor.Record) []int64 {
+	switch rec := r.(type) {
+	case *records.VersionRecord:
+		return []int64{int64(rec.StartHeight())}
+
+	case *records.BlockRecord:
+		if rec.Height() < 0 {
+			return nil
+		}
+
+		return []int64{int64(rec.Height())}
+
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package iptree
+
+import (
+	"net"
+	"sync"
+)
+
+// node is a single branch of the binary prefix tree. A node only carries a
+// value if a prefix ends exactly at its depth.
+type node struct {
+	children [2]*node
+	value    interface{}
+	set      bool
+}
+
+// IPTree implements a synchronized binary prefix tree for IP networks. It
+// keeps separate roots for IPv4 and IPv6 and allows longest-prefix matching
+// of single IP addresses in time proportional to the address length.
+type IPTree struct {
+	mutex *sync.RWMutex
+	root4 *node
+	root6 *node
+	count int
+}
+
+// New creates a new empty prefix tree.
+func New() *IPTree {
+	tree := &IPTree{
+		mutex: &sync.RWMutex{},
+		root4: &node{},
+		root6: &node{},
+	}
+
+	return tree
+}
+
+// Insert adds a network with an associated value to the tree. If the network
+// was already present, its value is replaced.
+func (tree *IPTree) Insert(ipnet *net.IPNet, value interface{}) {
+	ip, root := tree.normalize(ipnet.IP)
+	if ip == nil {
+		return
+	}
+
+	ones, _ := ipnet.Mask.Size()
+	if ones > len(ip)*8 {
+		ones = len(ip) * 8
+	}
+
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+
+	current := root
+	for i := 0; i < ones; i++ {
+		bit := bitAt(ip, i)
+		if current.children[bit] == nil {
+			current.children[bit] = &node{}
+		}
+
+		current = current.children[bit]
+	}
+
+	if !current.set {
+		tree.count++
+	}
+
+	current.value = value
+	current.set = true
+}
+
+// Lookup returns the value of the most specific network containing the given
+// IP. If no network contains the IP, the second return value is false.
+func (tree *IPTree) Lookup(addr net.IP) (interface{}, bool) {
+	ip, root := tree.normalize(addr)
+	if ip == nil {
+		return nil, false
+	}
+
+	tree.mutex.RLock()
+	defer tree.mutex.RUnlock()
+
+	var value interface{}
+	found := false
+
+	current := root
+	for i := 0; current != nil; i++ {
+		if current.set {
+			value = current.value
+			found = true
+		}
+
+		if i >= len(ip)*8 {
+			break
+		}
+
+		current = current.children[bitAt(ip, i)]
+	}
+
+	return value, found
+}
+
+// Contains checks whether the given IP is part of any network in the tree.
+func (tree *IPTree) Contains(addr net.IP) bool {
+	_, ok := tree.Lookup(addr)
+	return ok
+}
+
+// Count returns the total number of networks in the tree.
+func (tree *IPTree) Count() int {
+	tree.mutex.RLock()
+	defer tree.mutex.RUnlock()
+
+	return tree.count
+}
+
+// normalize returns the shortest byte representation of the IP and the root
+// of the tree for the corresponding address family.
+func (tree *IPTree) normalize(addr net.IP) (net.IP, *node) {
+	ip := addr.To4()
+	if ip != nil {
+		return ip, tree.root4
+	}
+
+	ip = addr.To16()
+	if ip != nil {
+		return ip, tree.root6
+	}
+
+	return nil, nil
+}
+
+// bitAt returns the bit at the given position of the IP, starting with the
+// most significant bit.
+func bitAt(ip net.IP, pos int) int {
+	return int(ip[pos/8]>>(7-uint(pos%8))) & 1
+}
+
+// ParseNetwork parses a network in CIDR notation. A single IP address is
+// accepted as well and treated as a network of its own.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err == nil {
+		return ipnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, err
+	}
+
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package iptree
+
+import (
+	"net"
+	"testing"
+)
+
+func mustNetwork(t *testing.T, s string) *net.IPNet {
+	ipnet, err := ParseNetwork(s)
+	if err != nil {
+		t.Fatalf("could not parse network %v (%v)", s, err)
+	}
+
+	return ipnet
+}
+
+func TestLookup(t *testing.T) {
+	tree := New()
+	for _, network := range []string{
+		"0.0.0.0/0",
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.3",
+		"192.168.0.0/24",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+	} {
+		tree.Insert(mustNetwork(t, network), network)
+	}
+
+	tests := []struct {
+		ip    string
+		value string
+	}{
+		{"8.8.8.8", "0.0.0.0/0"},
+		{"10.2.3.4", "10.0.0.0/8"},
+		{"10.1.3.4", "10.1.0.0/16"},
+		{"10.1.2.3", "10.1.2.3"},
+		{"10.1.2.4", "10.1.0.0/16"},
+		{"192.168.0.255", "192.168.0.0/24"},
+		{"192.168.1.0", "0.0.0.0/0"},
+		{"::ffff:10.1.2.3", "10.1.2.3"},
+		{"2001:db8:2::1", "2001:db8::/32"},
+		{"2001:db8:1::1", "2001:db8:1::/48"},
+	}
+
+	for _, test := range tests {
+		value, ok := tree.Lookup(net.ParseIP(test.ip))
+		if !ok {
+			t.Errorf("%v: no network found, want %v", test.ip, test.value)
+			continue
+		}
+
+		if value != test.value {
+			t.Errorf("%v: found %v, want %v", test.ip, value, test.value)
+		}
+	}
+}
+
+func TestLookupMissing(t *testing.T) {
+	tree := New()
+	tree.Insert(mustNetwork(t, "10.0.0.0/8"), true)
+	tree.Insert(mustNetwork(t, "2001:db8::/32"), true)
+
+	for _, ip := range []string{"11.0.0.1", "9.255.255.255", "2001:db9::1", "::1"} {
+		if tree.Contains(net.ParseIP(ip)) {
+			t.Errorf("%v: unexpected match", ip)
+		}
+	}
+
+	if tree.Contains(nil) {
+		t.Errorf("nil IP: unexpected match")
+	}
+}
+
+func TestInsertReplace(t *testing.T) {
+	tree := New()
+	tree.Insert(mustNetwork(t, "10.0.0.0/8"), 1)
+	tree.Insert(mustNetwork(t, "10.0.0.0/8"), 2)
+	tree.Insert(mustNetwork(t, "10.1.0.0/16"), 3)
+
+	if tree.Count() != 2 {
+		t.Errorf("count is %v, want 2", tree.Count())
+	}
+
+	value, _ := tree.Lookup(net.ParseIP("10.2.0.1"))
+	if value != 2 {
+		t.Errorf("value is %v, want 2", value)
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		valid bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		{"10.1.2.3/8", "10.0.0.0/8", true},
+		{"10.1.2.3", "10.1.2.3/32", true},
+		{"2001:db8::1", "2001:db8::1/128", true},
+		{"2001:db8::/32", "2001:db8::/32", true},
+		{"10.0.0.0/33", "", false},
+		{"example.com", "", false},
+	}
+
+	for _, test := range tests {
+		ipnet, err := ParseNetwork(test.input)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%v: expected error, got %v", test.input, ipnet)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: unexpected error (%v)", test.input, err)
+			continue
+		}
+
+		if ipnet.String() != test.want {
+			t.Errorf("%v: parsed %v, want %v", test.input, ipnet, test.want)
+		}
+	}
+}
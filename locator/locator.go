@@ -0,0 +1,224 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package locator
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/CIRCL/pbtc/adaptor"
+)
+
+// location holds the cached result of a lookup.
+type location struct {
+	country string
+	city    string
+	asn     uint32
+}
+
+// result is the subset of the MaxMind City, Country and ASN database formats
+// that we decode on lookup.
+type result struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN uint32 `maxminddb:"autonomous_system_number"`
+}
+
+// Locator is the default implementation of the locator interface. It looks up
+// IP addresses in a number of local MaxMind-format databases and caches the
+// results. Using several databases allows combining the city and ASN
+// databases, which are distributed separately.
+type Locator struct {
+	mutex   *sync.RWMutex
+	readers []*maxminddb.Reader
+	cache   map[string]*location
+
+	log adaptor.Log
+
+	dbPaths   []string
+	cacheSize int
+}
+
+// New creates a new locator with the given options. It fails if one of the
+// databases can't be opened.
+func New(options ...func(*Locator)) (*Locator, error) {
+	loc := &Locator{
+		mutex:     &sync.RWMutex{},
+		cache:     make(map[string]*location),
+		dbPaths:   []string{"GeoLite2-City.mmdb"},
+		cacheSize: 65536,
+	}
+
+	for _, option := range options {
+		option(loc)
+	}
+
+	readers, err := open(loc.dbPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	loc.readers = readers
+
+	return loc, nil
+}
+
+// SetDatabasePaths sets the paths of the MaxMind databases to be used. Later
+// databases only fill in the fields that are missing from earlier ones.
+func SetDatabasePaths(paths ...string) func(*Locator) {
+	return func(loc *Locator) {
+		loc.dbPaths = paths
+	}
+}
+
+// SetCacheSize sets the maximum number of cached lookups. Once the limit is
+// reached, the cache is cleared.
+func SetCacheSize(size int) func(*Locator) {
+	return func(loc *Locator) {
+		loc.cacheSize = size
+	}
+}
+
+func (loc *Locator) Start() {
+	loc.log.Info("[LOC] Start: begin")
+
+	loc.log.Info("[LOC] Start: completed")
+}
+
+func (loc *Locator) Stop() {
+	loc.log.Info("[LOC] Stop: begin")
+
+	loc.mutex.Lock()
+	closeAll(loc.readers)
+	loc.readers = nil
+	loc.mutex.Unlock()
+
+	loc.log.Info("[LOC] Stop: completed")
+}
+
+func (loc *Locator) SetLog(log adaptor.Log) {
+	loc.log = log
+}
+
+// Reload opens the databases again and clears the cache. It allows us to
+// update the databases without restarting. If opening fails, we keep using
+// the old databases.
+func (loc *Locator) Reload() error {
+	loc.log.Info("[LOC] Reload: begin")
+
+	readers, err := open(loc.dbPaths)
+	if err != nil {
+		loc.log.Warning("[LOC] Reload: failed (%v)", err)
+		return err
+	}
+
+	loc.mutex.Lock()
+	old := loc.readers
+	loc.readers = readers
+	loc.cache = make(map[string]*location)
+	loc.mutex.Unlock()
+
+	closeAll(old)
+
+	loc.log.Info("[LOC] Reload: completed")
+
+	return nil
+}
+
+// Locate returns the country ISO code, the English city name and the
+// autonomous system number for the given IP.
+func (loc *Locator) Locate(ip net.IP) (string, string, uint32) {
+	key := ip.String()
+
+	loc.mutex.RLock()
+	l, ok := loc.cache[key]
+	loc.mutex.RUnlock()
+	if ok {
+		return l.country, l.city, l.asn
+	}
+
+	loc.mutex.Lock()
+	defer loc.mutex.Unlock()
+
+	l = &location{}
+	for _, reader := range loc.readers {
+		res := &result{}
+		err := reader.Lookup(ip, res)
+		if err != nil {
+			loc.log.Debug("[LOC] %v lookup failed (%v)", ip, err)
+			continue
+		}
+
+		if l.country == "" {
+			l.country = res.Country.ISOCode
+		}
+
+		if l.city == "" {
+			l.city = res.City.Names["en"]
+		}
+
+		if l.asn == 0 {
+			l.asn = res.ASN
+		}
+	}
+
+	if len(loc.cache) >= loc.cacheSize {
+		loc.cache = make(map[string]*location)
+	}
+
+	loc.cache[key] = l
+
+	return l.country, l.city, l.asn
+}
+
+// open opens all databases at the given paths.
+func open(paths []string) ([]*maxminddb.Reader, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("locator: need database path")
+	}
+
+	readers := make([]*maxminddb.Reader, 0, len(paths))
+	for _, path := range paths {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			closeAll(readers)
+			return nil, err
+		}
+
+		readers = append(readers, reader)
+	}
+
+	return readers, nil
+}
+
+// closeAll closes all given database readers.
+func closeAll(readers []*maxminddb.Reader) {
+	for _, reader := range readers {
+		reader.Close()
+	}
+}
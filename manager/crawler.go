@@ -0,0 +1,182 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+)
+
+type SnapshotFormat int
+
+const (
+	CSVFormat SnapshotFormat = iota
+	JSONFormat
+)
+
+func ParseSnapshotFormat(format string) (SnapshotFormat, error) {
+	switch format {
+	case "CSV":
+		return CSVFormat, nil
+
+	case "JSON":
+		return JSONFormat, nil
+
+	default:
+		return -1, errors.New("invalid snapshot format string")
+	}
+}
+
+// crawlNode holds the information we collected about a reachable node during
+// the handshake. It is exported as one entry of the snapshot.
+type crawlNode struct {
+	Address   string        `json:"address"`
+	Version   int32         `json:"version"`
+	UserAgent string        `json:"user_agent"`
+	Services  uint64        `json:"services"`
+	Height    int32         `json:"start_height"`
+	Latency   time.Duration `json:"latency_ns"`
+	FirstSeen time.Time     `json:"first_seen"`
+	LastSeen  time.Time     `json:"last_seen"`
+}
+
+// crawled updates the information on a node after a successful handshake.
+func (mgr *Manager) crawled(p adaptor.Peer) {
+	msg := p.Version()
+	if msg == nil {
+		return
+	}
+
+	now := time.Now()
+	key := p.String()
+
+	mgr.crawlMutex.Lock()
+	defer mgr.crawlMutex.Unlock()
+
+	node, ok := mgr.crawlIndex[key]
+	if !ok {
+		node = &crawlNode{
+			Address:   key,
+			FirstSeen: now,
+		}
+
+		mgr.crawlIndex[key] = node
+	}
+
+	node.Version = msg.ProtocolVersion
+	node.UserAgent = msg.UserAgent
+	node.Services = uint64(msg.Services)
+	node.Height = msg.LastBlock
+	node.Latency = p.Latency()
+	node.LastSeen = now
+}
+
+// snapshot writes all nodes that we reached within the snapshot window to the
+// snapshot file. Nodes that have not been reached for longer are dropped. We
+// write to a temporary file first, so that readers never see a partial file.
+func (mgr *Manager) snapshot() {
+	mgr.crawlMutex.Lock()
+	defer mgr.crawlMutex.Unlock()
+
+	cutoff := time.Now().Add(-mgr.snapshotWindow)
+	nodes := make([]*crawlNode, 0, len(mgr.crawlIndex))
+	for key, node := range mgr.crawlIndex {
+		if node.LastSeen.Before(cutoff) {
+			delete(mgr.crawlIndex, key)
+			continue
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	mgr.log.Info("[MGR] Writing snapshot of %v reachable nodes", len(nodes))
+
+	tmp := mgr.snapshotPath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		mgr.log.Error("[MGR] Could not create snapshot file (%v)", err)
+		return
+	}
+
+	switch mgr.snapshotFormat {
+	case JSONFormat:
+		err = json.NewEncoder(file).Encode(nodes)
+
+	default:
+		err = writeCSV(file, nodes)
+	}
+
+	if err != nil {
+		mgr.log.Error("[MGR] Could not write snapshot (%v)", err)
+		file.Close()
+		return
+	}
+
+	err = file.Close()
+	if err != nil {
+		mgr.log.Error("[MGR] Could not close snapshot file (%v)", err)
+		return
+	}
+
+	err = os.Rename(tmp, mgr.snapshotPath)
+	if err != nil {
+		mgr.log.Error("[MGR] Could not move snapshot file (%v)", err)
+		return
+	}
+}
+
+// writeCSV writes the given nodes to the file in CSV format, including a
+// header line with the column names.
+func writeCSV(file *os.File, nodes []*crawlNode) error {
+	w := csv.NewWriter(file)
+
+	err := w.Write([]string{"address", "version", "user_agent", "services",
+		"start_height", "latency_ms", "first_seen", "last_seen"})
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		err = w.Write([]string{
+			node.Address,
+			strconv.FormatInt(int64(node.Version), 10),
+			node.UserAgent,
+			strconv.FormatUint(node.Services, 10),
+			strconv.FormatInt(int64(node.Height), 10),
+			strconv.FormatInt(int64(node.Latency/time.Millisecond), 10),
+			node.FirstSeen.Format(time.RFC3339),
+			node.LastSeen.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
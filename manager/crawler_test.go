@@ -0,0 +1,189 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestParseSnapshotFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   SnapshotFormat
+		valid  bool
+	}{
+		{"CSV", CSVFormat, true},
+		{"JSON", JSONFormat, true},
+		{"XML", -1, false},
+		{"", -1, false},
+	}
+
+	for _, test := range tests {
+		format, err := ParseSnapshotFormat(test.format)
+		if (err == nil) != test.valid || format != test.want {
+			t.Errorf("%q: parsed as %v (%v), want %v", test.format, format,
+				err, test.want)
+		}
+	}
+}
+
+func TestCrawled(t *testing.T) {
+	mgr, _ := newTestManager(t, SetMode(CrawlerMode))
+
+	silent := newFakePeer(t, "192.0.2.2:8333")
+	mgr.crawled(silent)
+	if len(mgr.crawlIndex) != 0 {
+		t.Fatalf("crawled peer without version")
+	}
+
+	p := newFakePeer(t, "192.0.2.1:8333")
+	p.latency = 80 * time.Millisecond
+	p.version = &wire.MsgVersion{
+		ProtocolVersion: 70002,
+		Services:        wire.SFNodeNetwork,
+		UserAgent:       "/Satoshi:0.10.0/",
+		LastBlock:       350000,
+	}
+
+	mgr.crawled(p)
+	first := mgr.crawlIndex[p.String()].FirstSeen
+
+	p.version.LastBlock = 350001
+	p.version.UserAgent = "/Satoshi:0.11.0/"
+	mgr.crawled(p)
+
+	node, ok := mgr.crawlIndex[p.String()]
+	if !ok || len(mgr.crawlIndex) != 1 {
+		t.Fatalf("crawl index has %v nodes", len(mgr.crawlIndex))
+	}
+
+	if node.Address != "192.0.2.1:8333" || node.Version != 70002 ||
+		node.UserAgent != "/Satoshi:0.11.0/" || node.Height != 350001 ||
+		node.Services != uint64(wire.SFNodeNetwork) ||
+		node.Latency != p.latency {
+		t.Errorf("crawled node is %+v", node)
+	}
+
+	if !node.FirstSeen.Equal(first) || node.LastSeen.Before(first) {
+		t.Errorf("first seen %v, last seen %v", node.FirstSeen, node.LastSeen)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("could not create directory (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		format SnapshotFormat
+		file   string
+	}{
+		{CSVFormat, "snapshot.csv"},
+		{JSONFormat, "snapshot.json"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		mgr, _ := newTestManager(t, SetMode(CrawlerMode),
+			SetSnapshotPath(path), SetSnapshotFormat(test.format),
+			SetSnapshotWindow(time.Hour))
+
+		now := time.Now()
+		mgr.crawlIndex["192.0.2.1:8333"] = &crawlNode{
+			Address:   "192.0.2.1:8333",
+			Version:   70002,
+			UserAgent: "/Satoshi:0.11.0/",
+			Latency:   80 * time.Millisecond,
+			FirstSeen: now.Add(-2 * time.Hour),
+			LastSeen:  now.Add(-time.Minute),
+		}
+		mgr.crawlIndex["192.0.2.2:8333"] = &crawlNode{
+			Address:   "192.0.2.2:8333",
+			Version:   70001,
+			FirstSeen: now.Add(-3 * time.Hour),
+			LastSeen:  now.Add(-2 * time.Hour),
+		}
+
+		mgr.snapshot()
+
+		_, ok := mgr.crawlIndex["192.0.2.2:8333"]
+		if ok || len(mgr.crawlIndex) != 1 {
+			t.Errorf("format %v: expired node kept", test.format)
+		}
+
+		_, err = os.Stat(path + ".tmp")
+		if !os.IsNotExist(err) {
+			t.Errorf("format %v: temporary file left behind", test.format)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("format %v: could not open snapshot (%v)", test.format,
+				err)
+		}
+
+		var addrs []string
+		switch test.format {
+		case JSONFormat:
+			var nodes []*crawlNode
+			err = json.NewDecoder(file).Decode(&nodes)
+			for _, node := range nodes {
+				addrs = append(addrs, node.Address)
+			}
+
+		default:
+			var lines [][]string
+			lines, err = csv.NewReader(file).ReadAll()
+			for _, line := range lines {
+				addrs = append(addrs, line[0])
+			}
+		}
+
+		file.Close()
+		if err != nil {
+			t.Fatalf("format %v: could not read snapshot (%v)", test.format,
+				err)
+		}
+
+		sort.Strings(addrs)
+		want := []string{"192.0.2.1:8333"}
+		if test.format == CSVFormat {
+			want = []string{"192.0.2.1:8333", "address"}
+		}
+
+		if strings.Join(addrs, " ") != strings.Join(want, " ") {
+			t.Errorf("format %v: snapshot has %v, want %v", test.format,
+				addrs, want)
+		}
+	}
+}
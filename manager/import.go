@@ -0,0 +1,129 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/convertor"
+	"github.com/CIRCL/pbtc/pcap"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// imported is implemented by records that can carry the time, direction,
+// size and raw bytes of a message from a capture.
+type imported interface {
+	SetTimestamp(time.Time)
+	SetDirection(string)
+	SetBytes(int)
+	SetWire([]byte)
+}
+
+// goImport replays the messages of all import files through our processors.
+// The sender of each message is used as remote address and the receiver as
+// local address.
+func (mgr *Manager) goImport() {
+	defer mgr.wg.Done()
+
+	for _, path := range mgr.importPaths {
+		select {
+		case <-mgr.sig:
+			return
+
+		default:
+		}
+
+		mgr.log.Info("[MGR] Importing %v", path)
+
+		count, err := mgr.replay(path)
+		if err != nil {
+			mgr.log.Error("[MGR] Could not import %v (%v)", path, err)
+			continue
+		}
+
+		mgr.log.Info("[MGR] Imported %v messages from %v", count, path)
+	}
+}
+
+// replay reads one capture file and processes the messages in it. It stops
+// early if the manager is stopped.
+func (mgr *Manager) replay(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader, err := pcap.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	handler := func(msg wire.Message, raw []byte, src *net.TCPAddr,
+		dst *net.TCPAddr, stamp time.Time) {
+		record := convertor.Message(msg, src, dst)
+		if record == nil {
+			return
+		}
+
+		i, ok := record.(imported)
+		if ok {
+			i.SetTimestamp(stamp)
+			i.SetDirection(records.DirectionIn)
+			i.SetBytes(len(raw))
+			if mgr.capture {
+				i.SetWire(raw)
+			}
+		}
+
+		for _, pro := range mgr.pro {
+			pro.Process(record)
+		}
+
+		count++
+	}
+
+	replayer := pcap.NewReplayer(mgr.network, mgr.version, handler)
+	for {
+		select {
+		case <-mgr.sig:
+			return count, nil
+
+		default:
+		}
+
+		packet, err := reader.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		replayer.Packet(packet)
+	}
+}
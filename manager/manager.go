@@ -21,6 +21,7 @@
 package manager
 
 import (
+	"errors"
 	"net"
 	"sync"
 	"time"
@@ -29,8 +30,34 @@ import (
 
 	"github.com/CIRCL/pbtc/adaptor"
 	"github.com/CIRCL/pbtc/parmap"
+	"github.com/CIRCL/pbtc/peer"
+	"github.com/CIRCL/pbtc/records"
 )
 
+type ManagerMode int
+
+const (
+	DefaultMode ManagerMode = iota
+	CrawlerMode
+	ImportMode
+)
+
+func ParseMode(mode string) (ManagerMode, error) {
+	switch mode {
+	case "DEFAULT":
+		return DefaultMode, nil
+
+	case "CRAWLER":
+		return CrawlerMode, nil
+
+	case "IMPORT":
+		return ImportMode, nil
+
+	default:
+		return -1, errors.New("invalid manager mode string")
+	}
+}
+
 // Manager is the module responsible for peer management. It will initialize
 // new incoming & outgoing peers and take care of state transitions. As the
 // main control instance, it defines most of the behaviour of our peer.
@@ -38,22 +65,46 @@ type Manager struct {
 	wg  *sync.WaitGroup
 	sig chan struct{}
 
-	incomingQ  chan adaptor.Peer
+	incomingQ  chan *net.TCPConn
 	outgoingQ  chan adaptor.Peer
 	connectedQ chan adaptor.Peer
 	readyQ     chan adaptor.Peer
 	stoppedQ   chan adaptor.Peer
+	addrQ      chan *net.TCPAddr
+	listenQ    chan *net.TCPAddr
+	relayQ     chan *relay
 
-	tickerT *time.Ticker
+	tickerT        *time.Ticker
+	tickerConn     *time.Ticker
+	tickerSnapshot *time.Ticker
+	tickerAnnounce *time.Ticker
 
 	peerIndex   *parmap.ParMap
-	listenIndex map[string]*net.TCPListener
+	listenIndex map[string]*net.TCPAddr
+	crawlIndex  map[string]*crawlNode
+	crawlMutex  *sync.Mutex
 
 	network        wire.BitcoinNet
 	version        uint32
 	connRate       time.Duration
 	tickerInterval time.Duration
 	connLimit      int
+	mode           ManagerMode
+	pollTimeout    time.Duration
+	snapshotPath   string
+	snapshotFormat SnapshotFormat
+	snapshotRate   time.Duration
+	snapshotWindow time.Duration
+	addrRelay      bool
+	addrSample     int
+	announceRate   time.Duration
+	honest         bool
+	capture        bool
+	recordSent     bool
+	recordSession  bool
+	recordLatency  bool
+	pingRate       time.Duration
+	importPaths    []string
 
 	log  adaptor.Log
 	repo adaptor.Repository
@@ -69,20 +120,36 @@ func New(options ...func(mgr *Manager)) (*Manager, error) {
 		wg:  &sync.WaitGroup{},
 		sig: make(chan struct{}),
 
-		incomingQ:  make(chan adaptor.Peer, 1),
+		incomingQ:  make(chan *net.TCPConn, 1),
 		outgoingQ:  make(chan adaptor.Peer, 1),
 		connectedQ: make(chan adaptor.Peer, 1),
 		readyQ:     make(chan adaptor.Peer, 1),
 		stoppedQ:   make(chan adaptor.Peer, 1),
+		addrQ:      make(chan *net.TCPAddr, 16),
+		listenQ:    make(chan *net.TCPAddr, 1),
+		relayQ:     make(chan *relay, 1),
 
 		peerIndex:   parmap.New(),
-		listenIndex: make(map[string]*net.TCPListener),
+		listenIndex: make(map[string]*net.TCPAddr),
+		crawlIndex:  make(map[string]*crawlNode),
+		crawlMutex:  &sync.Mutex{},
 
 		network:        wire.TestNet3,
 		version:        wire.RejectVersion,
 		connRate:       time.Second / 10,
 		connLimit:      100,
 		tickerInterval: time.Second * 10,
+		mode:           DefaultMode,
+		pollTimeout:    time.Second * 30,
+		snapshotPath:   "snapshot.csv",
+		snapshotFormat: CSVFormat,
+		snapshotRate:   time.Minute * 15,
+		snapshotWindow: time.Hour * 24,
+		addrRelay:      false,
+		addrSample:     wire.MaxAddrPerMsg,
+		announceRate:   time.Hour * 24,
+		honest:         false,
+		pingRate:       time.Minute,
 	}
 
 	nonce, err := wire.RandomUint64()
@@ -138,10 +205,157 @@ func SetTickerInterval(tickerInterval time.Duration) func(*Manager) {
 	}
 }
 
+// SetMode sets the mode the manager operates in. In crawler mode, the manager
+// disconnects from every peer shortly after the handshake and keeps track of
+// the reachable network instead of maintaining long-lived connections. In
+// import mode, it doesn't connect to any peers and replays the messages from
+// network captures instead.
+func SetMode(mode ManagerMode) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.mode = mode
+	}
+}
+
+// SetPollTimeout sets the time we wait for address messages after polling a
+// peer in crawler mode, before we disconnect.
+func SetPollTimeout(timeout time.Duration) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.pollTimeout = timeout
+	}
+}
+
+// SetSnapshotPath sets the path of the file the crawler writes the snapshot
+// of the reachable network to.
+func SetSnapshotPath(path string) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.snapshotPath = path
+	}
+}
+
+// SetSnapshotFormat sets the file format of the crawler snapshot.
+func SetSnapshotFormat(format SnapshotFormat) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.snapshotFormat = format
+	}
+}
+
+// SetSnapshotRate sets the interval at which the crawler snapshot is written.
+func SetSnapshotRate(rate time.Duration) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.snapshotRate = rate
+	}
+}
+
+// SetSnapshotWindow sets how long a node stays part of the snapshot after we
+// last completed a handshake with it.
+func SetSnapshotWindow(window time.Duration) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.snapshotWindow = window
+	}
+}
+
+// SetAddressRelay enables address gossip with our peers. We will answer
+// address requests with good addresses from the repository, relay fresh
+// addresses to other peers and announce our own listening addresses.
+func SetAddressRelay(enabled bool) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.addrRelay = enabled
+	}
+}
+
+// SetAddressSample sets the maximum number of addresses that we send in
+// response to an address request.
+func SetAddressSample(sample int) func(*Manager) {
+	return func(mgr *Manager) {
+		if sample > wire.MaxAddrPerMsg {
+			sample = wire.MaxAddrPerMsg
+		}
+
+		mgr.addrSample = sample
+	}
+}
+
+// SetAnnounceRate sets the interval at which we announce our own listening
+// addresses to our peers.
+func SetAnnounceRate(rate time.Duration) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.announceRate = rate
+	}
+}
+
+// SetHonest enables honest-node emulation on our peers, which answer header,
+// block and data requests instead of ignoring them.
+func SetHonest(enabled bool) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.honest = enabled
+	}
+}
+
+// SetCapture makes our peers attach the raw bytes of received messages to
+// their records.
+func SetCapture(enabled bool) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.capture = enabled
+	}
+}
+
+// SetRecordSent makes our peers create records for the messages they send.
+func SetRecordSent(enabled bool) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.recordSent = enabled
+	}
+}
+
+// SetRecordSession makes our peers create session records for the lifecycle
+// events of their connections.
+func SetRecordSession(enabled bool) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.recordSession = enabled
+	}
+}
+
+// SetRecordLatency makes our peers create latency records for the pings that
+// were answered.
+func SetRecordLatency(enabled bool) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.recordLatency = enabled
+	}
+}
+
+// SetPingRate sets the interval at which our peers ping their nodes to measure
+// the round-trip time. Rates that are not positive are ignored.
+func SetPingRate(rate time.Duration) func(*Manager) {
+	return func(mgr *Manager) {
+		if rate <= 0 {
+			return
+		}
+
+		mgr.pingRate = rate
+	}
+}
+
+// SetImportPaths sets the pcap or pcapng files replayed in import mode.
+func SetImportPaths(paths ...string) func(*Manager) {
+	return func(mgr *Manager) {
+		mgr.importPaths = append(mgr.importPaths, paths...)
+	}
+}
+
 func (mgr *Manager) Start() {
 	mgr.log.Info("[MGR] Start: begin")
 
+	if mgr.mode == ImportMode {
+		mgr.wg.Add(1)
+		go mgr.goImport()
+
+		mgr.log.Info("[MGR] Start: completed")
+		return
+	}
+
 	mgr.tickerT = time.NewTicker(mgr.tickerInterval)
+	mgr.tickerConn = time.NewTicker(mgr.connRate)
+	mgr.tickerSnapshot = time.NewTicker(mgr.snapshotRate)
+	mgr.tickerAnnounce = time.NewTicker(mgr.announceRate)
 
 	mgr.wg.Add(2)
 	go mgr.goTicker()
@@ -157,6 +371,13 @@ func (mgr *Manager) Stop() {
 
 	close(mgr.sig)
 
+	if mgr.mode == ImportMode {
+		mgr.wg.Wait()
+
+		mgr.log.Info("[MGR] Stop: completed")
+		return
+	}
+
 	for s := range mgr.peerIndex.Iter() {
 		p := s.(adaptor.Peer)
 		p.Stop()
@@ -164,6 +385,10 @@ func (mgr *Manager) Stop() {
 
 	mgr.wg.Wait()
 
+	if mgr.mode == CrawlerMode {
+		mgr.snapshot()
+	}
+
 	mgr.log.Info("[MGR] Stop: completed")
 }
 
@@ -189,10 +414,12 @@ func (mgr *Manager) Outgoing(p adaptor.Peer) {
 	mgr.outgoingQ <- p
 }
 
-func (mgr *Manager) Incoming(p adaptor.Peer) {
-	mgr.log.Debug("[MGR] Incoming: %v", p)
+// Incoming hands a connection that one of our servers accepted to the manager,
+// which creates a peer for it.
+func (mgr *Manager) Incoming(conn *net.TCPConn) {
+	mgr.log.Debug("[MGR] Incoming: %v", conn.RemoteAddr())
 
-	mgr.incomingQ <- p
+	mgr.incomingQ <- conn
 }
 
 // Connected signals to the manager that we have successfully established a
@@ -219,6 +446,22 @@ func (mgr *Manager) Stopped(p adaptor.Peer) {
 	mgr.stoppedQ <- p
 }
 
+// Listening signals to the manager that a server is accepting connections on
+// the given address, which we can announce to our peers.
+func (mgr *Manager) Listening(addr *net.TCPAddr) {
+	mgr.log.Debug("[MGR] Listening: %v", addr)
+
+	mgr.listenQ <- addr
+}
+
+// Relay asks the manager to forward addresses received from a peer to a few
+// of our other peers.
+func (mgr *Manager) Relay(p adaptor.Peer, addrs []*wire.NetAddress) {
+	mgr.log.Debug("[MGR] Relay: %v addresses from %v", len(addrs), p)
+
+	mgr.relayQ <- &relay{source: p, addrs: addrs}
+}
+
 func (mgr Manager) goTicker() {
 	defer mgr.wg.Done()
 
@@ -233,6 +476,19 @@ TickerLoop:
 		// print manager information to the log
 		case <-mgr.tickerT.C:
 			mgr.log.Info("[MGR] %v total peers managed", mgr.peerIndex.Count())
+
+		// request a new address if we are below our connection limit
+		// only the crawler dials addresses from the repository on its own
+		case <-mgr.tickerConn.C:
+			if mgr.mode != CrawlerMode {
+				continue
+			}
+
+			if mgr.peerIndex.Count() >= mgr.connLimit {
+				continue
+			}
+
+			mgr.repo.Retrieve(mgr.addrQ)
 		}
 	}
 }
@@ -250,7 +506,7 @@ PeerLoop:
 		case p := <-mgr.connectedQ:
 			if !mgr.peerIndex.Has(p) {
 				mgr.log.Warning("[MGR] %v connected unknown", p)
-				p.Stop()
+				p.Disconnect(records.ReasonUnmanaged)
 				continue
 			}
 
@@ -263,7 +519,7 @@ PeerLoop:
 		case p := <-mgr.readyQ:
 			if !mgr.peerIndex.Has(p) {
 				mgr.log.Warning("[MGR] %v already ready", p)
-				p.Stop()
+				p.Disconnect(records.ReasonUnmanaged)
 				continue
 			}
 
@@ -271,6 +527,15 @@ PeerLoop:
 			mgr.repo.Succeeded(p.Addr())
 			p.Poll()
 
+			// in crawler mode, we remember the node and disconnect once it
+			// had some time to answer our address request
+			if mgr.mode == CrawlerMode {
+				mgr.crawled(p)
+				time.AfterFunc(mgr.pollTimeout, func() {
+					p.Disconnect(records.ReasonPolled)
+				})
+			}
+
 		// manage peers that have dropped the connection
 		case p := <-mgr.stoppedQ:
 			if !mgr.peerIndex.Has(p) {
@@ -280,6 +545,34 @@ PeerLoop:
 
 			mgr.log.Debug("[MGR] %v: done", p)
 			mgr.peerIndex.Remove(p)
+
+		// remember the addresses our servers are listening on
+		case addr := <-mgr.listenQ:
+			mgr.listenIndex[addr.String()] = addr
+
+		// announce our listening addresses to all peers
+		case <-mgr.tickerAnnounce.C:
+			if !mgr.addrRelay || len(mgr.listenIndex) == 0 {
+				continue
+			}
+
+			mgr.announce()
+
+		// relay addresses to a few peers other than the source
+		case r := <-mgr.relayQ:
+			if !mgr.addrRelay {
+				continue
+			}
+
+			mgr.relay(r)
+
+		// write the snapshot of the crawled network
+		case <-mgr.tickerSnapshot.C:
+			if mgr.mode != CrawlerMode {
+				continue
+			}
+
+			mgr.snapshot()
 		}
 	}
 
@@ -314,11 +607,93 @@ PeerLoop:
 				break PeerLoop
 			}
 
-		// manage peers that have successfully connected
-		case _ = <-mgr.incomingQ:
+		// create a new incoming peer for a connection accepted by a server
+		case conn := <-mgr.incomingQ:
+			options := append(mgr.options(), peer.SetConnection(conn))
+			p, err := peer.New(options...)
+			if err != nil {
+				mgr.log.Warning("[MGR] %v peer creation failed (%v)",
+					conn.RemoteAddr(), err)
+				conn.Close()
+				continue
+			}
+
+			mgr.accept(p)
+
+		case p := <-mgr.outgoingQ:
+			if mgr.mode != CrawlerMode {
+				continue
+			}
+
+			mgr.connect(p)
+
+		// create a new outgoing peer for an address from the repository
+		case addr := <-mgr.addrQ:
+			if mgr.peerIndex.HasKey(addr.String()) {
+				continue
+			}
 
-		case _ = <-mgr.outgoingQ:
+			options := append(mgr.options(), peer.SetAddress(addr))
+			p, err := peer.New(options...)
+			if err != nil {
+				mgr.log.Warning("[MGR] %v peer creation failed (%v)", addr, err)
+				continue
+			}
 
+			mgr.connect(p)
 		}
 	}
 }
+
+// options returns the options shared by all peers we create.
+func (mgr *Manager) options() []func(*peer.Peer) {
+	return []func(*peer.Peer){
+		peer.SetLog(mgr.log),
+		peer.SetManager(mgr),
+		peer.SetProcessors(mgr.pro),
+		peer.SetRepository(mgr.repo),
+		peer.SetTracker(mgr.tkr),
+		peer.SetNetwork(mgr.network),
+		peer.SetVersion(mgr.version),
+		peer.SetNonce(mgr.nonce),
+		peer.SetAddressRelay(mgr.addrRelay),
+		peer.SetAddressSample(mgr.addrSample),
+		peer.SetHonest(mgr.honest),
+		peer.SetCapture(mgr.capture),
+		peer.SetRecordSent(mgr.recordSent),
+		peer.SetRecordSession(mgr.recordSession),
+		peer.SetRecordLatency(mgr.recordLatency),
+		peer.SetPingRate(mgr.pingRate),
+	}
+}
+
+// accept adds an incoming peer to the index and starts it, so it can answer
+// the handshake of the remote node. Peers above the connection limit are
+// disconnected right away.
+func (mgr *Manager) accept(p adaptor.Peer) {
+	full := mgr.peerIndex.Count() >= mgr.connLimit
+
+	mgr.log.Debug("[MGR] %v accepted", p)
+	mgr.peerIndex.Insert(p)
+
+	if full {
+		mgr.log.Debug("[MGR] %v over connection limit", p)
+		p.Disconnect(records.ReasonLimit)
+		return
+	}
+
+	p.Start()
+}
+
+// connect adds an outgoing peer to the index and starts the connection attempt.
+func (mgr *Manager) connect(p adaptor.Peer) {
+	if mgr.peerIndex.Has(p) {
+		mgr.log.Debug("[MGR] %v already managed", p)
+		return
+	}
+
+	mgr.log.Debug("[MGR] %v connecting", p)
+	mgr.peerIndex.Insert(p)
+	mgr.repo.Attempted(p.Addr())
+	p.Connect()
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// nullLog discards all log messages.
+type nullLog struct{}
+
+func (log nullLog) Debug(format string, args ...interface{})    {}
+func (log nullLog) Info(format string, args ...interface{})     {}
+func (log nullLog) Notice(format string, args ...interface{})   {}
+func (log nullLog) Warning(format string, args ...interface{})  {}
+func (log nullLog) Error(format string, args ...interface{})    {}
+func (log nullLog) Critical(format string, args ...interface{}) {}
+
+// fakePeer is a peer that remembers which of its methods were called.
+type fakePeer struct {
+	addr    *net.TCPAddr
+	version *wire.MsgVersion
+	latency time.Duration
+
+	mutex     sync.Mutex
+	calls     []string
+	announced [][]*wire.NetAddress
+}
+
+func newFakePeer(t *testing.T, addr string) *fakePeer {
+	ra, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatalf("invalid address %v (%v)", addr, err)
+	}
+
+	return &fakePeer{addr: ra}
+}
+
+func (p *fakePeer) call(name string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.calls = append(p.calls, name)
+}
+
+// called returns whether the method with the given name was called.
+func (p *fakePeer) called(name string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, call := range p.calls {
+		if call == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *fakePeer) String() string            { return p.addr.String() }
+func (p *fakePeer) Addr() *net.TCPAddr        { return p.addr }
+func (p *fakePeer) Version() *wire.MsgVersion { return p.version }
+func (p *fakePeer) Latency() time.Duration    { return p.latency }
+func (p *fakePeer) Start()                    { p.call("Start") }
+func (p *fakePeer) Stop()                     { p.call("Stop") }
+func (p *fakePeer) Disconnect(reason string)  { p.call("Disconnect " + reason) }
+func (p *fakePeer) Connect()                  { p.call("Connect") }
+func (p *fakePeer) Greet()                    { p.call("Greet") }
+func (p *fakePeer) Poll()                     { p.call("Poll") }
+
+func (p *fakePeer) Announce(addrs []*wire.NetAddress) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.announced = append(p.announced, addrs)
+}
+
+// fakeRepo is a repository that counts the connection attempts.
+type fakeRepo struct {
+	mutex    sync.Mutex
+	attempts int
+}
+
+func (repo *fakeRepo) SetLog(adaptor.Log)            {}
+func (repo *fakeRepo) SetLocator(adaptor.Locator)    {}
+func (repo *fakeRepo) Discovered(*net.TCPAddr)       {}
+func (repo *fakeRepo) Connected(*net.TCPAddr)        {}
+func (repo *fakeRepo) Succeeded(*net.TCPAddr)        {}
+func (repo *fakeRepo) Retrieve(chan<- *net.TCPAddr)  {}
+func (repo *fakeRepo) Sample(int) []*wire.NetAddress { return nil }
+func (repo *fakeRepo) Start()                        {}
+func (repo *fakeRepo) Stop()                         {}
+func (repo *fakeRepo) Measured(*net.TCPAddr, time.Duration, time.Duration,
+	time.Duration) {
+}
+
+func (repo *fakeRepo) Attempted(*net.TCPAddr) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	repo.attempts++
+}
+
+// newTestManager returns a manager with a fake repository that doesn't log.
+func newTestManager(t *testing.T, options ...func(*Manager)) (*Manager,
+	*fakeRepo) {
+	mgr, err := New(options...)
+	if err != nil {
+		t.Fatalf("could not create manager (%v)", err)
+	}
+
+	repo := &fakeRepo{}
+	mgr.SetLog(nullLog{})
+	mgr.SetRepository(repo)
+
+	return mgr, repo
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		mode  string
+		want  ManagerMode
+		valid bool
+	}{
+		{"DEFAULT", DefaultMode, true},
+		{"CRAWLER", CrawlerMode, true},
+		{"IMPORT", ImportMode, true},
+		{"crawler", -1, false},
+		{"", -1, false},
+	}
+
+	for _, test := range tests {
+		mode, err := ParseMode(test.mode)
+		if (err == nil) != test.valid || mode != test.want {
+			t.Errorf("%q: parsed as %v (%v), want %v", test.mode, mode, err,
+				test.want)
+		}
+	}
+}
+
+func TestOutgoing(t *testing.T) {
+	tests := []struct {
+		mode      ManagerMode
+		connected bool
+	}{
+		{DefaultMode, false},
+		{CrawlerMode, true},
+	}
+
+	for _, test := range tests {
+		mgr, repo := newTestManager(t, SetMode(test.mode))
+		mgr.outgoingQ = make(chan adaptor.Peer)
+
+		mgr.wg.Add(1)
+		go mgr.goPeers()
+
+		p := newFakePeer(t, "192.0.2.1:8333")
+		mgr.outgoingQ <- p
+
+		close(mgr.sig)
+		mgr.wg.Wait()
+
+		if p.called("Connect") != test.connected ||
+			mgr.peerIndex.Has(p) != test.connected {
+			t.Errorf("mode %v: connected is %v, want %v", test.mode,
+				!test.connected, test.connected)
+		}
+
+		if (repo.attempts == 1) != test.connected {
+			t.Errorf("mode %v: %v attempts recorded", test.mode,
+				repo.attempts)
+		}
+	}
+}
+
+func TestAccept(t *testing.T) {
+	tests := []struct {
+		limit   int
+		managed int
+		started bool
+	}{
+		{2, 0, true},
+		{2, 1, true},
+		{2, 2, false},
+		{0, 0, false},
+	}
+
+	for _, test := range tests {
+		mgr, _ := newTestManager(t, SetConnectionLimit(test.limit))
+		for i := 0; i < test.managed; i++ {
+			mgr.peerIndex.Insert(newFakePeer(t, "192.0.2."+
+				strconv.Itoa(i+1)+":8333"))
+		}
+
+		p := newFakePeer(t, "198.51.100.1:8333")
+		mgr.accept(p)
+
+		if !mgr.peerIndex.Has(p) {
+			t.Errorf("limit %v with %v peers: accepted peer not managed",
+				test.limit, test.managed)
+		}
+
+		if p.called("Start") != test.started ||
+			p.called("Disconnect "+records.ReasonLimit) == test.started {
+			t.Errorf("limit %v with %v peers: started is %v, want %v",
+				test.limit, test.managed, !test.started, test.started)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+)
+
+const (
+	relayFanout = 2
+)
+
+// relay holds a number of addresses that a peer sent us and that should be
+// relayed to other peers.
+type relay struct {
+	source adaptor.Peer
+	addrs  []*wire.NetAddress
+}
+
+// announce queues our listening addresses for all peers. Peers that haven't
+// completed the handshake yet will ignore them.
+func (mgr *Manager) announce() {
+	addrs := make([]*wire.NetAddress, 0, len(mgr.listenIndex))
+	for _, addr := range mgr.listenIndex {
+		na := wire.NewNetAddressIPPort(addr.IP, uint16(addr.Port),
+			wire.SFNodeNetwork)
+		addrs = append(addrs, na)
+	}
+
+	mgr.log.Debug("[MGR] Announcing %v addresses", len(addrs))
+
+	for s := range mgr.peerIndex.Iter() {
+		p := s.(adaptor.Peer)
+		p.Announce(addrs)
+	}
+}
+
+// relay forwards the addresses to a small number of randomly chosen peers,
+// excluding the peer they came from.
+func (mgr *Manager) relay(r *relay) {
+	peers := make([]adaptor.Peer, 0, mgr.peerIndex.Count())
+	for s := range mgr.peerIndex.Iter() {
+		p := s.(adaptor.Peer)
+		if p.String() == r.source.String() {
+			continue
+		}
+
+		peers = append(peers, p)
+	}
+
+	for i, j := range rand.Perm(len(peers)) {
+		if i >= relayFanout {
+			break
+		}
+
+		peers[j].Announce(r.addrs)
+	}
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
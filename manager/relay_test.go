@@ -0,0 +1,131 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestRelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		peers   int
+		relayed int
+	}{
+		{"source only", 1, 0},
+		{"one other peer", 2, 1},
+		{"fanout reached", 3, 2},
+		{"more peers than fanout", 8, 2},
+	}
+
+	addrs := []*wire.NetAddress{
+		wire.NewNetAddressIPPort(net.ParseIP("198.51.100.1"), 8333,
+			wire.SFNodeNetwork),
+	}
+
+	for _, test := range tests {
+		mgr, _ := newTestManager(t)
+
+		peers := make([]*fakePeer, test.peers)
+		for i := range peers {
+			peers[i] = newFakePeer(t, net.JoinHostPort(
+				net.IPv4(192, 0, 2, byte(i+1)).String(), "8333"))
+			mgr.peerIndex.Insert(peers[i])
+		}
+
+		mgr.relay(&relay{source: peers[0], addrs: addrs})
+
+		if len(peers[0].announced) != 0 {
+			t.Errorf("%v: addresses relayed to their source", test.name)
+		}
+
+		relayed := 0
+		for _, p := range peers {
+			relayed += len(p.announced)
+			for _, announced := range p.announced {
+				if len(announced) != 1 || announced[0] != addrs[0] {
+					t.Errorf("%v: relayed %v, want %v", test.name, announced,
+						addrs)
+				}
+			}
+		}
+
+		if relayed != test.relayed {
+			t.Errorf("%v: relayed to %v peers, want %v", test.name, relayed,
+				test.relayed)
+		}
+	}
+}
+
+func TestAnnounceListening(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen []string
+	}{
+		{"one address", []string{"203.0.113.1:8333"}},
+		{"two addresses", []string{"203.0.113.1:8333", "[2001:db8::1]:18333"}},
+	}
+
+	for _, test := range tests {
+		mgr, _ := newTestManager(t)
+		for _, listen := range test.listen {
+			addr, err := net.ResolveTCPAddr("tcp", listen)
+			if err != nil {
+				t.Fatalf("invalid address %v (%v)", listen, err)
+			}
+
+			mgr.listenIndex[addr.String()] = addr
+		}
+
+		peers := []*fakePeer{
+			newFakePeer(t, "192.0.2.1:8333"),
+			newFakePeer(t, "192.0.2.2:8333"),
+		}
+		for _, p := range peers {
+			mgr.peerIndex.Insert(p)
+		}
+
+		mgr.announce()
+
+		for _, p := range peers {
+			if len(p.announced) != 1 {
+				t.Fatalf("%v: %v announced %v times", test.name, p,
+					len(p.announced))
+			}
+
+			announced := make(map[string]bool)
+			for _, na := range p.announced[0] {
+				addr := &net.TCPAddr{IP: na.IP, Port: int(na.Port)}
+				announced[addr.String()] = true
+			}
+
+			for _, listen := range test.listen {
+				if !announced[listen] || len(announced) != len(test.listen) {
+					t.Errorf("%v: %v was announced %v", test.name, p,
+						p.announced[0])
+				}
+			}
+		}
+	}
+}
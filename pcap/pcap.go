@@ -0,0 +1,386 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package pcap reads and writes network captures in the pcap format, reads
+// captures in the pcapng format and reassembles the Bitcoin messages sent
+// over the TCP streams they contain.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Link types of the captured packets that we can decode.
+const (
+	LinkNull     = 0
+	LinkEthernet = 1
+	LinkRaw      = 101
+	LinkLinuxSLL = 113
+)
+
+const (
+	magicMicro = 0xa1b2c3d4
+	magicNano  = 0xa1b23c4d
+	magicNG    = 0x0a0d0d0a
+	magicBOM   = 0x1a2b3c4d
+)
+
+const (
+	blockInterface = 0x00000001
+	blockSimple    = 0x00000003
+	blockEnhanced  = 0x00000006
+)
+
+// snaplen is the maximum packet length we write.
+const snaplen = 262144
+
+// Packet is one captured packet.
+type Packet struct {
+	Stamp time.Time
+	Link  uint32
+	Data  []byte
+}
+
+// Writer writes packets to a pcap file. Packets are raw IP packets.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter creates a new writer and writes the file header.
+func NewWriter(w io.Writer) (*Writer, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], magicMicro)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], snaplen)
+	binary.LittleEndian.PutUint32(hdr[20:24], LinkRaw)
+
+	_, err := w.Write(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &Writer{w: w}
+
+	return writer, nil
+}
+
+// WritePacket writes one raw IP packet with the given timestamp.
+func (writer *Writer) WritePacket(stamp time.Time, data []byte) error {
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(stamp.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(stamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(data)))
+
+	_, err := writer.w.Write(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.w.Write(data)
+
+	return err
+}
+
+// Reader reads packets from a pcap or pcapng file.
+type Reader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ng     bool
+	nano   bool
+	link   uint32
+	links  []uint32
+	units  []uint64
+	header []byte
+}
+
+// NewReader creates a new reader and reads the file header. The format is
+// detected automatically.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{
+		r:     r,
+		links: make([]uint32, 0),
+		units: make([]uint64, 0),
+	}
+
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(magic) == magicNG {
+		reader.ng = true
+		err = reader.section()
+		if err != nil {
+			return nil, err
+		}
+
+		return reader, nil
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(magic) == magicMicro:
+		reader.order = binary.LittleEndian
+
+	case binary.BigEndian.Uint32(magic) == magicMicro:
+		reader.order = binary.BigEndian
+
+	case binary.LittleEndian.Uint32(magic) == magicNano:
+		reader.order = binary.LittleEndian
+		reader.nano = true
+
+	case binary.BigEndian.Uint32(magic) == magicNano:
+		reader.order = binary.BigEndian
+		reader.nano = true
+
+	default:
+		return nil, errors.New("invalid capture file")
+	}
+
+	hdr := make([]byte, 20)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	reader.link = reader.order.Uint32(hdr[16:20])
+
+	return reader, nil
+}
+
+// Next returns the next packet. It returns io.EOF at the end of the file.
+func (reader *Reader) Next() (*Packet, error) {
+	if reader.ng {
+		return reader.nextBlock()
+	}
+
+	hdr := make([]byte, 16)
+	_, err := io.ReadFull(reader.r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	sec := int64(reader.order.Uint32(hdr[0:4]))
+	frac := int64(reader.order.Uint32(hdr[4:8]))
+	if !reader.nano {
+		frac *= 1000
+	}
+
+	data := make([]byte, reader.order.Uint32(hdr[8:12]))
+	_, err = io.ReadFull(reader.r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := &Packet{
+		Stamp: time.Unix(sec, frac),
+		Link:  reader.link,
+		Data:  data,
+	}
+
+	return packet, nil
+}
+
+// section reads the rest of a pcapng section header block, after its type.
+func (reader *Reader) section() error {
+	hdr := make([]byte, 8)
+	_, err := io.ReadFull(reader.r, hdr)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(hdr[4:8]) == magicBOM:
+		reader.order = binary.LittleEndian
+
+	case binary.BigEndian.Uint32(hdr[4:8]) == magicBOM:
+		reader.order = binary.BigEndian
+
+	default:
+		return errors.New("invalid section header")
+	}
+
+	length := reader.order.Uint32(hdr[0:4])
+	if length < 12 {
+		return errors.New("invalid section header")
+	}
+
+	_, err = io.CopyN(ioutil.Discard, reader.r, int64(length-12))
+	if err != nil {
+		return err
+	}
+
+	reader.links = reader.links[:0]
+	reader.units = reader.units[:0]
+
+	return nil
+}
+
+// nextBlock reads pcapng blocks until it finds a packet.
+func (reader *Reader) nextBlock() (*Packet, error) {
+	for {
+		hdr := make([]byte, 4)
+		_, err := io.ReadFull(reader.r, hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		if binary.LittleEndian.Uint32(hdr) == magicNG {
+			err = reader.section()
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		kind := reader.order.Uint32(hdr)
+
+		_, err = io.ReadFull(reader.r, hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		length := reader.order.Uint32(hdr)
+		if length < 12 || length%4 != 0 {
+			return nil, errors.New("invalid block length")
+		}
+
+		body := make([]byte, length-8)
+		_, err = io.ReadFull(reader.r, body)
+		if err != nil {
+			return nil, err
+		}
+
+		body = body[:len(body)-4]
+
+		switch kind {
+		case blockInterface:
+			reader.iface(body)
+
+		case blockEnhanced:
+			packet, err := reader.enhanced(body)
+			if err != nil {
+				return nil, err
+			}
+
+			return packet, nil
+
+		case blockSimple:
+			packet, err := reader.simple(body)
+			if err != nil {
+				return nil, err
+			}
+
+			return packet, nil
+		}
+	}
+}
+
+// iface reads an interface description block.
+func (reader *Reader) iface(body []byte) {
+	if len(body) < 8 {
+		return
+	}
+
+	link := uint32(reader.order.Uint16(body[0:2]))
+	units := uint64(1000000)
+
+	options := body[8:]
+	for len(options) >= 4 {
+		code := reader.order.Uint16(options[0:2])
+		size := int(reader.order.Uint16(options[2:4]))
+		if code == 0 || len(options) < 4+size {
+			break
+		}
+
+		// if_tsresol gives the resolution as a power of ten or two
+		if code == 9 && size == 1 {
+			res := options[4]
+			units = 1
+			for i := 0; i < int(res&0x7f); i++ {
+				if res&0x80 != 0 {
+					units *= 2
+				} else {
+					units *= 10
+				}
+			}
+		}
+
+		options = options[4+(size+3)/4*4:]
+	}
+
+	reader.links = append(reader.links, link)
+	reader.units = append(reader.units, units)
+}
+
+// enhanced reads an enhanced packet block.
+func (reader *Reader) enhanced(body []byte) (*Packet, error) {
+	if len(body) < 20 {
+		return nil, errors.New("invalid packet block")
+	}
+
+	id := reader.order.Uint32(body[0:4])
+	if int(id) >= len(reader.links) {
+		return nil, errors.New("invalid interface id")
+	}
+
+	stamp := uint64(reader.order.Uint32(body[4:8]))<<32 |
+		uint64(reader.order.Uint32(body[8:12]))
+	length := reader.order.Uint32(body[12:16])
+	if int(length) > len(body)-20 {
+		return nil, errors.New("invalid packet length")
+	}
+
+	units := reader.units[id]
+	packet := &Packet{
+		Stamp: time.Unix(int64(stamp/units),
+			int64(stamp%units*1000000000/units)),
+		Link: reader.links[id],
+		Data: body[20 : 20+length],
+	}
+
+	return packet, nil
+}
+
+// simple reads a simple packet block, which has no timestamp.
+func (reader *Reader) simple(body []byte) (*Packet, error) {
+	if len(body) < 4 || len(reader.links) == 0 {
+		return nil, errors.New("invalid packet block")
+	}
+
+	length := reader.order.Uint32(body[0:4])
+	if int(length) > len(body)-4 {
+		length = uint32(len(body) - 4)
+	}
+
+	packet := &Packet{
+		Link: reader.links[0],
+		Data: body[4 : 4+length],
+	}
+
+	return packet, nil
+}
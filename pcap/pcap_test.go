@@ -0,0 +1,416 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// block builds a pcapng block of the given type, padding the body.
+func block(order binary.ByteOrder, kind uint32, body []byte) []byte {
+	length := 12 + (len(body)+3)/4*4
+	buf := make([]byte, length)
+	order.PutUint32(buf[0:4], kind)
+	order.PutUint32(buf[4:8], uint32(length))
+	copy(buf[8:], body)
+	order.PutUint32(buf[length-4:], uint32(length))
+
+	return buf
+}
+
+// sectionBlock builds a pcapng section header block.
+func sectionBlock(order binary.ByteOrder) []byte {
+	body := make([]byte, 16)
+	order.PutUint32(body[0:4], magicBOM)
+	order.PutUint16(body[4:6], 1)
+	binary.LittleEndian.PutUint64(body[8:16], 0xffffffffffffffff)
+
+	return block(order, magicNG, body)
+}
+
+// interfaceBlock builds a pcapng interface description block, with the given
+// timestamp resolution option if it is not zero.
+func interfaceBlock(order binary.ByteOrder, link uint16, res byte) []byte {
+	body := make([]byte, 8)
+	order.PutUint16(body[0:2], link)
+	order.PutUint32(body[4:8], snaplen)
+
+	if res != 0 {
+		option := make([]byte, 8)
+		order.PutUint16(option[0:2], 9)
+		order.PutUint16(option[2:4], 1)
+		option[4] = res
+		body = append(body, option...)
+	}
+
+	body = append(body, 0, 0, 0, 0)
+
+	return block(order, blockInterface, body)
+}
+
+// enhancedBlock builds a pcapng enhanced packet block.
+func enhancedBlock(order binary.ByteOrder, id uint32, stamp uint64,
+	data []byte) []byte {
+	body := make([]byte, 20, 20+len(data))
+	order.PutUint32(body[0:4], id)
+	order.PutUint32(body[4:8], uint32(stamp>>32))
+	order.PutUint32(body[8:12], uint32(stamp))
+	order.PutUint32(body[12:16], uint32(len(data)))
+	order.PutUint32(body[16:20], uint32(len(data)))
+	body = append(body, data...)
+
+	return block(order, blockEnhanced, body)
+}
+
+// simpleBlock builds a pcapng simple packet block.
+func simpleBlock(order binary.ByteOrder, data []byte) []byte {
+	body := make([]byte, 4, 4+len(data))
+	order.PutUint32(body[0:4], uint32(len(data)))
+	body = append(body, data...)
+
+	return block(order, blockSimple, body)
+}
+
+// readAll reads all packets of a capture.
+func readAll(t *testing.T, data []byte) []*Packet {
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("could not create reader (%v)", err)
+	}
+
+	packets := make([]*Packet, 0)
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("could not read packet %v (%v)", len(packets), err)
+		}
+
+		packets = append(packets, packet)
+	}
+}
+
+func checkPacket(t *testing.T, i int, packet *Packet, stamp time.Time,
+	link uint32, data []byte) {
+	if !packet.Stamp.Equal(stamp) {
+		t.Errorf("packet %v: stamp is %v, want %v", i, packet.Stamp, stamp)
+	}
+
+	if packet.Link != link {
+		t.Errorf("packet %v: link is %v, want %v", i, packet.Link, link)
+	}
+
+	if !bytes.Equal(packet.Data, data) {
+		t.Errorf("packet %v: data is %x, want %x", i, packet.Data, data)
+	}
+}
+
+func TestWriterReader(t *testing.T) {
+	stamps := []time.Time{
+		time.Unix(1500000000, 123456000),
+		time.Unix(1500000001, 0),
+		time.Unix(1500000002, 999999000),
+	}
+	payloads := [][]byte{{0x45, 0x00}, {}, bytes.Repeat([]byte{0xab}, 1500)}
+
+	buf := new(bytes.Buffer)
+	writer, err := NewWriter(buf)
+	if err != nil {
+		t.Fatalf("could not create writer (%v)", err)
+	}
+
+	for i := range stamps {
+		err = writer.WritePacket(stamps[i], payloads[i])
+		if err != nil {
+			t.Fatalf("could not write packet %v (%v)", i, err)
+		}
+	}
+
+	packets := readAll(t, buf.Bytes())
+	if len(packets) != len(stamps) {
+		t.Fatalf("read %v packets, want %v", len(packets), len(stamps))
+	}
+
+	for i, packet := range packets {
+		checkPacket(t, i, packet, stamps[i], LinkRaw, payloads[i])
+	}
+}
+
+func TestReaderBigEndianNano(t *testing.T) {
+	data := []byte{0xab, 0xcd}
+
+	buf := new(bytes.Buffer)
+	hdr := make([]byte, 24)
+	binary.BigEndian.PutUint32(hdr[0:4], magicNano)
+	binary.BigEndian.PutUint16(hdr[4:6], 2)
+	binary.BigEndian.PutUint16(hdr[6:8], 4)
+	binary.BigEndian.PutUint32(hdr[16:20], snaplen)
+	binary.BigEndian.PutUint32(hdr[20:24], LinkEthernet)
+	buf.Write(hdr)
+
+	rec := make([]byte, 16)
+	binary.BigEndian.PutUint32(rec[0:4], 1500000000)
+	binary.BigEndian.PutUint32(rec[4:8], 123456789)
+	binary.BigEndian.PutUint32(rec[8:12], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[12:16], uint32(len(data)))
+	buf.Write(rec)
+	buf.Write(data)
+
+	packets := readAll(t, buf.Bytes())
+	if len(packets) != 1 {
+		t.Fatalf("read %v packets, want 1", len(packets))
+	}
+
+	checkPacket(t, 0, packets[0], time.Unix(1500000000, 123456789),
+		LinkEthernet, data)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writer, err := NewWriter(buf)
+	if err != nil {
+		t.Fatalf("could not create writer (%v)", err)
+	}
+
+	err = writer.WritePacket(time.Unix(1500000000, 0), []byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("could not write packet (%v)", err)
+	}
+
+	reader, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-2]))
+	if err != nil {
+		t.Fatalf("could not create reader (%v)", err)
+	}
+
+	_, err = reader.Next()
+	if err == nil || err == io.EOF {
+		t.Errorf("truncated packet: error is %v", err)
+	}
+}
+
+func TestReaderInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		{},
+		{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 0},
+		sectionBlock(binary.LittleEndian)[:12],
+		append([]byte{0x0a, 0x0d, 0x0d, 0x0a, 28, 0, 0, 0}, 1, 2, 3, 4),
+	} {
+		_, err := NewReader(bytes.NewReader(data))
+		if err == nil {
+			t.Errorf("%x: expected error", data)
+		}
+	}
+}
+
+func TestReaderPcapNG(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian,
+		binary.BigEndian} {
+		first := []byte{0x45, 0x00, 0x00, 0x14, 0x01}
+		second := []byte{0x60, 0x00}
+		third := []byte{0xff, 0xee, 0xdd}
+		fourth := []byte{0x01, 0x02, 0x03, 0x04}
+
+		buf := new(bytes.Buffer)
+		buf.Write(sectionBlock(order))
+		buf.Write(interfaceBlock(order, LinkRaw, 9))
+		buf.Write(interfaceBlock(order, LinkEthernet, 0))
+		buf.Write(enhancedBlock(order, 0, 1500000000123456789, first))
+
+		// unknown blocks like interface statistics are skipped
+		buf.Write(block(order, 0x00000005, make([]byte, 16)))
+
+		buf.Write(enhancedBlock(order, 1, 1500000001000001, second))
+		buf.Write(simpleBlock(order, third))
+
+		// a new section forgets the interfaces of the previous one
+		buf.Write(sectionBlock(order))
+		buf.Write(interfaceBlock(order, LinkLinuxSLL, 0x80|10))
+		buf.Write(enhancedBlock(order, 0, 3*1024+512, fourth))
+
+		packets := readAll(t, buf.Bytes())
+		if len(packets) != 4 {
+			t.Fatalf("%v: read %v packets, want 4", order, len(packets))
+		}
+
+		checkPacket(t, 0, packets[0], time.Unix(1500000000, 123456789),
+			LinkRaw, first)
+		checkPacket(t, 1, packets[1], time.Unix(1500000001, 1000), LinkEthernet,
+			second)
+		checkPacket(t, 2, packets[2], time.Time{}, LinkRaw, third)
+		checkPacket(t, 3, packets[3], time.Unix(3, 500000000), LinkLinuxSLL,
+			fourth)
+	}
+}
+
+func TestReaderPcapNGInvalid(t *testing.T) {
+	order := binary.LittleEndian
+	tests := [][]byte{
+		// packet for an interface that was not described
+		enhancedBlock(order, 0, 0, []byte{1}),
+
+		// block length that is not a multiple of four
+		{0x06, 0, 0, 0, 13, 0, 0, 0},
+
+		// captured length beyond the block
+		func() []byte {
+			b := enhancedBlock(order, 0, 0, []byte{1, 2, 3, 4})
+			order.PutUint32(b[20:24], 100)
+			return b
+		}(),
+	}
+
+	for i, test := range tests {
+		buf := new(bytes.Buffer)
+		buf.Write(sectionBlock(order))
+		if i > 0 {
+			buf.Write(interfaceBlock(order, LinkRaw, 0))
+		}
+		buf.Write(test)
+
+		reader, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("test %v: could not create reader (%v)", i, err)
+		}
+
+		_, err = reader.Next()
+		if err == nil || err == io.EOF {
+			t.Errorf("test %v: error is %v", i, err)
+		}
+	}
+}
+
+func TestMarshalDecode(t *testing.T) {
+	tests := []struct {
+		src string
+		dst string
+	}{
+		{"10.0.0.1:50000", "10.0.0.2:8333"},
+		{"[2001:db8::1]:50000", "[2001:db8::2]:8333"},
+	}
+
+	for _, test := range tests {
+		src, _ := net.ResolveTCPAddr("tcp", test.src)
+		dst, _ := net.ResolveTCPAddr("tcp", test.dst)
+		seg := &Segment{
+			Src:     src,
+			Dst:     dst,
+			Seq:     0xfffffff0,
+			Ack:     42,
+			Flags:   FlagPSH | FlagACK,
+			Payload: []byte("hello"),
+		}
+
+		data := seg.Marshal()
+		if data[0]>>4 == 4 && checksum(data[:20]) != 0 {
+			t.Errorf("%v: invalid ipv4 header checksum", test.src)
+		}
+
+		decoded, err := Decode(&Packet{Link: LinkRaw, Data: data})
+		if err != nil {
+			t.Errorf("%v: could not decode (%v)", test.src, err)
+			continue
+		}
+
+		if decoded.Src.String() != src.String() ||
+			decoded.Dst.String() != dst.String() {
+			t.Errorf("%v: addresses are %v > %v", test.src, decoded.Src,
+				decoded.Dst)
+		}
+
+		if decoded.Seq != seg.Seq || decoded.Ack != seg.Ack ||
+			decoded.Flags != seg.Flags ||
+			!bytes.Equal(decoded.Payload, seg.Payload) {
+			t.Errorf("%v: decoded %+v, want %+v", test.src, decoded, seg)
+		}
+	}
+}
+
+func TestDecodeLinks(t *testing.T) {
+	seg := &Segment{
+		Src:     &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000},
+		Dst:     &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8333},
+		Flags:   FlagACK,
+		Payload: []byte{1, 2, 3},
+	}
+	ip := seg.Marshal()
+
+	ethernet := make([]byte, 14)
+	binary.BigEndian.PutUint16(ethernet[12:14], etherIPv4)
+
+	vlan := make([]byte, 18)
+	binary.BigEndian.PutUint16(vlan[12:14], etherVLAN)
+	binary.BigEndian.PutUint16(vlan[16:18], etherIPv4)
+
+	arp := make([]byte, 14)
+	binary.BigEndian.PutUint16(arp[12:14], 0x0806)
+
+	fragmented := append([]byte{}, ip...)
+	binary.BigEndian.PutUint16(fragmented[6:8], 0x2000)
+
+	udp := append([]byte{}, ip...)
+	udp[9] = 17
+
+	tests := []struct {
+		link  uint32
+		data  []byte
+		valid bool
+	}{
+		{LinkRaw, ip, true},
+		{LinkNull, append([]byte{2, 0, 0, 0}, ip...), true},
+		{LinkEthernet, append(ethernet, ip...), true},
+		{LinkEthernet, append(vlan, ip...), true},
+		{LinkLinuxSLL, append(make([]byte, 16), ip...), true},
+		{LinkEthernet, append(arp, ip...), false},
+		{LinkEthernet, ethernet[:10], false},
+		{LinkRaw, fragmented, false},
+		{LinkRaw, udp, false},
+		{LinkRaw, ip[:30], false},
+		{LinkRaw, nil, false},
+		{228, ip, false},
+	}
+
+	for i, test := range tests {
+		decoded, err := Decode(&Packet{Link: test.link, Data: test.data})
+		if !test.valid {
+			if err == nil {
+				t.Errorf("test %v: expected error", i)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("test %v: could not decode (%v)", i, err)
+			continue
+		}
+
+		if !bytes.Equal(decoded.Payload, seg.Payload) {
+			t.Errorf("test %v: payload is %x", i, decoded.Payload)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// maxPending is the maximum number of out-of-order segments we keep for one
+// stream before we give up on the missing data.
+const maxPending = 1024
+
+// headerSize is the size of a Bitcoin message header.
+const headerSize = 24
+
+// Handler is called for every message decoded from a capture, with the raw
+// message including its header, the sender and the receiver.
+type Handler func(msg wire.Message, raw []byte, src *net.TCPAddr,
+	dst *net.TCPAddr, stamp time.Time)
+
+// stream is one direction of a TCP connection.
+type stream struct {
+	started bool
+	next    uint32
+	buf     []byte
+	pending map[uint32][]byte
+}
+
+// Replayer reassembles the TCP streams of a capture and decodes the Bitcoin
+// messages sent over them.
+type Replayer struct {
+	network wire.BitcoinNet
+	version uint32
+	magic   []byte
+	handler Handler
+	streams map[string]*stream
+}
+
+// NewReplayer creates a new replayer for the given network, which calls the
+// handler for every decoded message.
+func NewReplayer(network wire.BitcoinNet, version uint32,
+	handler Handler) *Replayer {
+	magic := make([]byte, 4)
+	binary.LittleEndian.PutUint32(magic, uint32(network))
+
+	replayer := &Replayer{
+		network: network,
+		version: version,
+		magic:   magic,
+		handler: handler,
+		streams: make(map[string]*stream),
+	}
+
+	return replayer
+}
+
+// Replay reads all packets from a pcap or pcapng capture and decodes the
+// Bitcoin messages in them.
+func Replay(r io.Reader, network wire.BitcoinNet, version uint32,
+	handler Handler) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	replayer := NewReplayer(network, version, handler)
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		replayer.Packet(packet)
+	}
+}
+
+// Packet adds one captured packet. Packets that don't carry TCP are ignored.
+func (replayer *Replayer) Packet(packet *Packet) {
+	seg, err := Decode(packet)
+	if err != nil {
+		return
+	}
+
+	key := seg.Src.String() + ">" + seg.Dst.String()
+	s, ok := replayer.streams[key]
+	if !ok {
+		s = &stream{pending: make(map[uint32][]byte)}
+		replayer.streams[key] = s
+	}
+
+	// a new connection resets the stream
+	if seg.Flags&FlagSYN != 0 {
+		s.started = true
+		s.next = seg.Seq + 1
+		s.buf = nil
+		s.pending = make(map[uint32][]byte)
+		return
+	}
+
+	// if we missed the handshake, we start at the first segment we see
+	if !s.started {
+		s.started = true
+		s.next = seg.Seq
+	}
+
+	replayer.add(s, seg.Seq, seg.Payload)
+	replayer.extract(s, seg, packet.Stamp)
+
+	if seg.Flags&(FlagFIN|FlagRST) != 0 {
+		delete(replayer.streams, key)
+	}
+}
+
+// add puts the payload of a segment into the stream, in order.
+func (replayer *Replayer) add(s *stream, seq uint32, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	// segments ahead of the stream wait for the missing data; if too many are
+	// waiting, we skip the gap
+	if int32(seq-s.next) > 0 {
+		s.pending[seq] = payload
+		if len(s.pending) < maxPending {
+			return
+		}
+
+		first := seq
+		for pending := range s.pending {
+			if int32(pending-first) < 0 {
+				first = pending
+			}
+		}
+
+		s.next = first
+		s.buf = nil
+		seq = first
+		payload = s.pending[first]
+		delete(s.pending, first)
+	}
+
+	// retransmitted data is cut off
+	overlap := int(s.next - seq)
+	if overlap >= len(payload) {
+		return
+	}
+
+	s.buf = append(s.buf, payload[overlap:]...)
+	s.next += uint32(len(payload) - overlap)
+
+	for {
+		payload, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+
+		delete(s.pending, s.next)
+		s.buf = append(s.buf, payload...)
+		s.next += uint32(len(payload))
+	}
+}
+
+// extract decodes all complete messages from the stream buffer.
+func (replayer *Replayer) extract(s *stream, seg *Segment, stamp time.Time) {
+	for {
+		// look for the start of a message if we are out of sync
+		if !bytes.HasPrefix(s.buf, replayer.magic) {
+			i := bytes.Index(s.buf, replayer.magic)
+			if i < 0 {
+				if len(s.buf) > 3 {
+					s.buf = s.buf[len(s.buf)-3:]
+				}
+				return
+			}
+
+			s.buf = s.buf[i:]
+		}
+
+		if len(s.buf) < headerSize {
+			return
+		}
+
+		length := binary.LittleEndian.Uint32(s.buf[16:20])
+		if length > wire.MaxMessagePayload {
+			s.buf = s.buf[1:]
+			continue
+		}
+
+		total := headerSize + int(length)
+		if len(s.buf) < total {
+			return
+		}
+
+		raw := make([]byte, total)
+		copy(raw, s.buf[:total])
+		s.buf = s.buf[total:]
+
+		msg, _, err := wire.ReadMessage(bytes.NewReader(raw), replayer.version,
+			replayer.network)
+		if err != nil {
+			continue
+		}
+
+		replayer.handler(msg, raw, seg.Src, seg.Dst, stamp)
+	}
+}
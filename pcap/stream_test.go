@@ -0,0 +1,283 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package pcap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	testClient = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}
+	testServer = &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 18333}
+)
+
+// pings collects the nonces of the ping messages decoded by a replayer.
+type pings struct {
+	nonces []uint64
+}
+
+func (p *pings) handle(msg wire.Message, raw []byte, src *net.TCPAddr,
+	dst *net.TCPAddr, stamp time.Time) {
+	ping, ok := msg.(*wire.MsgPing)
+	if !ok {
+		return
+	}
+
+	p.nonces = append(p.nonces, ping.Nonce)
+}
+
+func (p *pings) check(t *testing.T, name string, want ...uint64) {
+	if len(p.nonces) != len(want) {
+		t.Errorf("%v: decoded pings %v, want %v", name, p.nonces, want)
+		return
+	}
+
+	for i := range want {
+		if p.nonces[i] != want[i] {
+			t.Errorf("%v: decoded pings %v, want %v", name, p.nonces, want)
+			return
+		}
+	}
+}
+
+// rawPings serializes ping messages with the given nonces.
+func rawPings(t *testing.T, nonces ...uint64) []byte {
+	buf := new(bytes.Buffer)
+	for _, nonce := range nonces {
+		err := wire.WriteMessage(buf, wire.NewMsgPing(nonce),
+			wire.ProtocolVersion, wire.TestNet3)
+		if err != nil {
+			t.Fatalf("could not serialize ping (%v)", err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// segment creates a packet from the client to the server.
+func segment(seq uint32, flags uint8, payload []byte) *Packet {
+	seg := &Segment{
+		Src:     testClient,
+		Dst:     testServer,
+		Seq:     seq,
+		Flags:   flags | FlagACK,
+		Payload: payload,
+	}
+
+	return &Packet{Link: LinkRaw, Data: seg.Marshal()}
+}
+
+// replay feeds the packets to a new replayer and returns the decoded pings.
+func replay(packets ...*Packet) *pings {
+	p := &pings{}
+	replayer := NewReplayer(wire.TestNet3, wire.ProtocolVersion, p.handle)
+	for _, packet := range packets {
+		replayer.Packet(packet)
+	}
+
+	return p
+}
+
+func TestReplayInOrder(t *testing.T) {
+	data := rawPings(t, 1, 2, 3)
+
+	// the sequence number wraps around during the stream
+	isn := uint32(0xffffffe0)
+	p := replay(
+		segment(isn, FlagSYN, nil),
+		segment(isn+1, 0, data[:10]),
+		segment(isn+11, 0, data[10:40]),
+		segment(isn+41, FlagPSH, data[40:]),
+	)
+
+	p.check(t, "in order", 1, 2, 3)
+}
+
+func TestReplayOutOfOrder(t *testing.T) {
+	data := rawPings(t, 1, 2, 3)
+
+	p := replay(
+		segment(1000, FlagSYN, nil),
+		segment(1041, 0, data[40:]),
+		segment(1011, 0, data[10:40]),
+		segment(1001, 0, data[:10]),
+	)
+
+	p.check(t, "out of order", 1, 2, 3)
+}
+
+func TestReplayRetransmission(t *testing.T) {
+	data := rawPings(t, 1, 2, 3)
+
+	p := replay(
+		segment(1000, FlagSYN, nil),
+		segment(1001, 0, data[:40]),
+		segment(1001, 0, data[:40]),
+		segment(1021, 0, data[20:60]),
+		segment(1001, 0, data[:10]),
+		segment(1061, 0, data[60:]),
+		segment(1061, 0, data[60:]),
+	)
+
+	p.check(t, "retransmission", 1, 2, 3)
+}
+
+func TestReplayResync(t *testing.T) {
+	data := rawPings(t, 1, 2)
+
+	// we missed the handshake and start in the middle of a message
+	partial := rawPings(t, 99)[5:]
+
+	// an oversized payload length after the magic is not a message
+	bogus := append(append([]byte{}, data[:16]...), 0xff, 0xff, 0xff, 0xff)
+
+	stream := append(append(append(partial, bogus...), 0x00, 0x01), data...)
+	p := replay(
+		segment(5000, 0, stream[:7]),
+		segment(5007, 0, stream[7:]),
+	)
+
+	p.check(t, "resync", 1, 2)
+}
+
+func TestReplayGap(t *testing.T) {
+	nonces := make([]uint64, maxPending)
+	for i := range nonces {
+		nonces[i] = uint64(i + 1)
+	}
+
+	partial := rawPings(t, 99)
+	lost := append(partial[30:], rawPings(t, 0)...)
+	packets := []*Packet{
+		segment(1000, FlagSYN, nil),
+		segment(1001, 0, partial[:30]),
+	}
+
+	// the segment after the first one is lost, so all following segments
+	// wait until too many are pending; the partial message before the gap is
+	// dropped with it
+	seq := uint32(1031 + len(lost))
+	for _, nonce := range nonces {
+		payload := rawPings(t, nonce)
+		packets = append(packets, segment(seq, 0, payload))
+		seq += uint32(len(payload))
+	}
+
+	p := replay(packets...)
+	p.check(t, "gap", nonces...)
+}
+
+func TestReplayReset(t *testing.T) {
+	first := rawPings(t, 1)
+	second := rawPings(t, 2)
+
+	p := replay(
+		segment(1000, FlagSYN, nil),
+		segment(1001, 0, first[:10]),
+		segment(1011, FlagFIN, nil),
+		segment(7000, FlagSYN, nil),
+		segment(7001, 0, second),
+		segment(2000, FlagSYN, nil),
+		segment(2001, FlagRST, first[10:]),
+	)
+
+	p.check(t, "reset", 2)
+}
+
+func TestReplayDirections(t *testing.T) {
+	request := rawPings(t, 1)
+	reply := rawPings(t, 2)
+
+	// we never see the start of the reply stream
+	start := &Segment{
+		Src:     testServer,
+		Dst:     testClient,
+		Seq:     8991,
+		Flags:   FlagACK,
+		Payload: reply[:10],
+	}
+	end := &Segment{
+		Src:     testServer,
+		Dst:     testClient,
+		Seq:     9001,
+		Flags:   FlagACK,
+		Payload: reply[10:],
+	}
+
+	p := &pings{}
+	replayer := NewReplayer(wire.TestNet3, wire.ProtocolVersion,
+		func(msg wire.Message, raw []byte, src *net.TCPAddr, dst *net.TCPAddr,
+			stamp time.Time) {
+			if src.String() == testServer.String() &&
+				!bytes.Equal(raw, reply) {
+				t.Errorf("raw reply is %x, want %x", raw, reply)
+			}
+
+			p.handle(msg, raw, src, dst, stamp)
+		})
+
+	for _, packet := range []*Packet{
+		segment(1000, FlagSYN, nil),
+		{Link: LinkRaw, Data: start.Marshal()},
+		segment(1001, 0, request),
+		{Link: LinkRaw, Data: end.Marshal()},
+	} {
+		replayer.Packet(packet)
+	}
+
+	p.check(t, "directions", 1, 2)
+}
+
+func TestReplayCapture(t *testing.T) {
+	data := rawPings(t, 1, 2)
+
+	buf := new(bytes.Buffer)
+	writer, err := NewWriter(buf)
+	if err != nil {
+		t.Fatalf("could not create writer (%v)", err)
+	}
+
+	stamp := time.Unix(1500000000, 0)
+	for _, packet := range []*Packet{
+		segment(1000, FlagSYN, nil),
+		segment(1001, 0, data[:20]),
+		segment(1021, 0, data[20:]),
+	} {
+		err = writer.WritePacket(stamp, packet.Data)
+		if err != nil {
+			t.Fatalf("could not write packet (%v)", err)
+		}
+	}
+
+	p := &pings{}
+	err = Replay(bytes.NewReader(buf.Bytes()), wire.TestNet3,
+		wire.ProtocolVersion, p.handle)
+	if err != nil {
+		t.Fatalf("could not replay capture (%v)", err)
+	}
+
+	p.check(t, "capture", 1, 2)
+}
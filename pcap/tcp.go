@@ -0,0 +1,231 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// TCP flags used in the segments we synthesize and decode.
+const (
+	FlagFIN = 0x01
+	FlagSYN = 0x02
+	FlagRST = 0x04
+	FlagPSH = 0x08
+	FlagACK = 0x10
+)
+
+const (
+	etherIPv4 = 0x0800
+	etherIPv6 = 0x86dd
+	etherVLAN = 0x8100
+)
+
+const protoTCP = 6
+
+// Segment is a TCP segment between two addresses.
+type Segment struct {
+	Src     *net.TCPAddr
+	Dst     *net.TCPAddr
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+	Payload []byte
+}
+
+// Marshal returns the segment as raw IP packet, with valid checksums. IPv4 is
+// used if both addresses are IPv4 addresses, IPv6 otherwise.
+func (seg *Segment) Marshal() []byte {
+	tcp := make([]byte, 20+len(seg.Payload))
+	binary.BigEndian.PutUint16(tcp[0:2], uint16(seg.Src.Port))
+	binary.BigEndian.PutUint16(tcp[2:4], uint16(seg.Dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:8], seg.Seq)
+	binary.BigEndian.PutUint32(tcp[8:12], seg.Ack)
+	tcp[12] = 5 << 4
+	tcp[13] = seg.Flags
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	copy(tcp[20:], seg.Payload)
+
+	src4 := seg.Src.IP.To4()
+	dst4 := seg.Dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:4], src4)
+		copy(pseudo[4:8], dst4)
+		pseudo[9] = protoTCP
+		binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:18], checksum(pseudo, tcp))
+
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:8], 0x4000)
+		ip[8] = 64
+		ip[9] = protoTCP
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+
+		return append(ip, tcp...)
+	}
+
+	src6 := seg.Src.IP.To16()
+	dst6 := seg.Dst.IP.To16()
+
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:16], src6)
+	copy(pseudo[16:32], dst6)
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(tcp)))
+	pseudo[39] = protoTCP
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(pseudo, tcp))
+
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(tcp)))
+	ip[6] = protoTCP
+	ip[7] = 64
+	copy(ip[8:24], src6)
+	copy(ip[24:40], dst6)
+
+	return append(ip, tcp...)
+}
+
+// Decode extracts the TCP segment from a captured packet. It returns an error
+// if the packet does not contain a TCP segment we can decode.
+func Decode(packet *Packet) (*Segment, error) {
+	data := packet.Data
+
+	switch packet.Link {
+	case LinkNull:
+		if len(data) < 4 {
+			return nil, errors.New("short loopback header")
+		}
+		data = data[4:]
+
+	case LinkEthernet:
+		if len(data) < 14 {
+			return nil, errors.New("short ethernet header")
+		}
+		kind := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for kind == etherVLAN && len(data) >= 4 {
+			kind = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if kind != etherIPv4 && kind != etherIPv6 {
+			return nil, errors.New("not an ip packet")
+		}
+
+	case LinkLinuxSLL:
+		if len(data) < 16 {
+			return nil, errors.New("short sll header")
+		}
+		data = data[16:]
+
+	case LinkRaw:
+
+	default:
+		return nil, errors.New("unsupported link type")
+	}
+
+	if len(data) < 1 {
+		return nil, errors.New("empty ip packet")
+	}
+
+	var src, dst net.IP
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, errors.New("short ipv4 header")
+		}
+		ihl := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:4]))
+		frag := binary.BigEndian.Uint16(data[6:8])
+		if data[9] != protoTCP || frag&0x3fff != 0 {
+			return nil, errors.New("not an unfragmented tcp packet")
+		}
+		if ihl < 20 || total < ihl || len(data) < total {
+			return nil, errors.New("invalid ipv4 header")
+		}
+		src = net.IP(append([]byte{}, data[12:16]...))
+		dst = net.IP(append([]byte{}, data[16:20]...))
+		data = data[ihl:total]
+
+	case 6:
+		if len(data) < 40 {
+			return nil, errors.New("short ipv6 header")
+		}
+		length := int(binary.BigEndian.Uint16(data[4:6]))
+		if data[6] != protoTCP || len(data) < 40+length {
+			return nil, errors.New("not a tcp packet")
+		}
+		src = net.IP(append([]byte{}, data[8:24]...))
+		dst = net.IP(append([]byte{}, data[24:40]...))
+		data = data[40 : 40+length]
+
+	default:
+		return nil, errors.New("not an ip packet")
+	}
+
+	if len(data) < 20 {
+		return nil, errors.New("short tcp header")
+	}
+
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || len(data) < offset {
+		return nil, errors.New("invalid tcp header")
+	}
+
+	seg := &Segment{
+		Src:     &net.TCPAddr{IP: src, Port: int(binary.BigEndian.Uint16(data[0:2]))},
+		Dst:     &net.TCPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(data[2:4]))},
+		Seq:     binary.BigEndian.Uint32(data[4:8]),
+		Ack:     binary.BigEndian.Uint32(data[8:12]),
+		Flags:   data[13],
+		Payload: data[offset:],
+	}
+
+	return seg, nil
+}
+
+// checksum calculates the internet checksum over the given buffers.
+func checksum(bufs ...[]byte) uint16 {
+	var sum uint32
+	odd := false
+	for _, buf := range bufs {
+		for _, b := range buf {
+			if odd {
+				sum += uint32(b)
+			} else {
+				sum += uint32(b) << 8
+			}
+			odd = !odd
+		}
+	}
+
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
@@ -21,7 +21,9 @@
 package peer
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -31,6 +33,7 @@ import (
 
 	"github.com/CIRCL/pbtc/adaptor"
 	"github.com/CIRCL/pbtc/convertor"
+	"github.com/CIRCL/pbtc/records"
 	"github.com/CIRCL/pbtc/util"
 )
 
@@ -49,20 +52,49 @@ const (
 	timeoutPing  = 1 * time.Minute
 	timeoutIdle  = 3 * time.Minute
 	timeoutDrain = 2 * time.Second
+	timeoutAddr  = 30 * time.Second
+	maxAddrKnown = 5000
+	maxAddrRelay = 10
+	maxAddrAge   = 10 * time.Minute
+	syncBackoff  = 1 * time.Minute
+	maxBackoff   = 1 * time.Hour
 	agentName    = "Satoshi"
 	agentVersion = "0.9.3"
 )
 
+// message is a message received from or sent to the peer, together with its
+// size on the wire and, if we capture them, its raw bytes.
+type message struct {
+	msg  wire.Message
+	size int
+	raw  []byte
+}
+
+// annotated is implemented by records that can carry the direction, size and
+// raw bytes of their message.
+type annotated interface {
+	SetDirection(string)
+	SetBytes(int)
+	SetWire([]byte)
+}
+
 // Peer represents a single peer that we communicate with on the network. It
 // groups together all necessary parameters, as well as queues and communication
 // functions.
 type Peer struct {
+	// message and byte counters are updated atomically, so we keep them at the
+	// start of the struct to guarantee their alignment
+	msgsIn   uint64
+	bytesIn  uint64
+	msgsOut  uint64
+	bytesOut uint64
+
 	wg         *sync.WaitGroup
 	sigSend    chan struct{}
 	sigRecv    chan struct{}
 	sigProcess chan struct{}
 	sendQ      chan wire.Message
-	recvQ      chan wire.Message
+	recvQ      chan *message
 
 	log     adaptor.Log
 	mgr     adaptor.Manager
@@ -77,11 +109,42 @@ type Peer struct {
 	conn    *net.TCPConn
 	me      *wire.NetAddress
 	you     *wire.NetAddress
+	remote  *wire.MsgVersion
+	latency time.Duration
+
+	attempted   time.Time
+	connected   time.Time
+	reason      string
+	reasonMutex *sync.Mutex
+
+	pingMutex   *sync.Mutex
+	pingPending map[uint64]time.Time
+	pingCount   int
+	rttMin      time.Duration
+	rttSum      time.Duration
+	rttLast     time.Duration
+
+	addrMutex   *sync.Mutex
+	addrPending []*wire.NetAddress
+	addrKnown   map[string]bool
+	addrRelay   bool
+	addrSample  int
+
+	syncRetry   time.Time
+	syncBackoff time.Duration
+
+	honest        bool
+	capture       bool
+	recordSent    bool
+	recordSession bool
+	recordLatency bool
+	pingRate      time.Duration
 
 	started uint32
 	done    uint32
 	sent    uint32
 	rcvd    uint32
+	polled  uint32
 }
 
 // New creates a new Peer with the given options. Communication on state is done
@@ -93,11 +156,28 @@ func New(options ...func(*Peer)) (*Peer, error) {
 		sigRecv:    make(chan struct{}),
 		sigProcess: make(chan struct{}),
 		sendQ:      make(chan wire.Message, 1),
-		recvQ:      make(chan wire.Message, 1),
+		recvQ:      make(chan *message, 1),
 
 		network: wire.TestNet3,
 		version: wire.RejectVersion,
 		nonce:   0,
+
+		reasonMutex: &sync.Mutex{},
+
+		pingMutex:   &sync.Mutex{},
+		pingPending: make(map[uint64]time.Time),
+
+		addrMutex:  &sync.Mutex{},
+		addrKnown:  make(map[string]bool),
+		addrRelay:  false,
+		addrSample: wire.MaxAddrPerMsg,
+
+		honest:        false,
+		capture:       false,
+		recordSent:    false,
+		recordSession: false,
+		recordLatency: false,
+		pingRate:      timeoutPing,
 	}
 
 	for _, option := range options {
@@ -128,6 +208,9 @@ func New(options ...func(*Peer)) (*Peer, error) {
 		return nil, err
 	}
 
+	p.connected = time.Now()
+	p.session(records.SessionConnect, records.ReasonIncoming, 0)
+
 	return p, nil
 }
 
@@ -206,6 +289,76 @@ func SetTracker(tracker adaptor.Tracker) func(*Peer) {
 	}
 }
 
+// SetAddressRelay enables answering address requests with addresses from the
+// repository, as well as relaying and announcing addresses to this peer.
+func SetAddressRelay(enabled bool) func(*Peer) {
+	return func(p *Peer) {
+		p.addrRelay = enabled
+	}
+}
+
+// SetAddressSample sets the maximum number of addresses we send in reply to an
+// address request.
+func SetAddressSample(sample int) func(*Peer) {
+	return func(p *Peer) {
+		p.addrSample = sample
+	}
+}
+
+// SetHonest enables honest-node emulation. In this mode, we answer requests
+// for headers and blocks from the header chain of the tracker and reply to
+// data requests with a not found message, as we do not keep any data.
+func SetHonest(enabled bool) func(*Peer) {
+	return func(p *Peer) {
+		p.honest = enabled
+	}
+}
+
+// SetCapture enables capturing the raw bytes of received messages, which are
+// attached to the records.
+func SetCapture(enabled bool) func(*Peer) {
+	return func(p *Peer) {
+		p.capture = enabled
+	}
+}
+
+// SetRecordSent enables creating records for the messages we send, in
+// addition to the ones we receive.
+func SetRecordSent(enabled bool) func(*Peer) {
+	return func(p *Peer) {
+		p.recordSent = enabled
+	}
+}
+
+// SetRecordSession enables creating session records for the lifecycle events
+// of the connection: connect, handshake and disconnect.
+func SetRecordSession(enabled bool) func(*Peer) {
+	return func(p *Peer) {
+		p.recordSession = enabled
+	}
+}
+
+// SetRecordLatency enables creating a latency record for every pong that
+// answers one of our pings.
+func SetRecordLatency(enabled bool) func(*Peer) {
+	return func(p *Peer) {
+		p.recordLatency = enabled
+	}
+}
+
+// SetPingRate sets the interval at which we ping the peer once the handshake
+// is complete, in order to measure the round-trip time. Rates that are not
+// positive are ignored.
+func SetPingRate(rate time.Duration) func(*Peer) {
+	return func(p *Peer) {
+		if rate <= 0 {
+			return
+		}
+
+		p.pingRate = rate
+	}
+}
+
 // String returns the address of this peer as string value.
 func (p *Peer) String() string {
 	return p.addr.String()
@@ -216,6 +369,31 @@ func (p *Peer) Addr() *net.TCPAddr {
 	return p.addr
 }
 
+// Version returns the version message the peer sent during the handshake. It
+// returns nil if we have not received it yet.
+func (p *Peer) Version() *wire.MsgVersion {
+	return p.remote
+}
+
+// Latency returns the time it took to establish the TCP connection to this
+// peer. It is zero for incoming connections.
+func (p *Peer) Latency() time.Duration {
+	return p.latency
+}
+
+// RoundTrip returns the minimum, average and last round-trip time of the pings
+// answered by this peer. They are zero if the peer has not answered any yet.
+func (p *Peer) RoundTrip() (time.Duration, time.Duration, time.Duration) {
+	p.pingMutex.Lock()
+	defer p.pingMutex.Unlock()
+
+	if p.pingCount == 0 {
+		return 0, 0, 0
+	}
+
+	return p.rttMin, p.rttSum / time.Duration(p.pingCount), p.rttLast
+}
+
 // Connect will try to start a connection attempt in a non-blocking manner.
 func (p *Peer) Connect() {
 	go p.connect()
@@ -231,6 +409,13 @@ func (p *Peer) Stop() {
 	go p.shutdown()
 }
 
+// Disconnect will try to initialize peer shutdown in a non-blocking manner,
+// giving the reason for the session record.
+func (p *Peer) Disconnect(reason string) {
+	p.setReason(reason)
+	go p.shutdown()
+}
+
 // Greet will queue a greeting message to this peer, used to conform to the
 // protocol.
 func (p *Peer) Greet() {
@@ -242,6 +427,30 @@ func (p *Peer) Poll() {
 	go p.pushGetAddr()
 }
 
+// Announce will queue the given addresses to be sent to this peer. Addresses
+// are sent in batches at regular intervals, similar to what other nodes do,
+// and addresses the peer already knows are skipped.
+func (p *Peer) Announce(addrs []*wire.NetAddress) {
+	if !p.addrRelay {
+		return
+	}
+
+	// if the address is unspecified, we announce the local IP of this
+	// connection; the slice is shared with other peers, so we don't modify it
+	own := make([]*wire.NetAddress, 0, len(addrs))
+	for _, na := range addrs {
+		if na.IP.IsUnspecified() && p.me != nil {
+			local := *na
+			local.IP = p.me.IP
+			na = &local
+		}
+
+		own = append(own, na)
+	}
+
+	p.queueAddrs(own)
+}
+
 // connect will try to connect to the address of the peer, if there is not
 // yet a connection that has been established
 func (p *Peer) connect() {
@@ -255,9 +464,13 @@ func (p *Peer) connect() {
 		return
 	}
 
+	p.attempted = time.Now()
+	p.session(records.SessionAttempt, "", 0)
+
 	connGen, err := net.DialTimeout("tcp", p.addr.String(), timeoutDial)
 	if err != nil {
 		p.log.Debug("[PEER] %v connection failed (%v)", p, err)
+		p.setReason(records.ReasonDial)
 		p.shutdown()
 		return
 	}
@@ -266,6 +479,7 @@ func (p *Peer) connect() {
 	conn, ok := connGen.(*net.TCPConn)
 	if !ok {
 		p.log.Debug("[PEER] %v connection type assert failed", p)
+		p.setReason(records.ReasonDial)
 		p.shutdown()
 		return
 	}
@@ -279,15 +493,19 @@ func (p *Peer) connect() {
 	}
 
 	p.conn = conn
+	p.connected = time.Now()
+	p.latency = p.connected.Sub(p.attempted)
 
 	err = p.parse()
 	if err != nil {
 		p.log.Debug("[PEER] %v connection parsing failed", p)
+		p.setReason(records.ReasonDial)
 		p.shutdown()
 		return
 	}
 
 	p.log.Debug("[PEER] %v connection established", p)
+	p.session(records.SessionConnect, records.ReasonOutgoing, p.latency)
 	p.mgr.Connected(p)
 }
 
@@ -317,9 +535,64 @@ func (p *Peer) shutdown() {
 		p.conn.Close()
 	}
 
+	p.reasonMutex.Lock()
+	reason := p.reason
+	p.reasonMutex.Unlock()
+
+	if reason == "" {
+		reason = records.ReasonStopped
+	}
+
+	// if we never connected, the session lasted as long as the attempt
+	var duration time.Duration
+	switch {
+	case !p.connected.IsZero():
+		duration = time.Since(p.connected)
+
+	case !p.attempted.IsZero():
+		duration = time.Since(p.attempted)
+	}
+
+	p.session(records.SessionDisconnect, reason, duration)
+
 	p.mgr.Stopped(p)
 }
 
+// setReason remembers why the connection to the peer ends. Only the first
+// reason is kept, as it is the one that triggered the shutdown.
+func (p *Peer) setReason(reason string) {
+	p.reasonMutex.Lock()
+	defer p.reasonMutex.Unlock()
+
+	if p.reason != "" {
+		return
+	}
+
+	p.reason = reason
+}
+
+// session forwards a session record for a lifecycle event of the connection
+// to our processors, if enabled.
+func (p *Peer) session(event string, reason string, duration time.Duration) {
+	if !p.recordSession {
+		return
+	}
+
+	var la *net.TCPAddr
+	if p.conn != nil {
+		la, _ = p.conn.LocalAddr().(*net.TCPAddr)
+	}
+
+	record := records.NewSessionRecord(event, reason, duration, p.addr, la,
+		atomic.LoadUint64(&p.msgsIn), atomic.LoadUint64(&p.bytesIn),
+		atomic.LoadUint64(&p.msgsOut), atomic.LoadUint64(&p.bytesOut))
+	record.SetLatency(p.RoundTrip())
+
+	for _, rec := range p.recs {
+		rec.Process(record)
+	}
+}
+
 // try to parse the connection parameters and address from the connection
 func (p *Peer) parse() error {
 	if p.addr == nil {
@@ -348,21 +621,41 @@ func (p *Peer) parse() error {
 }
 
 // sendMessage is used internally to send a message, blocking for timeout
-func (p *Peer) sendMessage(msg wire.Message) error {
+func (p *Peer) sendMessage(msg wire.Message) (*message, error) {
 	p.conn.SetWriteDeadline(time.Now().Add(timeoutSend))
 	version := atomic.LoadUint32(&p.version)
-	err := wire.WriteMessage(p.conn, msg, version, p.network)
 
-	return err
+	if !p.capture {
+		n, err := wire.WriteMessageN(p.conn, msg, version, p.network)
+		return &message{msg: msg, size: n}, err
+	}
+
+	buf := new(bytes.Buffer)
+	_, err := wire.WriteMessageN(buf, msg, version, p.network)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := p.conn.Write(buf.Bytes())
+
+	return &message{msg: msg, size: n, raw: buf.Bytes()}, err
 }
 
 // recvMessage is used internally to receive a message; it blocks for timeout
-func (p *Peer) recvMessage() (wire.Message, error) {
+func (p *Peer) recvMessage() (*message, error) {
 	p.conn.SetReadDeadline(time.Now().Add(timeoutRecv))
 	version := atomic.LoadUint32(&p.version)
-	msg, _, err := wire.ReadMessage(p.conn, version, p.network)
 
-	return msg, err
+	if !p.capture {
+		n, msg, _, err := wire.ReadMessageN(p.conn, version, p.network)
+		return &message{msg: msg, size: n}, err
+	}
+
+	buf := new(bytes.Buffer)
+	r := io.TeeReader(p.conn, buf)
+	n, msg, _, err := wire.ReadMessageN(r, version, p.network)
+
+	return &message{msg: msg, size: n, raw: buf.Bytes()}, err
 }
 
 // goSend takes care of reading the send queue and putting the messages on the
@@ -372,7 +665,8 @@ func (p *Peer) goSend() {
 
 	p.log.Debug("[PEER] %v send routine started", p)
 
-	idleTimer := time.NewTimer(timeoutPing)
+	pingTicker := time.NewTicker(p.pingRate)
+	addrTicker := time.NewTicker(timeoutAddr)
 
 SendLoop:
 	for {
@@ -382,32 +676,35 @@ SendLoop:
 				break SendLoop
 			}
 
-		// send ping if nothing was sent for a while
-		case <-idleTimer.C:
-			p.pushPing()
+		// send a ping to measure the round-trip time; we send it from here
+		// rather than through the queue, so nothing is left blocking on the
+		// queue once we stop
+		case <-pingTicker.C:
+			msg := p.nextPing()
+			if msg != nil && !p.send(msg) {
+				break SendLoop
+			}
+
+		// send the addresses that were queued since the last time
+		case <-addrTicker.C:
+			msg := p.nextAddr()
+			if msg != nil && !p.send(msg) {
+				break SendLoop
+			}
 
 		// if we have a message in the queue, send it
 		case msg := <-p.sendQ:
-			err := p.sendMessage(msg)
-			if e, ok := err.(net.Error); ok && e.Timeout() {
-				continue
-			}
-			if _, ok := err.(*wire.MessageError); ok {
-				p.log.Debug("[PEER] %v: send ignored (%v)", p, err)
-				continue
-			}
-			if err != nil {
-				p.log.Debug("[PEER] %v: disconnected (%v)", p, err)
+			if !p.send(msg) {
 				break SendLoop
 			}
-
-			idleTimer.Reset(timeoutPing)
 		}
 	}
 
 	p.Stop()
 
-	idleTimer.Reset(timeoutDrain)
+	addrTicker.Stop()
+	pingTicker.Stop()
+	timer := time.NewTimer(timeoutDrain)
 
 	// drain messages to be sent for a defined timespan
 	// this makes sure we don't get stuck somewhere because a sender is
@@ -415,7 +712,7 @@ SendLoop:
 DrainLoop:
 	for {
 		select {
-		case <-idleTimer.C:
+		case <-timer.C:
 			break DrainLoop
 
 		case <-p.sendQ:
@@ -426,6 +723,39 @@ DrainLoop:
 	p.log.Debug("[PEER] %v send routine stopped", p)
 }
 
+// send puts a message on the wire and records it. It returns false if the
+// connection failed.
+func (p *Peer) send(msg wire.Message) bool {
+	m, err := p.sendMessage(msg)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	if _, ok := err.(*wire.MessageError); ok {
+		p.log.Debug("[PEER] %v: send ignored (%v)", p, err)
+		return true
+	}
+	if err != nil {
+		p.log.Debug("[PEER] %v: disconnected (%v)", p, err)
+		p.setReason(records.ReasonSend)
+		return false
+	}
+
+	atomic.AddUint64(&p.msgsOut, 1)
+	atomic.AddUint64(&p.bytesOut, uint64(m.size))
+
+	// remember when we sent a ping so we can match the pong
+	ping, ok := msg.(*wire.MsgPing)
+	if ok {
+		p.pinged(ping.Nonce)
+	}
+
+	if p.recordSent {
+		p.record(m, records.DirectionOut)
+	}
+
+	return true
+}
+
 // goReceive handles incoming messages and queues them for processing
 func (p *Peer) goReceive() {
 	defer p.wg.Done()
@@ -445,6 +775,7 @@ ReceiveLoop:
 		// if we haven't received a message in a while, disconnect the peer
 		case <-idleTimer.C:
 			p.log.Debug("[PEER] %v: peer timed out", p)
+			p.setReason(records.ReasonTimeout)
 			break ReceiveLoop
 
 		// try to receive a message and put in on the receive queue
@@ -459,9 +790,13 @@ ReceiveLoop:
 			}
 			if err != nil {
 				p.log.Debug("[PEER] %v : disconnected (%v)", p, err)
+				p.setReason(records.ReasonReceive)
 				break ReceiveLoop
 			}
 
+			atomic.AddUint64(&p.msgsIn, 1)
+			atomic.AddUint64(&p.bytesIn, uint64(msg.size))
+
 			idleTimer.Reset(timeoutIdle)
 			p.recvQ <- msg
 		}
@@ -486,8 +821,8 @@ ProcessLoop:
 			}
 
 		// get messages from the receive queue and process them
-		case msg := <-p.recvQ:
-			p.processMessage(msg)
+		case m := <-p.recvQ:
+			p.processMessage(m)
 		}
 	}
 
@@ -507,24 +842,46 @@ DrainRecvLoop:
 	}
 }
 
-// processMessage does basic processing of the message to be in conformity
-// with the bitcoin protocol and then forwards it to the respective filters
-func (p *Peer) processMessage(msg wire.Message) {
+// record converts a message into a record and forwards it to our processors
+func (p *Peer) record(m *message, dir string) {
 	ra, ok1 := p.conn.RemoteAddr().(*net.TCPAddr)
 	la, ok2 := p.conn.LocalAddr().(*net.TCPAddr)
-	if ok1 && ok2 {
-		record := convertor.Message(msg, ra, la)
-		for _, rec := range p.recs {
-			rec.Process(record)
+	if !ok1 || !ok2 {
+		return
+	}
+
+	record := convertor.Message(m.msg, ra, la)
+	if record == nil {
+		return
+	}
+
+	a, ok := record.(annotated)
+	if ok {
+		a.SetDirection(dir)
+		a.SetBytes(m.size)
+		if m.raw != nil {
+			a.SetWire(m.raw)
 		}
 	}
 
+	for _, rec := range p.recs {
+		rec.Process(record)
+	}
+}
+
+// processMessage does basic processing of the message to be in conformity
+// with the bitcoin protocol and then forwards it to the respective filters
+func (p *Peer) processMessage(m *message) {
+	msg := m.msg
+	p.record(m, records.DirectionIn)
+
 	// if we have not yet received a version message and we receive any other
 	// message, the peer is breaking the protocol and we disconnect
 	if atomic.LoadUint32(&p.rcvd) == 0 {
 		_, ok := msg.(*wire.MsgVersion)
 		if !ok {
 			p.log.Debug("%v: out of order non-version message", p)
+			p.setReason(records.ReasonProtocol)
 			p.Stop()
 			return
 		}
@@ -538,22 +895,27 @@ func (p *Peer) processMessage(msg wire.Message) {
 	case *wire.MsgVersion:
 		if atomic.SwapUint32(&p.rcvd, 1) == 1 {
 			p.log.Debug("%v: out of order version message", p)
+			p.setReason(records.ReasonProtocol)
 			p.Stop()
 			return
 		}
 
 		if m.Nonce == p.nonce {
 			p.log.Debug("%v: detected connection to self", p)
+			p.setReason(records.ReasonSelf)
 			p.Stop()
 			return
 		}
 
 		if uint32(m.ProtocolVersion) < wire.MultipleAddressVersion {
 			p.log.Debug("%v: connected to obsolete peer", p)
+			p.setReason(records.ReasonObsolete)
 			p.Stop()
 			return
 		}
 
+		p.remote = m
+
 		// synchronize our protocol version to lowest supported one
 		version := atomic.LoadUint32(&p.version)
 		version = util.MinUint32(version, uint32(m.ProtocolVersion))
@@ -567,14 +929,14 @@ func (p *Peer) processMessage(msg wire.Message) {
 		if atomic.SwapUint32(&p.sent, 1) != 1 {
 			p.pushVersion()
 		} else {
-			p.mgr.Ready(p)
+			p.ready()
 		}
 
 	// verack messages only matter if we are waiting to finish handshake
 	// if we have both received and sent version, it is complete
 	case *wire.MsgVerAck:
 		if atomic.LoadUint32(&p.sent) == 1 && atomic.LoadUint32(&p.rcvd) == 1 {
-			p.mgr.Ready(p)
+			p.ready()
 		}
 
 	// only send a pong message if the protocol version expects it
@@ -583,32 +945,80 @@ func (p *Peer) processMessage(msg wire.Message) {
 			p.pushPong(m.Nonce)
 		}
 
+	// a pong answering one of our pings gives us the round-trip time
 	case *wire.MsgPong:
+		p.ponged(m.Nonce)
 
+	// answer the first address request with a sample of good addresses
 	case *wire.MsgGetAddr:
+		if !p.addrRelay || atomic.SwapUint32(&p.polled, 1) == 1 {
+			return
+		}
+
+		p.queueAddrs(p.repo.Sample(p.addrSample))
 
 	// if we get an address message, add the addresses to the repository
+	// small messages with fresh addresses are relayed to other peers
 	case *wire.MsgAddr:
+		fresh := make([]*wire.NetAddress, 0, len(m.AddrList))
 		for _, na := range m.AddrList {
 			addr := util.ParseNetAddress(na)
 			p.repo.Discovered(addr)
+			p.knowAddr(na)
+
+			if na.Timestamp.Add(maxAddrAge).After(time.Now()) {
+				fresh = append(fresh, na)
+			}
+		}
+
+		if p.addrRelay && len(m.AddrList) <= maxAddrRelay && len(fresh) > 0 {
+			p.mgr.Relay(p, fresh)
 		}
 
 	// if we get an inventory message, ask for the inventory
 	case *wire.MsgInv:
 		p.pushGetData(m)
 
+	// in honest mode, answer with the headers from our header chain
 	case *wire.MsgGetHeaders:
+		if !p.honest {
+			return
+		}
+
+		p.pushHeaders(m.BlockLocatorHashes, &m.HashStop)
 
+	// in honest mode, add headers to our header chain
 	case *wire.MsgHeaders:
+		if !p.honest {
+			return
+		}
 
+		p.syncHeaders(m.Headers)
+
+	// in honest mode, answer with the block inventory from our header chain
 	case *wire.MsgGetBlocks:
+		if !p.honest {
+			return
+		}
+
+		p.pushBlockInv(m.BlockLocatorHashes, &m.HashStop)
 
-	// if we receive a block message, mark the block hash as known
+	// if we receive a block message, mark the block hash as known; in honest
+	// mode, add the header to our header chain and if it isn't accepted, ask
+	// for headers
 	case *wire.MsgBlock:
 		p.tracker.AddBlock(m.BlockSha())
+		if p.honest && !p.tracker.AddHeader(&m.Header) {
+			p.resync()
+		}
 
+	// we don't keep any data, so we tell the peer we didn't find it
 	case *wire.MsgGetData:
+		if !p.honest {
+			return
+		}
+
+		p.pushNotFound(m)
 
 	// if we receive a transaction message, mark the transaction hash as known
 	case *wire.MsgTx:
@@ -621,6 +1031,13 @@ func (p *Peer) processMessage(msg wire.Message) {
 	}
 }
 
+// ready is called once the handshake is complete; it notifies the manager and
+// records the time the handshake took since the connection was established.
+func (p *Peer) ready() {
+	p.session(records.SessionHandshake, "", time.Since(p.connected))
+	p.mgr.Ready(p)
+}
+
 func (p *Peer) pushVerAck() {
 	p.sendQ <- wire.NewMsgVerAck()
 }
@@ -638,8 +1055,89 @@ func (p *Peer) pushVersion() {
 	p.sendQ <- msg
 }
 
-func (p *Peer) pushPing() {
-	p.sendQ <- wire.NewMsgPing(p.nonce)
+// nextPing returns a ping with a unique nonce, so that the pong answering it
+// can be told apart from others. Pinging before the handshake is complete
+// would break the protocol, so we return nil until then.
+func (p *Peer) nextPing() *wire.MsgPing {
+	if atomic.LoadUint32(&p.sent) == 0 || atomic.LoadUint32(&p.rcvd) == 0 {
+		return nil
+	}
+
+	nonce, err := wire.RandomUint64()
+	if err != nil {
+		p.log.Debug("[PEER] %v could not create ping nonce (%v)", p, err)
+		return nil
+	}
+
+	return wire.NewMsgPing(nonce)
+}
+
+// pinged remembers the time we sent the ping with the given nonce. Pings that
+// were not answered within the idle timeout are forgotten. Peers below the
+// version that introduced pongs never answer, so we don't wait for them.
+func (p *Peer) pinged(nonce uint64) {
+	if atomic.LoadUint32(&p.version) < wire.BIP0031Version {
+		return
+	}
+
+	p.pingMutex.Lock()
+	defer p.pingMutex.Unlock()
+
+	now := time.Now()
+	for pending, stamp := range p.pingPending {
+		if now.Sub(stamp) > timeoutIdle {
+			delete(p.pingPending, pending)
+		}
+	}
+
+	p.pingPending[nonce] = now
+}
+
+// ponged matches a pong to the ping we sent and updates the round-trip time
+// statistics. Pongs for unknown nonces are ignored.
+func (p *Peer) ponged(nonce uint64) {
+	p.pingMutex.Lock()
+	stamp, ok := p.pingPending[nonce]
+	if !ok {
+		p.pingMutex.Unlock()
+		return
+	}
+
+	delete(p.pingPending, nonce)
+
+	rtt := time.Since(stamp)
+	if p.pingCount == 0 || rtt < p.rttMin {
+		p.rttMin = rtt
+	}
+
+	p.rttSum += rtt
+	p.rttLast = rtt
+	p.pingCount++
+
+	min := p.rttMin
+	avg := p.rttSum / time.Duration(p.pingCount)
+	count := p.pingCount
+	p.pingMutex.Unlock()
+
+	p.log.Debug("[PEER] %v round-trip time %v", p, rtt)
+	if p.repo != nil {
+		p.repo.Measured(p.addr, min, avg, rtt)
+	}
+
+	if !p.recordLatency {
+		return
+	}
+
+	ra, ok1 := p.conn.RemoteAddr().(*net.TCPAddr)
+	la, ok2 := p.conn.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return
+	}
+
+	record := records.NewLatencyRecord(rtt, min, avg, count, ra, la)
+	for _, rec := range p.recs {
+		rec.Process(record)
+	}
 }
 
 func (p *Peer) pushPong(nonce uint64) {
@@ -650,14 +1148,162 @@ func (p *Peer) pushGetAddr() {
 	p.sendQ <- wire.NewMsgGetAddr()
 }
 
-func (p *Peer) pushAddr() {
+// nextAddr returns a message with the queued addresses, up to the maximum
+// allowed per message. It returns nil if there are none.
+func (p *Peer) nextAddr() *wire.MsgAddr {
+	p.addrMutex.Lock()
+	num := len(p.addrPending)
+	if num > wire.MaxAddrPerMsg {
+		num = wire.MaxAddrPerMsg
+	}
+
+	addrs := p.addrPending[:num]
+	p.addrPending = p.addrPending[num:]
+	p.addrMutex.Unlock()
+
+	if len(addrs) == 0 {
+		return nil
+	}
+
 	msg := wire.NewMsgAddr()
-	na, err := wire.NewNetAddress(p.conn.LocalAddr(), wire.SFNodeNetwork)
+	err := msg.AddAddresses(addrs...)
 	if err != nil {
+		p.log.Debug("[PEER] %v could not add addresses (%v)", p, err)
+		return nil
+	}
+
+	return msg
+}
+
+// queueAddrs adds addresses to the queue of addresses to send, skipping those
+// the peer already knows about.
+func (p *Peer) queueAddrs(addrs []*wire.NetAddress) {
+	p.addrMutex.Lock()
+	defer p.addrMutex.Unlock()
+
+	for _, na := range addrs {
+		key := util.ParseNetAddress(na).String()
+		if p.addrKnown[key] || len(p.addrPending) >= maxAddrKnown {
+			continue
+		}
+
+		p.markAddr(key)
+		p.addrPending = append(p.addrPending, na)
+	}
+}
+
+// knowAddr marks an address as known by the peer, so we don't send it back.
+func (p *Peer) knowAddr(na *wire.NetAddress) {
+	p.addrMutex.Lock()
+	defer p.addrMutex.Unlock()
+
+	p.markAddr(util.ParseNetAddress(na).String())
+}
+
+// markAddr adds a key to the set of known addresses, clearing it when it grows
+// too big. The caller needs to hold the address mutex.
+func (p *Peer) markAddr(key string) {
+	if len(p.addrKnown) >= maxAddrKnown {
+		p.addrKnown = make(map[string]bool)
+	}
+
+	p.addrKnown[key] = true
+}
+
+// syncHeaders adds headers to our header chain up to the first one that is not
+// accepted. If they all connected and the message was full, there are probably
+// more, so we ask for them right away.
+func (p *Peer) syncHeaders(hdrs []*wire.BlockHeader) {
+	for _, hdr := range hdrs {
+		if !p.tracker.AddHeader(hdr) {
+			p.resync()
+			return
+		}
+	}
+
+	if len(hdrs) > 0 {
+		p.syncBackoff = 0
+	}
+
+	if len(hdrs) == wire.MaxBlockHeadersPerMsg {
+		p.pushGetHeaders()
+	}
+}
+
+// resync asks the peer for headers after one of its headers was rejected. It
+// might not connect because we are behind, but it might also be from another
+// network, fail the proof-of-work check or fork off too deep; asking again
+// right away would then loop forever. We thus ask at most once per backoff,
+// which doubles until headers connect again.
+func (p *Peer) resync() {
+	now := time.Now()
+	if now.Before(p.syncRetry) {
 		return
 	}
 
-	msg.AddAddress(na)
+	p.syncBackoff *= 2
+	if p.syncBackoff == 0 {
+		p.syncBackoff = syncBackoff
+	}
+
+	if p.syncBackoff > maxBackoff {
+		p.syncBackoff = maxBackoff
+	}
+
+	p.syncRetry = now.Add(p.syncBackoff)
+	p.pushGetHeaders()
+}
+
+// pushGetHeaders asks the peer for the headers following our best chain.
+func (p *Peer) pushGetHeaders() {
+	msg := wire.NewMsgGetHeaders()
+	msg.ProtocolVersion = atomic.LoadUint32(&p.version)
+	for _, hash := range p.tracker.Locator() {
+		msg.AddBlockLocatorHash(hash)
+	}
+
+	p.sendQ <- msg
+}
+
+// pushHeaders sends the headers of our best chain after the locator.
+func (p *Peer) pushHeaders(locator []*wire.ShaHash, stop *wire.ShaHash) {
+	msg := wire.NewMsgHeaders()
+	hdrs := p.tracker.Headers(locator, stop, wire.MaxBlockHeadersPerMsg)
+	for _, hdr := range hdrs {
+		msg.AddBlockHeader(hdr)
+	}
+
+	p.sendQ <- msg
+}
+
+// pushBlockInv sends the block hashes of our best chain after the locator.
+// If there is nothing to announce, no message is sent, like a normal node.
+func (p *Peer) pushBlockInv(locator []*wire.ShaHash, stop *wire.ShaHash) {
+	hdrs := p.tracker.Headers(locator, stop, wire.MaxBlocksPerMsg)
+	if len(hdrs) == 0 {
+		return
+	}
+
+	msg := wire.NewMsgInv()
+	for _, hdr := range hdrs {
+		hash := hdr.BlockSha()
+		msg.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &hash))
+	}
+
+	p.sendQ <- msg
+}
+
+// pushNotFound tells the peer that we can't provide any of the requested data.
+func (p *Peer) pushNotFound(m *wire.MsgGetData) {
+	if len(m.InvList) == 0 {
+		return
+	}
+
+	msg := wire.NewMsgNotFound()
+	for _, inv := range m.InvList {
+		msg.AddInvVect(inv)
+	}
+
 	p.sendQ <- msg
 }
 
@@ -0,0 +1,711 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package peer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+	"github.com/CIRCL/pbtc/tracker"
+)
+
+// mainBlock returns the header of the first block after the genesis block of
+// the main network.
+func mainBlock(t *testing.T) *wire.BlockHeader {
+	merkle, err := wire.NewShaHashFromStr(
+		"0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098")
+	if err != nil {
+		t.Fatalf("invalid merkle root (%v)", err)
+	}
+
+	return &wire.BlockHeader{
+		Version:    1,
+		PrevBlock:  *chaincfg.MainNetParams.GenesisHash,
+		MerkleRoot: *merkle,
+		Timestamp:  time.Unix(1231469665, 0),
+		Bits:       0x1d00ffff,
+		Nonce:      2573394689,
+	}
+}
+
+// getHeaders returns the number of getheaders messages queued on the peer.
+func getHeaders(t *testing.T, p *Peer) int {
+	count := 0
+	for len(p.sendQ) > 0 {
+		msg := <-p.sendQ
+		_, ok := msg.(*wire.MsgGetHeaders)
+		if !ok {
+			t.Errorf("queued %v instead of getheaders", msg.Command())
+			continue
+		}
+
+		count++
+	}
+
+	return count
+}
+
+func TestSyncHeaders(t *testing.T) {
+	main := mainBlock(t)
+
+	// connects to the testnet genesis block, but the hash can't meet a target
+	// of one
+	weak := *main
+	weak.PrevBlock = *chaincfg.TestNet3Params.GenesisHash
+	weak.Bits = 0x03000001
+
+	tests := []struct {
+		name     string
+		network  wire.BitcoinNet
+		hdr      *wire.BlockHeader
+		accepted bool
+	}{
+		{"connected", wire.MainNet, main, true},
+		{"wrong network", wire.TestNet3, main, false},
+		{"bad proof of work", wire.TestNet3, &weak, false},
+	}
+
+	for _, test := range tests {
+		tkr, err := tracker.New(tracker.SetNetwork(test.network))
+		if err != nil {
+			t.Fatalf("%v: could not create tracker (%v)", test.name, err)
+		}
+
+		p := &Peer{
+			sendQ:   make(chan wire.Message, 8),
+			tracker: tkr,
+			version: wire.ProtocolVersion,
+		}
+
+		// rejected headers make us ask only once, no matter how often the
+		// peer sends them
+		for i := 0; i < 3; i++ {
+			p.syncHeaders([]*wire.BlockHeader{test.hdr})
+		}
+
+		want := 1
+		if test.accepted {
+			want = 0
+		}
+
+		count := getHeaders(t, p)
+		if count != want {
+			t.Errorf("%v: asked for headers %v times, want %v", test.name,
+				count, want)
+		}
+
+		if test.accepted {
+			continue
+		}
+
+		// once the backoff passed, we ask again and double the backoff
+		p.syncRetry = time.Now()
+		p.syncHeaders([]*wire.BlockHeader{test.hdr})
+
+		count = getHeaders(t, p)
+		if count != 1 || p.syncBackoff != 2*syncBackoff {
+			t.Errorf("%v: asked %v times after backoff, next backoff %v",
+				test.name, count, p.syncBackoff)
+		}
+	}
+}
+
+func TestResyncBackoff(t *testing.T) {
+	tkr, err := tracker.New(tracker.SetNetwork(wire.TestNet3))
+	if err != nil {
+		t.Fatalf("could not create tracker (%v)", err)
+	}
+
+	p := &Peer{
+		sendQ:   make(chan wire.Message, 16),
+		tracker: tkr,
+		version: wire.ProtocolVersion,
+	}
+
+	for i := 0; i < 10; i++ {
+		p.syncRetry = time.Time{}
+		p.resync()
+	}
+
+	if p.syncBackoff != maxBackoff {
+		t.Errorf("backoff is %v, want %v", p.syncBackoff, maxBackoff)
+	}
+
+	if getHeaders(t, p) != 10 {
+		t.Errorf("did not ask once per passed backoff")
+	}
+}
+
+// nullLog discards all log messages.
+type nullLog struct{}
+
+func (log nullLog) Debug(format string, args ...interface{})    {}
+func (log nullLog) Info(format string, args ...interface{})     {}
+func (log nullLog) Notice(format string, args ...interface{})   {}
+func (log nullLog) Warning(format string, args ...interface{})  {}
+func (log nullLog) Error(format string, args ...interface{})    {}
+func (log nullLog) Critical(format string, args ...interface{}) {}
+
+// newPeer returns a peer for the given address that was not started.
+func newPeer(t *testing.T, options ...func(*Peer)) *Peer {
+	addr := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333}
+	options = append(options, SetAddress(addr), SetLog(nullLog{}))
+
+	p, err := New(options...)
+	if err != nil {
+		t.Fatalf("could not create peer (%v)", err)
+	}
+
+	return p
+}
+
+func TestSetPingRate(t *testing.T) {
+	tests := []struct {
+		rate time.Duration
+		want time.Duration
+	}{
+		{-time.Second, timeoutPing},
+		{0, timeoutPing},
+		{5 * time.Second, 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		p := newPeer(t, SetPingRate(test.rate))
+		if p.pingRate != test.want {
+			t.Errorf("rate %v: ping rate is %v, want %v", test.rate,
+				p.pingRate, test.want)
+		}
+	}
+}
+
+func TestNextPing(t *testing.T) {
+	tests := []struct {
+		sent uint32
+		rcvd uint32
+		ping bool
+	}{
+		{0, 0, false},
+		{1, 0, false},
+		{0, 1, false},
+		{1, 1, true},
+	}
+
+	for _, test := range tests {
+		p := newPeer(t)
+		p.sent = test.sent
+		p.rcvd = test.rcvd
+
+		ping := p.nextPing()
+		if (ping != nil) != test.ping {
+			t.Errorf("sent %v, received %v: ping is %v", test.sent, test.rcvd,
+				ping)
+		}
+	}
+}
+
+func TestPonged(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint32
+		pings   []uint64
+		pongs   []uint64
+		count   int
+	}{
+		{"matched", wire.ProtocolVersion, []uint64{1, 2}, []uint64{2, 1}, 2},
+		{"unknown nonce", wire.ProtocolVersion, []uint64{1}, []uint64{2}, 0},
+		{"repeated pong", wire.ProtocolVersion, []uint64{1}, []uint64{1, 1}, 1},
+		{"no pong support", wire.BIP0031Version - 1, []uint64{1}, []uint64{1},
+			0},
+	}
+
+	for _, test := range tests {
+		// without a repository, the round-trip times are only kept locally
+		p := newPeer(t, SetVersion(test.version))
+		for _, nonce := range test.pings {
+			p.pinged(nonce)
+		}
+
+		for _, nonce := range test.pongs {
+			p.ponged(nonce)
+		}
+
+		if p.pingCount != test.count {
+			t.Errorf("%v: counted %v round trips, want %v", test.name,
+				p.pingCount, test.count)
+		}
+
+		min, avg, last := p.RoundTrip()
+		if test.count > 0 && (min > avg || last < min) {
+			t.Errorf("%v: invalid round trips (min %v, avg %v, last %v)",
+				test.name, min, avg, last)
+		}
+	}
+}
+
+func TestNextAddr(t *testing.T) {
+	p := newPeer(t, SetAddressRelay(true))
+
+	addrs := make([]*wire.NetAddress, 0, 1500)
+	for i := 0; i < cap(addrs); i++ {
+		ip := net.IPv4(10, 0, byte(i/256), byte(i%256))
+		addrs = append(addrs, wire.NewNetAddressIPPort(ip, 8333, 0))
+	}
+
+	p.Announce(addrs)
+
+	// known addresses are not queued again
+	p.Announce(addrs[:10])
+
+	sizes := []int{wire.MaxAddrPerMsg, 1500 - wire.MaxAddrPerMsg, 0}
+	for i, size := range sizes {
+		msg := p.nextAddr()
+		if size == 0 {
+			if msg != nil {
+				t.Errorf("message %v: got %v addresses, want none", i,
+					len(msg.AddrList))
+			}
+
+			continue
+		}
+
+		if msg == nil || len(msg.AddrList) != size {
+			t.Errorf("message %v: got %v, want %v addresses", i, msg, size)
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	addrs := []*wire.NetAddress{
+		wire.NewNetAddressIPPort(net.IPv4zero, 8333, wire.SFNodeNetwork),
+		wire.NewNetAddressIPPort(net.ParseIP("5.6.7.8"), 8333, 0),
+	}
+
+	tests := []struct {
+		me   string
+		want []string
+	}{
+		{"10.0.0.1", []string{"10.0.0.1", "5.6.7.8"}},
+		{"10.0.0.2", []string{"10.0.0.2", "5.6.7.8"}},
+		{"", []string{"0.0.0.0", "5.6.7.8"}},
+	}
+
+	// the same slice is announced to all peers, as the manager does
+	for _, test := range tests {
+		p := newPeer(t, SetAddressRelay(true))
+		if test.me != "" {
+			p.me = wire.NewNetAddressIPPort(net.ParseIP(test.me), 8333, 0)
+		}
+
+		p.Announce(addrs)
+
+		msg := p.nextAddr()
+		if msg == nil || len(msg.AddrList) != len(test.want) {
+			t.Errorf("local %v: got %v, want %v addresses", test.me, msg,
+				len(test.want))
+			continue
+		}
+
+		for i, na := range msg.AddrList {
+			if na.IP.String() != test.want[i] {
+				t.Errorf("local %v: address %v is %v, want %v", test.me, i,
+					na.IP, test.want[i])
+			}
+		}
+	}
+
+	if !addrs[0].IP.IsUnspecified() {
+		t.Errorf("announced slice was modified: %v", addrs[0].IP)
+	}
+}
+
+// connection returns both sides of a loopback connection.
+func connection(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, err := net.ListenTCP("tcp", local)
+	if err != nil {
+		t.Fatalf("could not listen (%v)", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan *net.TCPConn, 1)
+	go func() {
+		conn, _ := listener.AcceptTCP()
+		accepted <- conn
+	}()
+
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("could not connect (%v)", err)
+	}
+
+	remote := <-accepted
+	if remote == nil {
+		t.Fatalf("could not accept connection")
+	}
+
+	return conn, remote
+}
+
+// sampleRepo is a repository that returns a fixed sample and counts the
+// discovered addresses.
+type sampleRepo struct {
+	adaptor.Repository
+
+	sample     []*wire.NetAddress
+	discovered int
+}
+
+func (repo *sampleRepo) Discovered(*net.TCPAddr) {
+	repo.discovered++
+}
+
+func (repo *sampleRepo) Sample(int) []*wire.NetAddress {
+	return repo.sample
+}
+
+// relayManager is a manager that keeps the addresses it is asked to relay.
+type relayManager struct {
+	adaptor.Manager
+
+	relayed []*wire.NetAddress
+}
+
+func (mgr *relayManager) Relay(p adaptor.Peer, addrs []*wire.NetAddress) {
+	mgr.relayed = append(mgr.relayed, addrs...)
+}
+
+// readyPeer returns a peer on a loopback connection that completed the
+// handshake, together with the remote side of the connection.
+func readyPeer(t *testing.T, options ...func(*Peer)) (*Peer, *net.TCPConn) {
+	conn, remote := connection(t)
+	p := newPeer(t, append(options, SetConnection(conn))...)
+	p.rcvd = 1
+
+	return p, remote
+}
+
+// closePeer closes both sides of the connection of a peer.
+func closePeer(p *Peer, remote *net.TCPConn) {
+	p.conn.Close()
+	remote.Close()
+}
+
+func TestGetAddr(t *testing.T) {
+	sample := []*wire.NetAddress{
+		wire.NewNetAddressIPPort(net.ParseIP("5.6.7.8"), 8333, 0),
+		wire.NewNetAddressIPPort(net.ParseIP("5.6.7.9"), 8333, 0),
+	}
+
+	tests := []struct {
+		name     string
+		relay    bool
+		requests int
+		answered int
+	}{
+		{"relay disabled", false, 1, 0},
+		{"first request", true, 1, 2},
+		{"repeated request", true, 3, 2},
+	}
+
+	for _, test := range tests {
+		repo := &sampleRepo{sample: sample}
+		p, remote := readyPeer(t, SetAddressRelay(test.relay),
+			SetRepository(repo))
+
+		for i := 0; i < test.requests; i++ {
+			p.processMessage(&message{msg: wire.NewMsgGetAddr()})
+		}
+
+		answered := 0
+		for msg := p.nextAddr(); msg != nil; msg = p.nextAddr() {
+			answered += len(msg.AddrList)
+		}
+
+		if answered != test.answered {
+			t.Errorf("%v: answered with %v addresses, want %v", test.name,
+				answered, test.answered)
+		}
+
+		closePeer(p, remote)
+	}
+}
+
+func TestAddrRelay(t *testing.T) {
+	fresh := time.Now()
+	stale := fresh.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		relay   bool
+		stamps  []time.Time
+		relayed int
+	}{
+		{"relay disabled", false, []time.Time{fresh}, 0},
+		{"fresh addresses", true, []time.Time{fresh, fresh}, 2},
+		{"stale addresses", true, []time.Time{stale, stale}, 0},
+		{"only fresh ones", true, []time.Time{fresh, stale, fresh}, 2},
+		{"too many addresses", true, []time.Time{fresh, fresh, fresh, fresh,
+			fresh, fresh, fresh, fresh, fresh, fresh, fresh}, 0},
+	}
+
+	for _, test := range tests {
+		repo := &sampleRepo{}
+		mgr := &relayManager{}
+		p, remote := readyPeer(t, SetAddressRelay(test.relay),
+			SetRepository(repo), SetManager(mgr))
+
+		msg := wire.NewMsgAddr()
+		for i, stamp := range test.stamps {
+			na := wire.NewNetAddressTimestamp(stamp, 0,
+				net.IPv4(5, 6, 7, byte(i)), 8333)
+			msg.AddAddress(na)
+		}
+
+		p.processMessage(&message{msg: msg})
+
+		if repo.discovered != len(test.stamps) {
+			t.Errorf("%v: discovered %v addresses, want %v", test.name,
+				repo.discovered, len(test.stamps))
+		}
+
+		if len(mgr.relayed) != test.relayed {
+			t.Errorf("%v: relayed %v addresses, want %v", test.name,
+				len(mgr.relayed), test.relayed)
+		}
+
+		// addresses we got from the peer are not sent back to it
+		p.queueAddrs(msg.AddrList)
+		if p.nextAddr() != nil {
+			t.Errorf("%v: addresses queued for their source", test.name)
+		}
+
+		closePeer(p, remote)
+	}
+}
+
+// recorder is a processor that keeps the records it receives.
+type recorder struct {
+	records []adaptor.Record
+}
+
+func (rec *recorder) SetLog(adaptor.Log)        {}
+func (rec *recorder) AddNext(adaptor.Processor) {}
+func (rec *recorder) Start()                    {}
+func (rec *recorder) Stop()                     {}
+
+func (rec *recorder) Process(record adaptor.Record) {
+	rec.records = append(rec.records, record)
+}
+
+// annotations returns the direction, size and raw bytes of a record.
+func annotations(record adaptor.Record) (string, int, []byte) {
+	a, ok := record.(interface {
+		Direction() string
+		Bytes() int
+		Wire() []byte
+	})
+	if !ok {
+		return "", 0, nil
+	}
+
+	return a.Direction(), a.Bytes(), a.Wire()
+}
+
+func TestRecordSent(t *testing.T) {
+	tests := []struct {
+		name    string
+		sent    bool
+		capture bool
+		dirs    []string
+	}{
+		{"received only", false, false, []string{records.DirectionIn}},
+		{"sent", true, false, []string{records.DirectionOut,
+			records.DirectionIn}},
+		{"sent with capture", true, true, []string{records.DirectionOut,
+			records.DirectionIn}},
+	}
+
+	// a ping message has a header of 24 bytes and a nonce of 8 bytes
+	const size = 32
+
+	for _, test := range tests {
+		rec := &recorder{}
+		p, remote := readyPeer(t, SetRecordSent(test.sent),
+			SetCapture(test.capture),
+			SetProcessors([]adaptor.Processor{rec}))
+
+		if !p.send(wire.NewMsgPing(1)) {
+			t.Fatalf("%v: could not send ping", test.name)
+		}
+
+		p.processMessage(&message{msg: wire.NewMsgPong(1), size: size})
+
+		if p.msgsOut != 1 || p.bytesOut != size {
+			t.Errorf("%v: counted %v messages and %v bytes sent", test.name,
+				p.msgsOut, p.bytesOut)
+		}
+
+		if len(rec.records) != len(test.dirs) {
+			t.Errorf("%v: recorded %v messages, want %v", test.name,
+				len(rec.records), len(test.dirs))
+			closePeer(p, remote)
+			continue
+		}
+
+		for i, record := range rec.records {
+			dir, bytes, raw := annotations(record)
+			if dir != test.dirs[i] || bytes != size {
+				t.Errorf("%v: record %v is %v with %v bytes, want %v with %v",
+					test.name, i, dir, bytes, test.dirs[i], size)
+			}
+
+			if dir == records.DirectionOut && (raw != nil) != test.capture {
+				t.Errorf("%v: raw message is %v", test.name, raw)
+			}
+		}
+
+		closePeer(p, remote)
+	}
+}
+
+func TestSession(t *testing.T) {
+	tests := []struct {
+		enabled  bool
+		event    string
+		reason   string
+		duration time.Duration
+	}{
+		{false, records.SessionConnect, records.ReasonIncoming, 0},
+		{true, records.SessionAttempt, "", 0},
+		{true, records.SessionConnect, records.ReasonOutgoing, time.Second},
+		{true, records.SessionDisconnect, records.ReasonTimeout, time.Minute},
+	}
+
+	for _, test := range tests {
+		rec := &recorder{}
+		p, remote := readyPeer(t, SetRecordSession(test.enabled),
+			SetProcessors([]adaptor.Processor{rec}))
+
+		// a peer on an accepted connection starts with an incoming session
+		incoming := 0
+		if test.enabled {
+			incoming = 1
+		}
+
+		if len(rec.records) != incoming {
+			t.Errorf("%v: recorded %v sessions on connection, want %v",
+				test.event, len(rec.records), incoming)
+		}
+
+		rec.records = nil
+		p.send(wire.NewMsgPing(1))
+		p.session(test.event, test.reason, test.duration)
+		closePeer(p, remote)
+
+		if !test.enabled {
+			if len(rec.records) != 0 {
+				t.Errorf("%v: recorded %v sessions while disabled",
+					test.event, len(rec.records))
+			}
+
+			continue
+		}
+
+		if len(rec.records) != 1 {
+			t.Errorf("%v: recorded %v sessions, want 1", test.event,
+				len(rec.records))
+			continue
+		}
+
+		record, ok := rec.records[0].(*records.SessionRecord)
+		if !ok {
+			t.Errorf("%v: recorded %T", test.event, rec.records[0])
+			continue
+		}
+
+		if record.Event() != test.event || record.Reason() != test.reason ||
+			record.Duration() != test.duration {
+			t.Errorf("%v: recorded %v %q after %v, want %v %q after %v",
+				test.event, record.Event(), record.Reason(), record.Duration(),
+				test.event, test.reason, test.duration)
+		}
+
+		if record.MessagesOut() != 1 || record.BytesOut() != 32 ||
+			record.MessagesIn() != 0 {
+			t.Errorf("%v: recorded %v/%v messages in/out", test.event,
+				record.MessagesIn(), record.MessagesOut())
+		}
+	}
+}
+
+func TestLatencyRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		pongs   []uint64
+		counts  []int
+	}{
+		{"disabled", false, []uint64{1, 2}, nil},
+		{"matched", true, []uint64{1, 2}, []int{1, 2}},
+		{"unknown nonce", true, []uint64{3, 1}, []int{1}},
+	}
+
+	for _, test := range tests {
+		rec := &recorder{}
+		p, remote := readyPeer(t, SetRecordLatency(test.enabled),
+			SetProcessors([]adaptor.Processor{rec}))
+
+		p.pinged(1)
+		p.pinged(2)
+		for _, nonce := range test.pongs {
+			p.ponged(nonce)
+		}
+
+		closePeer(p, remote)
+
+		if len(rec.records) != len(test.counts) {
+			t.Errorf("%v: recorded %v latencies, want %v", test.name,
+				len(rec.records), len(test.counts))
+			continue
+		}
+
+		for i, r := range rec.records {
+			record, ok := r.(*records.LatencyRecord)
+			if !ok {
+				t.Errorf("%v: recorded %T", test.name, r)
+				continue
+			}
+
+			if record.Count() != test.counts[i] || record.Min() > record.Avg() ||
+				record.RTT() < record.Min() {
+				t.Errorf("%v: recorded %v round trips (rtt %v, min %v, avg %v)",
+					test.name, record.Count(), record.RTT(), record.Min(),
+					record.Avg())
+			}
+		}
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+	"github.com/CIRCL/pbtc/util"
+)
+
+// chainNode is a block header in the header tree of the chain analyzer. The
+// proof is the work of the block itself, while the work includes that of all
+// its ancestors in the tree.
+type chainNode struct {
+	hash      [32]byte
+	prev      [32]byte
+	height    int32
+	seen      time.Time
+	proof     *big.Int
+	work      *big.Int
+	parent    *chainNode
+	children  []*chainNode
+	connected bool
+}
+
+// peerTip remembers the highest block a peer told us about and since when.
+type peerTip struct {
+	node  *chainNode
+	since time.Time
+}
+
+// ChainAnalyzer is a processor that builds a tree of block headers from the
+// headers and block messages it receives. It detects competing tips and
+// reorganizations of the best chain, which is the one with the most work, and
+// emits fork and reorg records, which describe the tips and the peers that
+// were on them. Headers that don't meet their own target are ignored. All
+// records are forwarded, followed by the generated ones.
+//
+// Headers do not carry the block height, so heights are relative to the first
+// header the analyzer saw, until it sees a block with its height in the
+// coinbase. From then on, heights are absolute.
+type ChainAnalyzer struct {
+	Processor
+
+	wg        *sync.WaitGroup
+	sig       chan struct{}
+	recordQ   chan adaptor.Record
+	nodes     map[[32]byte]*chainNode
+	orphans   map[[32]byte][]*chainNode
+	peers     map[string]*peerTip
+	best      *chainNode
+	bestSince time.Time
+	depth     int32
+	pruned    int
+	anchored  bool
+	output    []adaptor.Record
+}
+
+// NewChainAnalyzer creates a new analyzer that tracks the block chain.
+func NewChainAnalyzer(options ...func(adaptor.Processor)) (*ChainAnalyzer,
+	error) {
+	analyzer := &ChainAnalyzer{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		recordQ: make(chan adaptor.Record, 1),
+		nodes:   make(map[[32]byte]*chainNode),
+		orphans: make(map[[32]byte][]*chainNode),
+		peers:   make(map[string]*peerTip),
+		depth:   2016,
+	}
+
+	for _, option := range options {
+		option(analyzer)
+	}
+
+	analyzer.pruned = int(analyzer.depth)
+
+	return analyzer, nil
+}
+
+// SetChainDepth sets the number of blocks below the best tip that we keep in
+// the header tree. Forks and reorganizations deeper than this are not seen.
+func SetChainDepth(depth int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*ChainAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.depth = int32(depth)
+	}
+}
+
+func (analyzer *ChainAnalyzer) Start() {
+	analyzer.log.Info("[PAC] Start: begin")
+
+	analyzer.wg.Add(1)
+	go analyzer.goProcess()
+
+	analyzer.log.Info("[PAC] Start: completed")
+}
+
+func (analyzer *ChainAnalyzer) Stop() {
+	analyzer.log.Info("[PAC] Stop: begin")
+
+	close(analyzer.sig)
+	analyzer.wg.Wait()
+
+	analyzer.log.Info("[PAC] Stop: completed")
+}
+
+// Process adds one record to the queue for analysis and forwarding.
+func (analyzer *ChainAnalyzer) Process(record adaptor.Record) {
+	analyzer.log.Debug("[PAC] Process: %v", record.Command())
+
+	analyzer.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (analyzer *ChainAnalyzer) goProcess() {
+	defer analyzer.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-analyzer.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case record := <-analyzer.recordQ:
+			analyzer.analyze(record)
+			analyzer.forward(record)
+
+			for _, output := range analyzer.output {
+				analyzer.forward(output)
+			}
+
+			analyzer.output = analyzer.output[:0]
+		}
+	}
+}
+
+// analyze adds all headers of a block or headers record to the tree and
+// updates the tip of the peer that sent them.
+func (analyzer *ChainAnalyzer) analyze(record adaptor.Record) {
+	if sent(record) {
+		return
+	}
+
+	var hdrs []*records.HeaderRecord
+	switch r := record.(type) {
+	case *records.BlockRecord:
+		hdrs = []*records.HeaderRecord{r.Header()}
+
+	case *records.HeadersRecord:
+		hdrs = r.Headers()
+
+	default:
+		return
+	}
+
+	var highest *chainNode
+	for _, hdr := range hdrs {
+		n := analyzer.add(hdr, record)
+		if n == nil || !n.connected {
+			continue
+		}
+
+		if highest == nil || n.work.Cmp(highest.work) > 0 {
+			highest = n
+		}
+	}
+
+	block, ok := record.(*records.BlockRecord)
+	if ok && highest != nil && block.Height() >= 0 {
+		analyzer.anchor(highest, block.Height())
+	}
+
+	ra := record.RemoteAddress()
+	if highest != nil && ra != nil {
+		analyzer.update(ra.String(), highest, record.Timestamp())
+	}
+
+	// we only prune once the tree grew by the depth since the last time, so
+	// orphans that survive pruning don't make us prune on every record
+	if len(analyzer.nodes) > analyzer.pruned+int(analyzer.depth) {
+		analyzer.prune()
+		analyzer.pruned = len(analyzer.nodes)
+	}
+}
+
+// add inserts a header into the tree, if we don't know it yet. Headers with
+// an unknown parent are kept as orphans, keyed by their previous block, until
+// the parent shows up. If the hash of the header does not meet its target,
+// nil is returned.
+func (analyzer *ChainAnalyzer) add(hdr *records.HeaderRecord,
+	record adaptor.Record) *chainNode {
+	n, ok := analyzer.nodes[hdr.Hash()]
+	if ok {
+		return n
+	}
+
+	hash := wire.ShaHash(hdr.Hash())
+	target := util.CompactToBig(hdr.Bits())
+	if target.Sign() <= 0 || util.HashToBig(&hash).Cmp(target) > 0 {
+		return nil
+	}
+
+	proof := util.CalcWork(target)
+	n = &chainNode{
+		hash:     hdr.Hash(),
+		prev:     hdr.PrevBlock(),
+		seen:     record.Timestamp(),
+		proof:    proof,
+		work:     proof,
+		children: make([]*chainNode, 0, 1),
+	}
+
+	analyzer.nodes[n.hash] = n
+
+	parent, ok := analyzer.nodes[n.prev]
+	switch {
+	case ok && parent.connected:
+		analyzer.attach(n, parent, record)
+
+	case analyzer.best == nil:
+		n.connected = true
+		analyzer.best = n
+		analyzer.bestSince = n.seen
+
+	default:
+		analyzer.orphans[n.prev] = append(analyzer.orphans[n.prev], n)
+		return n
+	}
+
+	// connect all orphans that were waiting for this node
+	queue := []*chainNode{n}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for _, child := range analyzer.orphans[parent.hash] {
+			analyzer.attach(child, parent, record)
+			queue = append(queue, child)
+		}
+
+		delete(analyzer.orphans, parent.hash)
+	}
+
+	return n
+}
+
+// attach connects a node to its parent, detecting forks and reorganizations.
+func (analyzer *ChainAnalyzer) attach(n *chainNode, parent *chainNode,
+	record adaptor.Record) {
+	n.parent = parent
+	n.height = parent.height + 1
+	n.work = new(big.Int).Add(parent.work, n.proof)
+	n.connected = true
+	parent.children = append(parent.children, n)
+
+	if len(parent.children) > 1 {
+		analyzer.fork(parent, record)
+	}
+
+	if n.work.Cmp(analyzer.best.work) <= 0 {
+		return
+	}
+
+	if ancestor(n, analyzer.best.height) != analyzer.best {
+		analyzer.reorg(n, record)
+	}
+
+	analyzer.best = n
+	analyzer.bestSince = record.Timestamp()
+}
+
+// fork emits a fork record for the competing children of the given parent.
+func (analyzer *ChainAnalyzer) fork(parent *chainNode, record adaptor.Record) {
+	analyzer.log.Info("[PAC] Fork detected at height %v", parent.height+1)
+
+	tips := make([]*records.TipRecord, 0, len(parent.children))
+	for _, child := range parent.children {
+		tips = append(tips, analyzer.tip(child, parent, record.Timestamp()))
+	}
+
+	output := records.NewForkRecord(parent.hash, parent.height+1, tips,
+		record.RemoteAddress(), record.LocalAddress())
+	analyzer.output = append(analyzer.output, output)
+}
+
+// reorg emits a reorg record for a switch of the best chain to the branch of
+// the given node.
+func (analyzer *ChainAnalyzer) reorg(n *chainNode, record adaptor.Record) {
+	old := analyzer.best
+
+	// walk back both branches until we find the common ancestor
+	a, b := old, n
+	for a != nil && b != nil && a != b {
+		if a.height >= b.height {
+			a = a.parent
+		} else {
+			b = b.parent
+		}
+	}
+
+	// if the branches don't meet, the common part was pruned
+	if a == nil || b == nil {
+		return
+	}
+
+	fork := a
+	stale := make([][32]byte, 0, old.height-fork.height)
+	for s := old; s != fork; s = s.parent {
+		stale = append(stale, s.hash)
+	}
+
+	now := record.Timestamp()
+	depth := old.height - fork.height
+	analyzer.log.Notice("[PAC] Reorg detected with depth %v", depth)
+
+	output := records.NewReorgRecord(fork.hash, depth,
+		now.Sub(analyzer.bestSince), analyzer.tip(old, fork, now),
+		analyzer.tip(n, fork, now), stale, record.RemoteAddress(),
+		record.LocalAddress())
+	analyzer.output = append(analyzer.output, output)
+}
+
+// tip describes the given node and the peers that are on its side of the
+// branch starting after the base node.
+func (analyzer *ChainAnalyzer) tip(n *chainNode, base *chainNode,
+	now time.Time) *records.TipRecord {
+	tip := records.NewTipRecord(n.hash, n.height, n.seen)
+	first := ancestor(n, base.height+1)
+
+	for addr, pt := range analyzer.peers {
+		if pt.node.height <= base.height {
+			continue
+		}
+
+		if ancestor(pt.node, base.height+1) != first {
+			continue
+		}
+
+		tip.AddPeer(addr, now.Sub(pt.since))
+	}
+
+	return tip
+}
+
+// anchor makes the heights in the tree absolute, using the height of a block
+// from its coinbase. This is only done once, so a block with a bogus height
+// can't move the tree around later.
+func (analyzer *ChainAnalyzer) anchor(n *chainNode, height int32) {
+	if analyzer.anchored {
+		return
+	}
+
+	analyzer.anchored = true
+	shift := height - n.height
+	for _, node := range analyzer.nodes {
+		if node.connected {
+			node.height += shift
+		}
+	}
+}
+
+// update sets the tip of a peer, if the node has more work than the current
+// one.
+func (analyzer *ChainAnalyzer) update(addr string, n *chainNode,
+	now time.Time) {
+	pt, ok := analyzer.peers[addr]
+	if ok && pt.node.work.Cmp(n.work) >= 0 {
+		return
+	}
+
+	analyzer.peers[addr] = &peerTip{node: n, since: now}
+}
+
+// prune removes all nodes, orphans and peer tips that are too far below the
+// best tip to be of interest.
+func (analyzer *ChainAnalyzer) prune() {
+	limit := analyzer.best.height - analyzer.depth
+
+	for hash, n := range analyzer.nodes {
+		if n.connected && n.height < limit {
+			delete(analyzer.nodes, hash)
+		}
+	}
+
+	for _, n := range analyzer.nodes {
+		if n.parent != nil && n.parent.height < limit {
+			n.parent = nil
+		}
+	}
+
+	for addr, pt := range analyzer.peers {
+		if pt.node.height < limit {
+			delete(analyzer.peers, addr)
+		}
+	}
+
+	if len(analyzer.orphans) > int(analyzer.depth) {
+		for _, orphans := range analyzer.orphans {
+			for _, n := range orphans {
+				delete(analyzer.nodes, n.hash)
+			}
+		}
+
+		analyzer.orphans = make(map[[32]byte][]*chainNode)
+	}
+}
+
+// forward will send the record to all processors following this analyzer.
+func (analyzer *ChainAnalyzer) forward(record adaptor.Record) {
+	for _, processor := range analyzer.next {
+		processor.Process(record)
+	}
+}
+
+// ancestor returns the ancestor of the node at the given height, or nil if it
+// is not in the tree.
+func ancestor(n *chainNode, height int32) *chainNode {
+	for n != nil && n.height > height {
+		n = n.parent
+	}
+
+	return n
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+	"github.com/CIRCL/pbtc/util"
+)
+
+const (
+	// easyBits is a target met by about every second hash.
+	easyBits = 0x207fffff
+
+	// hardBits is a target that needs about 512 hashes, so one block has as
+	// much work as hundreds of easy ones.
+	hardBits = 0x1f7fffff
+)
+
+// chainStep sends one header with the given name on top of the named parent.
+// If the height is not negative, the header comes in a block with that height
+// in the coinbase, otherwise in a headers message.
+type chainStep struct {
+	name   string
+	parent string
+	bits   uint32
+	height int32
+	mined  bool
+}
+
+// mineHeader returns a header on top of the given block. If mined is set, the
+// nonce is chosen so that the hash meets the target, otherwise so that it
+// doesn't. The salt makes headers with the same parent distinct.
+func mineHeader(prev wire.ShaHash, bits uint32, salt string,
+	mined bool) *wire.BlockHeader {
+	hdr := &wire.BlockHeader{
+		Version:   2,
+		PrevBlock: prev,
+		Timestamp: time.Unix(1400000000, 0),
+		Bits:      bits,
+	}
+	copy(hdr.MerkleRoot[:], salt)
+
+	target := util.CompactToBig(bits)
+	for {
+		hash := hdr.BlockSha()
+		if (util.HashToBig(&hash).Cmp(target) <= 0) == mined {
+			return hdr
+		}
+
+		hdr.Nonce++
+	}
+}
+
+// chainRecord wraps a header in a headers or block record.
+func chainRecord(hdr *wire.BlockHeader, height int32) adaptor.Record {
+	ra := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333}
+	la := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 45000}
+
+	if height < 0 {
+		msg := wire.NewMsgHeaders()
+		msg.AddBlockHeader(hdr)
+		return records.NewHeadersRecord(msg, ra, la)
+	}
+
+	coinbase := wire.NewMsgTx()
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&wire.ShaHash{},
+		0xffffffff), []byte{0x02, byte(height), byte(height >> 8)}))
+	coinbase.AddTxOut(wire.NewTxOut(5000000000, []byte{0x51}))
+
+	msg := wire.NewMsgBlock(hdr)
+	msg.AddTransaction(coinbase)
+
+	return records.NewBlockRecord(msg, ra, la)
+}
+
+// runChain sends the steps to a new analyzer and returns it with the commands
+// of the generated records and the hashes of the headers.
+func runChain(t *testing.T, steps []chainStep) (*ChainAnalyzer, []string,
+	map[string]wire.ShaHash) {
+	analyzer, err := NewChainAnalyzer()
+	if err != nil {
+		t.Fatalf("could not create analyzer (%v)", err)
+	}
+
+	analyzer.SetLog(nullLog{})
+
+	// headers are mined after their parents, but may be sent before them
+	hdrs := make(map[string]*wire.BlockHeader)
+	hashes := make(map[string]wire.ShaHash)
+	for len(hdrs) < len(steps) {
+		for _, step := range steps {
+			_, ok := hashes[step.parent]
+			if hdrs[step.name] != nil || (step.parent != "" && !ok) {
+				continue
+			}
+
+			hdr := mineHeader(hashes[step.parent], step.bits, step.name,
+				step.mined)
+			hdrs[step.name] = hdr
+			hashes[step.name] = hdr.BlockSha()
+		}
+	}
+
+	cmds := make([]string, 0)
+	for _, step := range steps {
+		analyzer.analyze(chainRecord(hdrs[step.name], step.height))
+		for _, output := range analyzer.output {
+			cmds = append(cmds, output.Command())
+		}
+
+		analyzer.output = analyzer.output[:0]
+	}
+
+	return analyzer, cmds, hashes
+}
+
+func TestChainAnalyzer(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []chainStep
+		cmds   []string
+		best   string
+		height int32
+	}{
+		{
+			name: "linear",
+			steps: []chainStep{
+				{"g", "", easyBits, -1, true},
+				{"a1", "g", easyBits, -1, true},
+				{"a2", "a1", easyBits, -1, true},
+			},
+			cmds: []string{},
+			best: "a2", height: 2,
+		},
+		{
+			name: "fork with equal work keeps the first tip",
+			steps: []chainStep{
+				{"g", "", easyBits, -1, true},
+				{"a1", "g", easyBits, -1, true},
+				{"b1", "g", easyBits, -1, true},
+			},
+			cmds: []string{"fork"},
+			best: "a1", height: 1,
+		},
+		{
+			name: "longer branch",
+			steps: []chainStep{
+				{"g", "", easyBits, -1, true},
+				{"a1", "g", easyBits, -1, true},
+				{"b1", "g", easyBits, -1, true},
+				{"b2", "b1", easyBits, -1, true},
+			},
+			cmds: []string{"fork", "reorg"},
+			best: "b2", height: 2,
+		},
+		{
+			name: "shorter branch with more work",
+			steps: []chainStep{
+				{"g", "", easyBits, -1, true},
+				{"a1", "g", easyBits, -1, true},
+				{"a2", "a1", easyBits, -1, true},
+				{"b1", "g", hardBits, -1, true},
+			},
+			cmds: []string{"fork", "reorg"},
+			best: "b1", height: 1,
+		},
+		{
+			name: "longer branch with less work",
+			steps: []chainStep{
+				{"g", "", easyBits, -1, true},
+				{"b1", "g", hardBits, -1, true},
+				{"a1", "g", easyBits, -1, true},
+				{"a2", "a1", easyBits, -1, true},
+			},
+			cmds: []string{"fork"},
+			best: "b1", height: 1,
+		},
+		{
+			name: "header not meeting its target",
+			steps: []chainStep{
+				{"g", "", easyBits, -1, true},
+				{"a1", "g", easyBits, -1, true},
+				{"b1", "g", hardBits, -1, false},
+			},
+			cmds: []string{},
+			best: "a1", height: 1,
+		},
+		{
+			name: "orphan connected later",
+			steps: []chainStep{
+				{"g", "", easyBits, -1, true},
+				{"a2", "a1", easyBits, -1, true},
+				{"a1", "g", easyBits, -1, true},
+			},
+			cmds: []string{},
+			best: "a2", height: 2,
+		},
+		{
+			name: "heights from the coinbase",
+			steps: []chainStep{
+				{"g", "", easyBits, -1, true},
+				{"a1", "g", easyBits, 300, true},
+				{"a2", "a1", easyBits, -1, true},
+			},
+			cmds: []string{},
+			best: "a2", height: 301,
+		},
+		{
+			name: "only the first coinbase height counts",
+			steps: []chainStep{
+				{"g", "", easyBits, 300, true},
+				{"a1", "g", easyBits, 7, true},
+			},
+			cmds: []string{},
+			best: "a1", height: 301,
+		},
+	}
+
+	for _, test := range tests {
+		analyzer, cmds, hashes := runChain(t, test.steps)
+
+		if len(cmds) != len(test.cmds) {
+			t.Errorf("%v: generated %v, want %v", test.name, cmds, test.cmds)
+		} else {
+			for i := range cmds {
+				if cmds[i] != test.cmds[i] {
+					t.Errorf("%v: generated %v, want %v", test.name, cmds,
+						test.cmds)
+					break
+				}
+			}
+		}
+
+		best := analyzer.best
+		if best.hash != hashes[test.best] || best.height != test.height {
+			t.Errorf("%v: best tip %x at %v, want %v at %v", test.name,
+				best.hash[:4], best.height, test.best, test.height)
+		}
+	}
+}
+
+func TestChainAnalyzerPrune(t *testing.T) {
+	analyzer, err := NewChainAnalyzer(SetChainDepth(4))
+	if err != nil {
+		t.Fatalf("could not create analyzer (%v)", err)
+	}
+
+	analyzer.SetLog(nullLog{})
+
+	root := mineHeader(wire.ShaHash{}, easyBits, "main", true)
+	analyzer.analyze(chainRecord(root, -1))
+
+	// orphans that never connect survive pruning; with them around, we must
+	// still not prune on every record
+	for i := 0; i < 4; i++ {
+		orphan := mineHeader(wire.ShaHash{byte(i + 1)}, easyBits, "orphan",
+			true)
+		analyzer.analyze(chainRecord(orphan, -1))
+	}
+
+	prev := root.BlockSha()
+	prunes := 0
+	for i := 0; i < 40; i++ {
+		hdr := mineHeader(prev, easyBits, "main", true)
+		prev = hdr.BlockSha()
+
+		count := len(analyzer.nodes)
+		analyzer.analyze(chainRecord(hdr, -1))
+		if len(analyzer.nodes) <= count {
+			prunes++
+		}
+	}
+
+	if analyzer.best.height != 40 {
+		t.Errorf("best tip at %v, want 40", analyzer.best.height)
+	}
+
+	if prunes == 0 || prunes > 10 {
+		t.Errorf("pruned %v times for 40 headers", prunes)
+	}
+
+	for _, n := range analyzer.nodes {
+		if n.connected && n.height < analyzer.best.height-2*analyzer.depth {
+			t.Errorf("node at %v was not pruned", n.height)
+		}
+	}
+}
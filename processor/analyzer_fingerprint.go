@@ -0,0 +1,428 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+const (
+	AnomalyNonce   = "nonce_reuse"
+	AnomalyAgent   = "agent_mismatch"
+	AnomalyHeight  = "impossible_height"
+	AnomalyAddrYou = "spoofed_addr_you"
+	AnomalyCluster = "agent_cluster"
+)
+
+const (
+	heightSamples   = 101
+	heightTolerance = 12
+	addrYouSamples  = 10
+	addrYouLimit    = 1024
+)
+
+// satoshiVersions maps the major and minor version of the reference client
+// to the range of protocol versions it announces.
+var satoshiVersions = map[string][2]int32{
+	"0.8":  {60002, 70001},
+	"0.9":  {70002, 70002},
+	"0.10": {70002, 70002},
+	"0.11": {70002, 70002},
+	"0.12": {70011, 70012},
+	"0.13": {70014, 70014},
+	"0.14": {70015, 70015},
+	"0.15": {70015, 70015},
+}
+
+// nonceUse remembers which IP used a version nonce and when.
+type nonceUse struct {
+	ip   string
+	seen time.Time
+}
+
+// agentCluster collects the IPs in a subnet that use the same user agent.
+type agentCluster struct {
+	ips      map[string]time.Time
+	reported bool
+}
+
+// FingerprintAnalyzer is a processor that inspects version records for signs
+// of fake or misconfigured nodes: the same nonce used from different IPs, a
+// user agent that doesn't match the protocol version, an impossible start
+// height, a spoofed address for us and clusters of identical user agents in
+// one subnet. It emits anomaly records for each finding. All records are
+// forwarded, followed by the generated ones.
+type FingerprintAnalyzer struct {
+	Processor
+
+	wg       *sync.WaitGroup
+	sig      chan struct{}
+	recordQ  chan adaptor.Record
+	ticker   *time.Ticker
+	nonces   map[uint64]*nonceUse
+	clusters map[string]*agentCluster
+	heights  []int32
+	addrYou  map[string]int
+	window   time.Duration
+	size     int
+	output   []adaptor.Record
+}
+
+// NewFingerprintAnalyzer creates a new analyzer for version fingerprints.
+func NewFingerprintAnalyzer(options ...func(adaptor.Processor)) (
+	*FingerprintAnalyzer, error) {
+	analyzer := &FingerprintAnalyzer{
+		wg:       &sync.WaitGroup{},
+		sig:      make(chan struct{}),
+		recordQ:  make(chan adaptor.Record, 1),
+		nonces:   make(map[uint64]*nonceUse),
+		clusters: make(map[string]*agentCluster),
+		heights:  make([]int32, 0, heightSamples),
+		addrYou:  make(map[string]int),
+		window:   24 * time.Hour,
+		size:     5,
+	}
+
+	for _, option := range options {
+		option(analyzer)
+	}
+
+	return analyzer, nil
+}
+
+// SetAnomalyWindow sets how long nonces and user agent clusters are kept in
+// memory for comparison.
+func SetAnomalyWindow(window time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*FingerprintAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.window = window
+	}
+}
+
+// SetClusterSize sets the number of IPs in a subnet that need to use the same
+// user agent for us to report a cluster.
+func SetClusterSize(size int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*FingerprintAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.size = size
+	}
+}
+
+func (analyzer *FingerprintAnalyzer) Start() {
+	analyzer.log.Info("[PAF] Start: begin")
+
+	analyzer.ticker = time.NewTicker(time.Minute)
+
+	analyzer.wg.Add(1)
+	go analyzer.goProcess()
+
+	analyzer.log.Info("[PAF] Start: completed")
+}
+
+func (analyzer *FingerprintAnalyzer) Stop() {
+	analyzer.log.Info("[PAF] Stop: begin")
+
+	close(analyzer.sig)
+	analyzer.wg.Wait()
+
+	analyzer.ticker.Stop()
+
+	analyzer.log.Info("[PAF] Stop: completed")
+}
+
+// Process adds one record to the queue for analysis and forwarding.
+func (analyzer *FingerprintAnalyzer) Process(record adaptor.Record) {
+	analyzer.log.Debug("[PAF] Process: %v", record.Command())
+
+	analyzer.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (analyzer *FingerprintAnalyzer) goProcess() {
+	defer analyzer.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-analyzer.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case now := <-analyzer.ticker.C:
+			analyzer.prune(now)
+
+		case record := <-analyzer.recordQ:
+			vr, ok := record.(*records.VersionRecord)
+			if ok && !sent(record) {
+				analyzer.analyze(vr)
+			}
+
+			analyzer.forward(record)
+
+			for _, output := range analyzer.output {
+				analyzer.forward(output)
+			}
+
+			analyzer.output = analyzer.output[:0]
+		}
+	}
+}
+
+// analyze runs all checks on a version record.
+func (analyzer *FingerprintAnalyzer) analyze(vr *records.VersionRecord) {
+	if vr.RemoteAddress() == nil {
+		return
+	}
+
+	analyzer.checkNonce(vr)
+	analyzer.checkAgent(vr)
+	analyzer.checkHeight(vr)
+	analyzer.checkAddrYou(vr)
+	analyzer.checkCluster(vr)
+}
+
+// checkNonce reports a nonce that was already used by a different IP.
+func (analyzer *FingerprintAnalyzer) checkNonce(vr *records.VersionRecord) {
+	if vr.Nonce() == 0 {
+		return
+	}
+
+	ip := vr.RemoteAddress().IP.String()
+	use, ok := analyzer.nonces[vr.Nonce()]
+	if ok && use.ip != ip {
+		analyzer.alert(AnomalyNonce, fmt.Sprintf("nonce %v already used by %v",
+			vr.Nonce(), use.ip), vr)
+	}
+
+	analyzer.nonces[vr.Nonce()] = &nonceUse{ip: ip, seen: vr.Timestamp()}
+}
+
+// checkAgent reports reference clients whose protocol version does not match
+// the one announced by that client version.
+func (analyzer *FingerprintAnalyzer) checkAgent(vr *records.VersionRecord) {
+	name, version := parseAgent(vr.Agent())
+	if name != "Satoshi" {
+		return
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return
+	}
+
+	expected, ok := satoshiVersions[parts[0]+"."+parts[1]]
+	if !ok {
+		return
+	}
+
+	if vr.Version() < expected[0] || vr.Version() > expected[1] {
+		analyzer.alert(AnomalyAgent, fmt.Sprintf("%v with protocol %v",
+			vr.Agent(), vr.Version()), vr)
+	}
+}
+
+// checkHeight reports negative start heights and start heights far above the
+// median of recently announced ones.
+func (analyzer *FingerprintAnalyzer) checkHeight(vr *records.VersionRecord) {
+	height := vr.StartHeight()
+	if height < 0 {
+		analyzer.alert(AnomalyHeight, fmt.Sprintf("negative height %v",
+			height), vr)
+		return
+	}
+
+	if len(analyzer.heights) == heightSamples {
+		sorted := make([]int32, len(analyzer.heights))
+		copy(sorted, analyzer.heights)
+		sort.Sort(byHeight(sorted))
+		median := sorted[len(sorted)/2]
+
+		if height > median+heightTolerance {
+			analyzer.alert(AnomalyHeight, fmt.Sprintf("height %v above median %v",
+				height, median), vr)
+			return
+		}
+
+		analyzer.heights = analyzer.heights[1:]
+	}
+
+	analyzer.heights = append(analyzer.heights, height)
+}
+
+// checkAddrYou reports peers that claim we have an address which is neither
+// our local address nor the one most other peers see.
+func (analyzer *FingerprintAnalyzer) checkAddrYou(vr *records.VersionRecord) {
+	you := vr.AddrYou()
+	if you == nil || you.IP.IsUnspecified() || you.IP.IsLoopback() {
+		return
+	}
+
+	ip := you.IP.String()
+	analyzer.addrYou[ip]++
+
+	la := vr.LocalAddress()
+	if la != nil && la.IP.Equal(you.IP) {
+		return
+	}
+
+	total, common, count := 0, "", 0
+	for candidate, num := range analyzer.addrYou {
+		total += num
+		if num > count {
+			common, count = candidate, num
+		}
+	}
+
+	if total < addrYouSamples || ip == common {
+		return
+	}
+
+	analyzer.alert(AnomalyAddrYou, fmt.Sprintf("addr_you %v instead of %v",
+		ip, common), vr)
+}
+
+// checkCluster reports the first time a number of IPs in the same subnet use
+// an identical user agent.
+func (analyzer *FingerprintAnalyzer) checkCluster(vr *records.VersionRecord) {
+	ip := vr.RemoteAddress().IP
+	var subnet *net.IPNet
+	if ip.To4() != nil {
+		subnet = &net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)),
+			Mask: net.CIDRMask(24, 32)}
+	} else {
+		subnet = &net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)),
+			Mask: net.CIDRMask(64, 128)}
+	}
+
+	key := subnet.String() + " " + vr.Agent()
+	cluster, ok := analyzer.clusters[key]
+	if !ok {
+		cluster = &agentCluster{ips: make(map[string]time.Time)}
+		analyzer.clusters[key] = cluster
+	}
+
+	cluster.ips[ip.String()] = vr.Timestamp()
+	if cluster.reported || len(cluster.ips) < analyzer.size {
+		return
+	}
+
+	cluster.reported = true
+	analyzer.alert(AnomalyCluster, fmt.Sprintf("%v nodes in %v using %v",
+		len(cluster.ips), subnet, vr.Agent()), vr)
+}
+
+// alert queues an anomaly record for forwarding.
+func (analyzer *FingerprintAnalyzer) alert(kind string, detail string,
+	vr *records.VersionRecord) {
+	analyzer.log.Info("[PAF] %v: %v (%v)", vr.RemoteAddress(), kind, detail)
+
+	output := records.NewAnomalyRecord(kind, detail, vr.RemoteAddress(),
+		vr.LocalAddress())
+	analyzer.output = append(analyzer.output, output)
+}
+
+// prune forgets about nonces and cluster members older than the window. The
+// addresses seen for us are reset if too many different ones were reported.
+func (analyzer *FingerprintAnalyzer) prune(now time.Time) {
+	if len(analyzer.addrYou) > addrYouLimit {
+		analyzer.addrYou = make(map[string]int)
+	}
+
+	for nonce, use := range analyzer.nonces {
+		if now.Sub(use.seen) > analyzer.window {
+			delete(analyzer.nonces, nonce)
+		}
+	}
+
+	for key, cluster := range analyzer.clusters {
+		for ip, seen := range cluster.ips {
+			if now.Sub(seen) > analyzer.window {
+				delete(cluster.ips, ip)
+			}
+		}
+
+		if len(cluster.ips) == 0 {
+			delete(analyzer.clusters, key)
+		}
+	}
+}
+
+// forward will send the record to all processors following this analyzer.
+func (analyzer *FingerprintAnalyzer) forward(record adaptor.Record) {
+	for _, processor := range analyzer.next {
+		processor.Process(record)
+	}
+}
+
+// parseAgent returns the name and version of the first component of a user
+// agent in BIP14 format, such as "/Satoshi:0.9.3/".
+func parseAgent(agent string) (string, string) {
+	agent = strings.TrimPrefix(agent, "/")
+	end := strings.Index(agent, "/")
+	if end >= 0 {
+		agent = agent[:end]
+	}
+
+	// strip comments in parentheses
+	end = strings.Index(agent, "(")
+	if end >= 0 {
+		agent = agent[:end]
+	}
+
+	parts := strings.SplitN(agent, ":", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// byHeight sorts block heights in ascending order.
+type byHeight []int32
+
+func (h byHeight) Len() int {
+	return len(h)
+}
+
+func (h byHeight) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h byHeight) Less(i, j int) bool {
+	return h[i] < h[j]
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/records"
+)
+
+// versionStep describes one version message from the given remote address
+// and the anomalies it should cause.
+type versionStep struct {
+	ra        string
+	agent     string
+	protocol  int32
+	height    int32
+	nonce     uint64
+	you       string
+	anomalies []string
+}
+
+// versionRecord returns a version record for the step, received on a fixed
+// local address.
+func versionRecord(t *testing.T, step versionStep) *records.VersionRecord {
+	msg := &wire.MsgVersion{
+		ProtocolVersion: step.protocol,
+		UserAgent:       step.agent,
+		LastBlock:       step.height,
+		Nonce:           step.nonce,
+	}
+
+	if step.you != "" {
+		you := tcpAddr(t, step.you)
+		msg.AddrYou = *wire.NewNetAddressIPPort(you.IP, uint16(you.Port), 0)
+	}
+
+	return records.NewVersionRecord(msg, tcpAddr(t, step.ra),
+		tcpAddr(t, "10.0.0.1:8333"))
+}
+
+// runFingerprint analyzes the steps in order and checks the anomalies found
+// for each of them.
+func runFingerprint(t *testing.T, analyzer *FingerprintAnalyzer,
+	steps []versionStep) {
+	for i, step := range steps {
+		analyzer.analyze(versionRecord(t, step))
+
+		kinds := make([]string, 0, len(analyzer.output))
+		for _, output := range analyzer.output {
+			kinds = append(kinds, output.(*records.AnomalyRecord).Kind())
+		}
+		analyzer.output = analyzer.output[:0]
+
+		if len(kinds) != len(step.anomalies) {
+			t.Errorf("step %v: found %v, want %v", i, kinds, step.anomalies)
+			continue
+		}
+
+		for j, kind := range kinds {
+			if kind != step.anomalies[j] {
+				t.Errorf("step %v: found %v, want %v", i, kinds,
+					step.anomalies)
+				break
+			}
+		}
+	}
+}
+
+// subnetAddr returns an address in the subnet with the given index.
+func subnetAddr(i int) string {
+	return net.JoinHostPort(net.IPv4(192, 0, byte(i), 1).String(), "8333")
+}
+
+// newFingerprint returns an analyzer that reports clusters of the given size.
+func newFingerprint(size int) *FingerprintAnalyzer {
+	analyzer, _ := NewFingerprintAnalyzer(SetClusterSize(size))
+	analyzer.SetLog(nullLog{})
+
+	return analyzer
+}
+
+func TestFingerprintAnalyzer(t *testing.T) {
+	const agent = "/Satoshi:0.11.0/"
+
+	steps := []versionStep{
+		{ra: "192.0.2.1:8333", agent: agent, protocol: 70002, nonce: 1},
+		{ra: "192.0.2.2:8333", agent: agent, protocol: 70002, nonce: 1,
+			anomalies: []string{AnomalyNonce}},
+		{ra: "192.0.2.2:8333", agent: agent, protocol: 70002, nonce: 1},
+		{ra: "192.0.2.3:8333", agent: agent, protocol: 70002, nonce: 2,
+			anomalies: []string{AnomalyCluster}},
+		{ra: "192.0.2.4:8333", agent: agent, protocol: 70002, nonce: 3},
+		{ra: "198.51.100.1:8333", agent: "/Satoshi:0.12.0/", protocol: 70002,
+			anomalies: []string{AnomalyAgent}},
+		{ra: "198.51.100.2:8333", agent: "/Satoshi:0.12.0(Linux)/",
+			protocol: 70012},
+		{ra: "198.51.100.3:8333", agent: "/btcd:0.12.0/", protocol: 70002},
+		{ra: "198.51.100.4:8333", agent: "/Satoshi:0.99.0/", protocol: 1},
+		{ra: "203.0.113.1:8333", agent: agent, protocol: 70002, height: -1,
+			anomalies: []string{AnomalyHeight}},
+		{ra: "203.0.113.2:8333", agent: "/Satoshi:0.8.6/", protocol: 70002,
+			nonce: 1, anomalies: []string{AnomalyNonce, AnomalyAgent}},
+		{ra: "", agent: "/Satoshi:0.8.6/", protocol: 70002, nonce: 1},
+	}
+
+	runFingerprint(t, newFingerprint(3), steps)
+}
+
+func TestFingerprintHeight(t *testing.T) {
+	steps := make([]versionStep, 0, heightSamples+3)
+	for i := 0; i < heightSamples; i++ {
+		steps = append(steps, versionStep{
+			ra:     subnetAddr(i),
+			height: 350000,
+		})
+	}
+
+	steps = append(steps,
+		versionStep{ra: "203.0.113.1:8333", height: 350000 + heightTolerance},
+		versionStep{ra: "203.0.113.2:8333",
+			height:    350001 + heightTolerance,
+			anomalies: []string{AnomalyHeight}},
+		versionStep{ra: "203.0.113.3:8333", height: 100},
+	)
+
+	runFingerprint(t, newFingerprint(1000), steps)
+}
+
+func TestFingerprintAddrYou(t *testing.T) {
+	steps := make([]versionStep, 0, addrYouSamples+4)
+	for i := 0; i < addrYouSamples-2; i++ {
+		steps = append(steps, versionStep{
+			ra:  subnetAddr(i),
+			you: "203.0.113.7:8333",
+		})
+	}
+
+	steps = append(steps,
+		versionStep{ra: "198.51.100.1:8333", you: "203.0.113.8:8333"},
+		versionStep{ra: "198.51.100.2:8333", you: "203.0.113.9:8333",
+			anomalies: []string{AnomalyAddrYou}},
+		versionStep{ra: "198.51.100.3:8333", you: "203.0.113.7:8333"},
+		versionStep{ra: "198.51.100.4:8333", you: "10.0.0.1:8333"},
+		versionStep{ra: "198.51.100.5:8333", you: "127.0.0.1:8333"},
+		versionStep{ra: "198.51.100.6:8333"},
+	)
+
+	runFingerprint(t, newFingerprint(1000), steps)
+}
+
+func TestFingerprintPrune(t *testing.T) {
+	analyzer := newFingerprint(3)
+	runFingerprint(t, analyzer, []versionStep{
+		{ra: "192.0.2.1:8333", agent: "/a/", nonce: 1},
+		{ra: "192.0.2.2:8333", agent: "/a/", nonce: 2},
+	})
+
+	analyzer.prune(time.Now().Add(analyzer.window + time.Minute))
+	if len(analyzer.nonces) != 0 || len(analyzer.clusters) != 0 {
+		t.Fatalf("kept %v nonces and %v clusters", len(analyzer.nonces),
+			len(analyzer.clusters))
+	}
+
+	// neither the nonce nor the first two cluster members are remembered
+	runFingerprint(t, analyzer, []versionStep{
+		{ra: "192.0.2.3:8333", agent: "/a/", nonce: 1},
+		{ra: "192.0.2.4:8333", agent: "/a/", nonce: 3},
+		{ra: "192.0.2.5:8333", agent: "/a/", nonce: 4,
+			anomalies: []string{AnomalyCluster}},
+	})
+}
+
+func TestParseAgent(t *testing.T) {
+	tests := []struct {
+		agent   string
+		name    string
+		version string
+	}{
+		{"/Satoshi:0.9.3/", "Satoshi", "0.9.3"},
+		{"/Satoshi:0.11.2(bitcore)/", "Satoshi", "0.11.2"},
+		{"/btcwire:0.2.0/btcd:0.11.0/", "btcwire", "0.2.0"},
+		{"/bitcoinj/", "bitcoinj", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		name, version := parseAgent(test.agent)
+		if name != test.name || version != test.version {
+			t.Errorf("%q: parsed as %q %q, want %q %q", test.agent, name,
+				version, test.name, test.version)
+		}
+	}
+}
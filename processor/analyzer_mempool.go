@@ -0,0 +1,264 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// feeLimits are the lower limits of the fee rate histogram buckets, in
+// satoshi per byte.
+var feeLimits = []int64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// mempoolTx is an unconfirmed transaction in our view of the mempool.
+type mempoolTx struct {
+	size int
+	fee  int64
+	seen time.Time
+}
+
+// MempoolAnalyzer is a processor that maintains an approximate view of the
+// mempool. Transactions are added when we see them and removed when they are
+// included in a block or expire. Fees are calculated with a cache of observed
+// outputs and an optional fallback source for previous outputs. At regular
+// intervals, it emits a record with the size, count and fee rate histogram of
+// the mempool. All records are forwarded.
+type MempoolAnalyzer struct {
+	Processor
+
+	wg       *sync.WaitGroup
+	sig      chan struct{}
+	recordQ  chan adaptor.Record
+	ticker   *time.Ticker
+	pool     map[[32]byte]*mempoolTx
+	cache    *UTXOCache
+	fallback PrevoutSource
+	size     int
+	budget   time.Duration
+	rate     time.Duration
+	expiry   time.Duration
+}
+
+// NewMempoolAnalyzer creates a new analyzer maintaining a mempool view.
+func NewMempoolAnalyzer(options ...func(adaptor.Processor)) (*MempoolAnalyzer,
+	error) {
+	analyzer := &MempoolAnalyzer{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		recordQ: make(chan adaptor.Record, 1),
+		pool:    make(map[[32]byte]*mempoolTx),
+		size:    cacheSize,
+		budget:  100 * time.Millisecond,
+		rate:    time.Minute,
+		expiry:  72 * time.Hour,
+	}
+
+	for _, option := range options {
+		option(analyzer)
+	}
+
+	if analyzer.cache == nil {
+		analyzer.cache = NewUTXOCache(analyzer.size, analyzer.fallback)
+	}
+
+	analyzer.cache.retain()
+
+	return analyzer, nil
+}
+
+// SetStatsRate sets the interval at which mempool statistics are emitted.
+func SetStatsRate(rate time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*MempoolAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.rate = rate
+	}
+}
+
+// SetMempoolExpiry sets the time after which unconfirmed transactions are
+// removed from the mempool view.
+func SetMempoolExpiry(expiry time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*MempoolAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.expiry = expiry
+	}
+}
+
+func (analyzer *MempoolAnalyzer) Start() {
+	analyzer.log.Info("[PAM] Start: begin")
+
+	analyzer.ticker = time.NewTicker(analyzer.rate)
+
+	analyzer.wg.Add(1)
+	go analyzer.goProcess()
+
+	analyzer.log.Info("[PAM] Start: completed")
+}
+
+func (analyzer *MempoolAnalyzer) Stop() {
+	analyzer.log.Info("[PAM] Stop: begin")
+
+	close(analyzer.sig)
+	analyzer.wg.Wait()
+
+	analyzer.ticker.Stop()
+	analyzer.cache.release()
+
+	analyzer.log.Info("[PAM] Stop: completed")
+}
+
+// Process adds one record to the queue for analysis and forwarding.
+func (analyzer *MempoolAnalyzer) Process(record adaptor.Record) {
+	analyzer.log.Debug("[PAM] Process: %v", record.Command())
+
+	analyzer.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (analyzer *MempoolAnalyzer) goProcess() {
+	defer analyzer.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-analyzer.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case now := <-analyzer.ticker.C:
+			analyzer.expire(now)
+			analyzer.forward(analyzer.stats())
+
+		case record := <-analyzer.recordQ:
+			analyzer.analyze(record)
+			analyzer.forward(record)
+		}
+	}
+}
+
+// analyze adds transactions to the mempool and removes the ones confirmed in
+// blocks.
+func (analyzer *MempoolAnalyzer) analyze(record adaptor.Record) {
+	if sent(record) {
+		return
+	}
+
+	switch r := record.(type) {
+	case *records.TransactionRecord:
+		analyzer.add(r.Details(), r.Timestamp())
+
+	case *records.BlockRecord:
+		analyzer.confirm(r.Details())
+	}
+}
+
+// add puts a transaction into the mempool and its outputs into the cache.
+func (analyzer *MempoolAnalyzer) add(tx *records.DetailsRecord,
+	seen time.Time) {
+	_, ok := analyzer.pool[tx.Hash()]
+	if ok {
+		return
+	}
+
+	analyzer.cache.Add(tx)
+
+	fee := int64(-1)
+	in, ok := inputValue(analyzer.cache, tx, analyzer.budget)
+	if ok {
+		fee = in - outputValue(tx)
+	}
+
+	analyzer.pool[tx.Hash()] = &mempoolTx{size: tx.Size(), fee: fee, seen: seen}
+}
+
+// confirm removes the transactions of a block from the mempool. Their outputs
+// are added to the cache and the outputs they spend are removed.
+func (analyzer *MempoolAnalyzer) confirm(txs []*records.DetailsRecord) {
+	for _, tx := range txs {
+		delete(analyzer.pool, tx.Hash())
+		analyzer.cache.Add(tx)
+	}
+
+	for _, tx := range txs {
+		analyzer.cache.Spend(tx)
+	}
+}
+
+// expire removes transactions that have been in the mempool for too long.
+func (analyzer *MempoolAnalyzer) expire(now time.Time) {
+	for hash, tx := range analyzer.pool {
+		if now.Sub(tx.seen) > analyzer.expiry {
+			delete(analyzer.pool, hash)
+		}
+	}
+}
+
+// stats creates a statistics record for the current mempool view.
+func (analyzer *MempoolAnalyzer) stats() *records.MempoolStatsRecord {
+	count, size, known, fees := 0, 0, 0, int64(0)
+	counts := make([]int, len(feeLimits))
+	sizes := make([]int, len(feeLimits))
+
+	for _, tx := range analyzer.pool {
+		count++
+		size += tx.size
+
+		if tx.fee < 0 || tx.size == 0 {
+			continue
+		}
+
+		known++
+		fees += tx.fee
+
+		rate := tx.fee / int64(tx.size)
+		i := len(feeLimits) - 1
+		for i > 0 && rate < feeLimits[i] {
+			i--
+		}
+
+		counts[i]++
+		sizes[i] += tx.size
+	}
+
+	analyzer.log.Debug("[PAM] Mempool: %v txs, %v bytes", count, size)
+
+	return records.NewMempoolStatsRecord(count, size, known, fees, feeLimits,
+		counts, sizes)
+}
+
+// forward will send the record to all processors following this analyzer.
+func (analyzer *MempoolAnalyzer) forward(record adaptor.Record) {
+	for _, processor := range analyzer.next {
+		processor.Process(record)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// newMempool returns a mempool analyzer without fallback source.
+func newMempool() *MempoolAnalyzer {
+	analyzer, _ := NewMempoolAnalyzer(SetCacheSize(64))
+	analyzer.SetLog(nullLog{})
+
+	return analyzer
+}
+
+// mempoolBlock returns a block record with the given transactions.
+func mempoolBlock(txs ...*wire.MsgTx) *records.BlockRecord {
+	msg := wire.NewMsgBlock(&wire.BlockHeader{Version: 2})
+	for _, tx := range txs {
+		msg.AddTransaction(tx)
+	}
+
+	return records.NewBlockRecord(msg, nil, nil)
+}
+
+func TestMempoolAnalyzer(t *testing.T) {
+	funding := testTx(wire.ShaHash{1}, 0, 10000, 20000)
+	first := testTx(funding.TxSha(), 0, 9000)
+	second := testTx(funding.TxSha(), 1, 19000)
+	double := testTx(funding.TxSha(), 0, 8000)
+	ours := testTx(funding.TxSha(), 1, 5000)
+
+	sentTx := records.NewTransactionRecord(ours, nil, nil)
+	sentTx.SetDirection(records.DirectionOut)
+
+	// fees are -1 for transactions whose inputs are unknown
+	tests := []struct {
+		name   string
+		record adaptor.Record
+		pool   map[*wire.MsgTx]int64
+	}{
+		{"unknown inputs", records.NewTransactionRecord(funding, nil, nil),
+			map[*wire.MsgTx]int64{funding: -1}},
+		{"known inputs", records.NewTransactionRecord(first, nil, nil),
+			map[*wire.MsgTx]int64{funding: -1, first: 1000}},
+		{"repeated", records.NewTransactionRecord(first, nil, nil),
+			map[*wire.MsgTx]int64{funding: -1, first: 1000}},
+		{"sent by us", sentTx,
+			map[*wire.MsgTx]int64{funding: -1, first: 1000}},
+		{"other record", &peerRecord{cmd: "inv"},
+			map[*wire.MsgTx]int64{funding: -1, first: 1000}},
+		{"confirmed", mempoolBlock(funding, first),
+			map[*wire.MsgTx]int64{}},
+		{"confirmed input", records.NewTransactionRecord(second, nil, nil),
+			map[*wire.MsgTx]int64{second: 1000}},
+		{"spent input", records.NewTransactionRecord(double, nil, nil),
+			map[*wire.MsgTx]int64{second: 1000, double: -1}},
+	}
+
+	analyzer := newMempool()
+	for _, test := range tests {
+		analyzer.analyze(test.record)
+
+		if len(analyzer.pool) != len(test.pool) {
+			t.Errorf("%v: %v transactions in the pool, want %v", test.name,
+				len(analyzer.pool), len(test.pool))
+		}
+
+		for msg, fee := range test.pool {
+			tx, ok := analyzer.pool[msg.TxSha()]
+			if !ok || tx.fee != fee || tx.size != msg.SerializeSize() {
+				t.Errorf("%v: pool has %+v for %v, want fee %v", test.name,
+					tx, msg.TxSha(), fee)
+			}
+		}
+	}
+}
+
+func TestMempoolExpire(t *testing.T) {
+	now := time.Now()
+
+	analyzer := newMempool()
+	analyzer.add(records.NewDetailsRecord(testTx(wire.ShaHash{1}, 0, 1)),
+		now.Add(-2*time.Hour))
+	analyzer.add(records.NewDetailsRecord(testTx(wire.ShaHash{2}, 0, 1)),
+		now.Add(-time.Minute))
+
+	tests := []struct {
+		expiry time.Duration
+		left   int
+	}{
+		{72 * time.Hour, 2},
+		{time.Hour, 1},
+		{time.Second, 0},
+	}
+
+	for _, test := range tests {
+		analyzer.expiry = test.expiry
+		analyzer.expire(now)
+
+		if len(analyzer.pool) != test.left {
+			t.Errorf("expiry %v: %v transactions left, want %v", test.expiry,
+				len(analyzer.pool), test.left)
+		}
+	}
+}
+
+func TestMempoolStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		pool  []mempoolTx
+		stats string
+	}{
+		{"empty", nil,
+			"0|0|0|0|11,0|0|0,1|0|0,2|0|0,5|0|0,10|0|0,20|0|0,50|0|0," +
+				"100|0|0,200|0|0,500|0|0,1000|0|0"},
+		{"unknown fees", []mempoolTx{{size: 250, fee: -1}, {size: 0, fee: 10}},
+			"2|250|0|0|11,0|0|0,1|0|0,2|0|0,5|0|0,10|0|0,20|0|0,50|0|0," +
+				"100|0|0,200|0|0,500|0|0,1000|0|0"},
+		{"buckets", []mempoolTx{{size: 200, fee: 0}, {size: 100, fee: 199},
+			{size: 100, fee: 200}, {size: 100, fee: 1000},
+			{size: 10, fee: 100000}},
+			"5|510|5|101399|11,0|1|200,1|1|100,2|1|100,5|0|0,10|1|100," +
+				"20|0|0,50|0|0,100|0|0,200|0|0,500|0|0,1000|1|10"},
+		{"top bucket", []mempoolTx{{size: 10, fee: 10000},
+			{size: 10, fee: 1000000}, {size: 250, fee: -1}},
+			"3|270|2|1010000|11,0|0|0,1|0|0,2|0|0,5|0|0,10|0|0,20|0|0," +
+				"50|0|0,100|0|0,200|0|0,500|0|0,1000|2|20"},
+	}
+
+	for _, test := range tests {
+		analyzer := newMempool()
+		for i := range test.pool {
+			analyzer.pool[[32]byte{byte(i)}] = &test.pool[i]
+		}
+
+		fields := strings.SplitN(analyzer.stats().String(), "|", 3)
+		if len(fields) != 3 || fields[1] != "mempoolstats" ||
+			fields[2] != test.stats {
+			t.Errorf("%v: stats are %v, want %v", test.name, fields,
+				test.stats)
+		}
+	}
+}
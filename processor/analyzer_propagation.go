@@ -0,0 +1,429 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+const (
+	// maxAnnounce is the largest number of blocks in an inventory or headers
+	// message that we consider an announcement; larger messages are answers
+	// to getblocks or getheaders requests, as sent during synchronization.
+	maxAnnounce = 8
+
+	// requestTimeout is how long after we asked a peer for headers or blocks
+	// its headers are considered the answer rather than an announcement.
+	requestTimeout = time.Minute
+
+	// relayExpiry is how long we keep the statistics of a peer after the last
+	// block it announced, so peers that went away don't use up memory.
+	relayExpiry = 24 * time.Hour
+)
+
+// announcement collects the peers that announced a block, in order.
+type announcement struct {
+	first  time.Time
+	ra     *net.TCPAddr
+	la     *net.TCPAddr
+	peers  []string
+	delays []time.Duration
+	known  map[string]bool
+	height int32
+	size   int
+	txs    int
+}
+
+// relayStats counts how often a peer announced a block and how often it was
+// the first one to do so, and remembers when it last did.
+type relayStats struct {
+	announced int
+	first     int
+	last      time.Time
+}
+
+// PropagationAnalyzer is a processor that observes when each peer announces
+// a block, either through an inventory or an unsolicited headers message with
+// a few headers. Headers only count if they build on a block we already know
+// of, so old blocks are not taken for new ones; block messages only add the
+// height, size and transaction count. Once the propagation window of a block
+// has passed, it emits a propagation record with the order in which peers
+// learned of the block and percentiles of the delay. Peers that are
+// consistently first are marked as likely miners or relay networks. Headers
+// that answer our own requests are only recognized if the records of sent
+// messages are created as well. All records are forwarded, followed by the
+// generated ones.
+type PropagationAnalyzer struct {
+	Processor
+
+	wg        *sync.WaitGroup
+	sig       chan struct{}
+	recordQ   chan adaptor.Record
+	ticker    *time.Ticker
+	pending   map[[32]byte]*announcement
+	done      map[[32]byte]time.Time
+	relays    map[string]*relayStats
+	requested map[string]time.Time
+	window    time.Duration
+	minBlocks int
+	minShare  float64
+	output    []adaptor.Record
+}
+
+// NewPropagationAnalyzer creates a new analyzer for block propagation.
+func NewPropagationAnalyzer(options ...func(adaptor.Processor)) (
+	*PropagationAnalyzer, error) {
+	analyzer := &PropagationAnalyzer{
+		wg:        &sync.WaitGroup{},
+		sig:       make(chan struct{}),
+		recordQ:   make(chan adaptor.Record, 1),
+		pending:   make(map[[32]byte]*announcement),
+		done:      make(map[[32]byte]time.Time),
+		relays:    make(map[string]*relayStats),
+		requested: make(map[string]time.Time),
+		window:    time.Minute,
+		minBlocks: 10,
+		minShare:  0.5,
+	}
+
+	for _, option := range options {
+		option(analyzer)
+	}
+
+	return analyzer, nil
+}
+
+// SetPropagationWindow sets how long after the first announcement of a block
+// we keep collecting announcements before reporting on it.
+func SetPropagationWindow(window time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*PropagationAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.window = window
+	}
+}
+
+// SetRelayThreshold sets the minimum number of blocks a peer has to announce
+// and the share of those it has to announce first to be marked as a likely
+// miner or relay network.
+func SetRelayThreshold(blocks int, share float64) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*PropagationAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.minBlocks = blocks
+		analyzer.minShare = share
+	}
+}
+
+func (analyzer *PropagationAnalyzer) Start() {
+	analyzer.log.Info("[PAP] Start: begin")
+
+	analyzer.ticker = time.NewTicker(time.Second)
+
+	analyzer.wg.Add(1)
+	go analyzer.goProcess()
+
+	analyzer.log.Info("[PAP] Start: completed")
+}
+
+func (analyzer *PropagationAnalyzer) Stop() {
+	analyzer.log.Info("[PAP] Stop: begin")
+
+	close(analyzer.sig)
+	analyzer.wg.Wait()
+
+	analyzer.ticker.Stop()
+
+	analyzer.log.Info("[PAP] Stop: completed")
+}
+
+// Process adds one record to the queue for analysis and forwarding.
+func (analyzer *PropagationAnalyzer) Process(record adaptor.Record) {
+	analyzer.log.Debug("[PAP] Process: %v", record.Command())
+
+	analyzer.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (analyzer *PropagationAnalyzer) goProcess() {
+	defer analyzer.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-analyzer.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case record := <-analyzer.recordQ:
+			analyzer.analyze(record)
+			analyzer.forward(record)
+
+		case now := <-analyzer.ticker.C:
+			analyzer.report(now)
+
+			for _, output := range analyzer.output {
+				analyzer.forward(output)
+			}
+
+			analyzer.output = analyzer.output[:0]
+		}
+	}
+}
+
+// analyze registers the block announcements contained in a record.
+func (analyzer *PropagationAnalyzer) analyze(record adaptor.Record) {
+	ra := record.RemoteAddress()
+	if ra == nil {
+		return
+	}
+
+	// remember when we asked a peer for headers or blocks, so we can tell
+	// its answer apart from announcements
+	if sent(record) {
+		switch record.(type) {
+		case *records.GetHeadersRecord, *records.GetBlocksRecord:
+			analyzer.requested[ra.String()] = record.Timestamp()
+		}
+
+		return
+	}
+
+	switch r := record.(type) {
+	case *records.InventoryRecord:
+		hashes := make([][32]byte, 0, len(r.Items()))
+		for _, item := range r.Items() {
+			if item.Category() == uint8(wire.InvTypeBlock) {
+				hashes = append(hashes, item.Hash())
+			}
+		}
+
+		if len(hashes) > maxAnnounce || analyzer.solicited(record) {
+			return
+		}
+
+		for _, hash := range hashes {
+			analyzer.announce(hash, record)
+		}
+
+	case *records.HeadersRecord:
+		hdrs := r.Headers()
+		if len(hdrs) > maxAnnounce || analyzer.solicited(record) {
+			return
+		}
+
+		for _, hdr := range hdrs {
+			if !analyzer.newer(hdr) {
+				continue
+			}
+
+			analyzer.announce(hdr.Hash(), record)
+		}
+
+	case *records.BlockRecord:
+		a, ok := analyzer.pending[r.Header().Hash()]
+		if !ok {
+			return
+		}
+
+		a.height = r.Height()
+		a.size = r.Size()
+		a.txs = r.Transactions()
+	}
+}
+
+// solicited checks whether a record answers a request for headers or blocks
+// we sent to its peer recently. The request is answered by the first reply.
+func (analyzer *PropagationAnalyzer) solicited(record adaptor.Record) bool {
+	peer := record.RemoteAddress().String()
+	stamp, ok := analyzer.requested[peer]
+	if !ok {
+		return false
+	}
+
+	delete(analyzer.requested, peer)
+
+	return record.Timestamp().Sub(stamp) < requestTimeout
+}
+
+// newer checks whether a header is newer than the tip we know of, meaning it
+// builds on a block that was already announced. Until we know of any block,
+// all headers are considered new.
+func (analyzer *PropagationAnalyzer) newer(hdr *records.HeaderRecord) bool {
+	if len(analyzer.pending) == 0 && len(analyzer.done) == 0 {
+		return true
+	}
+
+	prev := hdr.PrevBlock()
+	_, pending := analyzer.pending[prev]
+	_, done := analyzer.done[prev]
+
+	return pending || done
+}
+
+// announce registers that the peer of the record announced the given block.
+// Blocks that were already reported on are ignored.
+func (analyzer *PropagationAnalyzer) announce(hash [32]byte,
+	record adaptor.Record) *announcement {
+	_, ok := analyzer.done[hash]
+	if ok {
+		return nil
+	}
+
+	ra := record.RemoteAddress()
+
+	a, ok := analyzer.pending[hash]
+	if !ok {
+		a = &announcement{
+			first:  record.Timestamp(),
+			ra:     ra,
+			la:     record.LocalAddress(),
+			peers:  make([]string, 0),
+			delays: make([]time.Duration, 0),
+			known:  make(map[string]bool),
+			height: -1,
+		}
+
+		analyzer.pending[hash] = a
+	}
+
+	addr := ra.String()
+	if a.known[addr] {
+		return a
+	}
+
+	a.known[addr] = true
+	a.peers = append(a.peers, addr)
+	a.delays = append(a.delays, record.Timestamp().Sub(a.first))
+
+	return a
+}
+
+// report emits a propagation record for each block whose window has passed.
+func (analyzer *PropagationAnalyzer) report(now time.Time) {
+	for hash, a := range analyzer.pending {
+		if now.Sub(a.first) < analyzer.window {
+			continue
+		}
+
+		delete(analyzer.pending, hash)
+		analyzer.done[hash] = now
+
+		for i, peer := range a.peers {
+			stats, ok := analyzer.relays[peer]
+			if !ok {
+				stats = &relayStats{}
+				analyzer.relays[peer] = stats
+			}
+
+			stats.announced++
+			stats.last = now
+			if i == 0 {
+				stats.first++
+			}
+		}
+
+		delays := make([]time.Duration, len(a.delays))
+		copy(delays, a.delays)
+		sort.Sort(byDuration(delays))
+
+		output := records.NewPropagationRecord(hash, a.height, a.size, a.txs,
+			analyzer.likely(a.peers[0]), percentile(delays, 50),
+			percentile(delays, 90), a.peers, a.delays, a.first, a.ra, a.la)
+		analyzer.output = append(analyzer.output, output)
+	}
+
+	// forget about reported blocks after a while, so late announcements
+	// don't count as new blocks but memory stays bounded
+	for hash, stamp := range analyzer.done {
+		if now.Sub(stamp) > 24*time.Hour {
+			delete(analyzer.done, hash)
+		}
+	}
+
+	for peer, stamp := range analyzer.requested {
+		if now.Sub(stamp) > requestTimeout {
+			delete(analyzer.requested, peer)
+		}
+	}
+
+	for peer, stats := range analyzer.relays {
+		if now.Sub(stats.last) > relayExpiry {
+			delete(analyzer.relays, peer)
+		}
+	}
+}
+
+// likely checks whether a peer is consistently the first to announce blocks.
+func (analyzer *PropagationAnalyzer) likely(peer string) bool {
+	stats, ok := analyzer.relays[peer]
+	if !ok || stats.announced < analyzer.minBlocks {
+		return false
+	}
+
+	return float64(stats.first)/float64(stats.announced) >= analyzer.minShare
+}
+
+// forward will send the record to all processors following this analyzer.
+func (analyzer *PropagationAnalyzer) forward(record adaptor.Record) {
+	for _, processor := range analyzer.next {
+		processor.Process(record)
+	}
+}
+
+// byDuration sorts durations in ascending order.
+type byDuration []time.Duration
+
+func (d byDuration) Len() int {
+	return len(d)
+}
+
+func (d byDuration) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+
+func (d byDuration) Less(i, j int) bool {
+	return d[i] < d[j]
+}
+
+// percentile returns the given percentile of sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	return sorted[(len(sorted)-1)*p/100]
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// propagationStep is a message from or to a peer. Blocks are given by their
+// index in the test, headers build on the block with the previous index.
+type propagationStep struct {
+	cmd    string
+	peer   string
+	blocks []int
+}
+
+// propagationRecord creates the record for a step, using the given headers.
+func propagationRecord(t *testing.T, step propagationStep,
+	hdrs []*wire.BlockHeader) adaptor.Record {
+	ra := tcpAddr(t, step.peer)
+	la := tcpAddr(t, "10.0.0.1:45000")
+
+	switch step.cmd {
+	case "inv":
+		msg := wire.NewMsgInv()
+		for _, i := range step.blocks {
+			hash := hdrs[i].BlockSha()
+			msg.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &hash))
+		}
+
+		return records.NewInventoryRecord(msg, ra, la)
+
+	case "headers":
+		msg := wire.NewMsgHeaders()
+		for _, i := range step.blocks {
+			msg.AddBlockHeader(hdrs[i])
+		}
+
+		return records.NewHeadersRecord(msg, ra, la)
+
+	case "getheaders":
+		record := records.NewGetHeadersRecord(wire.NewMsgGetHeaders(), ra, la)
+		record.SetDirection(records.DirectionOut)
+		return record
+
+	default:
+		t.Fatalf("invalid step %v", step.cmd)
+		return nil
+	}
+}
+
+func TestPropagationAnalyzer(t *testing.T) {
+	// a chain of headers, so each one builds on the previous one
+	hdrs := make([]*wire.BlockHeader, 12)
+	prev := wire.ShaHash{}
+	for i := range hdrs {
+		hdrs[i] = &wire.BlockHeader{Version: 2, PrevBlock: prev, Nonce: 7}
+		prev = hdrs[i].BlockSha()
+	}
+
+	tests := []struct {
+		name  string
+		steps []propagationStep
+		want  map[int][]string
+	}{
+		{
+			name: "inventory announcements in order",
+			steps: []propagationStep{
+				{"inv", "1.2.3.4:8333", []int{0}},
+				{"inv", "5.6.7.8:8333", []int{0}},
+				{"inv", "1.2.3.4:8333", []int{0}},
+			},
+			want: map[int][]string{0: {"1.2.3.4:8333", "5.6.7.8:8333"}},
+		},
+		{
+			name: "too many blocks for an announcement",
+			steps: []propagationStep{
+				{"inv", "1.2.3.4:8333", []int{0, 1, 2, 3, 4, 5, 6, 7, 8}},
+			},
+			want: map[int][]string{},
+		},
+		{
+			name: "headers building on a known block",
+			steps: []propagationStep{
+				{"inv", "1.2.3.4:8333", []int{0}},
+				{"headers", "5.6.7.8:8333", []int{1}},
+				{"headers", "5.6.7.8:8333", []int{3}},
+			},
+			want: map[int][]string{
+				0: {"1.2.3.4:8333"},
+				1: {"5.6.7.8:8333"},
+			},
+		},
+		{
+			name: "headers answering our request",
+			steps: []propagationStep{
+				{"inv", "1.2.3.4:8333", []int{0}},
+				{"getheaders", "5.6.7.8:8333", nil},
+				{"headers", "5.6.7.8:8333", []int{1}},
+				{"headers", "5.6.7.8:8333", []int{1}},
+			},
+			want: map[int][]string{
+				0: {"1.2.3.4:8333"},
+				1: {"5.6.7.8:8333"},
+			},
+		},
+		{
+			name: "request of another peer",
+			steps: []propagationStep{
+				{"inv", "1.2.3.4:8333", []int{0}},
+				{"getheaders", "1.2.3.4:8333", nil},
+				{"headers", "5.6.7.8:8333", []int{1}},
+			},
+			want: map[int][]string{
+				0: {"1.2.3.4:8333"},
+				1: {"5.6.7.8:8333"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		analyzer, err := NewPropagationAnalyzer()
+		if err != nil {
+			t.Fatalf("could not create analyzer (%v)", err)
+		}
+
+		analyzer.SetLog(nullLog{})
+
+		for _, step := range test.steps {
+			analyzer.analyze(propagationRecord(t, step, hdrs))
+		}
+
+		if len(analyzer.pending) != len(test.want) {
+			t.Errorf("%v: %v blocks announced, want %v", test.name,
+				len(analyzer.pending), len(test.want))
+		}
+
+		for i, peers := range test.want {
+			a, ok := analyzer.pending[hdrs[i].BlockSha()]
+			if !ok {
+				t.Errorf("%v: block %v not announced", test.name, i)
+				continue
+			}
+
+			if len(a.peers) != len(peers) {
+				t.Errorf("%v: block %v announced by %v, want %v", test.name, i,
+					a.peers, peers)
+				continue
+			}
+
+			for j := range peers {
+				if a.peers[j] != peers[j] {
+					t.Errorf("%v: block %v announced by %v, want %v",
+						test.name, i, a.peers, peers)
+					break
+				}
+			}
+		}
+
+		analyzer.report(time.Now().Add(analyzer.window))
+		if len(analyzer.output) != len(test.want) {
+			t.Errorf("%v: %v propagation records, want %v", test.name,
+				len(analyzer.output), len(test.want))
+		}
+	}
+}
+
+func TestPropagationRelayExpiry(t *testing.T) {
+	analyzer, err := NewPropagationAnalyzer(SetRelayThreshold(2, 0.5))
+	if err != nil {
+		t.Fatalf("could not create analyzer (%v)", err)
+	}
+
+	analyzer.SetLog(nullLog{})
+
+	var reported time.Time
+	for i := 0; i < 2; i++ {
+		hdr := &wire.BlockHeader{Version: 2, Nonce: uint32(i)}
+		step := propagationStep{"inv", "1.2.3.4:8333", []int{0}}
+		analyzer.analyze(propagationRecord(t, step, []*wire.BlockHeader{hdr}))
+
+		reported = time.Now().Add(analyzer.window)
+		analyzer.report(reported)
+	}
+
+	if !analyzer.likely("1.2.3.4:8333") {
+		t.Errorf("peer first for all blocks is not a likely miner")
+	}
+
+	analyzer.report(reported.Add(relayExpiry))
+	if len(analyzer.relays) != 1 {
+		t.Errorf("statistics expired too early")
+	}
+
+	analyzer.report(reported.Add(relayExpiry + time.Second))
+	if len(analyzer.relays) != 0 {
+		t.Errorf("statistics of %v peers kept after expiry",
+			len(analyzer.relays))
+	}
+}
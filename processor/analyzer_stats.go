@@ -0,0 +1,461 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+const (
+	GroupCommand   = "command"
+	GroupIP        = "ip"
+	GroupSubnet    = "subnet"
+	GroupAgent     = "agent"
+	GroupDirection = "direction"
+)
+
+// agentExpiry is the time after which we forget the user agent of a peer that
+// hasn't sent us anything.
+const agentExpiry = time.Hour
+
+// statsGroup holds the counts for records with the same key values.
+type statsGroup struct {
+	values []string
+	count  int
+	size   int
+	peers  map[string]struct{}
+}
+
+// statsPane holds the counts for one slide of the window.
+type statsPane struct {
+	start  time.Time
+	count  int
+	size   int
+	peers  map[string]struct{}
+	groups map[string]*statsGroup
+}
+
+// newStatsPane creates an empty pane starting at the given time.
+func newStatsPane(start time.Time) *statsPane {
+	pane := &statsPane{
+		start:  start,
+		peers:  make(map[string]struct{}),
+		groups: make(map[string]*statsGroup),
+	}
+
+	return pane
+}
+
+// add counts a record for the group with the given values.
+func (pane *statsPane) add(values []string, size int, peer string) {
+	pane.count++
+	pane.size += size
+	pane.peers[peer] = struct{}{}
+
+	key := strings.Join(values, "\x00")
+	group, ok := pane.groups[key]
+	if !ok {
+		group = &statsGroup{
+			values: values,
+			peers:  make(map[string]struct{}),
+		}
+		pane.groups[key] = group
+	}
+
+	group.count++
+	group.size += size
+	group.peers[peer] = struct{}{}
+}
+
+// merge adds the counts of another pane to this one.
+func (pane *statsPane) merge(other *statsPane) {
+	pane.count += other.count
+	pane.size += other.size
+	for peer := range other.peers {
+		pane.peers[peer] = struct{}{}
+	}
+
+	for key, group := range other.groups {
+		merged, ok := pane.groups[key]
+		if !ok {
+			merged = &statsGroup{
+				values: group.values,
+				peers:  make(map[string]struct{}),
+			}
+			pane.groups[key] = merged
+		}
+
+		merged.count += group.count
+		merged.size += group.size
+		for peer := range group.peers {
+			merged.peers[peer] = struct{}{}
+		}
+	}
+}
+
+// byCount sorts groups by descending number of messages.
+type byCount []*statsGroup
+
+func (b byCount) Len() int {
+	return len(b)
+}
+
+func (b byCount) Less(i int, j int) bool {
+	if b[i].count != b[j].count {
+		return b[i].count > b[j].count
+	}
+
+	return strings.Join(b[i].values, "\x00") < strings.Join(b[j].values, "\x00")
+}
+
+func (b byCount) Swap(i int, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// StatsAnalyzer is a processor that aggregates the records received from
+// peers into time windows. Records are grouped by a configurable set of keys:
+// the command, the remote IP address, its subnet, the user agent of the peer
+// and whether the message was received or sent. When a window closes, it
+// emits a record with the number of messages, bytes and distinct peers for
+// each group. Windows are tumbling by default; if the slide is shorter than
+// the window, they are sliding and a record is emitted after every slide.
+type StatsAnalyzer struct {
+	Processor
+
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	recordQ chan adaptor.Record
+	ticker  *time.Ticker
+	keys    []string
+	window  time.Duration
+	slide   time.Duration
+	top     int
+	only    bool
+	panes   []*statsPane
+	agents  map[string]string
+	seen    map[string]time.Time
+}
+
+// NewStatsAnalyzer creates a new analyzer aggregating records into windows.
+// If a grouping key is unknown or the window is not a multiple of the slide,
+// an error is returned.
+func NewStatsAnalyzer(options ...func(adaptor.Processor)) (*StatsAnalyzer,
+	error) {
+	analyzer := &StatsAnalyzer{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		recordQ: make(chan adaptor.Record, 1),
+		keys:    make([]string, 0),
+		window:  time.Minute,
+		panes:   make([]*statsPane, 0),
+		agents:  make(map[string]string),
+		seen:    make(map[string]time.Time),
+	}
+
+	for _, option := range options {
+		option(analyzer)
+	}
+
+	if len(analyzer.keys) == 0 {
+		analyzer.keys = append(analyzer.keys, GroupCommand)
+	}
+
+	for _, key := range analyzer.keys {
+		switch key {
+		case GroupCommand, GroupIP, GroupSubnet, GroupAgent, GroupDirection:
+
+		default:
+			return nil, errors.New("invalid grouping key: " + key)
+		}
+	}
+
+	if analyzer.slide == 0 {
+		analyzer.slide = analyzer.window
+	}
+
+	if analyzer.slide <= 0 || analyzer.window%analyzer.slide != 0 {
+		return nil, errors.New("window is not a multiple of slide")
+	}
+
+	return analyzer, nil
+}
+
+// SetGroupKeys sets the keys by which records are grouped. Available keys are
+// command, ip, subnet, agent and direction. By default, records are grouped by
+// command.
+func SetGroupKeys(keys ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*StatsAnalyzer)
+		if !ok {
+			return
+		}
+
+		for _, key := range keys {
+			analyzer.keys = append(analyzer.keys, strings.ToLower(key))
+		}
+	}
+}
+
+// SetStatsWindow sets the duration of the aggregation window.
+func SetStatsWindow(window time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*StatsAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.window = window
+	}
+}
+
+// SetStatsSlide sets the interval at which a sliding window advances. By
+// default, it is equal to the window, which makes the windows tumbling.
+func SetStatsSlide(slide time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*StatsAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.slide = slide
+	}
+}
+
+// SetStatsTop limits the emitted groups to the ones with the most messages.
+// By default, all groups are emitted.
+func SetStatsTop(top int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*StatsAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.top = top
+	}
+}
+
+// SetStatsOnly makes the analyzer forward only the aggregated records instead
+// of all records.
+func SetStatsOnly(enabled bool) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*StatsAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.only = enabled
+	}
+}
+
+func (analyzer *StatsAnalyzer) Start() {
+	analyzer.log.Info("[PAS] Start: begin")
+
+	analyzer.panes = append(analyzer.panes, newStatsPane(time.Now()))
+	analyzer.ticker = time.NewTicker(analyzer.slide)
+
+	analyzer.wg.Add(1)
+	go analyzer.goProcess()
+
+	analyzer.log.Info("[PAS] Start: completed")
+}
+
+func (analyzer *StatsAnalyzer) Stop() {
+	analyzer.log.Info("[PAS] Stop: begin")
+
+	close(analyzer.sig)
+	analyzer.wg.Wait()
+
+	analyzer.ticker.Stop()
+
+	analyzer.log.Info("[PAS] Stop: completed")
+}
+
+// Process adds one record to the queue for aggregation and forwarding.
+func (analyzer *StatsAnalyzer) Process(record adaptor.Record) {
+	analyzer.log.Debug("[PAS] Process: %v", record.Command())
+
+	analyzer.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine. The current window is closed
+// when we stop.
+func (analyzer *StatsAnalyzer) goProcess() {
+	defer analyzer.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-analyzer.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case now := <-analyzer.ticker.C:
+			analyzer.close(now)
+
+		case record := <-analyzer.recordQ:
+			analyzer.aggregate(record)
+			if !analyzer.only {
+				analyzer.forward(record)
+			}
+		}
+	}
+
+	current := analyzer.panes[len(analyzer.panes)-1]
+	if current.count > 0 {
+		analyzer.close(time.Now())
+	}
+}
+
+// aggregate counts a record received from a peer in the current pane.
+func (analyzer *StatsAnalyzer) aggregate(record adaptor.Record) {
+	ra := record.RemoteAddress()
+	if ra == nil {
+		return
+	}
+
+	// session and latency records describe connections, not messages
+	switch record.(type) {
+	case *records.SessionRecord, *records.LatencyRecord:
+		return
+	}
+
+	peer := ra.String()
+	analyzer.seen[peer] = record.Timestamp()
+
+	version, ok := record.(*records.VersionRecord)
+	if ok && !sent(record) {
+		analyzer.agents[peer] = version.Agent()
+	}
+
+	values := make([]string, 0, len(analyzer.keys))
+	for _, key := range analyzer.keys {
+		switch key {
+		case GroupCommand:
+			values = append(values, record.Command())
+
+		case GroupIP:
+			values = append(values, ra.IP.String())
+
+		case GroupSubnet:
+			values = append(values, subnet(ra.IP))
+
+		case GroupAgent:
+			values = append(values, analyzer.agents[peer])
+
+		case GroupDirection:
+			direction := records.DirectionIn
+			if sent(record) {
+				direction = records.DirectionOut
+			}
+			values = append(values, direction)
+		}
+	}
+
+	size := 0
+	s, ok := record.(sized)
+	if ok {
+		size = s.Bytes()
+	}
+
+	current := analyzer.panes[len(analyzer.panes)-1]
+	current.add(values, size, ra.IP.String())
+}
+
+// close ends the current pane, emits the statistics for the window ending
+// with it and starts a new pane.
+func (analyzer *StatsAnalyzer) close(now time.Time) {
+	total := newStatsPane(analyzer.panes[0].start)
+	for _, pane := range analyzer.panes {
+		total.merge(pane)
+	}
+
+	record := records.NewStatsRecord(total.start, now.Sub(total.start),
+		analyzer.keys, total.count, total.size, len(total.peers))
+
+	groups := make([]*statsGroup, 0, len(total.groups))
+	for _, group := range total.groups {
+		groups = append(groups, group)
+	}
+
+	sort.Sort(byCount(groups))
+
+	if analyzer.top > 0 && len(groups) > analyzer.top {
+		groups = groups[:analyzer.top]
+	}
+
+	for _, group := range groups {
+		record.AddGroup(group.values, group.count, group.size,
+			len(group.peers))
+	}
+
+	if len(analyzer.panes) >= int(analyzer.window/analyzer.slide) {
+		analyzer.panes[0] = nil
+		analyzer.panes = analyzer.panes[1:]
+	}
+
+	analyzer.panes = append(analyzer.panes, newStatsPane(now))
+
+	for peer, seen := range analyzer.seen {
+		if now.Sub(seen) > agentExpiry {
+			delete(analyzer.seen, peer)
+			delete(analyzer.agents, peer)
+		}
+	}
+
+	analyzer.forward(record)
+}
+
+// forward will send the record to all processors following this analyzer.
+func (analyzer *StatsAnalyzer) forward(record adaptor.Record) {
+	for _, processor := range analyzer.next {
+		processor.Process(record)
+	}
+}
+
+// subnet returns the network of an IP address in CIDR notation, with a /24
+// prefix for IPv4 and a /48 prefix for IPv6.
+func subnet(ip net.IP) string {
+	ipv4 := ip.To4()
+	if ipv4 != nil {
+		network := net.IPNet{IP: ipv4.Mask(net.CIDRMask(24, 32)),
+			Mask: net.CIDRMask(24, 32)}
+		return network.String()
+	}
+
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)),
+		Mask: net.CIDRMask(48, 128)}
+	return network.String()
+}
+
+// sized is implemented by records that carry the size of their message on the
+// wire.
+type sized interface {
+	Bytes() int
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+func TestNewStatsAnalyzer(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []func(adaptor.Processor)
+		valid   bool
+	}{
+		{"defaults", nil, true},
+		{"keys", []func(adaptor.Processor){SetGroupKeys("IP", "agent")}, true},
+		{"unknown key", []func(adaptor.Processor){SetGroupKeys("port")},
+			false},
+		{"sliding", []func(adaptor.Processor){SetStatsWindow(time.Hour),
+			SetStatsSlide(time.Minute)}, true},
+		{"uneven slide", []func(adaptor.Processor){SetStatsWindow(time.Hour),
+			SetStatsSlide(7 * time.Minute)}, false},
+		{"negative slide", []func(adaptor.Processor){
+			SetStatsSlide(-time.Minute)}, false},
+	}
+
+	for _, test := range tests {
+		_, err := NewStatsAnalyzer(test.options...)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: error is %v, want valid %v", test.name, err,
+				test.valid)
+		}
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	tests := []struct {
+		ip     string
+		subnet string
+	}{
+		{"192.0.2.1", "192.0.2.0/24"},
+		{"192.0.2.255", "192.0.2.0/24"},
+		{"::ffff:198.51.100.7", "198.51.100.0/24"},
+		{"2001:db8:1:2::1", "2001:db8:1::/48"},
+	}
+
+	for _, test := range tests {
+		subnet := subnet(net.ParseIP(test.ip))
+		if subnet != test.subnet {
+			t.Errorf("%v: subnet is %v, want %v", test.ip, subnet, test.subnet)
+		}
+	}
+}
+
+// statsRecords returns a version and a ping from one peer, a ping from
+// another peer and a ping we sent to the first one, together with records
+// that are not counted.
+func statsRecords(t *testing.T) []adaptor.Record {
+	first := tcpAddr(t, "192.0.2.1:8333")
+	second := tcpAddr(t, "192.0.2.2:8333")
+
+	version := records.NewVersionRecord(&wire.MsgVersion{
+		ProtocolVersion: 70002,
+		UserAgent:       "/Satoshi:0.11.0/",
+	}, first, nil)
+	version.SetBytes(100)
+
+	ping := func(ra *net.TCPAddr, dir string) adaptor.Record {
+		record := records.NewPingRecord(wire.NewMsgPing(1), ra, nil)
+		record.SetDirection(dir)
+		record.SetBytes(32)
+		return record
+	}
+
+	return []adaptor.Record{
+		version,
+		ping(first, records.DirectionIn),
+		ping(second, ""),
+		ping(first, records.DirectionOut),
+		records.NewSessionRecord(records.SessionConnect,
+			records.ReasonOutgoing, 0, first, nil, 0, 0, 0, 0),
+		records.NewLatencyRecord(time.Second, time.Second, time.Second, 1,
+			first, nil),
+		&peerRecord{cmd: "stats"},
+	}
+}
+
+func TestStatsAnalyzer(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  []string
+		top   int
+		stats string
+	}{
+		{"command", nil, 0,
+			"60|command|4|196|2|2,ping|3|96|2,version|1|100|1"},
+		{"ip and direction", []string{"ip", "direction"}, 0,
+			"60|ip+direction|4|196|2|3,192.0.2.1|in|2|132|1," +
+				"192.0.2.1|out|1|32|1,192.0.2.2|in|1|32|1"},
+		{"subnet", []string{"subnet"}, 0,
+			"60|subnet|4|196|2|1,192.0.2.0/24|4|196|2"},
+		{"agent", []string{"agent"}, 0,
+			"60|agent|4|196|2|2,/Satoshi:0.11.0/|3|164|1,|1|32|1"},
+		{"top", []string{"command"}, 1,
+			"60|command|4|196|2|1,ping|3|96|2"},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		out := newCollector()
+		analyzer, err := NewStatsAnalyzer(SetGroupKeys(test.keys...),
+			SetStatsTop(test.top))
+		if err != nil {
+			t.Fatalf("%v: could not create analyzer (%v)", test.name, err)
+		}
+
+		analyzer.SetLog(nullLog{})
+		analyzer.AddNext(out)
+		analyzer.panes = append(analyzer.panes, newStatsPane(start))
+
+		for _, record := range statsRecords(t) {
+			analyzer.aggregate(record)
+		}
+
+		analyzer.close(start.Add(time.Minute))
+
+		fields := strings.SplitN(out.expect(t, "stats")[0].String(), "|", 4)
+		if len(fields) != 4 || fields[3] != test.stats {
+			t.Errorf("%v: stats are %v, want %v", test.name, fields,
+				test.stats)
+		}
+	}
+}
+
+func TestStatsSliding(t *testing.T) {
+	out := newCollector()
+	analyzer, _ := NewStatsAnalyzer(SetStatsWindow(2*time.Minute),
+		SetStatsSlide(time.Minute))
+	analyzer.SetLog(nullLog{})
+	analyzer.AddNext(out)
+
+	start := time.Now()
+	analyzer.panes = append(analyzer.panes, newStatsPane(start))
+
+	// pings lists the number of pings we receive before each slide
+	tests := []struct {
+		pings    int
+		start    time.Duration
+		window   time.Duration
+		messages int
+	}{
+		{1, 0, time.Minute, 1},
+		{2, 0, 2 * time.Minute, 3},
+		{0, time.Minute, 2 * time.Minute, 2},
+		{0, 2 * time.Minute, 2 * time.Minute, 0},
+	}
+
+	for i, test := range tests {
+		for j := 0; j < test.pings; j++ {
+			analyzer.aggregate(pingRecord(t, "192.0.2.1:8333"))
+		}
+
+		analyzer.close(start.Add(time.Duration(i+1) * time.Minute))
+
+		sr := out.expect(t, "stats")[0].(*records.StatsRecord)
+		if !sr.Start().Equal(start.Add(test.start)) ||
+			sr.Window() != test.window || sr.Messages() != test.messages {
+			t.Errorf("slide %v: %v messages in %v from %v, want %v in %v "+
+				"from %v", i, sr.Messages(), sr.Window(), sr.Start(),
+				test.messages, test.window, start.Add(test.start))
+		}
+	}
+}
+
+func TestStatsAgentExpiry(t *testing.T) {
+	analyzer, _ := NewStatsAnalyzer(SetGroupKeys("agent"))
+	analyzer.SetLog(nullLog{})
+	analyzer.AddNext(newCollector())
+
+	start := time.Now()
+	analyzer.panes = append(analyzer.panes, newStatsPane(start))
+	for _, record := range statsRecords(t) {
+		analyzer.aggregate(record)
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		agents  int
+	}{
+		{time.Minute, 1},
+		{agentExpiry, 1},
+		{agentExpiry + time.Minute, 0},
+	}
+
+	for _, test := range tests {
+		analyzer.close(start.Add(test.elapsed))
+		if len(analyzer.agents) != test.agents {
+			t.Errorf("after %v: %v agents known, want %v", test.elapsed,
+				len(analyzer.agents), test.agents)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+const (
+	WatchIn  = "in"
+	WatchOut = "out"
+
+	SourceMempool = "mempool"
+	SourceBlock   = "block"
+)
+
+// watchedOutput is an output paying to a watched address.
+type watchedOutput struct {
+	address string
+	value   int64
+}
+
+// WatchlistAnalyzer is a processor that checks transactions from the mempool
+// and from blocks against a set of watched addresses. Outputs to a watched
+// address are remembered, so we can recognize when they are spent later. For
+// each payment to or spend from a watched address, it emits a watch hit
+// record. All records are forwarded, followed by the generated ones.
+//
+// The number of remembered outputs is limited; when full, the oldest ones are
+// forgotten first. Optionally, they are saved to a state file on stop and
+// loaded again on the next start.
+type WatchlistAnalyzer struct {
+	Processor
+
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	recordQ chan adaptor.Record
+	path    string
+	state   string
+	limit   int
+	watched map[string]bool
+	outputs map[outpoint]*watchedOutput
+	order   []outpoint
+	oldest  int
+	output  []adaptor.Record
+}
+
+// NewWatchlistAnalyzer creates a new analyzer for the watched addresses. If a
+// watchlist file is set, it has to be readable.
+func NewWatchlistAnalyzer(options ...func(adaptor.Processor)) (
+	*WatchlistAnalyzer, error) {
+	analyzer := &WatchlistAnalyzer{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		recordQ: make(chan adaptor.Record, 1),
+		limit:   65536,
+		watched: make(map[string]bool),
+		outputs: make(map[outpoint]*watchedOutput),
+	}
+
+	for _, option := range options {
+		option(analyzer)
+	}
+
+	if analyzer.limit < 1 {
+		return nil, errors.New("invalid watched output limit")
+	}
+
+	analyzer.order = make([]outpoint, analyzer.limit)
+
+	if analyzer.path != "" {
+		err := analyzer.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if analyzer.state != "" {
+		err := analyzer.restore()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return analyzer, nil
+}
+
+// SetWatchlistPath sets the path of a file with one Base58 address per line.
+// Empty lines and lines starting with a hash sign are ignored.
+func SetWatchlistPath(path string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*WatchlistAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.path = path
+	}
+}
+
+// SetWatchedAddresses adds addresses to the watchlist directly.
+func SetWatchedAddresses(addresses ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*WatchlistAnalyzer)
+		if !ok {
+			return
+		}
+
+		for _, address := range addresses {
+			analyzer.watched[address] = true
+		}
+	}
+}
+
+// SetWatchLimit sets the maximum number of outputs to watched addresses that
+// are remembered to recognize their spends.
+func SetWatchLimit(limit int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*WatchlistAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.limit = limit
+	}
+}
+
+// SetWatchState sets the path of a file the remembered outputs are saved to
+// on stop and loaded from on creation. A missing file is not an error.
+func SetWatchState(path string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		analyzer, ok := pro.(*WatchlistAnalyzer)
+		if !ok {
+			return
+		}
+
+		analyzer.state = path
+	}
+}
+
+func (analyzer *WatchlistAnalyzer) Start() {
+	analyzer.log.Info("[PAW] Start: begin")
+
+	analyzer.log.Info("[PAW] Watching %v addresses", len(analyzer.watched))
+
+	analyzer.wg.Add(1)
+	go analyzer.goProcess()
+
+	analyzer.log.Info("[PAW] Start: completed")
+}
+
+func (analyzer *WatchlistAnalyzer) Stop() {
+	analyzer.log.Info("[PAW] Stop: begin")
+
+	close(analyzer.sig)
+	analyzer.wg.Wait()
+
+	if analyzer.state != "" {
+		err := analyzer.save()
+		if err != nil {
+			analyzer.log.Warning("[PAW] Stop: could not save state (%v)", err)
+		}
+	}
+
+	analyzer.log.Info("[PAW] Stop: completed")
+}
+
+// Process adds one record to the queue for analysis and forwarding.
+func (analyzer *WatchlistAnalyzer) Process(record adaptor.Record) {
+	analyzer.log.Debug("[PAW] Process: %v", record.Command())
+
+	analyzer.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (analyzer *WatchlistAnalyzer) goProcess() {
+	defer analyzer.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-analyzer.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case record := <-analyzer.recordQ:
+			analyzer.analyze(record)
+			analyzer.forward(record)
+
+			for _, output := range analyzer.output {
+				analyzer.forward(output)
+			}
+
+			analyzer.output = analyzer.output[:0]
+		}
+	}
+}
+
+// analyze checks the transactions of a record for watched addresses.
+func (analyzer *WatchlistAnalyzer) analyze(record adaptor.Record) {
+	if sent(record) {
+		return
+	}
+
+	switch r := record.(type) {
+	case *records.TransactionRecord:
+		analyzer.check(r.Details(), SourceMempool, record)
+
+	case *records.BlockRecord:
+		for _, tx := range r.Details() {
+			analyzer.check(tx, SourceBlock, record)
+		}
+	}
+}
+
+// load reads the watched addresses from the watchlist file.
+func (analyzer *WatchlistAnalyzer) load() error {
+	file, err := os.Open(analyzer.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		analyzer.watched[line] = true
+	}
+
+	return scanner.Err()
+}
+
+// check looks for spends of watched outputs and for new outputs to watched
+// addresses in a transaction. Spent outputs are forgotten once the spend is
+// confirmed in a block.
+func (analyzer *WatchlistAnalyzer) check(tx *records.DetailsRecord,
+	source string, record adaptor.Record) {
+	for _, input := range tx.Inputs() {
+		op := outpoint{hash: input.Hash(), index: input.Index()}
+		watched, ok := analyzer.outputs[op]
+		if !ok {
+			continue
+		}
+
+		analyzer.hit(watched.address, WatchOut, watched.value, tx.Hash(),
+			source, record)
+
+		if source == SourceBlock {
+			delete(analyzer.outputs, op)
+		}
+	}
+
+	for i, output := range tx.Outputs() {
+		for _, addr := range output.Addresses() {
+			address := addr.EncodeAddress()
+			if !analyzer.watched[address] {
+				continue
+			}
+
+			op := outpoint{hash: tx.Hash(), index: uint32(i)}
+			analyzer.remember(op, address, output.Value())
+
+			analyzer.hit(address, WatchIn, output.Value(), tx.Hash(), source,
+				record)
+		}
+	}
+}
+
+// remember adds an output to a watched address, forgetting the oldest one if
+// we are at the limit.
+func (analyzer *WatchlistAnalyzer) remember(op outpoint, address string,
+	value int64) {
+	_, ok := analyzer.outputs[op]
+	if !ok {
+		delete(analyzer.outputs, analyzer.order[analyzer.oldest])
+		analyzer.order[analyzer.oldest] = op
+		analyzer.oldest = (analyzer.oldest + 1) % len(analyzer.order)
+	}
+
+	analyzer.outputs[op] = &watchedOutput{address: address, value: value}
+}
+
+// save writes the remembered outputs to the state file, oldest first, with
+// one "hash:index address value" line per output. The file is replaced only
+// once it was written completely.
+func (analyzer *WatchlistAnalyzer) save() error {
+	file, err := os.Create(analyzer.state + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for i := range analyzer.order {
+		op := analyzer.order[(analyzer.oldest+i)%len(analyzer.order)]
+		watched, ok := analyzer.outputs[op]
+		if !ok {
+			continue
+		}
+
+		fmt.Fprintf(writer, "%v:%v %v %v\n", hex.EncodeToString(op.hash[:]),
+			op.index, watched.address, watched.value)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(analyzer.state+".tmp", analyzer.state)
+}
+
+// restore reads the remembered outputs from the state file, if it exists.
+func (analyzer *WatchlistAnalyzer) restore() error {
+	file, err := os.Open(analyzer.state)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return errors.New("invalid watch state: " + scanner.Text())
+		}
+
+		op, err := parseOutpoint(fields[0])
+		if err != nil {
+			return err
+		}
+
+		value, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		analyzer.remember(op, fields[1], value)
+	}
+
+	return scanner.Err()
+}
+
+// parseOutpoint parses an outpoint in the "hash:index" format of the state
+// file.
+func parseOutpoint(s string) (outpoint, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return outpoint{}, errors.New("invalid outpoint: " + s)
+	}
+
+	hash, err := hex.DecodeString(parts[0])
+	if err != nil || len(hash) != 32 {
+		return outpoint{}, errors.New("invalid outpoint hash: " + s)
+	}
+
+	index, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return outpoint{}, err
+	}
+
+	op := outpoint{index: uint32(index)}
+	copy(op.hash[:], hash)
+
+	return op, nil
+}
+
+// hit queues a watch hit record for forwarding.
+func (analyzer *WatchlistAnalyzer) hit(address string, direction string,
+	amount int64, hash [32]byte, source string, record adaptor.Record) {
+	analyzer.log.Info("[PAW] %v %v %v (%v)", address, direction, amount,
+		source)
+
+	output := records.NewWatchHitRecord(address, direction, amount, hash,
+		source, record.RemoteAddress(), record.LocalAddress())
+	analyzer.output = append(analyzer.output, output)
+}
+
+// forward will send the record to all processors following this analyzer.
+func (analyzer *WatchlistAnalyzer) forward(record adaptor.Record) {
+	for _, processor := range analyzer.next {
+		processor.Process(record)
+	}
+}
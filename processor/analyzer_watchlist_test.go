@@ -0,0 +1,278 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// payTo returns a pay-to-pubkey-hash script for a key hash filled with the
+// given byte, and its address.
+func payTo(t *testing.T, b byte) ([]byte, string) {
+	hash := make([]byte, 20)
+	for i := range hash {
+		hash[i] = b
+	}
+
+	addr, err := btcutil.NewAddressPubKeyHash(hash, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("could not create address (%v)", err)
+	}
+
+	script := append([]byte{0x76, 0xa9, 0x14}, hash...)
+	script = append(script, 0x88, 0xac)
+
+	return script, addr.EncodeAddress()
+}
+
+// payTx returns a transaction spending the given output with one output of
+// the given value and script.
+func payTx(prev wire.ShaHash, index uint32, value int64,
+	script []byte) *wire.MsgTx {
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prev, index), []byte{0x51}))
+	tx.AddTxOut(wire.NewTxOut(value, script))
+
+	return tx
+}
+
+// watchRecord wraps a transaction in a record from the given source.
+func watchRecord(t *testing.T, tx *wire.MsgTx, source string) adaptor.Record {
+	ra := tcpAddr(t, "1.2.3.4:8333")
+	la := tcpAddr(t, "10.0.0.1:45000")
+
+	if source == SourceMempool {
+		return records.NewTransactionRecord(tx, ra, la)
+	}
+
+	msg := wire.NewMsgBlock(&wire.BlockHeader{Version: 2})
+	msg.AddTransaction(tx)
+
+	return records.NewBlockRecord(msg, ra, la)
+}
+
+// watchHits returns the direction, amount and source of the generated watch
+// hit records and clears them.
+func watchHits(analyzer *WatchlistAnalyzer) []string {
+	hits := make([]string, 0, len(analyzer.output))
+	for _, output := range analyzer.output {
+		hit := output.(*records.WatchHitRecord)
+		hits = append(hits, hit.Direction()+" "+
+			strconv.FormatInt(hit.Amount(), 10)+" "+hit.Source())
+	}
+
+	analyzer.output = analyzer.output[:0]
+
+	return hits
+}
+
+func newWatchlist(t *testing.T,
+	options ...func(adaptor.Processor)) *WatchlistAnalyzer {
+	analyzer, err := NewWatchlistAnalyzer(options...)
+	if err != nil {
+		t.Fatalf("could not create analyzer (%v)", err)
+	}
+
+	analyzer.SetLog(nullLog{})
+
+	return analyzer
+}
+
+func TestWatchlistAnalyzer(t *testing.T) {
+	watched, address := payTo(t, 1)
+	other, _ := payTo(t, 2)
+
+	pay := payTx(wire.ShaHash{1}, 0, 1000, watched)
+	spend := payTx(pay.TxSha(), 0, 900, other)
+	unwatched := payTx(wire.ShaHash{2}, 0, 500, other)
+
+	type step struct {
+		tx     *wire.MsgTx
+		source string
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		hits  []string
+	}{
+		{
+			name:  "payment",
+			steps: []step{{pay, SourceMempool}},
+			hits:  []string{"in 1000 mempool"},
+		},
+		{
+			name:  "other address",
+			steps: []step{{unwatched, SourceMempool}},
+			hits:  []string{},
+		},
+		{
+			name:  "spend",
+			steps: []step{{pay, SourceMempool}, {spend, SourceMempool}},
+			hits:  []string{"in 1000 mempool", "out 1000 mempool"},
+		},
+		{
+			name: "spend confirmed",
+			steps: []step{
+				{pay, SourceBlock},
+				{spend, SourceMempool},
+				{spend, SourceBlock},
+				{spend, SourceBlock},
+			},
+			hits: []string{"in 1000 block", "out 1000 mempool",
+				"out 1000 block"},
+		},
+		{
+			name:  "spend of unknown payment",
+			steps: []step{{spend, SourceMempool}},
+			hits:  []string{},
+		},
+	}
+
+	for _, test := range tests {
+		analyzer := newWatchlist(t, SetWatchedAddresses(address))
+
+		hits := make([]string, 0)
+		for _, step := range test.steps {
+			analyzer.analyze(watchRecord(t, step.tx, step.source))
+			hits = append(hits, watchHits(analyzer)...)
+		}
+
+		if strings.Join(hits, ", ") != strings.Join(test.hits, ", ") {
+			t.Errorf("%v: hits %v, want %v", test.name, hits, test.hits)
+		}
+	}
+}
+
+func TestWatchlistLimit(t *testing.T) {
+	watched, address := payTo(t, 1)
+	other, _ := payTo(t, 2)
+
+	analyzer := newWatchlist(t, SetWatchedAddresses(address),
+		SetWatchLimit(2))
+
+	pays := make([]*wire.MsgTx, 3)
+	for i := range pays {
+		pays[i] = payTx(wire.ShaHash{byte(i + 1)}, 0, 1000, watched)
+		analyzer.analyze(watchRecord(t, pays[i], SourceMempool))
+	}
+
+	watchHits(analyzer)
+	if len(analyzer.outputs) != 2 {
+		t.Errorf("remembered %v outputs, want 2", len(analyzer.outputs))
+	}
+
+	tests := []struct {
+		pay  int
+		hits int
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 1},
+	}
+
+	for _, test := range tests {
+		spend := payTx(pays[test.pay].TxSha(), 0, 900, other)
+		analyzer.analyze(watchRecord(t, spend, SourceMempool))
+
+		hits := watchHits(analyzer)
+		if len(hits) != test.hits {
+			t.Errorf("spend of payment %v: %v hits, want %v", test.pay,
+				len(hits), test.hits)
+		}
+	}
+
+	_, err := NewWatchlistAnalyzer(SetWatchLimit(0))
+	if err == nil {
+		t.Errorf("zero limit accepted")
+	}
+}
+
+func TestWatchlistState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watchlist")
+	if err != nil {
+		t.Fatalf("could not create directory (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	watched, address := payTo(t, 1)
+	other, _ := payTo(t, 2)
+	state := filepath.Join(dir, "watchlist.state")
+
+	pays := make([]*wire.MsgTx, 3)
+	for i := range pays {
+		pays[i] = payTx(wire.ShaHash{byte(i + 1)}, uint32(i), 1000, watched)
+	}
+
+	// the state is saved on stop, keeping the limit and order
+	before := newWatchlist(t, SetWatchedAddresses(address),
+		SetWatchState(state), SetWatchLimit(2))
+	before.Start()
+	for _, pay := range pays {
+		before.analyze(watchRecord(t, pay, SourceMempool))
+	}
+	before.Stop()
+
+	after := newWatchlist(t, SetWatchedAddresses(address),
+		SetWatchState(state), SetWatchLimit(2))
+
+	for i, pay := range pays {
+		spend := payTx(pay.TxSha(), 0, 900, other)
+		after.analyze(watchRecord(t, spend, SourceMempool))
+
+		hits := watchHits(after)
+		want := []string{"out 1000 mempool"}
+		if i == 0 {
+			want = []string{}
+		}
+
+		if strings.Join(hits, ", ") != strings.Join(want, ", ") {
+			t.Errorf("spend of payment %v: hits %v, want %v", i, hits, want)
+		}
+	}
+
+	err = ioutil.WriteFile(state, []byte("00:0 address\n"), 0644)
+	if err != nil {
+		t.Fatalf("could not write state (%v)", err)
+	}
+
+	_, err = NewWatchlistAnalyzer(SetWatchState(state))
+	if err == nil {
+		t.Errorf("invalid state accepted")
+	}
+
+	_, err = NewWatchlistAnalyzer(SetWatchState(filepath.Join(dir, "none")))
+	if err != nil {
+		t.Errorf("missing state not accepted (%v)", err)
+	}
+}
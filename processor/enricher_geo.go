@@ -0,0 +1,141 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"sync"
+
+	"github.com/CIRCL/pbtc/adaptor"
+)
+
+// locatable is implemented by records that can carry the geolocation of their
+// remote address.
+type locatable interface {
+	SetLocation(country string, city string, asn uint32)
+	Country() string
+}
+
+// GeoEnricher is a processor that looks up the geolocation of the remote
+// address of each record and attaches it to the record before forwarding it,
+// so that writers can include it in their output.
+type GeoEnricher struct {
+	Processor
+
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	recordQ chan adaptor.Record
+	loc     adaptor.Locator
+}
+
+// NewGeoEnricher creates a new enricher that attaches the geolocation to all
+// records and forwards them. Without a locator, records are forwarded as is.
+func NewGeoEnricher(options ...func(adaptor.Processor)) (*GeoEnricher, error) {
+	enricher := &GeoEnricher{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		recordQ: make(chan adaptor.Record, 1),
+	}
+
+	for _, option := range options {
+		option(enricher)
+	}
+
+	return enricher, nil
+}
+
+// SetLocator injects the locator used to look up the geolocation.
+func (enricher *GeoEnricher) SetLocator(loc adaptor.Locator) {
+	enricher.loc = loc
+}
+
+func (enricher *GeoEnricher) Start() {
+	enricher.log.Info("[PEG] Start: begin")
+
+	enricher.wg.Add(1)
+	go enricher.goProcess()
+
+	enricher.log.Info("[PEG] Start: completed")
+}
+
+func (enricher *GeoEnricher) Stop() {
+	enricher.log.Info("[PEG] Stop: begin")
+
+	close(enricher.sig)
+	enricher.wg.Wait()
+
+	enricher.log.Info("[PEG] Stop: completed")
+}
+
+// Process adds one record to the queue for enrichment and forwarding.
+func (enricher *GeoEnricher) Process(record adaptor.Record) {
+	enricher.log.Debug("[PEG] Process: %v", record.Command())
+
+	enricher.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (enricher *GeoEnricher) goProcess() {
+	defer enricher.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-enricher.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case record := <-enricher.recordQ:
+			enricher.forward(locate(enricher.loc, record))
+		}
+	}
+}
+
+// forward will send the record to all processors following this enricher.
+func (enricher *GeoEnricher) forward(record adaptor.Record) {
+	for _, processor := range enricher.next {
+		processor.Process(record)
+	}
+}
+
+// locate returns a copy of the record with the geolocation of the remote
+// address attached. If there is nothing to attach or the record already
+// carries a location, the record itself is returned.
+func locate(loc adaptor.Locator, record adaptor.Record) adaptor.Record {
+	if loc == nil {
+		return record
+	}
+
+	l, ok := record.(locatable)
+	if !ok || l.Country() != "" {
+		return record
+	}
+
+	ra := record.RemoteAddress()
+	if ra == nil {
+		return record
+	}
+
+	located := clone(record)
+	located.(locatable).SetLocation(loc.Locate(ra.IP))
+
+	return located
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// fakeLocator locates the addresses it knows and counts its lookups.
+type fakeLocator struct {
+	countries map[string]string
+	lookups   int
+}
+
+func (loc *fakeLocator) SetLog(log adaptor.Log) {}
+func (loc *fakeLocator) Reload() error          { return nil }
+func (loc *fakeLocator) Start()                 {}
+func (loc *fakeLocator) Stop()                  {}
+
+func (loc *fakeLocator) Locate(ip net.IP) (string, string, uint32) {
+	loc.lookups++
+	country, ok := loc.countries[ip.String()]
+	if !ok {
+		return "", "", 0
+	}
+
+	return country, "City of " + country, 42
+}
+
+func newFakeLocator() *fakeLocator {
+	return &fakeLocator{
+		countries: map[string]string{
+			"192.0.2.1": "LU",
+			"192.0.2.2": "DE",
+		},
+	}
+}
+
+// pingRecord returns a ping record from the given remote address.
+func pingRecord(t *testing.T, ra string) *records.PingRecord {
+	return records.NewPingRecord(wire.NewMsgPing(1), tcpAddr(t, ra),
+		tcpAddr(t, "127.0.0.1:8333"))
+}
+
+func TestLocate(t *testing.T) {
+	located := pingRecord(t, "192.0.2.2:8333")
+	located.SetLocation("FR", "Paris", 7)
+
+	tests := []struct {
+		name    string
+		noloc   bool
+		record  adaptor.Record
+		country string
+		asn     uint32
+		copied  bool
+	}{
+		{"no locator", true, pingRecord(t, "192.0.2.1:8333"), "", 0, false},
+		{"not locatable", false, &peerRecord{cmd: "ping"}, "", 0, false},
+		{"already located", false, located, "FR", 7, false},
+		{"no remote address", false, pingRecord(t, ""), "", 0, false},
+		{"known address", false, pingRecord(t, "192.0.2.1:8333"), "LU", 42,
+			true},
+		{"unknown address", false, pingRecord(t, "198.51.100.1:8333"), "", 0,
+			true},
+	}
+
+	for _, test := range tests {
+		var loc adaptor.Locator
+		if !test.noloc {
+			loc = newFakeLocator()
+		}
+
+		result := locate(loc, test.record)
+		if (result != test.record) != test.copied {
+			t.Errorf("%v: copied is %v, want %v", test.name, !test.copied,
+				test.copied)
+		}
+
+		l, ok := result.(*records.PingRecord)
+		if !ok {
+			continue
+		}
+
+		if l.Country() != test.country || l.ASN() != test.asn {
+			t.Errorf("%v: located in %v (%v), want %v (%v)", test.name,
+				l.Country(), l.ASN(), test.country, test.asn)
+		}
+
+		original := test.record.(*records.PingRecord)
+		if test.copied && original.Country() != "" {
+			t.Errorf("%v: original located in %v", test.name,
+				original.Country())
+		}
+	}
+}
+
+func TestGeoFilterValid(t *testing.T) {
+	tests := []struct {
+		name      string
+		countries []string
+		ra        string
+		valid     bool
+	}{
+		{"no countries", nil, "192.0.2.1:8333", false},
+		{"listed country", []string{"LU"}, "192.0.2.1:8333", true},
+		{"one of several", []string{"FR", "DE"}, "192.0.2.2:8333", true},
+		{"unlisted country", []string{"LU"}, "192.0.2.2:8333", false},
+		{"unknown location", []string{"LU"}, "198.51.100.1:8333", false},
+		{"no remote address", []string{"LU"}, "", false},
+	}
+
+	for _, test := range tests {
+		filter, _ := NewGeoFilter(SetCountries(test.countries...))
+		filter.SetLocator(newFakeLocator())
+
+		record := locate(filter.loc, pingRecord(t, test.ra))
+		if filter.valid(record) != test.valid {
+			t.Errorf("%v: valid is %v, want %v", test.name, !test.valid,
+				test.valid)
+		}
+	}
+
+	filter, _ := NewGeoFilter(SetCountries("LU"))
+	if filter.valid(&peerRecord{cmd: "ping"}) {
+		t.Errorf("record without location is valid")
+	}
+}
+
+func TestGeoEnricher(t *testing.T) {
+	loc := newFakeLocator()
+	out := newCollector()
+
+	enricher, _ := NewGeoEnricher()
+	enricher.SetLog(nullLog{})
+	enricher.SetLocator(loc)
+	enricher.AddNext(out)
+	enricher.Start()
+
+	enricher.Process(pingRecord(t, "192.0.2.1:8333"))
+	enricher.Process(&peerRecord{cmd: "pong"})
+
+	received := out.expect(t, "ping", "pong")
+	enricher.Stop()
+
+	ping, ok := received[0].(*records.PingRecord)
+	if !ok || ping.Country() != "LU" || ping.City() != "City of LU" {
+		t.Errorf("ping forwarded as %v", received[0])
+	}
+
+	if loc.lookups != 1 {
+		t.Errorf("%v lookups, want 1", loc.lookups)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"sync"
 
 	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/expression"
 	"github.com/CIRCL/pbtc/records"
 )
 
@@ -36,6 +37,7 @@ type AddressFilter struct {
 	sig     chan struct{}
 	recordQ chan adaptor.Record
 	config  []string
+	expr    *expression.Expression
 }
 
 // NewBase58 creates a new filter that only forwards transactions if they
@@ -53,6 +55,13 @@ func NewAddressFilter(options ...func(adaptor.Processor)) (*AddressFilter, error
 		option(filter)
 	}
 
+	expr, err := compileList("address", filter.config)
+	if err != nil {
+		return nil, err
+	}
+
+	filter.expr = expr
+
 	return filter, nil
 }
 
@@ -119,18 +128,12 @@ ProcessLoop:
 
 // valid checks whether a record fulfills the criteria for forwarding.
 func (filter *AddressFilter) valid(record adaptor.Record) bool {
-	tx, ok := record.(*records.TransactionRecord)
+	_, ok := record.(*records.TransactionRecord)
 	if !ok {
 		return false
 	}
 
-	for _, base58 := range filter.config {
-		if tx.HasAddress(base58) {
-			return true
-		}
-	}
-
-	return false
+	return filter.expr != nil && filter.expr.Match(record)
 }
 
 // forward will send the message to all processors following this filter.
@@ -24,6 +24,7 @@ import (
 	"sync"
 
 	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/expression"
 )
 
 // CommandFilter represents a filter that will only forward messages that fall
@@ -34,7 +35,8 @@ type CommandFilter struct {
 	wg      *sync.WaitGroup
 	sig     chan struct{}
 	recordQ chan adaptor.Record
-	config  map[string]bool
+	config  []string
+	expr    *expression.Expression
 }
 
 // NewCommand returs a new filter that will filter all messages for a list
@@ -45,13 +47,20 @@ func NewCommandFilter(options ...func(adaptor.Processor)) (*CommandFilter, error
 		wg:      &sync.WaitGroup{},
 		sig:     make(chan struct{}),
 		recordQ: make(chan adaptor.Record, 1),
-		config:  make(map[string]bool),
+		config:  make([]string, 0),
 	}
 
 	for _, option := range options {
 		option(filter)
 	}
 
+	expr, err := compileList("command", filter.config)
+	if err != nil {
+		return nil, err
+	}
+
+	filter.expr = expr
+
 	return filter, nil
 }
 
@@ -65,9 +74,7 @@ func SetCommands(cmds ...string) func(adaptor.Processor) {
 			return
 		}
 
-		for _, cmd := range cmds {
-			filter.config[cmd] = true
-		}
+		filter.config = append(filter.config, cmds...)
 	}
 }
 
@@ -118,7 +125,7 @@ ProcessLoop:
 
 // valid checks whether a record fulfills the criteria for forwarding.
 func (filter *CommandFilter) valid(record adaptor.Record) bool {
-	return filter.config[record.Command()]
+	return filter.expr != nil && filter.expr.Match(record)
 }
 
 // forward will send the message to all processors following this filter.
@@ -0,0 +1,346 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"crypto/sha256"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// dedupEntry remembers the first record with a given content key.
+type dedupEntry struct {
+	key    [32]byte
+	first  time.Time
+	count  int
+	record adaptor.Record
+}
+
+// annotated is implemented by records that can carry a duplicate count.
+type annotated interface {
+	SetDuplicates(int)
+}
+
+// annotations is implemented by records with optional annotations, which are
+// not part of their content.
+type annotations interface {
+	SetDirection(string)
+	SetDuplicates(int)
+	SetLocation(string, string, uint32)
+}
+
+// annotatedCommands are the commands of the records that include the
+// duplicate count in their output.
+var annotatedCommands = map[string]bool{
+	"tx":      true,
+	"block":   true,
+	"inv":     true,
+	"addr":    true,
+	"headers": true,
+}
+
+// DedupFilter is a filter that drops records whose content was already seen
+// within a time window, regardless of the peer that sent it. Transactions are
+// keyed by their hash, blocks by the block hash, address records by the
+// advertised addresses and services and all other records by a hash of their
+// normalized payload, which ignores the timestamp, the peer, the annotations
+// and the order of list items. Optionally, the first record is held back until
+// the window closes and a copy annotated with the number of duplicates is
+// forwarded.
+type DedupFilter struct {
+	Processor
+
+	wg       *sync.WaitGroup
+	sig      chan struct{}
+	recordQ  chan adaptor.Record
+	ticker   *time.Ticker
+	entries  map[[32]byte]*dedupEntry
+	order    []*dedupEntry
+	commands map[string]bool
+	window   time.Duration
+	limit    int
+	annotate bool
+}
+
+// NewDedupFilter creates a new filter dropping duplicate records.
+func NewDedupFilter(options ...func(adaptor.Processor)) (*DedupFilter,
+	error) {
+	filter := &DedupFilter{
+		wg:       &sync.WaitGroup{},
+		sig:      make(chan struct{}),
+		recordQ:  make(chan adaptor.Record, 1),
+		entries:  make(map[[32]byte]*dedupEntry),
+		order:    make([]*dedupEntry, 0),
+		commands: make(map[string]bool),
+		window:   10 * time.Minute,
+		limit:    1 << 20,
+	}
+
+	for _, option := range options {
+		option(filter)
+	}
+
+	if len(filter.commands) == 0 {
+		for _, cmd := range []string{"tx", "block", "inv", "addr", "headers"} {
+			filter.commands[cmd] = true
+		}
+	}
+
+	return filter, nil
+}
+
+// SetDedupCommands sets the commands of the records that are deduplicated.
+// Other records are always forwarded. By default, these are transaction,
+// block, inventory, address and headers records.
+func SetDedupCommands(cmds ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*DedupFilter)
+		if !ok {
+			return
+		}
+
+		for _, cmd := range cmds {
+			filter.commands[strings.ToLower(cmd)] = true
+		}
+	}
+}
+
+// SetDedupWindow sets how long we remember the content of a record.
+func SetDedupWindow(window time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*DedupFilter)
+		if !ok {
+			return
+		}
+
+		filter.window = window
+	}
+}
+
+// SetDedupLimit sets the maximum number of records we remember. When it is
+// reached, the oldest record is forgotten before its window closes.
+func SetDedupLimit(limit int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*DedupFilter)
+		if !ok {
+			return
+		}
+
+		filter.limit = limit
+	}
+}
+
+// SetAnnotation enables holding back the first record until its window closes
+// and annotating it with the number of duplicates seen.
+func SetAnnotation(enabled bool) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*DedupFilter)
+		if !ok {
+			return
+		}
+
+		filter.annotate = enabled
+	}
+}
+
+func (filter *DedupFilter) Start() {
+	filter.log.Info("[PFD] Start: begin")
+
+	filter.ticker = time.NewTicker(time.Second)
+
+	filter.wg.Add(1)
+	go filter.goProcess()
+
+	filter.log.Info("[PFD] Start: completed")
+}
+
+func (filter *DedupFilter) Stop() {
+	filter.log.Info("[PFD] Stop: begin")
+
+	close(filter.sig)
+	filter.wg.Wait()
+
+	filter.ticker.Stop()
+
+	filter.log.Info("[PFD] Stop: completed")
+}
+
+// Process adds one record to the filter for processing and forwarding.
+func (filter *DedupFilter) Process(record adaptor.Record) {
+	filter.log.Debug("[PFD] Process: %v", record.Command())
+
+	filter.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine. Records that are held back
+// are flushed when we stop.
+func (filter *DedupFilter) goProcess() {
+	defer filter.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-filter.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case now := <-filter.ticker.C:
+			filter.expire(now)
+
+		case record := <-filter.recordQ:
+			filter.dedup(record)
+		}
+	}
+
+	for len(filter.order) > 0 {
+		filter.evict()
+	}
+}
+
+// dedup forwards a record if we haven't seen its content, or counts it as a
+// duplicate otherwise.
+func (filter *DedupFilter) dedup(record adaptor.Record) {
+	if !filter.commands[record.Command()] {
+		filter.forward(record)
+		return
+	}
+
+	key := contentKey(record)
+	entry, ok := filter.entries[key]
+	if ok {
+		entry.count++
+		return
+	}
+
+	if len(filter.order) >= filter.limit {
+		filter.evict()
+	}
+
+	entry = &dedupEntry{key: key, first: time.Now()}
+	filter.entries[key] = entry
+	filter.order = append(filter.order, entry)
+
+	_, ok = record.(annotated)
+	if filter.annotate && ok && annotatedCommands[record.Command()] {
+		entry.record = record
+		return
+	}
+
+	filter.forward(record)
+}
+
+// expire forgets all records whose window has closed.
+func (filter *DedupFilter) expire(now time.Time) {
+	for len(filter.order) > 0 &&
+		now.Sub(filter.order[0].first) >= filter.window {
+		filter.evict()
+	}
+}
+
+// evict forgets the oldest record, forwarding it if it was held back.
+func (filter *DedupFilter) evict() {
+	entry := filter.order[0]
+	filter.order[0] = nil
+	filter.order = filter.order[1:]
+	delete(filter.entries, entry.key)
+
+	if entry.record == nil {
+		return
+	}
+
+	// the record is shared with other processors, so we annotate a copy
+	record := clone(entry.record)
+	record.(annotated).SetDuplicates(entry.count)
+	filter.forward(record)
+}
+
+// forward will send the record to all processors following this filter.
+func (filter *DedupFilter) forward(record adaptor.Record) {
+	for _, processor := range filter.next {
+		processor.Process(record)
+	}
+}
+
+// contentKey returns the key identifying the content of a record.
+func contentKey(record adaptor.Record) [32]byte {
+	switch r := record.(type) {
+	case *records.TransactionRecord:
+		return r.Details().Hash()
+
+	case *records.BlockRecord:
+		return r.Header().Hash()
+
+	case *records.AddressRecord:
+		return sha256.Sum256([]byte(normalizeAddresses(r)))
+
+	default:
+		return sha256.Sum256([]byte(normalize(record)))
+	}
+}
+
+// normalize returns the payload of a record without the timestamp, the peer
+// addresses, the direction, the duplicate count and the geolocation, with list
+// items sorted.
+func normalize(record adaptor.Record) string {
+	record = clone(record)
+	a, ok := record.(annotations)
+	if ok {
+		a.SetDirection("")
+		a.SetDuplicates(0)
+		a.SetLocation("", "", 0)
+	}
+
+	parts := strings.SplitN(record.String(), records.Delimiter1, 5)
+	if len(parts) < 5 {
+		return record.Command()
+	}
+
+	// the annotation columns are empty now; they would stick to the last item
+	payload := strings.TrimRight(parts[4], records.Delimiter1)
+	items := strings.Split(payload, records.Delimiter2)
+	sort.Strings(items)
+
+	return record.Command() + records.Delimiter1 +
+		strings.Join(items, records.Delimiter2)
+}
+
+// normalizeAddresses returns the services and addresses advertised by an
+// address record, sorted. The timestamps of the addresses are ignored, as
+// peers update them whenever they relay an address.
+func normalizeAddresses(record *records.AddressRecord) string {
+	items := make([]string, 0, len(record.Addresses()))
+	for _, entry := range record.Addresses() {
+		items = append(items, strconv.FormatUint(entry.Services(), 10)+
+			records.Delimiter3+entry.Address().String())
+	}
+
+	sort.Strings(items)
+
+	return record.Command() + records.Delimiter1 +
+		strings.Join(items, records.Delimiter2)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// dedupStep processes one record and lists the commands of the records that
+// should be forwarded as a result.
+type dedupStep struct {
+	name   string
+	record adaptor.Record
+	cmds   []string
+}
+
+// newDedupFilter returns a dedup filter forwarding to the returned collector.
+func newDedupFilter(options ...func(adaptor.Processor)) (*DedupFilter,
+	*collector) {
+	out := newCollector()
+	filter, _ := NewDedupFilter(options...)
+	filter.SetLog(nullLog{})
+	filter.AddNext(out)
+
+	return filter, out
+}
+
+// runDedup runs the steps through the filter in order.
+func runDedup(t *testing.T, filter *DedupFilter, out *collector,
+	steps []dedupStep) {
+	for _, step := range steps {
+		filter.dedup(step.record)
+		if len(out.records) != len(step.cmds) {
+			t.Errorf("%v: forwarded %v records, want %v", step.name,
+				len(out.records), len(step.cmds))
+		}
+
+		out.expect(t, step.cmds...)
+	}
+}
+
+// invRecord returns an inventory record for transactions with the given
+// hashes from the given peer.
+func invRecord(t *testing.T, ra string, hashes ...byte) adaptor.Record {
+	msg := wire.NewMsgInv()
+	for _, hash := range hashes {
+		msg.AddInvVect(wire.NewInvVect(wire.InvTypeTx, &wire.ShaHash{hash}))
+	}
+
+	return records.NewInventoryRecord(msg, tcpAddr(t, ra), nil)
+}
+
+// addrRecord returns an address record advertising the given IPs with the
+// given services and timestamp.
+func addrRecord(t *testing.T, stamp time.Time, services wire.ServiceFlag,
+	ips ...string) adaptor.Record {
+	msg := wire.NewMsgAddr()
+	for _, ip := range ips {
+		msg.AddAddress(wire.NewNetAddressTimestamp(stamp, services,
+			net.ParseIP(ip), 8333))
+	}
+
+	return records.NewAddressRecord(msg, tcpAddr(t, "192.0.2.1:8333"), nil)
+}
+
+func TestDedupFilter(t *testing.T) {
+	first := testTx(wire.ShaHash{1}, 0, 1000)
+	second := testTx(wire.ShaHash{2}, 0, 1000)
+	block := scriptBlock(first)
+	now := time.Now()
+
+	steps := []dedupStep{
+		{"transaction", records.NewTransactionRecord(first,
+			tcpAddr(t, "192.0.2.1:8333"), nil), []string{"tx"}},
+		{"same transaction", records.NewTransactionRecord(first,
+			tcpAddr(t, "192.0.2.2:8333"), nil), nil},
+		{"other transaction", records.NewTransactionRecord(second, nil, nil),
+			[]string{"tx"}},
+		{"block", block, []string{"block"}},
+		{"same block", scriptBlock(first), nil},
+		{"inventory", invRecord(t, "192.0.2.1:8333", 1, 2),
+			[]string{"inv"}},
+		{"reordered inventory", invRecord(t, "192.0.2.2:8333", 2, 1), nil},
+		{"other inventory", invRecord(t, "192.0.2.2:8333", 1, 3),
+			[]string{"inv"}},
+		{"addresses", addrRecord(t, now, 1, "198.51.100.1", "198.51.100.2"),
+			[]string{"addr"}},
+		{"relayed addresses", addrRecord(t, now.Add(time.Minute), 1,
+			"198.51.100.2", "198.51.100.1"), nil},
+		{"other services", addrRecord(t, now, 0, "198.51.100.1",
+			"198.51.100.2"), []string{"addr"}},
+		{"ping", pingRecord(t, "192.0.2.1:8333"), []string{"ping"}},
+		{"same ping", pingRecord(t, "192.0.2.1:8333"), []string{"ping"}},
+	}
+
+	filter, out := newDedupFilter()
+	runDedup(t, filter, out, steps)
+}
+
+func TestDedupCommands(t *testing.T) {
+	tx := testTx(wire.ShaHash{1}, 0, 1000)
+
+	steps := []dedupStep{
+		{"ping", pingRecord(t, "192.0.2.1:8333"), []string{"ping"}},
+		{"same ping", pingRecord(t, "192.0.2.2:8333"), nil},
+		{"transaction", records.NewTransactionRecord(tx, nil, nil),
+			[]string{"tx"}},
+		{"same transaction", records.NewTransactionRecord(tx, nil, nil),
+			[]string{"tx"}},
+	}
+
+	filter, out := newDedupFilter(SetDedupCommands("PING"))
+	runDedup(t, filter, out, steps)
+}
+
+func TestDedupWindow(t *testing.T) {
+	tx := func(hash byte) adaptor.Record {
+		return records.NewTransactionRecord(testTx(wire.ShaHash{hash}, 0, 1),
+			nil, nil)
+	}
+
+	tests := []struct {
+		name    string
+		limit   int
+		elapsed time.Duration
+		cmds    []string
+	}{
+		{"within window", 10, time.Minute, nil},
+		{"window closed", 10, time.Hour, []string{"tx"}},
+		{"limit reached", 2, time.Minute, []string{"tx"}},
+	}
+
+	for _, test := range tests {
+		filter, out := newDedupFilter(SetDedupWindow(time.Hour),
+			SetDedupLimit(test.limit))
+		runDedup(t, filter, out, []dedupStep{
+			{test.name, tx(1), []string{"tx"}},
+			{test.name, tx(2), []string{"tx"}},
+			{test.name, tx(3), []string{"tx"}},
+		})
+
+		filter.expire(time.Now().Add(test.elapsed))
+		runDedup(t, filter, out, []dedupStep{{test.name, tx(1), test.cmds}})
+	}
+}
+
+func TestDedupAnnotation(t *testing.T) {
+	msg := testTx(wire.ShaHash{1}, 0, 1000)
+	original := records.NewTransactionRecord(msg, nil, nil)
+
+	filter, out := newDedupFilter(SetAnnotation(true),
+		SetDedupCommands("tx", "ping"))
+	runDedup(t, filter, out, []dedupStep{
+		{"held back", original, nil},
+		{"duplicate", records.NewTransactionRecord(msg, nil, nil), nil},
+		{"second duplicate", records.NewTransactionRecord(msg, nil, nil),
+			nil},
+		{"not annotated", pingRecord(t, "192.0.2.1:8333"),
+			[]string{"ping"}},
+	})
+
+	filter.expire(time.Now().Add(time.Hour))
+
+	forwarded := out.expect(t, "tx")
+	annotated, ok := forwarded[0].(*records.TransactionRecord)
+	if !ok || annotated == original || annotated.Duplicates() != 2 {
+		t.Errorf("forwarded %v with %v duplicates, want a copy with 2",
+			forwarded[0], annotated.Duplicates())
+	}
+
+	if original.Duplicates() != 0 {
+		t.Errorf("original annotated with %v duplicates",
+			original.Duplicates())
+	}
+
+	if len(filter.order) != 0 || len(filter.entries) != 0 {
+		t.Errorf("kept %v records after the window", len(filter.entries))
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/expression"
+)
+
+// ExpressionFilter is a filter that forwards records matching a boolean
+// expression over the record fields, for example:
+//
+//	command in (tx, block) and (ip in (1.2.3.0/24) or address == "1dice...")
+//
+// The address, command and IP filters are special cases of it.
+type ExpressionFilter struct {
+	Processor
+
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	recordQ chan adaptor.Record
+	src     string
+	expr    *expression.Expression
+}
+
+// NewExpressionFilter creates a new filter for the given expression. If the
+// expression is invalid, an error describing the problem is returned. If no
+// expression is given, all records are filtered out.
+func NewExpressionFilter(options ...func(adaptor.Processor)) (
+	*ExpressionFilter, error) {
+	filter := &ExpressionFilter{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		recordQ: make(chan adaptor.Record, 1),
+	}
+
+	for _, option := range options {
+		option(filter)
+	}
+
+	if filter.src != "" {
+		expr, err := expression.Compile(filter.src)
+		if err != nil {
+			return nil, err
+		}
+
+		filter.expr = expr
+	}
+
+	return filter, nil
+}
+
+// SetExpression sets the expression records have to match to be forwarded.
+func SetExpression(src string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ExpressionFilter)
+		if !ok {
+			return
+		}
+
+		filter.src = src
+	}
+}
+
+func (filter *ExpressionFilter) Start() {
+	filter.log.Info("[PFE] Start: begin")
+
+	filter.wg.Add(1)
+	go filter.goProcess()
+
+	filter.log.Info("[PFE] Start: completed")
+}
+
+func (filter *ExpressionFilter) Stop() {
+	filter.log.Info("[PFE] Stop: begin")
+
+	close(filter.sig)
+	filter.wg.Wait()
+
+	filter.log.Info("[PFE] Stop: completed")
+}
+
+// Process adds one record to the filter for processing and forwarding.
+func (filter *ExpressionFilter) Process(record adaptor.Record) {
+	filter.log.Debug("[PFE] Process: %v", record.Command())
+
+	filter.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (filter *ExpressionFilter) goProcess() {
+	defer filter.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-filter.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case record := <-filter.recordQ:
+			if filter.valid(record) {
+				filter.forward(record)
+			}
+		}
+	}
+}
+
+// valid checks whether a record matches the expression.
+func (filter *ExpressionFilter) valid(record adaptor.Record) bool {
+	return filter.expr != nil && filter.expr.Match(record)
+}
+
+// forward will send the record to all processors following this filter.
+func (filter *ExpressionFilter) forward(record adaptor.Record) {
+	for _, processor := range filter.next {
+		processor.Process(record)
+	}
+}
+
+// compileList compiles an expression matching any of the values for a field.
+// It returns nil if there are no values, so that nothing matches.
+func compileList(field string, values []string) (*expression.Expression,
+	error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	return expression.Compile(listExpression(field, values))
+}
+
+// listExpression returns the source of an expression matching any of the
+// values for a field.
+func listExpression(field string, values []string) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(field)
+	buf.WriteString(" in (")
+	for i, value := range values {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+
+		buf.WriteString(strconv.Quote(value))
+	}
+	buf.WriteString(")")
+
+	return buf.String()
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"sync"
+
+	"github.com/CIRCL/pbtc/adaptor"
+)
+
+// GeoFilter is a filter that only forwards records whose remote address is
+// located in one of the given countries. Records that were not enriched yet
+// are located on the fly and keep their location when forwarded.
+type GeoFilter struct {
+	Processor
+
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	recordQ chan adaptor.Record
+	loc     adaptor.Locator
+	config  map[string]bool
+}
+
+// NewGeoFilter creates a new filter that forwards records from a given set of
+// countries.
+func NewGeoFilter(options ...func(adaptor.Processor)) (*GeoFilter, error) {
+	filter := &GeoFilter{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		recordQ: make(chan adaptor.Record, 1),
+		config:  make(map[string]bool),
+	}
+
+	for _, option := range options {
+		option(filter)
+	}
+
+	return filter, nil
+}
+
+// SetCountries can be passed as a parameter to NewGeoFilter to set the list of
+// ISO country codes to filter for. If no list is provided, all messages are
+// filtered out.
+func SetCountries(countries ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*GeoFilter)
+		if !ok {
+			return
+		}
+
+		for _, country := range countries {
+			filter.config[country] = true
+		}
+	}
+}
+
+// SetLocator injects the locator used to look up the geolocation.
+func (filter *GeoFilter) SetLocator(loc adaptor.Locator) {
+	filter.loc = loc
+}
+
+func (filter *GeoFilter) Start() {
+	filter.log.Info("[PFG] Start: begin")
+
+	filter.wg.Add(1)
+	go filter.goProcess()
+
+	filter.log.Info("[PFG] Start: completed")
+}
+
+func (filter *GeoFilter) Stop() {
+	filter.log.Info("[PFG] Stop: begin")
+
+	close(filter.sig)
+	filter.wg.Wait()
+
+	filter.log.Info("[PFG] Stop: completed")
+}
+
+// Process will add a record to the queue of records to be processed.
+func (filter *GeoFilter) Process(record adaptor.Record) {
+	filter.log.Debug("[PFG] Process: %v", record.Command())
+
+	filter.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (filter *GeoFilter) goProcess() {
+	defer filter.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-filter.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case record := <-filter.recordQ:
+			record = locate(filter.loc, record)
+			if filter.valid(record) {
+				filter.forward(record)
+			}
+		}
+	}
+}
+
+// valid checks whether the record comes from one of the configured countries.
+func (filter *GeoFilter) valid(record adaptor.Record) bool {
+	l, ok := record.(locatable)
+	if !ok {
+		return false
+	}
+
+	return filter.config[l.Country()]
+}
+
+// forward will send the message to the following processors for processing.
+func (filter *GeoFilter) forward(record adaptor.Record) {
+	for _, processor := range filter.next {
+		processor.Process(record)
+	}
+}
@@ -21,41 +21,93 @@
 package processor
 
 import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/iptree"
 )
 
-// IPFilter is a filter to forward only messages that come from a peer whose
-// remote address is in the given list of IP addresses.
+const (
+	MatchRemote = "remote"
+	MatchLocal  = "local"
+	MatchAny    = "any"
+)
+
+// IPFilter is a filter to forward only messages whose remote or local address
+// is in a given list of IP addresses and networks, and optionally uses one of
+// a given list of ports. In exclude mode, it forwards all other messages.
+// The lists are loaded into a prefix tree for efficient lookup.
 type IPFilter struct {
 	Processor
 
 	wg      *sync.WaitGroup
 	sig     chan struct{}
 	recordQ chan adaptor.Record
-	config  map[string]bool
+	config  []string
+	ports   map[int]bool
+	paths   []string
+	target  string
+	exclude bool
+	tree    *iptree.IPTree
+	invalid []string
 }
 
 // NewIP creates a new IP filter that will only forward messages coming from
-// a given set of IP addresses.
+// a given set of IP addresses. If a configured entry is invalid or a list file
+// can't be read, an error is returned. Invalid lines in list files are skipped
+// and reported with their line number when the filter starts.
 func NewIPFilter(options ...func(adaptor.Processor)) (*IPFilter, error) {
 	filter := &IPFilter{
 		wg:      &sync.WaitGroup{},
 		sig:     make(chan struct{}),
 		recordQ: make(chan adaptor.Record, 1),
-		config:  make(map[string]bool),
+		config:  make([]string, 0),
+		ports:   make(map[int]bool),
+		paths:   make([]string, 0),
+		target:  MatchRemote,
+		tree:    iptree.New(),
+		invalid: make([]string, 0),
 	}
 
 	for _, option := range options {
 		option(filter)
 	}
 
+	switch filter.target {
+	case MatchRemote, MatchLocal, MatchAny:
+
+	default:
+		return nil, errors.New("invalid ip filter target: " + filter.target)
+	}
+
+	for _, entry := range filter.config {
+		network, err := iptree.ParseNetwork(entry)
+		if err != nil {
+			return nil, errors.New("invalid ip filter entry: " + entry)
+		}
+
+		filter.tree.Insert(network, true)
+	}
+
+	for _, path := range filter.paths {
+		err := filter.load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return filter, nil
 }
 
 // SetIPs can be passed as a parameter to NewIP to set the list of IP addresses
-// to filter for. If no list is provided, all messages are filtered out.
+// to filter for. Networks in CIDR notation are accepted as well. If no list
+// is provided, all messages are filtered out.
 func SetIPs(ips ...string) func(adaptor.Processor) {
 	return func(pro adaptor.Processor) {
 		filter, ok := pro.(*IPFilter)
@@ -63,15 +115,71 @@ func SetIPs(ips ...string) func(adaptor.Processor) {
 			return
 		}
 
-		for _, ip := range ips {
-			filter.config[ip] = true
+		filter.config = append(filter.config, ips...)
+	}
+}
+
+// SetIPPaths adds files to load IP addresses and networks from, with one entry
+// per line. Empty lines and lines starting with a hash sign are ignored.
+func SetIPPaths(paths ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*IPFilter)
+		if !ok {
+			return
+		}
+
+		filter.paths = append(filter.paths, paths...)
+	}
+}
+
+// SetPorts sets the list of ports to filter for, on the same side as the IP
+// addresses. If no list is provided, all ports match.
+func SetPorts(ports ...int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*IPFilter)
+		if !ok {
+			return
+		}
+
+		for _, port := range ports {
+			filter.ports[port] = true
+		}
+	}
+}
+
+// SetMatchTarget sets which address of a record is matched: the remote one,
+// the local one or any of the two.
+func SetMatchTarget(target string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*IPFilter)
+		if !ok {
+			return
+		}
+
+		filter.target = strings.ToLower(target)
+	}
+}
+
+// SetExcludeMode inverts the filter, so that only messages that don't match
+// are forwarded.
+func SetExcludeMode(enabled bool) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*IPFilter)
+		if !ok {
+			return
 		}
+
+		filter.exclude = enabled
 	}
 }
 
 func (filter *IPFilter) Start() {
 	filter.log.Info("[PFI] Start: begin")
 
+	for _, entry := range filter.invalid {
+		filter.log.Warning("[PFI] Start: skipped invalid entry %v", entry)
+	}
+
 	filter.wg.Add(1)
 	go filter.goProcess()
 
@@ -114,9 +222,45 @@ ProcessLoop:
 	}
 }
 
-// valid for dummy filter simply returns true for every record
+// valid checks whether a record matches the lists, or doesn't match them in
+// exclude mode.
 func (filter *IPFilter) valid(record adaptor.Record) bool {
-	return filter.config[record.RemoteAddress().IP.String()]
+	if filter.tree.Count() == 0 && len(filter.ports) == 0 {
+		return filter.exclude
+	}
+
+	var match bool
+	switch filter.target {
+	case MatchRemote:
+		match = filter.match(record.RemoteAddress())
+
+	case MatchLocal:
+		match = filter.match(record.LocalAddress())
+
+	case MatchAny:
+		match = filter.match(record.RemoteAddress()) ||
+			filter.match(record.LocalAddress())
+	}
+
+	return match != filter.exclude
+}
+
+// match checks whether an address is in the IP list and uses one of the ports.
+// Empty lists match all addresses.
+func (filter *IPFilter) match(addr *net.TCPAddr) bool {
+	if addr == nil {
+		return false
+	}
+
+	if filter.tree.Count() > 0 && !filter.tree.Contains(addr.IP) {
+		return false
+	}
+
+	if len(filter.ports) > 0 && !filter.ports[addr.Port] {
+		return false
+	}
+
+	return true
 }
 
 // forward will send the message to the following processors for processing.
@@ -125,3 +269,32 @@ func (filter *IPFilter) forward(record adaptor.Record) {
 		processor.Process(record)
 	}
 }
+
+// load adds the IP addresses and networks from a file to the tree. Invalid
+// lines are remembered with their position, so we can report them.
+func (filter *IPFilter) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		network, err := iptree.ParseNetwork(line)
+		if err != nil {
+			entry := path + ":" + strconv.Itoa(number) + ": " + line
+			filter.invalid = append(filter.invalid, entry)
+			continue
+		}
+
+		filter.tree.Insert(network, true)
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/CIRCL/pbtc/adaptor"
+)
+
+func TestIPFilterValid(t *testing.T) {
+	remote := SetMatchTarget(MatchRemote)
+	local := SetMatchTarget(MatchLocal)
+	any := SetMatchTarget(MatchAny)
+	exclude := SetExcludeMode(true)
+	ips := SetIPs("1.2.3.4", "5.6.0.0/16", "2001:db8::/32")
+	ports := SetPorts(8333)
+
+	tests := []struct {
+		name    string
+		options []func(adaptor.Processor)
+		ra      string
+		la      string
+		valid   bool
+	}{
+		{"no lists", nil, "1.2.3.4:8333", "10.0.0.1:45000", false},
+		{"no lists excluded", []func(adaptor.Processor){exclude},
+			"1.2.3.4:8333", "10.0.0.1:45000", true},
+		{"address", []func(adaptor.Processor){ips}, "1.2.3.4:8333", "",
+			true},
+		{"other address", []func(adaptor.Processor){ips}, "1.2.3.5:8333",
+			"", false},
+		{"network", []func(adaptor.Processor){ips}, "5.6.7.8:8333", "",
+			true},
+		{"ipv6 network", []func(adaptor.Processor){ips},
+			"[2001:db8::1]:8333", "", true},
+		{"ipv6 other", []func(adaptor.Processor){ips}, "[2001:db9::1]:8333",
+			"", false},
+		{"port", []func(adaptor.Processor){ports}, "9.9.9.9:8333", "", true},
+		{"other port", []func(adaptor.Processor){ports}, "9.9.9.9:18333", "",
+			false},
+		{"address and port", []func(adaptor.Processor){ips, ports},
+			"1.2.3.4:8333", "", true},
+		{"address but other port", []func(adaptor.Processor){ips, ports},
+			"1.2.3.4:18333", "", false},
+		{"no remote address", []func(adaptor.Processor){ips}, "",
+			"1.2.3.4:8333", false},
+		{"remote target", []func(adaptor.Processor){ips, remote},
+			"9.9.9.9:8333", "1.2.3.4:8333", false},
+		{"local target", []func(adaptor.Processor){ips, local},
+			"9.9.9.9:8333", "1.2.3.4:8333", true},
+		{"local target with port", []func(adaptor.Processor){ips, ports,
+			local}, "9.9.9.9:8333", "1.2.3.4:45000", false},
+		{"any target remote", []func(adaptor.Processor){ips, any},
+			"1.2.3.4:8333", "10.0.0.1:45000", true},
+		{"any target local", []func(adaptor.Processor){ips, any},
+			"9.9.9.9:8333", "1.2.3.4:45000", true},
+		{"any target none", []func(adaptor.Processor){ips, any},
+			"9.9.9.9:8333", "10.0.0.1:45000", false},
+		{"excluded", []func(adaptor.Processor){ips, exclude},
+			"1.2.3.4:8333", "", false},
+		{"not excluded", []func(adaptor.Processor){ips, exclude},
+			"9.9.9.9:8333", "", true},
+	}
+
+	for _, test := range tests {
+		filter, err := NewIPFilter(test.options...)
+		if err != nil {
+			t.Errorf("%v: could not create filter (%v)", test.name, err)
+			continue
+		}
+
+		record := &peerRecord{
+			cmd: "tx",
+			ra:  tcpAddr(t, test.ra),
+			la:  tcpAddr(t, test.la),
+		}
+
+		if filter.valid(record) != test.valid {
+			t.Errorf("%v: valid is %v, want %v", test.name, !test.valid,
+				test.valid)
+		}
+	}
+}
+
+func TestIPFilterLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbtc")
+	if err != nil {
+		t.Fatalf("could not create directory (%v)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "list.txt")
+	data := "# blocklist\n\n1.2.3.0/24\nbogus\n 2001:db8::1 \n1.2.3.4/99\n"
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("could not write list (%v)", err)
+	}
+
+	filter, err := NewIPFilter(SetIPPaths(path), SetIPs("5.6.7.8"))
+	if err != nil {
+		t.Fatalf("could not create filter (%v)", err)
+	}
+
+	if filter.tree.Count() != 3 {
+		t.Errorf("loaded %v networks, want 3", filter.tree.Count())
+	}
+
+	invalid := []string{path + ":4: bogus", path + ":6: 1.2.3.4/99"}
+	if len(filter.invalid) != len(invalid) {
+		t.Fatalf("invalid entries are %v, want %v", filter.invalid, invalid)
+	}
+
+	for i, entry := range invalid {
+		if filter.invalid[i] != entry {
+			t.Errorf("invalid entry is %q, want %q", filter.invalid[i], entry)
+		}
+	}
+
+	// the filter starts, reporting the invalid entries, and forwards matches
+	out := newCollector()
+	filter.SetLog(nullLog{})
+	filter.AddNext(out)
+	filter.Start()
+	defer filter.Stop()
+
+	filter.Process(&peerRecord{cmd: "ping", ra: tcpAddr(t, "9.9.9.9:8333")})
+	filter.Process(&peerRecord{cmd: "tx", ra: tcpAddr(t, "1.2.3.9:8333")})
+
+	out.expect(t, "tx")
+}
+
+func TestIPFilterErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []func(adaptor.Processor)
+	}{
+		{"invalid entry", []func(adaptor.Processor){SetIPs("1.2.3")}},
+		{"invalid target", []func(adaptor.Processor){SetMatchTarget("both")}},
+		{"missing file", []func(adaptor.Processor){
+			SetIPPaths(filepath.Join(os.TempDir(), "pbtc-missing.txt"))}},
+	}
+
+	for _, test := range tests {
+		_, err := NewIPFilter(test.options...)
+		if err == nil {
+			t.Errorf("%v: expected error", test.name)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+const (
+	SampleHash   = "hash"
+	SampleRandom = "random"
+)
+
+// bucket is a token bucket refilling at a given rate per second up to a
+// maximum burst size.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket creates a full token bucket. Without a burst size, the bucket
+// holds one second worth of tokens.
+func newBucket(rate float64, burst int, now time.Time) *bucket {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+
+	b := &bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+
+	return b
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+}
+
+// take removes a token from the bucket and returns whether one was available.
+func (b *bucket) take(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// dropCount keeps track of what happened to the records of one command
+// during a reporting period.
+type dropCount struct {
+	kept    int
+	sampled int
+	limited int
+	peers   int
+}
+
+// SampleFilter is a filter that reduces the volume of records. It samples
+// records, either deterministically based on the hash of their content, so
+// that the same transaction is kept or dropped consistently across
+// collectors, or randomly. It then enforces token bucket rate limits per
+// command and per peer. At a regular interval, it emits a record with the
+// number of records forwarded and dropped per command.
+type SampleFilter struct {
+	Processor
+
+	wg        *sync.WaitGroup
+	sig       chan struct{}
+	recordQ   chan adaptor.Record
+	ticker    *time.Ticker
+	rand      *rand.Rand
+	commands  map[string]bool
+	rate      float64
+	mode      string
+	limits    map[string]*bucket
+	peerRate  float64
+	peerBurst int
+	peers     map[string]*bucket
+	counts    map[string]*dropCount
+	interval  time.Duration
+	last      time.Time
+}
+
+// NewSampleFilter creates a new filter sampling and rate-limiting records.
+// If the sampling mode is unknown, an error is returned.
+func NewSampleFilter(options ...func(adaptor.Processor)) (*SampleFilter,
+	error) {
+	filter := &SampleFilter{
+		wg:       &sync.WaitGroup{},
+		sig:      make(chan struct{}),
+		recordQ:  make(chan adaptor.Record, 1),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		commands: make(map[string]bool),
+		rate:     1,
+		mode:     SampleHash,
+		limits:   make(map[string]*bucket),
+		peers:    make(map[string]*bucket),
+		counts:   make(map[string]*dropCount),
+		interval: time.Minute,
+	}
+
+	for _, option := range options {
+		option(filter)
+	}
+
+	if filter.mode != SampleHash && filter.mode != SampleRandom {
+		return nil, errors.New("invalid sample mode: " + filter.mode)
+	}
+
+	if filter.rate < 0 || filter.rate > 1 {
+		return nil, errors.New("invalid sample rate")
+	}
+
+	return filter, nil
+}
+
+// SetSampleCommands sets the commands of the records that are sampled and
+// rate-limited. Other records are always forwarded. By default, all records
+// received from peers are affected, while records generated by other
+// processors are always forwarded.
+func SetSampleCommands(cmds ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*SampleFilter)
+		if !ok {
+			return
+		}
+
+		for _, cmd := range cmds {
+			filter.commands[strings.ToLower(cmd)] = true
+		}
+	}
+}
+
+// SetSampleRate sets the share of records that is kept by sampling, between
+// zero and one. By default, all records are kept.
+func SetSampleRate(rate float64) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*SampleFilter)
+		if !ok {
+			return
+		}
+
+		filter.rate = rate
+	}
+}
+
+// SetSampleMode sets whether records are sampled based on the hash of their
+// content or randomly. By default, the hash is used.
+func SetSampleMode(mode string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*SampleFilter)
+		if !ok {
+			return
+		}
+
+		filter.mode = strings.ToLower(mode)
+	}
+}
+
+// SetCommandLimit limits the records for a command to the given number per
+// second, with bursts of up to the given size.
+func SetCommandLimit(cmd string, rate float64,
+	burst int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*SampleFilter)
+		if !ok {
+			return
+		}
+
+		filter.limits[strings.ToLower(cmd)] = newBucket(rate, burst, time.Now())
+	}
+}
+
+// SetPeerLimit limits the records from each peer to the given number per
+// second, with bursts of up to the given size.
+func SetPeerLimit(rate float64, burst int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*SampleFilter)
+		if !ok {
+			return
+		}
+
+		filter.peerRate = rate
+		filter.peerBurst = burst
+	}
+}
+
+// SetDropRate sets the interval at which we emit records about dropped
+// records.
+func SetDropRate(interval time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*SampleFilter)
+		if !ok {
+			return
+		}
+
+		filter.interval = interval
+	}
+}
+
+func (filter *SampleFilter) Start() {
+	filter.log.Info("[PFR] Start: begin")
+
+	filter.last = time.Now()
+	filter.ticker = time.NewTicker(filter.interval)
+
+	filter.wg.Add(1)
+	go filter.goProcess()
+
+	filter.log.Info("[PFR] Start: completed")
+}
+
+func (filter *SampleFilter) Stop() {
+	filter.log.Info("[PFR] Stop: begin")
+
+	close(filter.sig)
+	filter.wg.Wait()
+
+	filter.ticker.Stop()
+
+	filter.log.Info("[PFR] Stop: completed")
+}
+
+// Process adds one record to the filter for processing and forwarding.
+func (filter *SampleFilter) Process(record adaptor.Record) {
+	filter.log.Debug("[PFR] Process: %v", record.Command())
+
+	filter.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (filter *SampleFilter) goProcess() {
+	defer filter.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-filter.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case now := <-filter.ticker.C:
+			filter.report(now)
+
+		case record := <-filter.recordQ:
+			filter.filter(record)
+		}
+	}
+
+	filter.report(time.Now())
+}
+
+// filter decides whether a record is forwarded and counts the outcome.
+func (filter *SampleFilter) filter(record adaptor.Record) {
+	if !filter.applies(record) {
+		filter.forward(record)
+		return
+	}
+
+	cmd := record.Command()
+	count, ok := filter.counts[cmd]
+	if !ok {
+		count = &dropCount{}
+		filter.counts[cmd] = count
+	}
+
+	if !filter.sample(record) {
+		count.sampled++
+		return
+	}
+
+	now := time.Now()
+	limit, ok := filter.limits[cmd]
+	if ok && !limit.take(now) {
+		count.limited++
+		return
+	}
+
+	if filter.peerRate > 0 && record.RemoteAddress() != nil {
+		ip := record.RemoteAddress().IP.String()
+		peer, ok := filter.peers[ip]
+		if !ok {
+			peer = newBucket(filter.peerRate, filter.peerBurst, now)
+			filter.peers[ip] = peer
+		}
+
+		if !peer.take(now) {
+			count.peers++
+			return
+		}
+	}
+
+	count.kept++
+	filter.forward(record)
+}
+
+// applies returns whether the record is subject to sampling and rate limits.
+func (filter *SampleFilter) applies(record adaptor.Record) bool {
+	if len(filter.commands) == 0 {
+		return record.RemoteAddress() != nil
+	}
+
+	return filter.commands[record.Command()]
+}
+
+// sample returns whether the record is kept by sampling.
+func (filter *SampleFilter) sample(record adaptor.Record) bool {
+	if filter.rate >= 1 {
+		return true
+	}
+
+	if filter.mode == SampleRandom {
+		return filter.rand.Float64() < filter.rate
+	}
+
+	key := contentKey(record)
+	value := binary.BigEndian.Uint64(key[:8])
+
+	return float64(value) < filter.rate*math.MaxUint64
+}
+
+// report emits a record with the counts of the past period and forgets the
+// buckets of peers that have been idle long enough to be full again.
+func (filter *SampleFilter) report(now time.Time) {
+	for ip, peer := range filter.peers {
+		peer.refill(now)
+		if peer.tokens >= peer.burst {
+			delete(filter.peers, ip)
+		}
+	}
+
+	if len(filter.counts) == 0 {
+		filter.last = now
+		return
+	}
+
+	commands := make([]string, 0, len(filter.counts))
+	for cmd := range filter.counts {
+		commands = append(commands, cmd)
+	}
+
+	sort.Strings(commands)
+
+	kept := make([]int, len(commands))
+	sampled := make([]int, len(commands))
+	limited := make([]int, len(commands))
+	peers := make([]int, len(commands))
+	for i, cmd := range commands {
+		count := filter.counts[cmd]
+		kept[i] = count.kept
+		sampled[i] = count.sampled
+		limited[i] = count.limited
+		peers[i] = count.peers
+	}
+
+	record := records.NewDroppedRecord(now.Sub(filter.last), filter.rate,
+		commands, kept, sampled, limited, peers)
+
+	filter.counts = make(map[string]*dropCount)
+	filter.last = now
+
+	filter.forward(record)
+}
+
+// forward will send the record to all processors following this filter.
+func (filter *SampleFilter) forward(record adaptor.Record) {
+	for _, processor := range filter.next {
+		processor.Process(record)
+	}
+}
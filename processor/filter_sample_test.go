@@ -0,0 +1,225 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Now()
+
+	// takes lists the offsets from the start at which a token is taken
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		takes []time.Duration
+		taken []bool
+	}{
+		{"burst", 1, 3, []time.Duration{0, 0, 0, 0},
+			[]bool{true, true, true, false}},
+		{"refill", 1, 1, []time.Duration{0, 0, time.Second, time.Second},
+			[]bool{true, false, true, false}},
+		{"partial refill", 2, 1, []time.Duration{0, 0, 250 * time.Millisecond,
+			500 * time.Millisecond}, []bool{true, false, false, true}},
+		{"capped refill", 1, 2, []time.Duration{0, 0, time.Hour, time.Hour,
+			time.Hour}, []bool{true, true, true, true, false}},
+		{"default burst", 2.5, 0, []time.Duration{0, 0, 0, 0},
+			[]bool{true, true, true, false}},
+	}
+
+	for _, test := range tests {
+		b := newBucket(test.rate, test.burst, start)
+		for i, offset := range test.takes {
+			if b.take(start.Add(offset)) != test.taken[i] {
+				t.Errorf("%v: take %v returned %v, want %v", test.name, i,
+					!test.taken[i], test.taken[i])
+			}
+		}
+	}
+}
+
+func TestNewSampleFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []func(adaptor.Processor)
+		valid   bool
+	}{
+		{"defaults", nil, true},
+		{"random mode", []func(adaptor.Processor){SetSampleMode("Random")},
+			true},
+		{"unknown mode", []func(adaptor.Processor){SetSampleMode("first")},
+			false},
+		{"no records", []func(adaptor.Processor){SetSampleRate(0)}, true},
+		{"negative rate", []func(adaptor.Processor){SetSampleRate(-0.1)},
+			false},
+		{"rate above one", []func(adaptor.Processor){SetSampleRate(1.5)},
+			false},
+	}
+
+	for _, test := range tests {
+		_, err := NewSampleFilter(test.options...)
+		if (err == nil) != test.valid {
+			t.Errorf("%v: error is %v, want valid %v", test.name, err,
+				test.valid)
+		}
+	}
+}
+
+// sampleTxs returns records for a number of distinct transactions, each
+// received from the given peer.
+func sampleTxs(t *testing.T, ra string, count int) []adaptor.Record {
+	txs := make([]adaptor.Record, 0, count)
+	for i := 0; i < count; i++ {
+		tx := testTx(wire.ShaHash{byte(i), byte(i >> 8)}, 0, 1000)
+		txs = append(txs, records.NewTransactionRecord(tx, tcpAddr(t, ra),
+			nil))
+	}
+
+	return txs
+}
+
+// samplePings returns ping records from each of the given peers.
+func samplePings(t *testing.T, count int, ras ...string) []adaptor.Record {
+	pings := make([]adaptor.Record, 0, count*len(ras))
+	for _, ra := range ras {
+		for i := 0; i < count; i++ {
+			pings = append(pings, pingRecord(t, ra))
+		}
+	}
+
+	return pings
+}
+
+func TestSampleFilter(t *testing.T) {
+	generated := make([]adaptor.Record, 0, 10)
+	for i := 0; i < cap(generated); i++ {
+		generated = append(generated, &peerRecord{cmd: "stats"})
+	}
+
+	tests := []struct {
+		name    string
+		options []func(adaptor.Processor)
+		records []adaptor.Record
+		min     int
+		max     int
+	}{
+		{"defaults", nil, samplePings(t, 10, "192.0.2.1:8333"), 10, 10},
+		{"nothing kept", []func(adaptor.Processor){SetSampleRate(0)},
+			samplePings(t, 10, "192.0.2.1:8333"), 0, 0},
+		{"generated records", []func(adaptor.Processor){SetSampleRate(0)},
+			generated, 10, 10},
+		{"other commands", []func(adaptor.Processor){SetSampleRate(0),
+			SetSampleCommands("TX")}, samplePings(t, 10, "192.0.2.1:8333"),
+			10, 10},
+		{"listed command", []func(adaptor.Processor){SetSampleRate(0),
+			SetSampleCommands("ping")}, samplePings(t, 10, "192.0.2.1:8333"),
+			0, 0},
+		{"hash sampling", []func(adaptor.Processor){SetSampleRate(0.5)},
+			sampleTxs(t, "192.0.2.1:8333", 400), 150, 250},
+		{"random sampling", []func(adaptor.Processor){SetSampleRate(0.5),
+			SetSampleMode("random")}, samplePings(t, 400, "192.0.2.1:8333"),
+			150, 250},
+		{"command limit", []func(adaptor.Processor){
+			SetCommandLimit("PING", 1, 3)}, samplePings(t, 10,
+			"192.0.2.1:8333", "192.0.2.2:8333"), 3, 3},
+		{"peer limit", []func(adaptor.Processor){SetPeerLimit(1, 2)},
+			samplePings(t, 10, "192.0.2.1:8333", "192.0.2.2:8333",
+				"192.0.2.2:18333"), 4, 4},
+	}
+
+	for _, test := range tests {
+		out := &collector{records: make(chan adaptor.Record, 1000)}
+		filter, err := NewSampleFilter(test.options...)
+		if err != nil {
+			t.Fatalf("%v: could not create filter (%v)", test.name, err)
+		}
+
+		filter.SetLog(nullLog{})
+		filter.AddNext(out)
+
+		for _, record := range test.records {
+			filter.filter(record)
+		}
+
+		kept := len(out.records)
+		if kept < test.min || kept > test.max {
+			t.Errorf("%v: kept %v records, want %v to %v", test.name, kept,
+				test.min, test.max)
+		}
+	}
+}
+
+func TestSampleHash(t *testing.T) {
+	first := sampleTxs(t, "192.0.2.1:8333", 100)
+	second := sampleTxs(t, "192.0.2.2:8333", 100)
+
+	filter, _ := NewSampleFilter(SetSampleRate(0.5))
+	for i := range first {
+		if filter.sample(first[i]) != filter.sample(second[i]) {
+			t.Errorf("transaction %v sampled differently per peer", i)
+		}
+	}
+}
+
+func TestSampleReport(t *testing.T) {
+	out := newCollector()
+	filter, _ := NewSampleFilter(SetSampleCommands("ping", "tx"),
+		SetCommandLimit("ping", 1, 2), SetPeerLimit(1, 3))
+	filter.SetLog(nullLog{})
+	filter.AddNext(out)
+
+	filter.last = time.Now()
+	filter.report(filter.last.Add(time.Minute))
+	if len(out.records) != 0 {
+		t.Fatalf("reported without records")
+	}
+
+	received := append(samplePings(t, 3, "192.0.2.1:8333"),
+		sampleTxs(t, "192.0.2.1:8333", 2)...)
+	for _, record := range received {
+		filter.filter(record)
+	}
+
+	out.expect(t, "ping", "ping", "tx")
+
+	filter.report(filter.last.Add(time.Minute))
+	fields := strings.SplitN(out.expect(t, "dropped")[0].String(), "|", 3)
+	if len(fields) != 3 || fields[2] != "60|1|2,ping|2|0|1|0,tx|1|0|0|1" {
+		t.Errorf("reported %v", fields)
+	}
+
+	// the bucket of the peer is forgotten once it is full again
+	filter.report(filter.last.Add(time.Minute))
+	_, ok := filter.peers[net.ParseIP("192.0.2.1").String()]
+	if ok || len(out.records) != 0 {
+		t.Errorf("kept the bucket of an idle peer")
+	}
+}
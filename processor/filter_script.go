@@ -0,0 +1,313 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// protocolMarkers maps known data carrier protocols to the prefix of their
+// null data payloads.
+var protocolMarkers = map[string][]byte{
+	"omni":         []byte("omni"),
+	"counterparty": []byte("CNTRPRTY"),
+}
+
+// ScriptFilter is a filter that forwards transactions, and blocks containing
+// transactions, with outputs of the given script classes or with null data
+// payloads matching known protocol markers or custom prefixes. Optionally, the
+// decoded payloads of the null data outputs are attached to copies of the
+// matching transactions; for blocks, each matching transaction is forwarded
+// with its payloads after the block.
+type ScriptFilter struct {
+	Processor
+
+	wg       *sync.WaitGroup
+	sig      chan struct{}
+	recordQ  chan adaptor.Record
+	classes  map[string]bool
+	prefixes map[string][]byte
+	extract  bool
+}
+
+// NewScriptFilter creates a new filter on output scripts.
+func NewScriptFilter(options ...func(adaptor.Processor)) (*ScriptFilter,
+	error) {
+	filter := &ScriptFilter{
+		wg:       &sync.WaitGroup{},
+		sig:      make(chan struct{}),
+		recordQ:  make(chan adaptor.Record, 1),
+		classes:  make(map[string]bool),
+		prefixes: make(map[string][]byte),
+	}
+
+	for _, option := range options {
+		option(filter)
+	}
+
+	return filter, nil
+}
+
+// SetClasses sets the script classes we forward transactions for, using the
+// names of records.ParseClass, such as "nulldata" or "multisig".
+func SetClasses(classes ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ScriptFilter)
+		if !ok {
+			return
+		}
+
+		for _, class := range classes {
+			filter.classes[strings.ToLower(class)] = true
+		}
+	}
+}
+
+// SetProtocols sets the known protocols, "omni" or "counterparty", whose null
+// data payloads we forward transactions for.
+func SetProtocols(protocols ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ScriptFilter)
+		if !ok {
+			return
+		}
+
+		for _, protocol := range protocols {
+			protocol = strings.ToLower(protocol)
+			marker, ok := protocolMarkers[protocol]
+			if !ok {
+				continue
+			}
+
+			filter.prefixes[protocol] = marker
+		}
+	}
+}
+
+// SetPrefixes sets custom prefixes, in hex, of null data payloads that we
+// forward transactions for. Invalid prefixes are ignored.
+func SetPrefixes(prefixes ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ScriptFilter)
+		if !ok {
+			return
+		}
+
+		for _, prefix := range prefixes {
+			marker, err := hex.DecodeString(prefix)
+			if err != nil || len(marker) == 0 {
+				continue
+			}
+
+			filter.prefixes[prefix] = marker
+		}
+	}
+}
+
+// SetExtraction enables attaching the decoded null data payloads to the
+// transactions we forward.
+func SetExtraction(enabled bool) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ScriptFilter)
+		if !ok {
+			return
+		}
+
+		filter.extract = enabled
+	}
+}
+
+func (filter *ScriptFilter) Start() {
+	filter.log.Info("[PFS] Start: begin")
+
+	filter.wg.Add(1)
+	go filter.goProcess()
+
+	filter.log.Info("[PFS] Start: completed")
+}
+
+func (filter *ScriptFilter) Stop() {
+	filter.log.Info("[PFS] Stop: begin")
+
+	close(filter.sig)
+	filter.wg.Wait()
+
+	filter.log.Info("[PFS] Stop: completed")
+}
+
+// Process adds one record to the filter for processing and forwarding.
+func (filter *ScriptFilter) Process(record adaptor.Record) {
+	filter.log.Debug("[PFS] Process: %v", record.Command())
+
+	filter.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (filter *ScriptFilter) goProcess() {
+	defer filter.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-filter.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case record := <-filter.recordQ:
+			filter.filter(record)
+		}
+	}
+}
+
+// filter forwards the transaction and block records with matching outputs.
+// The records we receive are shared with other processors, so payloads are
+// only ever attached to copies.
+func (filter *ScriptFilter) filter(record adaptor.Record) {
+	switch r := record.(type) {
+	case *records.TransactionRecord:
+		match, payloads := filter.match(r.Details())
+		if !match {
+			return
+		}
+
+		if !filter.extract || len(payloads) == 0 {
+			filter.forward(record)
+			return
+		}
+
+		tr := clone(r).(*records.TransactionRecord)
+		tr.SetPayloads(payloads)
+		filter.forward(tr)
+
+	case *records.BlockRecord:
+		found := false
+		txs := make([]*records.TransactionRecord, 0)
+		for i, tx := range r.Details() {
+			match, payloads := filter.match(tx)
+			if !match {
+				continue
+			}
+
+			found = true
+			if filter.extract && len(payloads) > 0 {
+				tr := r.Transaction(i)
+				tr.SetPayloads(payloads)
+				txs = append(txs, tr)
+			}
+		}
+
+		if !found {
+			return
+		}
+
+		filter.forward(record)
+		for _, tr := range txs {
+			filter.forward(tr)
+		}
+	}
+}
+
+// match checks whether a transaction has an output of one of the classes or
+// a payload matching one of the prefixes, and returns the payloads of all of
+// its null data outputs.
+func (filter *ScriptFilter) match(tx *records.DetailsRecord) (bool,
+	[]*records.PayloadRecord) {
+	match := false
+	payloads := make([]*records.PayloadRecord, 0)
+	for i, output := range tx.Outputs() {
+		if filter.classes[records.ParseClass(output.Class())] {
+			match = true
+		}
+
+		if output.Data() == nil {
+			continue
+		}
+
+		protocol, data := filter.identify(output.Data(), tx)
+		if protocol != "" {
+			match = true
+		}
+
+		payloads = append(payloads,
+			records.NewPayloadRecord(uint32(i), protocol, data))
+	}
+
+	return match, payloads
+}
+
+// identify matches a payload against the prefixes. Counterparty payloads are
+// obfuscated with RC4, using the hash of the first input as key, so we also
+// try to match the decrypted payload. It returns the name of the matching
+// prefix, if any, and the decoded payload.
+func (filter *ScriptFilter) identify(data []byte,
+	tx *records.DetailsRecord) (string, []byte) {
+	decrypted := decryptPayload(data, tx)
+	for name, prefix := range filter.prefixes {
+		if bytes.HasPrefix(data, prefix) {
+			return name, data
+		}
+
+		if decrypted != nil && bytes.HasPrefix(decrypted, prefix) {
+			return name, decrypted
+		}
+	}
+
+	return "", data
+}
+
+// forward will send the record to all processors following this filter.
+func (filter *ScriptFilter) forward(record adaptor.Record) {
+	for _, processor := range filter.next {
+		processor.Process(record)
+	}
+}
+
+// decryptPayload decrypts a payload with RC4, using the hash of the first
+// input in display byte order as key, like Counterparty does.
+func decryptPayload(data []byte, tx *records.DetailsRecord) []byte {
+	if len(tx.Inputs()) == 0 {
+		return nil
+	}
+
+	hash := tx.Inputs()[0].Hash()
+	key := make([]byte, len(hash))
+	for i := range hash {
+		key[i] = hash[len(hash)-1-i]
+	}
+
+	cipher, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil
+	}
+
+	decrypted := make([]byte, len(data))
+	cipher.XORKeyStream(decrypted, data)
+
+	return decrypted
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+var (
+	// payToHash is a pay-to-pubkey-hash output script.
+	payToHash = append(append([]byte{0x76, 0xa9, 0x14},
+		bytes.Repeat([]byte{0x01}, 20)...), 0x88, 0xac)
+
+	// bareMultisig is a one-of-one multisig output script.
+	bareMultisig = append(append([]byte{0x51, 0x21, 0x02},
+		bytes.Repeat([]byte{0x01}, 32)...), 0x51, 0xae)
+)
+
+// nullData returns a null data output script pushing the given payload.
+func nullData(data []byte) []byte {
+	return append([]byte{0x6a, byte(len(data))}, data...)
+}
+
+// scriptTx returns a transaction spending the given output with one output
+// for each of the given scripts.
+func scriptTx(prev wire.ShaHash, scripts ...[]byte) *wire.MsgTx {
+	tx := testTx(prev, 0)
+	for _, script := range scripts {
+		tx.AddTxOut(wire.NewTxOut(0, script))
+	}
+
+	return tx
+}
+
+// scriptBlock returns a block record with the given transactions.
+func scriptBlock(txs ...*wire.MsgTx) *records.BlockRecord {
+	msg := wire.NewMsgBlock(&wire.BlockHeader{Version: 2})
+	for _, tx := range txs {
+		msg.AddTransaction(tx)
+	}
+
+	return records.NewBlockRecord(msg, nil, nil)
+}
+
+// counterpartyTx returns a transaction with a Counterparty payload, encrypted
+// with the hash of its first input.
+func counterpartyTx() *wire.MsgTx {
+	tx := scriptTx(wire.ShaHash{7})
+	details := records.NewDetailsRecord(tx)
+	data := decryptPayload([]byte("CNTRPRTY\x00\x01"), details)
+	tx.AddTxOut(wire.NewTxOut(0, nullData(data)))
+
+	return tx
+}
+
+func TestScriptFilter(t *testing.T) {
+	plain := scriptTx(wire.ShaHash{1}, payToHash)
+	hello := scriptTx(wire.ShaHash{2}, payToHash, nullData([]byte("hello")))
+	omni := scriptTx(wire.ShaHash{3}, nullData([]byte("omni\x00\x01")))
+	custom := scriptTx(wire.ShaHash{4}, nullData([]byte{0xca, 0xfe, 0x01}))
+	multisig := scriptTx(wire.ShaHash{5}, bareMultisig)
+	counterparty := counterpartyTx()
+
+	tx := func(msg *wire.MsgTx) adaptor.Record {
+		return records.NewTransactionRecord(msg, nil, nil)
+	}
+
+	// payloads lists the protocols of the payloads attached to each of the
+	// forwarded records, with "-" for payloads without protocol
+	tests := []struct {
+		name     string
+		options  []func(adaptor.Processor)
+		record   adaptor.Record
+		payloads [][]string
+	}{
+		{"no options", nil, tx(hello), nil},
+		{"other class", []func(adaptor.Processor){SetClasses("nulldata")},
+			tx(plain), nil},
+		{"class", []func(adaptor.Processor){SetClasses("nulldata")},
+			tx(hello), [][]string{{}}},
+		{"class name case", []func(adaptor.Processor){SetClasses("MultiSig")},
+			tx(multisig), [][]string{{}}},
+		{"class payload", []func(adaptor.Processor){SetClasses("nulldata"),
+			SetExtraction(true)}, tx(hello), [][]string{{"-"}}},
+		{"protocol", []func(adaptor.Processor){SetProtocols("Omni"),
+			SetExtraction(true)}, tx(omni), [][]string{{"omni"}}},
+		{"other protocol", []func(adaptor.Processor){
+			SetProtocols("counterparty")}, tx(omni), nil},
+		{"unknown protocol", []func(adaptor.Processor){SetProtocols("colu")},
+			tx(omni), nil},
+		{"encrypted protocol", []func(adaptor.Processor){
+			SetProtocols("counterparty"), SetExtraction(true)},
+			tx(counterparty), [][]string{{"counterparty"}}},
+		{"prefix", []func(adaptor.Processor){SetPrefixes("cafe"),
+			SetExtraction(true)}, tx(custom), [][]string{{"cafe"}}},
+		{"invalid prefix", []func(adaptor.Processor){SetPrefixes("zz", "")},
+			tx(custom), nil},
+		{"no payload", []func(adaptor.Processor){SetClasses("multisig"),
+			SetExtraction(true)}, tx(multisig), [][]string{{}}},
+		{"block", []func(adaptor.Processor){SetProtocols("omni")},
+			scriptBlock(plain, omni), [][]string{{}}},
+		{"block payloads", []func(adaptor.Processor){SetProtocols("omni"),
+			SetClasses("multisig"), SetExtraction(true)},
+			scriptBlock(plain, omni, hello, multisig),
+			[][]string{{}, {"omni"}}},
+		{"block without match", []func(adaptor.Processor){
+			SetProtocols("omni")}, scriptBlock(plain, hello), nil},
+		{"other record", []func(adaptor.Processor){SetClasses("nulldata")},
+			&peerRecord{cmd: "inv"}, nil},
+	}
+
+	for _, test := range tests {
+		out := newCollector()
+		filter, _ := NewScriptFilter(test.options...)
+		filter.SetLog(nullLog{})
+		filter.AddNext(out)
+
+		filter.filter(test.record)
+
+		if len(out.records) != len(test.payloads) {
+			t.Errorf("%v: forwarded %v records, want %v", test.name,
+				len(out.records), len(test.payloads))
+			continue
+		}
+
+		for i, protocols := range test.payloads {
+			record := <-out.records
+			if i == 0 && len(protocols) == 0 && record != test.record {
+				t.Errorf("%v: forwarded a copy without payloads", test.name)
+			}
+
+			tr, ok := record.(*records.TransactionRecord)
+			if !ok {
+				continue
+			}
+
+			payloads := tr.Payloads()
+			if len(payloads) != len(protocols) {
+				t.Errorf("%v: record %v has %v payloads, want %v", test.name,
+					i, len(payloads), len(protocols))
+				continue
+			}
+
+			for j, payload := range payloads {
+				protocol := payload.Protocol()
+				if protocol == "" {
+					protocol = "-"
+				}
+
+				if protocol != protocols[j] {
+					t.Errorf("%v: payload %v is %v, want %v", test.name, j,
+						protocol, protocols[j])
+				}
+			}
+		}
+
+		// the received record is shared and never gets payloads attached
+		original, ok := test.record.(*records.TransactionRecord)
+		if ok && len(original.Payloads()) > 0 {
+			t.Errorf("%v: payloads attached to the original", test.name)
+		}
+	}
+}
+
+func TestDecryptPayload(t *testing.T) {
+	tx := records.NewDetailsRecord(scriptTx(wire.ShaHash{9}))
+	plain := []byte("CNTRPRTY\x00\x00\x00\x00")
+
+	encrypted := decryptPayload(plain, tx)
+	if bytes.Equal(encrypted, plain) {
+		t.Fatalf("payload was not encrypted")
+	}
+
+	if !bytes.Equal(decryptPayload(encrypted, tx), plain) {
+		t.Errorf("payload does not decrypt to the original")
+	}
+
+	other := records.NewDetailsRecord(scriptTx(wire.ShaHash{10}))
+	if bytes.Equal(decryptPayload(encrypted, other), plain) {
+		t.Errorf("payload decrypts with the key of another transaction")
+	}
+
+	coinbase := records.NewDetailsRecord(wire.NewMsgTx())
+	if decryptPayload(encrypted, coinbase) != nil {
+		t.Errorf("payload decrypted without inputs")
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// ValueFilter is a filter that forwards transactions and blocks containing
+// large transactions. A transaction matches if its total output value reaches
+// the general threshold, or if the outputs of one script class reach the
+// threshold for that class. Optionally, a large transaction record is
+// forwarded as an alert for each match, up to a maximum number of alerts per
+// minute; it includes the input value and fee when the previous outputs are
+// known.
+type ValueFilter struct {
+	Processor
+
+	wg        *sync.WaitGroup
+	sig       chan struct{}
+	recordQ   chan adaptor.Record
+	ticker    *time.Ticker
+	cache     *UTXOCache
+	fallback  PrevoutSource
+	size      int
+	budget    time.Duration
+	threshold int64
+	classes   map[string]int64
+	alert     bool
+	limit     int
+	alerts    int
+	dropped   int
+}
+
+// NewValueFilter creates a new filter for large transactions.
+func NewValueFilter(options ...func(adaptor.Processor)) (*ValueFilter, error) {
+	filter := &ValueFilter{
+		wg:        &sync.WaitGroup{},
+		sig:       make(chan struct{}),
+		recordQ:   make(chan adaptor.Record, 1),
+		size:      cacheSize,
+		budget:    100 * time.Millisecond,
+		threshold: 100000000000,
+		classes:   make(map[string]int64),
+		limit:     60,
+	}
+
+	for _, option := range options {
+		option(filter)
+	}
+
+	if filter.cache == nil {
+		filter.cache = NewUTXOCache(filter.size, filter.fallback)
+	}
+
+	filter.cache.retain()
+
+	return filter, nil
+}
+
+// SetValueThreshold sets the general threshold in satoshis. Zero disables it.
+func SetValueThreshold(threshold int64) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ValueFilter)
+		if !ok {
+			return
+		}
+
+		filter.threshold = threshold
+	}
+}
+
+// SetClassThreshold sets the threshold in satoshis for the total value of the
+// outputs of one script class, such as "multisig".
+func SetClassThreshold(class string, threshold int64) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ValueFilter)
+		if !ok {
+			return
+		}
+
+		filter.classes[strings.ToLower(class)] = threshold
+	}
+}
+
+// SetValueAlerts enables forwarding a large transaction record after each
+// matching transaction or block record.
+func SetValueAlerts(enabled bool) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ValueFilter)
+		if !ok {
+			return
+		}
+
+		filter.alert = enabled
+	}
+}
+
+// SetAlertLimit sets the maximum number of alerts forwarded per minute.
+// Zero means no limit.
+func SetAlertLimit(limit int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		filter, ok := pro.(*ValueFilter)
+		if !ok {
+			return
+		}
+
+		filter.limit = limit
+	}
+}
+
+func (filter *ValueFilter) Start() {
+	filter.log.Info("[PFV] Start: begin")
+
+	filter.ticker = time.NewTicker(time.Minute)
+
+	filter.wg.Add(1)
+	go filter.goProcess()
+
+	filter.log.Info("[PFV] Start: completed")
+}
+
+func (filter *ValueFilter) Stop() {
+	filter.log.Info("[PFV] Stop: begin")
+
+	close(filter.sig)
+	filter.wg.Wait()
+
+	filter.ticker.Stop()
+	filter.cache.release()
+
+	filter.log.Info("[PFV] Stop: completed")
+}
+
+// Process adds one record to the filter for processing and forwarding.
+func (filter *ValueFilter) Process(record adaptor.Record) {
+	filter.log.Debug("[PFV] Process: %v", record.Command())
+
+	filter.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (filter *ValueFilter) goProcess() {
+	defer filter.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-filter.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case <-filter.ticker.C:
+			if filter.dropped > 0 {
+				filter.log.Notice("[PFV] Dropped %v alerts", filter.dropped)
+			}
+
+			filter.alerts = 0
+			filter.dropped = 0
+
+		case record := <-filter.recordQ:
+			if sent(record) {
+				continue
+			}
+
+			filter.filter(record)
+		}
+	}
+}
+
+// filter forwards transaction and block records with large transactions,
+// each followed by the alerts for its matching transactions.
+func (filter *ValueFilter) filter(record adaptor.Record) {
+	var txs []*records.DetailsRecord
+	var source string
+	switch r := record.(type) {
+	case *records.TransactionRecord:
+		txs = []*records.DetailsRecord{r.Details()}
+		source = SourceMempool
+
+	case *records.BlockRecord:
+		txs = r.Details()
+		source = SourceBlock
+
+	default:
+		return
+	}
+
+	found := false
+	alerts := make([]adaptor.Record, 0)
+	for _, tx := range txs {
+		filter.cache.Add(tx)
+
+		out := outputValue(tx)
+		class, ok := filter.valid(tx, out)
+		if !ok {
+			continue
+		}
+
+		found = true
+		alert := filter.alarm(tx, out, class, source, record)
+		if alert != nil {
+			alerts = append(alerts, alert)
+		}
+	}
+
+	if source == SourceBlock {
+		for _, tx := range txs {
+			filter.cache.Spend(tx)
+		}
+	}
+
+	if !found {
+		return
+	}
+
+	filter.forward(record)
+	for _, alert := range alerts {
+		filter.forward(alert)
+	}
+}
+
+// alarm creates the large transaction record for a matching transaction. It
+// returns nil if alerts are disabled or the alert limit has been reached.
+func (filter *ValueFilter) alarm(tx *records.DetailsRecord, out int64,
+	class string, source string, record adaptor.Record) adaptor.Record {
+	if !filter.alert {
+		return nil
+	}
+
+	if filter.limit > 0 && filter.alerts >= filter.limit {
+		filter.dropped++
+		return nil
+	}
+
+	filter.alerts++
+
+	in, ok := inputValue(filter.cache, tx, filter.budget)
+	if !ok {
+		in = -1
+	}
+
+	return records.NewLargeTxRecord(tx, out, in, class, source,
+		record.RemoteAddress(), record.LocalAddress())
+}
+
+// valid checks the output values against the thresholds and returns the class
+// whose threshold was reached, or an empty string for the general threshold.
+func (filter *ValueFilter) valid(tx *records.DetailsRecord,
+	out int64) (string, bool) {
+	if filter.threshold > 0 && out >= filter.threshold {
+		return "", true
+	}
+
+	if len(filter.classes) == 0 {
+		return "", false
+	}
+
+	values := make(map[string]int64)
+	for _, output := range tx.Outputs() {
+		values[records.ParseClass(output.Class())] += output.Value()
+	}
+
+	for class, value := range values {
+		threshold, ok := filter.classes[class]
+		if ok && threshold > 0 && value >= threshold {
+			return class, true
+		}
+	}
+
+	return "", false
+}
+
+// forward will send the record to all processors following this filter.
+func (filter *ValueFilter) forward(record adaptor.Record) {
+	for _, processor := range filter.next {
+		processor.Process(record)
+	}
+}
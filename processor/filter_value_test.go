@@ -0,0 +1,174 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// valueAlert describes an expected large transaction record.
+type valueAlert struct {
+	class  string
+	source string
+	out    int64
+	in     int64
+}
+
+// newValueFilter returns a value filter that doesn't wait for previous
+// outputs, forwarding to the returned collector.
+func newValueFilter(options ...func(adaptor.Processor)) (*ValueFilter,
+	*collector) {
+	out := newCollector()
+	options = append(options, SetCacheSize(64), SetPrevoutBudget(0))
+	filter, _ := NewValueFilter(options...)
+	filter.SetLog(nullLog{})
+	filter.AddNext(out)
+
+	return filter, out
+}
+
+// checkAlerts checks that the records forwarded after the first one are the
+// expected alerts.
+func checkAlerts(t *testing.T, name string, forwarded []adaptor.Record,
+	alerts []valueAlert) {
+	for i, alert := range alerts {
+		lr, ok := forwarded[i+1].(*records.LargeTxRecord)
+		if !ok {
+			t.Errorf("%v: record %v is not an alert", name, i+1)
+			continue
+		}
+
+		if lr.Class() != alert.class || lr.Source() != alert.source ||
+			lr.OutputValue() != alert.out || lr.InputValue() != alert.in {
+			t.Errorf("%v: alert %v is %v %v %v %v, want %+v", name, i,
+				lr.Class(), lr.Source(), lr.OutputValue(), lr.InputValue(),
+				alert)
+		}
+	}
+}
+
+func TestValueFilter(t *testing.T) {
+	small := testTx(wire.ShaHash{1}, 0, 400, 500)
+	exact := testTx(wire.ShaHash{5}, 0, 1000)
+	large := testTx(wire.ShaHash{2}, 0, 600, 500)
+	larger := testTx(wire.ShaHash{3}, 0, 5000)
+	multisig := testTx(wire.ShaHash{4}, 0, 10)
+	multisig.AddTxOut(wire.NewTxOut(600, bareMultisig))
+
+	tx := func(msg *wire.MsgTx) adaptor.Record {
+		return records.NewTransactionRecord(msg, nil, nil)
+	}
+
+	tests := []struct {
+		name    string
+		options []func(adaptor.Processor)
+		record  adaptor.Record
+		cmds    []string
+		alerts  []valueAlert
+	}{
+		{"below threshold", []func(adaptor.Processor){
+			SetValueThreshold(1000)}, tx(small), nil, nil},
+		{"at threshold", []func(adaptor.Processor){SetValueThreshold(1000)},
+			tx(exact), []string{"tx"}, nil},
+		{"above threshold", []func(adaptor.Processor){
+			SetValueThreshold(1000)}, tx(large), []string{"tx"}, nil},
+		{"alert", []func(adaptor.Processor){SetValueThreshold(1000),
+			SetValueAlerts(true)}, tx(large), []string{"tx", "largetx"},
+			[]valueAlert{{"", SourceMempool, 1100, -1}}},
+		{"disabled threshold", []func(adaptor.Processor){
+			SetValueThreshold(0)}, tx(larger), nil, nil},
+		{"class", []func(adaptor.Processor){SetValueThreshold(0),
+			SetClassThreshold("MultiSig", 500), SetValueAlerts(true)},
+			tx(multisig), []string{"tx", "largetx"},
+			[]valueAlert{{"multisig", SourceMempool, 610, -1}}},
+		{"class below threshold", []func(adaptor.Processor){
+			SetValueThreshold(0), SetClassThreshold("multisig", 700)},
+			tx(multisig), nil, nil},
+		{"other class", []func(adaptor.Processor){SetValueThreshold(0),
+			SetClassThreshold("multisig", 500)}, tx(larger), nil, nil},
+		{"block", []func(adaptor.Processor){SetValueThreshold(1000),
+			SetValueAlerts(true)}, scriptBlock(small, larger),
+			[]string{"block", "largetx"},
+			[]valueAlert{{"", SourceBlock, 5000, -1}}},
+		{"alert limit", []func(adaptor.Processor){SetValueThreshold(1000),
+			SetValueAlerts(true), SetAlertLimit(1)},
+			scriptBlock(large, larger), []string{"block", "largetx"},
+			[]valueAlert{{"", SourceBlock, 1100, -1}}},
+		{"no alert limit", []func(adaptor.Processor){SetValueThreshold(1000),
+			SetValueAlerts(true), SetAlertLimit(0)},
+			scriptBlock(large, larger), []string{"block", "largetx",
+				"largetx"}, []valueAlert{{"", SourceBlock, 1100, -1},
+				{"", SourceBlock, 5000, -1}}},
+		{"block without match", []func(adaptor.Processor){
+			SetValueThreshold(1000)}, scriptBlock(small), nil, nil},
+		{"other record", []func(adaptor.Processor){SetValueThreshold(1)},
+			&peerRecord{cmd: "inv"}, nil, nil},
+	}
+
+	for _, test := range tests {
+		filter, out := newValueFilter(test.options...)
+		filter.filter(test.record)
+
+		forwarded := out.expect(t, test.cmds...)
+		if len(forwarded) > 0 && forwarded[0] != test.record {
+			t.Errorf("%v: forwarded a different record", test.name)
+		}
+
+		checkAlerts(t, test.name, forwarded, test.alerts)
+	}
+}
+
+func TestValueFilterInputs(t *testing.T) {
+	funding := testTx(wire.ShaHash{1}, 0, 3000, 4000)
+	spending := testTx(funding.TxSha(), 1, 3500)
+	double := testTx(funding.TxSha(), 1, 3600)
+
+	tests := []struct {
+		name   string
+		record adaptor.Record
+		cmds   []string
+		alerts []valueAlert
+	}{
+		{"funding", records.NewTransactionRecord(funding, nil, nil),
+			[]string{"tx", "largetx"},
+			[]valueAlert{{"", SourceMempool, 7000, -1}}},
+		{"known input", records.NewTransactionRecord(spending, nil, nil),
+			[]string{"tx", "largetx"},
+			[]valueAlert{{"", SourceMempool, 3500, 4000}}},
+		{"confirmed", scriptBlock(spending), []string{"block", "largetx"},
+			[]valueAlert{{"", SourceBlock, 3500, 4000}}},
+		{"spent input", records.NewTransactionRecord(double, nil, nil),
+			[]string{"tx", "largetx"},
+			[]valueAlert{{"", SourceMempool, 3600, -1}}},
+	}
+
+	filter, out := newValueFilter(SetValueThreshold(3000),
+		SetValueAlerts(true))
+	for _, test := range tests {
+		filter.filter(test.record)
+		checkAlerts(t, test.name, out.expect(t, test.cmds...), test.alerts)
+	}
+}
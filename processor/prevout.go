@@ -0,0 +1,467 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+const (
+	// restWorkers is the number of concurrent lookups of the REST source.
+	restWorkers = 4
+
+	// restQueue is the number of lookups that can wait for a worker; when
+	// the queue is full, further lookups are dropped.
+	restQueue = 1024
+
+	// restCache is the number of transactions whose lookup results, including
+	// misses, the REST source remembers.
+	restCache = 65536
+
+	// cacheSize is the default number of outputs kept in a UTXO cache.
+	cacheSize = 1 << 20
+)
+
+// PrevoutSource provides the value of previous transaction outputs, so that
+// processors can calculate input values and fees. The second return value is
+// false if the output is unknown. Sources that need time to look up an output
+// may wait until the deadline; if it has passed, they return right away.
+type PrevoutSource interface {
+	Value(hash [32]byte, index uint32, deadline time.Time) (int64, bool)
+}
+
+// SetPrevoutSource sets the source used to look up the value of previous
+// outputs that are not in the local cache. It applies to the mempool analyzer
+// and the value filter.
+func SetPrevoutSource(source PrevoutSource) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		switch p := pro.(type) {
+		case *MempoolAnalyzer:
+			p.fallback = source
+
+		case *ValueFilter:
+			p.fallback = source
+		}
+	}
+}
+
+// SetPrevoutBudget sets the maximum time spent waiting for the prevout source
+// per transaction. Lookups that take longer are still completed in the
+// background, so their result is available for later transactions. It applies
+// to the mempool analyzer and the value filter.
+func SetPrevoutBudget(budget time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		switch p := pro.(type) {
+		case *MempoolAnalyzer:
+			p.budget = budget
+
+		case *ValueFilter:
+			p.budget = budget
+		}
+	}
+}
+
+// SetCacheSize sets the number of outputs kept in the local cache. It applies
+// to the mempool analyzer and the value filter, and is ignored if they are
+// given a shared cache.
+func SetCacheSize(size int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		switch p := pro.(type) {
+		case *MempoolAnalyzer:
+			p.size = size
+
+		case *ValueFilter:
+			p.size = size
+		}
+	}
+}
+
+// SetUTXOCache sets a cache shared with other processors, instead of the one
+// each processor creates from its cache size and prevout source. It applies
+// to the mempool analyzer and the value filter.
+func SetUTXOCache(cache *UTXOCache) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		switch p := pro.(type) {
+		case *MempoolAnalyzer:
+			p.cache = cache
+
+		case *ValueFilter:
+			p.cache = cache
+		}
+	}
+}
+
+// outpoint identifies a transaction output.
+type outpoint struct {
+	hash  [32]byte
+	index uint32
+}
+
+// UTXOCache is a prevout source that remembers the values of outputs of the
+// transactions it is given. When full, the oldest outputs are evicted first.
+// If an output is not in the cache, it asks the fallback source, if any. The
+// cache can be shared by several processors; the fallback source is stopped
+// once all of them have released it.
+type UTXOCache struct {
+	mutex    *sync.Mutex
+	values   map[outpoint]int64
+	order    []outpoint
+	next     int
+	fallback PrevoutSource
+	users    int
+}
+
+// NewUTXOCache creates a new cache holding up to the given number of outputs.
+// If the size is zero, the cache holds 1048576 outputs.
+func NewUTXOCache(size int, fallback PrevoutSource) *UTXOCache {
+	if size < 1 {
+		size = cacheSize
+	}
+
+	cache := &UTXOCache{
+		mutex:    &sync.Mutex{},
+		values:   make(map[outpoint]int64),
+		order:    make([]outpoint, size),
+		fallback: fallback,
+	}
+
+	return cache
+}
+
+// Add remembers the values of all outputs of a transaction.
+func (cache *UTXOCache) Add(tx *records.DetailsRecord) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	hash := tx.Hash()
+	for i, output := range tx.Outputs() {
+		op := outpoint{hash: hash, index: uint32(i)}
+		_, ok := cache.values[op]
+		if ok {
+			continue
+		}
+
+		// evict the oldest output to make room
+		old := cache.order[cache.next]
+		delete(cache.values, old)
+
+		cache.values[op] = output.Value()
+		cache.order[cache.next] = op
+		cache.next = (cache.next + 1) % len(cache.order)
+	}
+}
+
+// Spend removes the outputs spent by a transaction from the cache.
+func (cache *UTXOCache) Spend(tx *records.DetailsRecord) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for _, input := range tx.Inputs() {
+		delete(cache.values, outpoint{hash: input.Hash(), index: input.Index()})
+	}
+}
+
+// retain registers a processor using the cache.
+func (cache *UTXOCache) retain() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.users++
+}
+
+// release unregisters a processor using the cache. When the last one is gone,
+// the fallback source is stopped, if it can be.
+func (cache *UTXOCache) release() {
+	cache.mutex.Lock()
+	cache.users--
+	last := cache.users == 0
+	cache.mutex.Unlock()
+
+	if !last {
+		return
+	}
+
+	stopper, ok := cache.fallback.(interface {
+		Stop()
+	})
+	if ok {
+		stopper.Stop()
+	}
+}
+
+// Value returns the value of an output from the cache or the fallback.
+func (cache *UTXOCache) Value(hash [32]byte, index uint32,
+	deadline time.Time) (int64, bool) {
+	cache.mutex.Lock()
+	value, ok := cache.values[outpoint{hash: hash, index: index}]
+	cache.mutex.Unlock()
+
+	if ok || cache.fallback == nil {
+		return value, ok
+	}
+
+	return cache.fallback.Value(hash, index, deadline)
+}
+
+// lookup is the lookup of a transaction by the REST source. The done channel
+// is closed once the output values are known; they are nil if the lookup
+// failed.
+type lookup struct {
+	hash   [32]byte
+	done   chan struct{}
+	values []int64
+}
+
+// RESTSource is a prevout source that looks up transactions using the REST
+// interface of a Bitcoin Core node with a transaction index. Lookups are done
+// by a fixed number of workers, so they never block the caller for longer than
+// its deadline. The results, including misses, are remembered for the most
+// recently requested transactions. Once stopped, new lookups fail right away.
+type RESTSource struct {
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	url     string
+	client  *http.Client
+	mutex   *sync.Mutex
+	lookups map[[32]byte]*lookup
+	order   [][32]byte
+	next    int
+	queue   chan *lookup
+	stopped bool
+}
+
+// NewRESTSource creates a new source for the REST interface at the given URL,
+// for example "http://127.0.0.1:8332", and starts its workers.
+func NewRESTSource(url string) *RESTSource {
+	source := &RESTSource{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		url:     strings.TrimSuffix(url, "/"),
+		client:  &http.Client{Timeout: 5 * time.Second},
+		mutex:   &sync.Mutex{},
+		lookups: make(map[[32]byte]*lookup),
+		order:   make([][32]byte, restCache),
+		queue:   make(chan *lookup, restQueue),
+	}
+
+	source.wg.Add(restWorkers)
+	for i := 0; i < restWorkers; i++ {
+		go source.goFetch()
+	}
+
+	return source
+}
+
+// Stop cancels the running lookups and waits for the workers to exit. Lookups
+// that are still queued are never completed.
+func (source *RESTSource) Stop() {
+	source.mutex.Lock()
+	if source.stopped {
+		source.mutex.Unlock()
+		return
+	}
+
+	source.stopped = true
+	close(source.sig)
+	source.mutex.Unlock()
+
+	source.wg.Wait()
+}
+
+// Value returns the value of an output by looking up its transaction. If the
+// lookup is not done yet, it waits until the deadline at most.
+func (source *RESTSource) Value(hash [32]byte, index uint32,
+	deadline time.Time) (int64, bool) {
+	l, ok := source.request(hash)
+	if !ok {
+		return 0, false
+	}
+
+	wait := deadline.Sub(time.Now())
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-l.done:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	select {
+	case <-l.done:
+	default:
+		return 0, false
+	}
+
+	if int(index) >= len(l.values) {
+		return 0, false
+	}
+
+	return l.values[index], true
+}
+
+// request returns the lookup of a transaction, queueing a new one if needed.
+// It returns false if the queue is full or the source is stopped.
+func (source *RESTSource) request(hash [32]byte) (*lookup, bool) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if source.stopped {
+		return nil, false
+	}
+
+	l, ok := source.lookups[hash]
+	if ok {
+		return l, true
+	}
+
+	l = &lookup{hash: hash, done: make(chan struct{})}
+	select {
+	case source.queue <- l:
+
+	default:
+		return nil, false
+	}
+
+	// forget the oldest lookup to make room
+	delete(source.lookups, source.order[source.next])
+	source.lookups[hash] = l
+	source.order[source.next] = hash
+	source.next = (source.next + 1) % len(source.order)
+
+	return l, true
+}
+
+// goFetch works through the queued lookups until the source is stopped.
+func (source *RESTSource) goFetch() {
+	defer source.wg.Done()
+
+	for {
+		select {
+		case <-source.sig:
+			return
+
+		case l := <-source.queue:
+			tx, err := source.fetch(wire.ShaHash(l.hash))
+			if err == nil {
+				l.values = make([]int64, len(tx.TxOut))
+				for i, output := range tx.TxOut {
+					l.values[i] = output.Value
+				}
+			}
+
+			close(l.done)
+		}
+	}
+}
+
+// fetch downloads and decodes a transaction in binary format.
+func (source *RESTSource) fetch(hash wire.ShaHash) (*wire.MsgTx, error) {
+	req, err := http.NewRequest("GET", source.url+"/rest/tx/"+hash.String()+
+		".bin", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// stopping the source aborts the request
+	req.Cancel = source.sig
+
+	resp, err := source.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("prevout: " + resp.Status)
+	}
+
+	tx := &wire.MsgTx{}
+	err = tx.Deserialize(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// inputValue sums up the values of all inputs of a transaction, waiting for
+// the source for the given budget at most. If any of them is unknown, or the
+// transaction is a coinbase, false is returned.
+func inputValue(source PrevoutSource, tx *records.DetailsRecord,
+	budget time.Duration) (int64, bool) {
+	if source == nil {
+		return 0, false
+	}
+
+	for _, input := range tx.Inputs() {
+		if input.Hash() == [32]byte{} {
+			return 0, false
+		}
+	}
+
+	// the first pass doesn't wait, so all lookups are started at once
+	total, ok := sumInputs(source, tx, time.Time{})
+	if ok || budget <= 0 {
+		return total, ok
+	}
+
+	return sumInputs(source, tx, time.Now().Add(budget))
+}
+
+// sumInputs sums up the values of all inputs of a transaction. It asks the
+// source for every input, even after one is unknown, so their lookups run
+// concurrently.
+func sumInputs(source PrevoutSource, tx *records.DetailsRecord,
+	deadline time.Time) (int64, bool) {
+	total := int64(0)
+	known := true
+	for _, input := range tx.Inputs() {
+		value, ok := source.Value(input.Hash(), input.Index(), deadline)
+		if !ok {
+			known = false
+			continue
+		}
+
+		total += value
+	}
+
+	return total, known
+}
+
+// outputValue sums up the values of all outputs of a transaction.
+func outputValue(tx *records.DetailsRecord) int64 {
+	total := int64(0)
+	for _, output := range tx.Outputs() {
+		total += output.Value()
+	}
+
+	return total
+}
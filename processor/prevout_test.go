@@ -0,0 +1,189 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/records"
+)
+
+// stopSource is a prevout source that knows no outputs and counts its stops.
+type stopSource struct {
+	stops int
+}
+
+func (source *stopSource) Value(hash [32]byte, index uint32,
+	deadline time.Time) (int64, bool) {
+	return 0, false
+}
+
+func (source *stopSource) Stop() {
+	source.stops++
+}
+
+func TestUTXOCache(t *testing.T) {
+	first := records.NewDetailsRecord(testTx(wire.ShaHash{1}, 0, 1000, 2000))
+	second := records.NewDetailsRecord(testTx(first.Hash(), 1, 1500))
+
+	tests := []struct {
+		size  int
+		spend bool
+		hash  [32]byte
+		index uint32
+		value int64
+		ok    bool
+	}{
+		{4, false, first.Hash(), 0, 1000, true},
+		{4, false, first.Hash(), 1, 2000, true},
+		{4, false, first.Hash(), 2, 0, false},
+		{4, false, second.Hash(), 0, 1500, true},
+		{4, true, first.Hash(), 0, 1000, true},
+		{4, true, first.Hash(), 1, 0, false},
+		{2, false, first.Hash(), 0, 0, false},
+		{2, false, first.Hash(), 1, 2000, true},
+		{2, false, second.Hash(), 0, 1500, true},
+	}
+
+	for _, test := range tests {
+		cache := NewUTXOCache(test.size, nil)
+		cache.Add(first)
+		cache.Add(second)
+		if test.spend {
+			cache.Spend(second)
+		}
+
+		value, ok := cache.Value(test.hash, test.index, time.Time{})
+		if value != test.value || ok != test.ok {
+			t.Errorf("size %v, spend %v, output %x:%v: got %v %v, want %v %v",
+				test.size, test.spend, test.hash[:4], test.index, value, ok,
+				test.value, test.ok)
+		}
+	}
+}
+
+func TestUTXOCacheRelease(t *testing.T) {
+	source := &stopSource{}
+	cache := NewUTXOCache(0, source)
+	if len(cache.order) != cacheSize {
+		t.Errorf("default size %v, want %v", len(cache.order), cacheSize)
+	}
+
+	cache.retain()
+	cache.retain()
+
+	cache.release()
+	if source.stops != 0 {
+		t.Errorf("source stopped while the cache is still used")
+	}
+
+	cache.release()
+	if source.stops != 1 {
+		t.Errorf("source stopped %v times, want 1", source.stops)
+	}
+}
+
+func TestRESTSource(t *testing.T) {
+	tx := testTx(wire.ShaHash{1}, 0, 1000, 2000)
+	buf := &bytes.Buffer{}
+	err := tx.Serialize(buf)
+	if err != nil {
+		t.Fatalf("could not serialize transaction (%v)", err)
+	}
+
+	hash := tx.TxSha()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/rest/tx/"+hash.String()+".bin" {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Write(buf.Bytes())
+		}))
+	defer server.Close()
+
+	source := NewRESTSource(server.URL + "/")
+	deadline := time.Now().Add(5 * time.Second)
+
+	tests := []struct {
+		hash  [32]byte
+		index uint32
+		value int64
+		ok    bool
+	}{
+		{hash, 0, 1000, true},
+		{hash, 1, 2000, true},
+		{hash, 2, 0, false},
+		{[32]byte{2}, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		value, ok := source.Value(test.hash, test.index, deadline)
+		if value != test.value || ok != test.ok {
+			t.Errorf("output %x:%v: got %v %v, want %v %v", test.hash[:4],
+				test.index, value, ok, test.value, test.ok)
+		}
+	}
+
+	source.Stop()
+	source.Stop()
+
+	_, ok := source.Value([32]byte{3}, 0, deadline)
+	if ok {
+		t.Errorf("stopped source returned a value")
+	}
+}
+
+func TestRESTSourceStop(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+	defer server.Close()
+	defer close(release)
+
+	source := NewRESTSource(server.URL)
+	_, ok := source.Value([32]byte{1}, 0, time.Now().Add(50*time.Millisecond))
+	if ok {
+		t.Errorf("unanswered lookup returned a value")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		source.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+
+	case <-time.After(time.Second):
+		t.Fatalf("stop did not abort the running lookup")
+	}
+}
@@ -22,8 +22,10 @@ package processor
 
 import (
 	"errors"
+	"reflect"
 
 	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
 )
 
 type ProcessorType int
@@ -35,6 +37,22 @@ const (
 	FileWriterType
 	RedisWriterType
 	ZeroMQWriterType
+	GeoEnricherType
+	GeoFilterType
+	ChainAnalyzerType
+	PropagationAnalyzerType
+	FingerprintAnalyzerType
+	MempoolAnalyzerType
+	WatchlistAnalyzerType
+	ScriptFilterType
+	ValueFilterType
+	ExpressionFilterType
+	DedupFilterType
+	SampleFilterType
+	StatsAnalyzerType
+	RouterType
+	CaptureWriterType
+	PcapWriterType
 )
 
 func ParseType(processor string) (ProcessorType, error) {
@@ -57,6 +75,54 @@ func ParseType(processor string) (ProcessorType, error) {
 	case "ZEROMQ_WRITER":
 		return ZeroMQWriterType, nil
 
+	case "GEO_ENRICHER":
+		return GeoEnricherType, nil
+
+	case "GEO_FILTER":
+		return GeoFilterType, nil
+
+	case "CHAIN_ANALYZER":
+		return ChainAnalyzerType, nil
+
+	case "PROPAGATION_ANALYZER":
+		return PropagationAnalyzerType, nil
+
+	case "FINGERPRINT_ANALYZER":
+		return FingerprintAnalyzerType, nil
+
+	case "MEMPOOL_ANALYZER":
+		return MempoolAnalyzerType, nil
+
+	case "WATCHLIST_ANALYZER":
+		return WatchlistAnalyzerType, nil
+
+	case "SCRIPT_FILTER":
+		return ScriptFilterType, nil
+
+	case "VALUE_FILTER":
+		return ValueFilterType, nil
+
+	case "EXPRESSION_FILTER":
+		return ExpressionFilterType, nil
+
+	case "DEDUP_FILTER":
+		return DedupFilterType, nil
+
+	case "SAMPLE_FILTER":
+		return SampleFilterType, nil
+
+	case "STATS_ANALYZER":
+		return StatsAnalyzerType, nil
+
+	case "ROUTER":
+		return RouterType, nil
+
+	case "CAPTURE_WRITER":
+		return CaptureWriterType, nil
+
+	case "PCAP_WRITER":
+		return PcapWriterType, nil
+
 	default:
 		return -1, errors.New("invalid processor string")
 	}
@@ -79,3 +145,37 @@ func (pro *Processor) SetLog(log adaptor.Log) {
 func (pro *Processor) AddNext(next adaptor.Processor) {
 	pro.next = append(pro.next, next)
 }
+
+// directed is implemented by records that know whether their message was
+// received or sent.
+type directed interface {
+	Direction() string
+}
+
+// sent returns whether a record describes a message that we sent. Analyzers
+// ignore these records, as they only describe our own behaviour.
+func sent(record adaptor.Record) bool {
+	d, ok := record.(directed)
+
+	return ok && d.Direction() == records.DirectionOut
+}
+
+// clone returns a shallow copy of a record. Peers and processors hand the same
+// record to all of their followers, which read it concurrently, so we annotate
+// a copy instead of changing the shared record.
+func clone(record adaptor.Record) adaptor.Record {
+	value := reflect.ValueOf(record)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return record
+	}
+
+	copied := reflect.New(value.Elem().Type())
+	copied.Elem().Set(value.Elem())
+
+	c, ok := copied.Interface().(adaptor.Record)
+	if !ok {
+		return record
+	}
+
+	return c
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
+)
+
+// nullLog discards all log messages.
+type nullLog struct{}
+
+func (log nullLog) Debug(format string, args ...interface{})    {}
+func (log nullLog) Info(format string, args ...interface{})     {}
+func (log nullLog) Notice(format string, args ...interface{})   {}
+func (log nullLog) Warning(format string, args ...interface{})  {}
+func (log nullLog) Error(format string, args ...interface{})    {}
+func (log nullLog) Critical(format string, args ...interface{}) {}
+
+// peerRecord is a record with a command and the addresses of a connection.
+type peerRecord struct {
+	cmd string
+	ra  *net.TCPAddr
+	la  *net.TCPAddr
+}
+
+func (r *peerRecord) Timestamp() time.Time        { return time.Time{} }
+func (r *peerRecord) RemoteAddress() *net.TCPAddr { return r.ra }
+func (r *peerRecord) LocalAddress() *net.TCPAddr  { return r.la }
+func (r *peerRecord) Command() string             { return r.cmd }
+func (r *peerRecord) String() string              { return r.cmd }
+
+// directedRecord is a record with a direction.
+type directedRecord struct {
+	peerRecord
+
+	dir string
+}
+
+func (r *directedRecord) Direction() string { return r.dir }
+
+// tcpAddr parses an address with a port, or returns nil for an empty string.
+func tcpAddr(t *testing.T, s string) *net.TCPAddr {
+	if s == "" {
+		return nil
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		t.Fatalf("invalid address %v (%v)", s, err)
+	}
+
+	return addr
+}
+
+// testTx returns a transaction spending the given output with one output for
+// each of the given values.
+func testTx(prev wire.ShaHash, index uint32, values ...int64) *wire.MsgTx {
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prev, index), []byte{0x51}))
+	for _, value := range values {
+		tx.AddTxOut(wire.NewTxOut(value, []byte{0x51}))
+	}
+
+	return tx
+}
+
+// collector is a processor that keeps the records forwarded to it.
+type collector struct {
+	Processor
+
+	records chan adaptor.Record
+}
+
+func newCollector() *collector {
+	return &collector{records: make(chan adaptor.Record, 64)}
+}
+
+func (c *collector) Start() {}
+func (c *collector) Stop()  {}
+
+func (c *collector) Process(record adaptor.Record) {
+	c.records <- record
+}
+
+// receive waits for the next forwarded record.
+func (c *collector) receive(t *testing.T) adaptor.Record {
+	select {
+	case record := <-c.records:
+		return record
+
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no record forwarded")
+		return nil
+	}
+}
+
+// expect waits for records with the given commands, in order, and checks that
+// nothing else was forwarded.
+func (c *collector) expect(t *testing.T, cmds ...string) []adaptor.Record {
+	received := make([]adaptor.Record, 0, len(cmds))
+	for _, cmd := range cmds {
+		record := c.receive(t)
+		if record.Command() != cmd {
+			t.Errorf("forwarded %v, want %v", record.Command(), cmd)
+		}
+
+		received = append(received, record)
+	}
+
+	if len(c.records) > 0 {
+		t.Errorf("forwarded %v more records", len(c.records))
+	}
+
+	return received
+}
+
+func TestSent(t *testing.T) {
+	tests := []struct {
+		record adaptor.Record
+		sent   bool
+	}{
+		{&peerRecord{cmd: "tx"}, false},
+		{&directedRecord{dir: ""}, false},
+		{&directedRecord{dir: records.DirectionIn}, false},
+		{&directedRecord{dir: records.DirectionOut}, true},
+	}
+
+	for i, test := range tests {
+		if sent(test.record) != test.sent {
+			t.Errorf("record %v: sent is %v, want %v", i, !test.sent,
+				test.sent)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	original := &directedRecord{
+		peerRecord: peerRecord{cmd: "tx"},
+		dir:        records.DirectionIn,
+	}
+
+	copied, ok := clone(original).(*directedRecord)
+	if !ok || copied == original {
+		t.Fatalf("clone returned %v", copied)
+	}
+
+	copied.dir = records.DirectionOut
+	if original.dir != records.DirectionIn || copied.cmd != "tx" {
+		t.Errorf("copy shares fields with the original")
+	}
+
+	var missing *directedRecord
+	if clone(missing) != adaptor.Record(missing) {
+		t.Errorf("clone of nil record is not nil")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+)
+
+// routeDefault is the name under which the default route is counted.
+const routeDefault = "default"
+
+// Router is a processor that dispatches each record to exactly one branch,
+// based on its command. Records with a command that has no route are sent to
+// the default route, which consists of the processors added with AddNext; if
+// there are none, they are dropped. The number of records sent down each
+// route is logged at a regular interval.
+type Router struct {
+	Processor
+
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	recordQ chan adaptor.Record
+	ticker  *time.Ticker
+	routes  map[string][]adaptor.Processor
+	mutex   *sync.Mutex
+	counts  map[string]int
+	rate    time.Duration
+}
+
+// NewRouter creates a new router without any routes.
+func NewRouter(options ...func(adaptor.Processor)) (*Router, error) {
+	router := &Router{
+		wg:      &sync.WaitGroup{},
+		sig:     make(chan struct{}),
+		recordQ: make(chan adaptor.Record, 1),
+		routes:  make(map[string][]adaptor.Processor),
+		mutex:   &sync.Mutex{},
+		counts:  make(map[string]int),
+		rate:    time.Minute,
+	}
+
+	for _, option := range options {
+		option(router)
+	}
+
+	return router, nil
+}
+
+// SetRouteReport sets the interval at which the route counters are logged.
+func SetRouteReport(rate time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		router, ok := pro.(*Router)
+		if !ok {
+			return
+		}
+
+		router.rate = rate
+	}
+}
+
+// AddRoute adds a processor to the route for the given command. Several
+// processors can be added to the same route. It has to be called before the
+// router is started.
+func (router *Router) AddRoute(cmd string, next adaptor.Processor) {
+	cmd = strings.ToLower(cmd)
+	router.routes[cmd] = append(router.routes[cmd], next)
+}
+
+// Counts returns the number of records sent down each route so far, keyed by
+// command; records on the default route are counted under "default".
+func (router *Router) Counts() map[string]int {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	counts := make(map[string]int, len(router.counts))
+	for route, count := range router.counts {
+		counts[route] = count
+	}
+
+	return counts
+}
+
+func (router *Router) Start() {
+	router.log.Info("[PRC] Start: begin")
+
+	router.ticker = time.NewTicker(router.rate)
+
+	router.wg.Add(1)
+	go router.goProcess()
+
+	router.log.Info("[PRC] Start: completed")
+}
+
+func (router *Router) Stop() {
+	router.log.Info("[PRC] Stop: begin")
+
+	close(router.sig)
+	router.wg.Wait()
+
+	router.ticker.Stop()
+
+	router.report()
+
+	router.log.Info("[PRC] Stop: completed")
+}
+
+// Process adds one record to the queue for dispatching.
+func (router *Router) Process(record adaptor.Record) {
+	router.log.Debug("[PRC] Process: %v", record.Command())
+
+	router.recordQ <- record
+}
+
+// goProcess has to be launched as a go routine.
+func (router *Router) goProcess() {
+	defer router.wg.Done()
+
+ProcessLoop:
+	for {
+		select {
+		case _, ok := <-router.sig:
+			if !ok {
+				break ProcessLoop
+			}
+
+		case <-router.ticker.C:
+			router.report()
+
+		case record := <-router.recordQ:
+			router.dispatch(record)
+		}
+	}
+}
+
+// dispatch sends the record down the route for its command, or down the
+// default route if there is none.
+func (router *Router) dispatch(record adaptor.Record) {
+	route := record.Command()
+	next, ok := router.routes[route]
+	if !ok {
+		route = routeDefault
+		next = router.next
+	}
+
+	router.mutex.Lock()
+	router.counts[route]++
+	router.mutex.Unlock()
+
+	for _, processor := range next {
+		processor.Process(record)
+	}
+}
+
+// report logs the route counters.
+func (router *Router) report() {
+	counts := router.Counts()
+
+	routes := make([]string, 0, len(counts))
+	for route := range counts {
+		routes = append(routes, route)
+	}
+
+	sort.Strings(routes)
+
+	for _, route := range routes {
+		router.log.Info("[PRC] Route %v: %v records", route, counts[route])
+	}
+}
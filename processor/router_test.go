@@ -0,0 +1,93 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback bool
+		cmds     []string
+		routed   map[string][]string
+		counts   map[string]int
+	}{
+		{"routes only", false, []string{"tx", "block", "ping", "tx"},
+			map[string][]string{
+				"transactions": {"tx", "tx"},
+				"blocks":       {"block"},
+				"archive":      {"block"},
+			},
+			map[string]int{"tx": 2, "block": 1, "default": 1}},
+		{"default route", true, []string{"ping", "tx", "inv"},
+			map[string][]string{
+				"transactions": {"tx"},
+				"default":      {"ping", "inv"},
+			},
+			map[string]int{"tx": 1, "ping": 0, "default": 2}},
+	}
+
+	for _, test := range tests {
+		outs := map[string]*collector{
+			"transactions": newCollector(),
+			"blocks":       newCollector(),
+			"archive":      newCollector(),
+			"default":      newCollector(),
+		}
+
+		router, _ := NewRouter()
+		router.SetLog(nullLog{})
+		router.AddRoute("TX", outs["transactions"])
+		router.AddRoute("block", outs["blocks"])
+		router.AddRoute("block", outs["archive"])
+		if test.fallback {
+			router.AddNext(outs["default"])
+		}
+
+		// once the marker went through, all records before it were routed
+		marker := newCollector()
+		router.AddRoute("marker", marker)
+
+		router.Start()
+		for _, cmd := range test.cmds {
+			router.Process(&peerRecord{cmd: cmd})
+		}
+
+		router.Process(&peerRecord{cmd: "marker"})
+		marker.receive(t)
+
+		for name, out := range outs {
+			out.expect(t, test.routed[name]...)
+		}
+
+		router.Stop()
+
+		counts := router.Counts()
+		for route, count := range test.counts {
+			if counts[route] != count {
+				t.Errorf("%v: route %v has %v records, want %v", test.name,
+					route, counts[route], count)
+			}
+		}
+	}
+}
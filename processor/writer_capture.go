@@ -0,0 +1,294 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/capture"
+)
+
+// wired is implemented by records that can carry their raw message.
+type wired interface {
+	Wire() []byte
+}
+
+// CaptureWriter writes the raw messages attached to records into capture
+// files, together with an index file for each of them. Records without a raw
+// message are ignored. Files are rotated when they reach a size or age limit.
+type CaptureWriter struct {
+	Processor
+
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	recordQ chan adaptor.Record
+	ticker  *time.Ticker
+	file    *os.File
+	index   *os.File
+	buf     *bufio.Writer
+	ibuf    *bufio.Writer
+	writer  *capture.Writer
+
+	path      string
+	prefix    string
+	name      string
+	sizelimit int64
+	agelimit  time.Duration
+}
+
+// NewCaptureWriter creates a new writer for raw messages.
+func NewCaptureWriter(options ...func(adaptor.Processor)) (*CaptureWriter,
+	error) {
+	w := &CaptureWriter{
+		wg:        &sync.WaitGroup{},
+		sig:       make(chan struct{}),
+		recordQ:   make(chan adaptor.Record, 1),
+		path:      "captures/",
+		prefix:    "pbtc-",
+		name:      "2006-01-02T15:04:05Z07:00",
+		sizelimit: 1 << 30,
+		agelimit:  time.Hour,
+	}
+
+	for _, option := range options {
+		option(w)
+	}
+
+	err := os.MkdirAll(w.path, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// SetCapturePath sets the directory the capture files are written to.
+func SetCapturePath(path string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*CaptureWriter)
+		if !ok {
+			return
+		}
+
+		w.path = path
+	}
+}
+
+// SetCapturePrefix sets the prefix of the capture file names.
+func SetCapturePrefix(prefix string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*CaptureWriter)
+		if !ok {
+			return
+		}
+
+		w.prefix = prefix
+	}
+}
+
+// SetCaptureName sets the name of the capture files, in Go timestamp format.
+func SetCaptureName(name string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*CaptureWriter)
+		if !ok {
+			return
+		}
+
+		w.name = name
+	}
+}
+
+// SetCaptureSizelimit sets the size upon which the capture files rotate. Zero
+// disables rotation on size.
+func SetCaptureSizelimit(sizelimit int64) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*CaptureWriter)
+		if !ok {
+			return
+		}
+
+		w.sizelimit = sizelimit
+	}
+}
+
+// SetCaptureAgelimit sets the age upon which the capture files rotate. Zero
+// disables rotation on age.
+func SetCaptureAgelimit(agelimit time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*CaptureWriter)
+		if !ok {
+			return
+		}
+
+		w.agelimit = agelimit
+	}
+}
+
+func (w *CaptureWriter) Start() {
+	w.log.Info("[PWC] Start: begin")
+
+	w.rotate()
+
+	if w.agelimit != 0 {
+		w.ticker = time.NewTicker(w.agelimit)
+	}
+
+	w.wg.Add(1)
+	go w.goProcess()
+
+	w.log.Info("[PWC] Start: completed")
+}
+
+func (w *CaptureWriter) Stop() {
+	w.log.Info("[PWC] Stop: begin")
+
+	close(w.sig)
+	w.wg.Wait()
+
+	if w.ticker != nil {
+		w.ticker.Stop()
+	}
+
+	w.log.Info("[PWC] Stop: completed")
+}
+
+func (w *CaptureWriter) Process(record adaptor.Record) {
+	w.log.Debug("[PWC] Process: %v", record.Command())
+
+	w.recordQ <- record
+}
+
+func (w *CaptureWriter) goProcess() {
+	defer w.wg.Done()
+
+	var tick <-chan time.Time
+	if w.ticker != nil {
+		tick = w.ticker.C
+	}
+
+WriteLoop:
+	for {
+		select {
+		case _, ok := <-w.sig:
+			if !ok {
+				break WriteLoop
+			}
+
+		case <-tick:
+			w.rotate()
+
+		case record := <-w.recordQ:
+			w.write(record)
+		}
+	}
+
+	w.close()
+}
+
+// write appends the raw message of a record to the capture file.
+func (w *CaptureWriter) write(record adaptor.Record) {
+	r, ok := record.(wired)
+	if !ok || r.Wire() == nil || w.writer == nil {
+		return
+	}
+
+	entry := &capture.Entry{
+		Stamp:    record.Timestamp(),
+		Remote:   record.RemoteAddress(),
+		Local:    record.LocalAddress(),
+		Outbound: sent(record),
+		Raw:      r.Wire(),
+	}
+
+	err := w.writer.Write(entry)
+	if err != nil {
+		w.log.Error("[PWC] Could not write capture file (%v)", err)
+		return
+	}
+
+	if w.sizelimit != 0 && w.writer.Offset() >= w.sizelimit {
+		w.rotate()
+	}
+}
+
+// rotate closes the current files and starts new ones.
+func (w *CaptureWriter) rotate() {
+	w.close()
+
+	stamp := time.Now().Format(w.name)
+	base := w.path + w.prefix + stamp
+
+	file, err := os.Create(base + ".cap")
+	if err != nil {
+		w.log.Error("[PWC] Could not create capture file (%v)", err)
+		return
+	}
+
+	index, err := os.Create(base + ".idx")
+	if err != nil {
+		w.log.Error("[PWC] Could not create index file (%v)", err)
+		file.Close()
+		return
+	}
+
+	buf := bufio.NewWriter(file)
+	ibuf := bufio.NewWriter(index)
+
+	writer, err := capture.NewWriter(buf, ibuf)
+	if err != nil {
+		w.log.Error("[PWC] Could not write capture header (%v)", err)
+		file.Close()
+		index.Close()
+		return
+	}
+
+	w.file = file
+	w.index = index
+	w.buf = buf
+	w.ibuf = ibuf
+	w.writer = writer
+}
+
+// close flushes and closes the current files.
+func (w *CaptureWriter) close() {
+	if w.writer == nil {
+		return
+	}
+
+	err := w.buf.Flush()
+	if err != nil {
+		w.log.Warning("[PWC] Could not flush capture file (%v)", err)
+	}
+
+	err = w.ibuf.Flush()
+	if err != nil {
+		w.log.Warning("[PWC] Could not flush index file (%v)", err)
+	}
+
+	w.file.Close()
+	w.index.Close()
+
+	w.writer = nil
+}
@@ -0,0 +1,361 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"bufio"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/pcap"
+)
+
+// segmentSize is the maximum payload of the TCP segments we synthesize.
+const segmentSize = 1460
+
+// connectionExpiry is the time after which we forget an idle connection.
+const connectionExpiry = time.Hour
+
+// pcapConnection holds the sequence numbers of a synthesized connection.
+type pcapConnection struct {
+	localSeq  uint32
+	remoteSeq uint32
+	seen      time.Time
+}
+
+// PcapWriter writes the raw messages attached to records into pcap files, as
+// TCP segments between the real remote and local addresses, in the direction
+// the message travelled. The first message
+// of a connection is preceded by a synthesized handshake. Records without a
+// raw message are ignored. Files are rotated when they reach a size or age
+// limit.
+type PcapWriter struct {
+	Processor
+
+	wg      *sync.WaitGroup
+	sig     chan struct{}
+	recordQ chan adaptor.Record
+	ticker  *time.Ticker
+	file    *os.File
+	buf     *bufio.Writer
+	writer  *pcap.Writer
+	size    int64
+	conns   map[string]*pcapConnection
+
+	path      string
+	prefix    string
+	name      string
+	sizelimit int64
+	agelimit  time.Duration
+}
+
+// NewPcapWriter creates a new writer for pcap files.
+func NewPcapWriter(options ...func(adaptor.Processor)) (*PcapWriter, error) {
+	w := &PcapWriter{
+		wg:        &sync.WaitGroup{},
+		sig:       make(chan struct{}),
+		recordQ:   make(chan adaptor.Record, 1),
+		conns:     make(map[string]*pcapConnection),
+		path:      "captures/",
+		prefix:    "pbtc-",
+		name:      "2006-01-02T15:04:05Z07:00",
+		sizelimit: 1 << 30,
+		agelimit:  time.Hour,
+	}
+
+	for _, option := range options {
+		option(w)
+	}
+
+	err := os.MkdirAll(w.path, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// SetPcapPath sets the directory the pcap files are written to.
+func SetPcapPath(path string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*PcapWriter)
+		if !ok {
+			return
+		}
+
+		w.path = path
+	}
+}
+
+// SetPcapPrefix sets the prefix of the pcap file names.
+func SetPcapPrefix(prefix string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*PcapWriter)
+		if !ok {
+			return
+		}
+
+		w.prefix = prefix
+	}
+}
+
+// SetPcapName sets the name of the pcap files, in Go timestamp format.
+func SetPcapName(name string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*PcapWriter)
+		if !ok {
+			return
+		}
+
+		w.name = name
+	}
+}
+
+// SetPcapSizelimit sets the size upon which the pcap files rotate. Zero
+// disables rotation on size.
+func SetPcapSizelimit(sizelimit int64) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*PcapWriter)
+		if !ok {
+			return
+		}
+
+		w.sizelimit = sizelimit
+	}
+}
+
+// SetPcapAgelimit sets the age upon which the pcap files rotate. Zero
+// disables rotation on age.
+func SetPcapAgelimit(agelimit time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*PcapWriter)
+		if !ok {
+			return
+		}
+
+		w.agelimit = agelimit
+	}
+}
+
+func (w *PcapWriter) Start() {
+	w.log.Info("[PWP] Start: begin")
+
+	w.rotate()
+
+	if w.agelimit != 0 {
+		w.ticker = time.NewTicker(w.agelimit)
+	}
+
+	w.wg.Add(1)
+	go w.goProcess()
+
+	w.log.Info("[PWP] Start: completed")
+}
+
+func (w *PcapWriter) Stop() {
+	w.log.Info("[PWP] Stop: begin")
+
+	close(w.sig)
+	w.wg.Wait()
+
+	if w.ticker != nil {
+		w.ticker.Stop()
+	}
+
+	w.log.Info("[PWP] Stop: completed")
+}
+
+func (w *PcapWriter) Process(record adaptor.Record) {
+	w.log.Debug("[PWP] Process: %v", record.Command())
+
+	w.recordQ <- record
+}
+
+func (w *PcapWriter) goProcess() {
+	defer w.wg.Done()
+
+	var tick <-chan time.Time
+	if w.ticker != nil {
+		tick = w.ticker.C
+	}
+
+WriteLoop:
+	for {
+		select {
+		case _, ok := <-w.sig:
+			if !ok {
+				break WriteLoop
+			}
+
+		case <-tick:
+			w.rotate()
+
+		case record := <-w.recordQ:
+			w.write(record)
+		}
+	}
+
+	w.close()
+}
+
+// write synthesizes the segments carrying the raw message of a record from
+// the remote to the local address, or the other way around for messages we
+// sent.
+func (w *PcapWriter) write(record adaptor.Record) {
+	r, ok := record.(wired)
+	if !ok || r.Wire() == nil || w.writer == nil {
+		return
+	}
+
+	ra := record.RemoteAddress()
+	la := record.LocalAddress()
+	if ra == nil || la == nil {
+		return
+	}
+
+	stamp := record.Timestamp()
+	conn := w.connection(ra, la, stamp)
+	conn.seen = stamp
+
+	raw := r.Wire()
+	for len(raw) > 0 {
+		n := len(raw)
+		if n > segmentSize {
+			n = segmentSize
+		}
+
+		if sent(record) {
+			w.packet(stamp, &pcap.Segment{Src: la, Dst: ra, Seq: conn.localSeq,
+				Ack: conn.remoteSeq, Flags: pcap.FlagPSH | pcap.FlagACK,
+				Payload: raw[:n]})
+			conn.localSeq += uint32(n)
+		} else {
+			w.packet(stamp, &pcap.Segment{Src: ra, Dst: la, Seq: conn.remoteSeq,
+				Ack: conn.localSeq, Flags: pcap.FlagPSH | pcap.FlagACK,
+				Payload: raw[:n]})
+			conn.remoteSeq += uint32(n)
+		}
+
+		raw = raw[n:]
+	}
+
+	if w.sizelimit != 0 && w.size >= w.sizelimit {
+		w.rotate()
+	}
+}
+
+// connection returns the state of the connection between two addresses. For
+// a new connection, it writes a handshake initiated by the local address.
+func (w *PcapWriter) connection(ra *net.TCPAddr, la *net.TCPAddr,
+	stamp time.Time) *pcapConnection {
+	key := ra.String() + "|" + la.String()
+	conn, ok := w.conns[key]
+	if ok {
+		return conn
+	}
+
+	conn = &pcapConnection{
+		localSeq:  rand.Uint32(),
+		remoteSeq: rand.Uint32(),
+	}
+	w.conns[key] = conn
+
+	w.packet(stamp, &pcap.Segment{Src: la, Dst: ra, Seq: conn.localSeq,
+		Flags: pcap.FlagSYN})
+	conn.localSeq++
+
+	w.packet(stamp, &pcap.Segment{Src: ra, Dst: la, Seq: conn.remoteSeq,
+		Ack: conn.localSeq, Flags: pcap.FlagSYN | pcap.FlagACK})
+	conn.remoteSeq++
+
+	w.packet(stamp, &pcap.Segment{Src: la, Dst: ra, Seq: conn.localSeq,
+		Ack: conn.remoteSeq, Flags: pcap.FlagACK})
+
+	return conn
+}
+
+// packet writes one segment to the pcap file.
+func (w *PcapWriter) packet(stamp time.Time, seg *pcap.Segment) {
+	data := seg.Marshal()
+
+	err := w.writer.WritePacket(stamp, data)
+	if err != nil {
+		w.log.Error("[PWP] Could not write pcap file (%v)", err)
+		return
+	}
+
+	w.size += int64(16 + len(data))
+}
+
+// rotate closes the current file, starts a new one and forgets idle
+// connections. Connections we still know continue in the new file without
+// a new handshake.
+func (w *PcapWriter) rotate() {
+	w.close()
+
+	now := time.Now()
+	for key, conn := range w.conns {
+		if now.Sub(conn.seen) > connectionExpiry {
+			delete(w.conns, key)
+		}
+	}
+
+	stamp := now.Format(w.name)
+	file, err := os.Create(w.path + w.prefix + stamp + ".pcap")
+	if err != nil {
+		w.log.Error("[PWP] Could not create pcap file (%v)", err)
+		return
+	}
+
+	buf := bufio.NewWriter(file)
+
+	writer, err := pcap.NewWriter(buf)
+	if err != nil {
+		w.log.Error("[PWP] Could not write pcap header (%v)", err)
+		file.Close()
+		return
+	}
+
+	w.file = file
+	w.buf = buf
+	w.writer = writer
+	w.size = 24
+}
+
+// close flushes and closes the current file.
+func (w *PcapWriter) close() {
+	if w.writer == nil {
+		return
+	}
+
+	err := w.buf.Flush()
+	if err != nil {
+		w.log.Warning("[PWP] Could not flush pcap file (%v)", err)
+	}
+
+	w.file.Close()
+
+	w.writer = nil
+}
@@ -21,44 +21,104 @@
 package processor
 
 import (
+	"errors"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/btcsuite/btcd/wire"
 	redis "gopkg.in/redis.v3"
 
 	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
 )
 
+const (
+	RedisPublish = "publish"
+	RedisList    = "list"
+	RedisStream  = "stream"
+	RedisStore   = "store"
+)
+
+// maxBackoff is the longest time we wait between attempts to reconnect.
+const maxBackoff = time.Minute
+
+// RedisWriter writes records to a redis server. Each record can be published
+// to a channel, pushed to a capped list, added to a capped stream and, for
+// transactions and blocks, stored under its hash with an expiry. Channel and
+// key names are templates, where {command} is replaced by the record command
+// and {hash} by the transaction or block hash. Commands are pipelined in
+// batches; if the connection is lost, records are dropped until we manage to
+// reconnect.
 type RedisWriter struct {
 	Processor
 
-	lineQ  chan string
-	wg     *sync.WaitGroup
-	sig    chan struct{}
-	client *redis.Client
-	host   string
-	pw     string
-	db     int64
+	recordQ   chan adaptor.Record
+	wg        *sync.WaitGroup
+	sig       chan struct{}
+	ticker    *time.Ticker
+	client    *redis.Client
+	host      string
+	pw        string
+	db        int64
+	targets   map[string]bool
+	channel   string
+	list      string
+	listMax   int64
+	stream    string
+	streamMax int64
+	store     string
+	ttl       time.Duration
+	batch     int
+	flush     time.Duration
+	pending   []adaptor.Record
+	down      bool
+	backoff   time.Duration
+	retry     time.Time
+	dropped   int
 }
 
 func NewRedisWriter(options ...func(adaptor.Processor)) (*RedisWriter, error) {
 	w := &RedisWriter{
-		lineQ: make(chan string, 1),
-		sig:   make(chan struct{}),
-		wg:    &sync.WaitGroup{},
-		host:  "127.0.0.1:23456",
-		pw:    "",
-		db:    0,
+		recordQ:   make(chan adaptor.Record, 1),
+		sig:       make(chan struct{}),
+		wg:        &sync.WaitGroup{},
+		host:      "127.0.0.1:23456",
+		pw:        "",
+		db:        0,
+		targets:   make(map[string]bool),
+		channel:   "pbtc:{command}",
+		list:      "pbtc:list:{command}",
+		listMax:   1000,
+		stream:    "pbtc:stream:{command}",
+		streamMax: 10000,
+		store:     "pbtc:{command}:{hash}",
+		ttl:       time.Hour,
+		batch:     100,
+		flush:     100 * time.Millisecond,
+		backoff:   time.Second,
 	}
 
 	for _, option := range options {
 		option(w)
 	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr:     w.host,
-		Password: w.pw,
-		DB:       w.db,
-	})
+	if len(w.targets) == 0 {
+		w.targets[RedisPublish] = true
+	}
+
+	for target := range w.targets {
+		switch target {
+		case RedisPublish, RedisList, RedisStream, RedisStore:
+
+		default:
+			return nil, errors.New("invalid redis target: " + target)
+		}
+	}
+
+	w.pending = make([]adaptor.Record, 0, w.batch)
+
+	client := w.connect()
 
 	err := client.Ping().Err()
 	if err != nil {
@@ -103,9 +163,139 @@ func SetRedisDatabase(db int64) func(adaptor.Processor) {
 	}
 }
 
+// SetRedisTargets sets how records are written: publish, list, stream and
+// store. By default, records are only published.
+func SetRedisTargets(targets ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		for _, target := range targets {
+			w.targets[strings.ToLower(target)] = true
+		}
+	}
+}
+
+// SetRedisChannel sets the template for the channel records are published to.
+func SetRedisChannel(channel string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.channel = channel
+	}
+}
+
+// SetRedisList sets the template for the key of the lists records are pushed
+// to.
+func SetRedisList(list string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.list = list
+	}
+}
+
+// SetRedisListLimit sets the number of records the lists are trimmed to.
+func SetRedisListLimit(max int64) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.listMax = max
+	}
+}
+
+// SetRedisStream sets the template for the key of the streams records are
+// added to.
+func SetRedisStream(stream string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.stream = stream
+	}
+}
+
+// SetRedisStreamLimit sets the approximate maximum length of the streams.
+func SetRedisStreamLimit(max int64) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.streamMax = max
+	}
+}
+
+// SetRedisStore sets the template for the key transactions and blocks are
+// stored under.
+func SetRedisStore(store string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.store = store
+	}
+}
+
+// SetRedisExpiry sets the time after which stored transactions and blocks
+// expire.
+func SetRedisExpiry(ttl time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.ttl = ttl
+	}
+}
+
+// SetRedisBatch sets the maximum number of records sent in one pipeline.
+func SetRedisBatch(batch int) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.batch = batch
+	}
+}
+
+// SetRedisFlush sets the maximum time a record waits before the pipeline is
+// sent.
+func SetRedisFlush(flush time.Duration) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*RedisWriter)
+		if !ok {
+			return
+		}
+
+		w.flush = flush
+	}
+}
+
 func (w *RedisWriter) Start() {
 	w.log.Info("[PWR] Start: begin")
 
+	w.ticker = time.NewTicker(w.flush)
+
 	w.wg.Add(1)
 	go w.goProcess()
 
@@ -118,13 +308,16 @@ func (w *RedisWriter) Stop() {
 	close(w.sig)
 	w.wg.Wait()
 
+	w.ticker.Stop()
+	w.client.Close()
+
 	w.log.Info("[PWR] Stop: completed")
 }
 
 func (w *RedisWriter) Process(record adaptor.Record) {
 	w.log.Debug("[PWR] Process: %v", record.Command())
 
-	w.lineQ <- record.String()
+	w.recordQ <- record
 }
 
 func (w *RedisWriter) goProcess() {
@@ -138,12 +331,148 @@ LineLoop:
 				break LineLoop
 			}
 
-		case line := <-w.lineQ:
-			err := w.client.Publish("", line).Err()
-			if err != nil {
-				w.log.Error("Could not send line to redis (%v)", err)
-				continue
+		case <-w.ticker.C:
+			w.send()
+
+		case record := <-w.recordQ:
+			w.pending = append(w.pending, record)
+			if len(w.pending) >= w.batch {
+				w.send()
 			}
 		}
 	}
+
+	w.send()
+}
+
+// send writes the pending records to redis in one pipeline. While we are
+// disconnected, the records are dropped.
+func (w *RedisWriter) send() {
+	if len(w.pending) == 0 {
+		return
+	}
+
+	if w.down && !w.reconnect() {
+		w.dropped += len(w.pending)
+		w.pending = w.pending[:0]
+		return
+	}
+
+	pipe := w.client.Pipeline()
+	for _, record := range w.pending {
+		w.queue(pipe, record)
+	}
+
+	_, err := pipe.Exec()
+	pipe.Close()
+
+	w.pending = w.pending[:0]
+
+	if err == nil {
+		return
+	}
+
+	w.log.Error("Could not send records to redis (%v)", err)
+
+	err = w.client.Ping().Err()
+	if err != nil {
+		w.log.Warning("[PWR] Connection lost (%v)", err)
+		w.down = true
+		w.retry = time.Now().Add(w.backoff)
+	}
+}
+
+// queue adds the commands for one record to the pipeline.
+func (w *RedisWriter) queue(pipe *redis.Pipeline, record adaptor.Record) {
+	line := record.String()
+
+	if w.targets[RedisPublish] {
+		// pipelines have no publish method, so the command is built by hand
+		channel := w.expand(w.channel, record, "")
+		pipe.Process(redis.NewIntCmd("PUBLISH", channel, line))
+	}
+
+	if w.targets[RedisList] {
+		key := w.expand(w.list, record, "")
+		pipe.LPush(key, line)
+		pipe.LTrim(key, 0, w.listMax-1)
+	}
+
+	if w.targets[RedisStream] {
+		key := w.expand(w.stream, record, "")
+		cmd := redis.NewStringCmd("XADD", key, "MAXLEN", "~", w.streamMax,
+			"*", "command", record.Command(), "record", line)
+		pipe.Process(cmd)
+	}
+
+	if w.targets[RedisStore] {
+		hash, ok := recordHash(record)
+		if ok {
+			pipe.Set(w.expand(w.store, record, hash), line, w.ttl)
+		}
+	}
+}
+
+// reconnect tries to establish a new connection once the backoff has passed.
+// It returns whether we are connected.
+func (w *RedisWriter) reconnect() bool {
+	if time.Now().Before(w.retry) {
+		return false
+	}
+
+	w.client.Close()
+	w.client = w.connect()
+
+	err := w.client.Ping().Err()
+	if err != nil {
+		w.backoff *= 2
+		if w.backoff > maxBackoff {
+			w.backoff = maxBackoff
+		}
+
+		w.retry = time.Now().Add(w.backoff)
+		return false
+	}
+
+	w.log.Notice("[PWR] Reconnected (%v records dropped)", w.dropped)
+
+	w.down = false
+	w.backoff = time.Second
+	w.dropped = 0
+
+	return true
+}
+
+// connect creates a new client for the configured server.
+func (w *RedisWriter) connect() *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr:     w.host,
+		Password: w.pw,
+		DB:       w.db,
+	})
+
+	return client
+}
+
+// expand fills in the command and hash of a record in a template.
+func (w *RedisWriter) expand(template string, record adaptor.Record,
+	hash string) string {
+	key := strings.Replace(template, "{command}", record.Command(), -1)
+	key = strings.Replace(key, "{hash}", hash, -1)
+
+	return key
+}
+
+// recordHash returns the hash of a transaction or block record.
+func recordHash(record adaptor.Record) (string, bool) {
+	switch r := record.(type) {
+	case *records.TransactionRecord:
+		return wire.ShaHash(r.Details().Hash()).String(), true
+
+	case *records.BlockRecord:
+		return wire.ShaHash(r.Header().Hash()).String(), true
+
+	default:
+		return "", false
+	}
 }
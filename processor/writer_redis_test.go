@@ -0,0 +1,387 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package processor
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineRecord is a record with a fixed command and string representation.
+type lineRecord struct {
+	cmd  string
+	line string
+}
+
+func (r *lineRecord) Timestamp() time.Time        { return time.Time{} }
+func (r *lineRecord) RemoteAddress() *net.TCPAddr { return nil }
+func (r *lineRecord) LocalAddress() *net.TCPAddr  { return nil }
+func (r *lineRecord) Command() string             { return r.cmd }
+func (r *lineRecord) String() string              { return r.line }
+
+// fakeRedis is an in-process server speaking enough of the redis protocol for
+// the redis writer. It remembers the commands it received and on which
+// connection. While failing, it closes all connections.
+type fakeRedis struct {
+	listener *net.TCPListener
+	mutex    *sync.Mutex
+	conns    map[int]net.Conn
+	next     int
+	failing  bool
+	cmds     [][]string
+	connIDs  []int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen (%v)", err)
+	}
+
+	fake := &fakeRedis{
+		listener: listener,
+		mutex:    &sync.Mutex{},
+		conns:    make(map[int]net.Conn),
+	}
+
+	go fake.goAccept()
+
+	return fake
+}
+
+func (fake *fakeRedis) addr() string {
+	return fake.listener.Addr().String()
+}
+
+func (fake *fakeRedis) close() {
+	fake.listener.Close()
+	fake.fail(true)
+}
+
+// fail sets whether the server drops all connections.
+func (fake *fakeRedis) fail(failing bool) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	fake.failing = failing
+	if !failing {
+		return
+	}
+
+	for id, conn := range fake.conns {
+		conn.Close()
+		delete(fake.conns, id)
+	}
+}
+
+// commands returns the commands received so far, skipping pings.
+func (fake *fakeRedis) commands() ([][]string, []int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	cmds := make([][]string, 0, len(fake.cmds))
+	ids := make([]int, 0, len(fake.cmds))
+	for i, cmd := range fake.cmds {
+		if cmd[0] == "PING" {
+			continue
+		}
+
+		cmds = append(cmds, cmd)
+		ids = append(ids, fake.connIDs[i])
+	}
+
+	return cmds, ids
+}
+
+// wait waits until the server received the given number of commands, not
+// counting pings.
+func (fake *fakeRedis) wait(t *testing.T, count int) ([][]string, []int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cmds, ids := fake.commands()
+		if len(cmds) >= count {
+			return cmds, ids
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("received %v commands, want %v: %v", len(cmds), count,
+				cmds)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (fake *fakeRedis) goAccept() {
+	for {
+		conn, err := fake.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		fake.mutex.Lock()
+		if fake.failing {
+			fake.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+
+		id := fake.next
+		fake.next++
+		fake.conns[id] = conn
+		fake.mutex.Unlock()
+
+		go fake.goServe(id, conn)
+	}
+}
+
+func (fake *fakeRedis) goServe(id int, conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		cmd, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		cmd[0] = strings.ToUpper(cmd[0])
+
+		fake.mutex.Lock()
+		_, ok := fake.conns[id]
+		if ok {
+			fake.cmds = append(fake.cmds, cmd)
+			fake.connIDs = append(fake.connIDs, id)
+		}
+		fake.mutex.Unlock()
+
+		if !ok {
+			return
+		}
+
+		_, err = io.WriteString(conn, reply(cmd))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads one command sent as array of bulk strings.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	count, err := readLength(reader, '*')
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := make([]string, count)
+	for i := range cmd {
+		size, err := readLength(reader, '$')
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd[i] = string(buf[:size])
+	}
+
+	if len(cmd) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	return cmd, nil
+}
+
+// readLength reads a line with the given prefix and a length.
+func readLength(reader *bufio.Reader, prefix byte) (int, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) < 2 || line[0] != prefix {
+		return 0, errors.New("invalid line: " + line)
+	}
+
+	return strconv.Atoi(line[1:])
+}
+
+// reply returns the reply to a command.
+func reply(cmd []string) string {
+	switch cmd[0] {
+	case "PING":
+		return "+PONG\r\n"
+
+	case "PUBLISH", "LPUSH":
+		return ":1\r\n"
+
+	case "XADD":
+		return "$3\r\n1-0\r\n"
+
+	default:
+		return "+OK\r\n"
+	}
+}
+
+func checkCommand(t *testing.T, cmd []string, want ...string) {
+	if strings.Join(cmd, " ") != strings.Join(want, " ") {
+		t.Errorf("command is %q, want %q", cmd, want)
+	}
+}
+
+func TestRedisWriterPipeline(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.close()
+
+	w, err := NewRedisWriter(
+		SetRedisHost(fake.addr()),
+		SetRedisTargets(RedisPublish, RedisList, RedisStream),
+		SetRedisListLimit(10),
+		SetRedisStreamLimit(100),
+		SetRedisBatch(2),
+		SetRedisFlush(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("could not create writer (%v)", err)
+	}
+
+	w.SetLog(nullLog{})
+	w.Start()
+
+	w.Process(&lineRecord{cmd: "inv", line: "first"})
+
+	// the first record waits for the batch to be full
+	time.Sleep(50 * time.Millisecond)
+	cmds, _ := fake.commands()
+	if len(cmds) != 0 {
+		t.Errorf("received %v commands before the batch was full", len(cmds))
+	}
+
+	w.Process(&lineRecord{cmd: "tx", line: "second"})
+
+	cmds, ids := fake.wait(t, 8)
+	w.Stop()
+
+	checkCommand(t, cmds[0], "PUBLISH", "pbtc:inv", "first")
+	checkCommand(t, cmds[1], "LPUSH", "pbtc:list:inv", "first")
+	checkCommand(t, cmds[2], "LTRIM", "pbtc:list:inv", "0", "9")
+	checkCommand(t, cmds[3], "XADD", "pbtc:stream:inv", "MAXLEN", "~", "100",
+		"*", "command", "inv", "record", "first")
+	checkCommand(t, cmds[4], "PUBLISH", "pbtc:tx", "second")
+	checkCommand(t, cmds[5], "LPUSH", "pbtc:list:tx", "second")
+	checkCommand(t, cmds[6], "LTRIM", "pbtc:list:tx", "0", "9")
+	checkCommand(t, cmds[7], "XADD", "pbtc:stream:tx", "MAXLEN", "~", "100",
+		"*", "command", "tx", "record", "second")
+
+	// the whole batch is sent as one pipeline on one connection
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("batch sent on connections %v", ids)
+			break
+		}
+	}
+}
+
+func TestRedisWriterFlush(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.close()
+
+	w, err := NewRedisWriter(
+		SetRedisHost(fake.addr()),
+		SetRedisChannel("records"),
+		SetRedisFlush(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("could not create writer (%v)", err)
+	}
+
+	w.SetLog(nullLog{})
+	w.Start()
+
+	w.Process(&lineRecord{cmd: "addr", line: "only"})
+
+	cmds, _ := fake.wait(t, 1)
+	w.Stop()
+
+	checkCommand(t, cmds[0], "PUBLISH", "records", "only")
+}
+
+func TestRedisWriterReconnect(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.close()
+
+	w, err := NewRedisWriter(
+		SetRedisHost(fake.addr()),
+		SetRedisBatch(1),
+		SetRedisFlush(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("could not create writer (%v)", err)
+	}
+
+	w.SetLog(nullLog{})
+	w.backoff = 100 * time.Millisecond
+	w.Start()
+
+	w.Process(&lineRecord{cmd: "tx", line: "before"})
+	fake.wait(t, 1)
+
+	// records sent while the server is down are dropped; the queue holds one
+	// record, so once the third record is accepted, the first one was sent
+	fake.fail(true)
+	w.Process(&lineRecord{cmd: "tx", line: "lost"})
+	w.Process(&lineRecord{cmd: "tx", line: "dropped"})
+	w.Process(&lineRecord{cmd: "tx", line: "early"})
+
+	// we don't try to reconnect before the backoff has passed
+	fake.fail(false)
+	w.Process(&lineRecord{cmd: "tx", line: "waiting"})
+
+	time.Sleep(200 * time.Millisecond)
+	w.Process(&lineRecord{cmd: "tx", line: "after"})
+
+	cmds, _ := fake.wait(t, 2)
+	w.Stop()
+
+	if len(cmds) != 2 {
+		t.Fatalf("received %v commands, want 2: %v", len(cmds), cmds)
+	}
+
+	checkCommand(t, cmds[0], "PUBLISH", "pbtc:tx", "before")
+	checkCommand(t, cmds[1], "PUBLISH", "pbtc:tx", "after")
+
+	if w.down || w.dropped != 0 || w.backoff != time.Second {
+		t.Errorf("writer still down after reconnect (down %v, dropped %v, "+
+			"backoff %v)", w.down, w.dropped, w.backoff)
+	}
+}
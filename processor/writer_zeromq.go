@@ -21,48 +21,109 @@
 package processor
 
 import (
+	"encoding/binary"
+	"errors"
+	"strings"
 	"sync"
 
 	zmq "github.com/pebbe/zmq4"
 
 	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/records"
 )
 
+const (
+	ZeromqRecord    = "record"
+	ZeromqRawTx     = "rawtx"
+	ZeromqRawBlock  = "rawblock"
+	ZeromqHashTx    = "hashtx"
+	ZeromqHashBlock = "hashblock"
+)
+
+const (
+	ZeromqPub  = "pub"
+	ZeromqPush = "push"
+)
+
+// ZeroMQWriter sends records as multipart messages on a ZeroMQ socket. Every
+// message has three frames, following the conventions of bitcoind: the topic,
+// the payload and a little-endian 32-bit sequence number that is counted per
+// topic. Records are sent as strings with the command as topic. Optionally,
+// transactions and blocks are also sent as raw serialized bytes on the rawtx
+// and rawblock topics, and their hashes on the hashtx and hashblock topics.
 type ZeroMQWriter struct {
 	Processor
 
-	addr  string
-	pub   *zmq.Socket
-	lineQ chan string
-	sig   chan struct{}
-	wg    *sync.WaitGroup
+	addr     string
+	kind     string
+	connect  bool
+	formats  map[string]bool
+	sequence map[string]uint32
+	sock     *zmq.Socket
+	recordQ  chan adaptor.Record
+	sig      chan struct{}
+	wg       *sync.WaitGroup
 }
 
 func NewZeroMQWriter(options ...func(adaptor.Processor)) (*ZeroMQWriter, error) {
 	w := &ZeroMQWriter{
-		addr:  "tcp://127.0.0.1:12345",
-		lineQ: make(chan string, 1),
-		sig:   make(chan struct{}),
-		wg:    &sync.WaitGroup{},
+		addr:     "tcp://127.0.0.1:12345",
+		kind:     ZeromqPub,
+		formats:  make(map[string]bool),
+		sequence: make(map[string]uint32),
+		recordQ:  make(chan adaptor.Record, 1),
+		sig:      make(chan struct{}),
+		wg:       &sync.WaitGroup{},
 	}
 
 	for _, option := range options {
 		option(w)
 	}
 
-	pub, err := zmq.NewSocket(zmq.PUB)
+	if len(w.formats) == 0 {
+		w.formats[ZeromqRecord] = true
+	}
+
+	for format := range w.formats {
+		switch format {
+		case ZeromqRecord, ZeromqRawTx, ZeromqRawBlock, ZeromqHashTx,
+			ZeromqHashBlock:
+
+		default:
+			return nil, errors.New("invalid zeromq format: " + format)
+		}
+	}
+
+	var kind zmq.Type
+	switch w.kind {
+	case ZeromqPub:
+		kind = zmq.PUB
+
+	case ZeromqPush:
+		kind = zmq.PUSH
+
+	default:
+		return nil, errors.New("invalid zeromq socket: " + w.kind)
+	}
+
+	sock, err := zmq.NewSocket(kind)
 	if err != nil {
 		return nil, err
 	}
 
 	addr := w.addr
 
-	err = pub.Bind(addr)
+	if w.connect {
+		err = sock.Connect(addr)
+	} else {
+		err = sock.Bind(addr)
+	}
 	if err != nil {
+		sock.Close()
 		return nil, err
 	}
 
-	w.pub = pub
+	w.sock = sock
 
 	return w, nil
 }
@@ -78,6 +139,47 @@ func SetZeromqHost(addr string) func(adaptor.Processor) {
 	}
 }
 
+// SetZeromqSocket sets the socket type, either pub or push. By default, a pub
+// socket is used.
+func SetZeromqSocket(kind string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*ZeroMQWriter)
+		if !ok {
+			return
+		}
+
+		w.kind = strings.ToLower(kind)
+	}
+}
+
+// SetZeromqConnect makes the socket connect to the endpoint instead of binding
+// to it.
+func SetZeromqConnect(connect bool) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*ZeroMQWriter)
+		if !ok {
+			return
+		}
+
+		w.connect = connect
+	}
+}
+
+// SetZeromqFormats sets what is sent: record, rawtx, rawblock, hashtx and
+// hashblock. By default, only records are sent.
+func SetZeromqFormats(formats ...string) func(adaptor.Processor) {
+	return func(pro adaptor.Processor) {
+		w, ok := pro.(*ZeroMQWriter)
+		if !ok {
+			return
+		}
+
+		for _, format := range formats {
+			w.formats[strings.ToLower(format)] = true
+		}
+	}
+}
+
 func (w *ZeroMQWriter) Start() {
 	w.log.Info("[PWZ] Start: begin")
 
@@ -93,13 +195,15 @@ func (w *ZeroMQWriter) Stop() {
 	close(w.sig)
 	w.wg.Wait()
 
+	w.sock.Close()
+
 	w.log.Info("[PWZ] Stop: completed")
 }
 
 func (w *ZeroMQWriter) Process(record adaptor.Record) {
 	w.log.Debug("[PWZ] Process: %v", record.Command())
 
-	w.lineQ <- record.String()
+	w.recordQ <- record
 }
 
 func (w *ZeroMQWriter) goLines() {
@@ -113,12 +217,60 @@ LineLoop:
 				break LineLoop
 			}
 
-		case line := <-w.lineQ:
-			_, err := w.pub.Send(line, 0)
-			if err != nil {
-				w.log.Error("Could not send line on zmq (%v)", err)
-				continue
-			}
+		case record := <-w.recordQ:
+			w.write(record)
 		}
 	}
 }
+
+// write sends the messages for one record in all configured formats.
+func (w *ZeroMQWriter) write(record adaptor.Record) {
+	if w.formats[ZeromqRecord] {
+		w.send(record.Command(), []byte(record.String()))
+	}
+
+	switch r := record.(type) {
+	case *records.TransactionRecord:
+		if w.formats[ZeromqHashTx] {
+			hash := r.Details().Hash()
+			w.send(ZeromqHashTx, reverse(hash[:]))
+		}
+
+		if w.formats[ZeromqRawTx] {
+			w.send(ZeromqRawTx, r.Raw())
+		}
+
+	case *records.BlockRecord:
+		if w.formats[ZeromqHashBlock] {
+			hash := r.Header().Hash()
+			w.send(ZeromqHashBlock, reverse(hash[:]))
+		}
+
+		if w.formats[ZeromqRawBlock] {
+			w.send(ZeromqRawBlock, r.Raw())
+		}
+	}
+}
+
+// send sends one multipart message with the next sequence number of the
+// topic.
+func (w *ZeroMQWriter) send(topic string, payload []byte) {
+	seq := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seq, w.sequence[topic])
+	w.sequence[topic]++
+
+	_, err := w.sock.SendMessage(topic, payload, seq)
+	if err != nil {
+		w.log.Error("Could not send message on zmq (%v)", err)
+	}
+}
+
+// reverse returns a copy of a hash in the byte order used for display.
+func reverse(hash []byte) []byte {
+	reversed := make([]byte, len(hash))
+	for i, b := range hash {
+		reversed[len(hash)-1-i] = b
+	}
+
+	return reversed
+}
@@ -21,14 +21,21 @@
 package records
 
 import (
+	"bytes"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/btcsuite/btcd/txscript"
 )
 
 const (
-	Version = "PBTC LOG VERSION 1.0"
+	Version = "PBTC LOG VERSION 2.0"
+)
+
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
 )
 
 const (
@@ -69,12 +76,28 @@ type Record struct {
 	la    *net.TCPAddr
 	ra    *net.TCPAddr
 	cmd   string
+
+	country string
+	city    string
+	asn     uint32
+
+	dups  int
+	bytes int
+	wire  []byte
+	dir   string
 }
 
 func (r *Record) Timestamp() time.Time {
 	return r.stamp
 }
 
+// SetTimestamp overrides the time at which the record was created, for records
+// of messages that were received earlier, like the ones imported from network
+// captures.
+func (r *Record) SetTimestamp(stamp time.Time) {
+	r.stamp = stamp
+}
+
 func (r *Record) RemoteAddress() *net.TCPAddr {
 	return r.ra
 }
@@ -86,3 +109,100 @@ func (r *Record) LocalAddress() *net.TCPAddr {
 func (r *Record) Command() string {
 	return r.cmd
 }
+
+// SetLocation attaches the geolocation of the remote address to the record.
+// Its columns are part of the string representation and empty if not set.
+func (r *Record) SetLocation(country string, city string, asn uint32) {
+	r.country = country
+	r.city = city
+	r.asn = asn
+}
+
+func (r *Record) Country() string {
+	return r.country
+}
+
+func (r *Record) City() string {
+	return r.city
+}
+
+func (r *Record) ASN() uint32 {
+	return r.asn
+}
+
+// SetDirection sets whether the record describes a message that we received
+// from or sent to the peer. Records of sent messages are marked as such in
+// their string representation.
+func (r *Record) SetDirection(dir string) {
+	r.dir = dir
+}
+
+func (r *Record) Direction() string {
+	return r.dir
+}
+
+// direction returns the string representation of the direction, including the
+// leading delimiter. The column is always present and empty if not set.
+func (r *Record) direction() string {
+	return Delimiter1 + r.dir
+}
+
+// SetDuplicates annotates the record with the number of duplicates of it that
+// were seen later. It is part of the string representation of transaction,
+// block, inventory, address and headers records.
+func (r *Record) SetDuplicates(dups int) {
+	r.dups = dups
+}
+
+func (r *Record) Duplicates() int {
+	return r.dups
+}
+
+// SetBytes sets the size of the message the record was created from on the
+// wire, including the message header. It is not part of the string
+// representation.
+func (r *Record) SetBytes(bytes int) {
+	r.bytes = bytes
+}
+
+func (r *Record) Bytes() int {
+	return r.bytes
+}
+
+// SetWire attaches the raw message the record was created from, including the
+// message header. It is optional and not part of the string representation.
+func (r *Record) SetWire(wire []byte) {
+	r.wire = wire
+}
+
+func (r *Record) Wire() []byte {
+	return r.wire
+}
+
+// duplicates returns the string representation of the duplicate count,
+// including the leading delimiter. The column is always present and empty if
+// not set.
+func (r *Record) duplicates() string {
+	if r.dups == 0 {
+		return Delimiter1
+	}
+
+	return Delimiter1 + strconv.FormatInt(int64(r.dups), 10)
+}
+
+// location returns the string representation of the geolocation fields,
+// including the leading delimiter. The columns are always present and empty if
+// no location was attached to the record.
+func (r *Record) location() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(r.country)
+	buf.WriteString(Delimiter3)
+	buf.WriteString(r.city)
+	buf.WriteString(Delimiter3)
+	if r.asn != 0 {
+		buf.WriteString(strconv.FormatUint(uint64(r.asn), 10))
+	}
+
+	return buf.String()
+}
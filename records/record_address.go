@@ -55,6 +55,10 @@ func NewAddressRecord(msg *wire.MsgAddr, ra *net.TCPAddr,
 	return ar
 }
 
+func (ar *AddressRecord) Addresses() []*EntryRecord {
+	return ar.addrs
+}
+
 func (ar *AddressRecord) String() string {
 	buf := new(bytes.Buffer)
 
@@ -73,5 +77,9 @@ func (ar *AddressRecord) String() string {
 		buf.WriteString(addr.String())
 	}
 
+	buf.WriteString(ar.direction())
+	buf.WriteString(ar.duplicates())
+	buf.WriteString(ar.location())
+
 	return buf.String()
 }
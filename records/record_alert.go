@@ -134,5 +134,8 @@ func (ar *AlertRecord) String() string {
 	buf.WriteString(Delimiter2)
 	buf.WriteString(base64.StdEncoding.EncodeToString([]byte(ar.reserved)))
 
+	buf.WriteString(ar.direction())
+	buf.WriteString(ar.location())
+
 	return buf.String()
 }
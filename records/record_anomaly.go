@@ -0,0 +1,82 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+// AnomalyRecord is emitted by analyzers when a peer behaves in a way that
+// suggests it is not what it claims to be. The kind identifies the check that
+// triggered and the detail gives a human readable explanation.
+type AnomalyRecord struct {
+	Record
+
+	kind   string
+	detail string
+}
+
+func NewAnomalyRecord(kind string, detail string, ra *net.TCPAddr,
+	la *net.TCPAddr) *AnomalyRecord {
+	record := &AnomalyRecord{
+		Record: Record{
+			stamp: time.Now(),
+			ra:    ra,
+			la:    la,
+			cmd:   "anomaly",
+		},
+
+		kind:   kind,
+		detail: detail,
+	}
+
+	return record
+}
+
+func (ar *AnomalyRecord) Kind() string {
+	return ar.kind
+}
+
+func (ar *AnomalyRecord) Detail() string {
+	return ar.detail
+}
+
+func (ar *AnomalyRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(ar.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(ar.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(ar.ra.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(ar.la.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(ar.kind)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(ar.detail)
+
+	buf.WriteString(ar.location())
+
+	return buf.String()
+}
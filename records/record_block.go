@@ -32,8 +32,11 @@ import (
 type BlockRecord struct {
 	Record
 
+	msg     *wire.MsgBlock
 	hdr     *HeaderRecord
 	details []*DetailsRecord
+	size    int
+	height  int32
 }
 
 func NewBlockRecord(msg *wire.MsgBlock, ra *net.TCPAddr,
@@ -46,8 +49,11 @@ func NewBlockRecord(msg *wire.MsgBlock, ra *net.TCPAddr,
 			cmd:   msg.Command(),
 		},
 
+		msg:     msg,
 		hdr:     NewHeaderRecord(&msg.Header),
 		details: make([]*DetailsRecord, len(msg.Transactions)),
+		size:    msg.SerializeSize(),
+		height:  parseHeight(msg),
 	}
 
 	for i, tx := range msg.Transactions {
@@ -57,6 +63,63 @@ func NewBlockRecord(msg *wire.MsgBlock, ra *net.TCPAddr,
 	return record
 }
 
+func (br *BlockRecord) Header() *HeaderRecord {
+	return br.hdr
+}
+
+func (br *BlockRecord) Details() []*DetailsRecord {
+	return br.details
+}
+
+// Transaction returns a record for the transaction at the given index of the
+// block. It shares the timestamp, addresses, direction and location of the
+// block record; the raw message, size and duplicates of the block don't apply
+// to the transaction and are left unset.
+func (br *BlockRecord) Transaction(i int) *TransactionRecord {
+	msg := br.msg.Transactions[i]
+	record := &TransactionRecord{
+		Record: Record{
+			stamp:   br.stamp,
+			ra:      br.ra,
+			la:      br.la,
+			cmd:     msg.Command(),
+			country: br.country,
+			city:    br.city,
+			asn:     br.asn,
+			dir:     br.dir,
+		},
+
+		msg:     msg,
+		details: br.details[i],
+	}
+
+	return record
+}
+
+// Raw returns the serialized block as it was received.
+func (br *BlockRecord) Raw() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, br.size))
+	br.msg.Serialize(buf)
+
+	return buf.Bytes()
+}
+
+// Size returns the serialized size of the block in bytes.
+func (br *BlockRecord) Size() int {
+	return br.size
+}
+
+// Transactions returns the number of transactions in the block.
+func (br *BlockRecord) Transactions() int {
+	return len(br.details)
+}
+
+// Height returns the height of the block as encoded in the coinbase, or -1
+// if the block does not include it.
+func (br *BlockRecord) Height() int32 {
+	return br.height
+}
+
 func (br *BlockRecord) String() string {
 	buf := new(bytes.Buffer)
 
@@ -78,5 +141,31 @@ func (br *BlockRecord) String() string {
 		buf.WriteString(tx.String())
 	}
 
+	buf.WriteString(br.direction())
+	buf.WriteString(br.duplicates())
+	buf.WriteString(br.location())
+
 	return buf.String()
 }
+
+// parseHeight extracts the block height from the coinbase signature script,
+// where it is the first push for blocks of version 2 and above (BIP34).
+func parseHeight(msg *wire.MsgBlock) int32 {
+	if msg.Header.Version < 2 || len(msg.Transactions) == 0 ||
+		len(msg.Transactions[0].TxIn) == 0 {
+		return -1
+	}
+
+	script := msg.Transactions[0].TxIn[0].SignatureScript
+	if len(script) == 0 || script[0] < 1 || script[0] > 4 ||
+		len(script) < int(script[0])+1 {
+		return -1
+	}
+
+	height := int32(0)
+	for i := int(script[0]); i > 0; i-- {
+		height = height<<8 | int32(script[i])
+	}
+
+	return height
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testTx returns a transaction spending the given output with one output of
+// the given value and script.
+func testTx(prev wire.ShaHash, index uint32, value int64,
+	script []byte) *wire.MsgTx {
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prev, index), []byte{0x51}))
+	tx.AddTxOut(wire.NewTxOut(value, script))
+
+	return tx
+}
+
+// testBlock returns a version 2 block at the given height with a coinbase and
+// the given transactions.
+func testBlock(t *testing.T, height byte, txs ...*wire.MsgTx) *wire.MsgBlock {
+	coinbase := wire.NewMsgTx()
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&wire.ShaHash{},
+		0xffffffff), []byte{0x01, height}))
+	coinbase.AddTxOut(wire.NewTxOut(5000000000, []byte{0x51}))
+
+	block := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:   2,
+		Timestamp: time.Unix(1400000000, 0),
+		Bits:      0x207fffff,
+	})
+
+	for _, tx := range append([]*wire.MsgTx{coinbase}, txs...) {
+		err := block.AddTransaction(tx)
+		if err != nil {
+			t.Fatalf("could not add transaction (%v)", err)
+		}
+	}
+
+	return block
+}
+
+func TestBlockTransaction(t *testing.T) {
+	ra := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 8333}
+	la := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 45000}
+
+	msg := testBlock(t, 7,
+		testTx(wire.ShaHash{1}, 0, 1000, []byte{0x51}),
+		testTx(wire.ShaHash{2}, 1, 2000, []byte{0x6a, 0x01, 0x2a}),
+	)
+
+	br := NewBlockRecord(msg, ra, la)
+	br.SetBytes(24 + br.Size())
+	br.SetWire([]byte{0xf9, 0xbe, 0xb4, 0xd9})
+	br.SetDuplicates(3)
+	br.SetDirection(DirectionOut)
+	br.SetLocation("LU", "Luxembourg", 6661)
+
+	if br.Height() != 7 {
+		t.Errorf("block height is %v, want 7", br.Height())
+	}
+
+	for i, tx := range msg.Transactions {
+		tr := br.Transaction(i)
+
+		if tr.Command() != "tx" || tr.Details() != br.Details()[i] {
+			t.Errorf("tx %v: wrong command %v or details", i, tr.Command())
+		}
+
+		// the record is for the transaction, not the block it came in
+		if tr.Bytes() != 0 || tr.Wire() != nil || tr.Duplicates() != 0 {
+			t.Errorf("tx %v: carries block data (bytes %v, wire %v, dups %v)",
+				i, tr.Bytes(), tr.Wire(), tr.Duplicates())
+		}
+
+		if !bytes.Equal(tr.Raw(), serialize(t, tx)) {
+			t.Errorf("tx %v: raw transaction differs", i)
+		}
+
+		// but it shares where and when the block was seen
+		if !tr.Timestamp().Equal(br.Timestamp()) ||
+			tr.RemoteAddress() != ra || tr.LocalAddress() != la ||
+			tr.Direction() != DirectionOut || tr.Country() != "LU" ||
+			tr.City() != "Luxembourg" || tr.ASN() != 6661 {
+			t.Errorf("tx %v: peer data differs from block", i)
+		}
+	}
+
+	// the block record itself is left alone
+	if br.Bytes() == 0 || br.Wire() == nil || br.Duplicates() != 3 {
+		t.Errorf("block annotations changed")
+	}
+}
+
+// serialize returns the serialized transaction.
+func serialize(t *testing.T, tx *wire.MsgTx) []byte {
+	buf := new(bytes.Buffer)
+	err := tx.Serialize(buf)
+	if err != nil {
+		t.Fatalf("could not serialize transaction (%v)", err)
+	}
+
+	return buf.Bytes()
+}
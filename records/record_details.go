@@ -32,6 +32,7 @@ type DetailsRecord struct {
 	hash [32]byte
 	ins  []*InputRecord
 	outs []*OutputRecord
+	size int
 }
 
 func NewDetailsRecord(msg *wire.MsgTx) *DetailsRecord {
@@ -39,6 +40,7 @@ func NewDetailsRecord(msg *wire.MsgTx) *DetailsRecord {
 		hash: msg.TxSha(),
 		ins:  make([]*InputRecord, len(msg.TxIn)),
 		outs: make([]*OutputRecord, len(msg.TxOut)),
+		size: msg.SerializeSize(),
 	}
 
 	for i, txin := range msg.TxIn {
@@ -52,6 +54,23 @@ func NewDetailsRecord(msg *wire.MsgTx) *DetailsRecord {
 	return record
 }
 
+func (dr *DetailsRecord) Hash() [32]byte {
+	return dr.hash
+}
+
+func (dr *DetailsRecord) Inputs() []*InputRecord {
+	return dr.ins
+}
+
+func (dr *DetailsRecord) Outputs() []*OutputRecord {
+	return dr.outs
+}
+
+// Size returns the serialized size of the transaction in bytes.
+func (dr *DetailsRecord) Size() int {
+	return dr.size
+}
+
 func (dr *DetailsRecord) String() string {
 	buf := new(bytes.Buffer)
 
@@ -0,0 +1,93 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// DroppedRecord reports how many records of each command were forwarded and
+// how many were dropped by sampling, by the rate limit for the command and by
+// the rate limit for the peer during one reporting period. Downstream
+// statistics can be corrected by scaling with the ratio of seen to forwarded
+// records.
+type DroppedRecord struct {
+	Record
+
+	period   time.Duration
+	rate     float64
+	commands []string
+	kept     []int
+	sampled  []int
+	limited  []int
+	peers    []int
+}
+
+func NewDroppedRecord(period time.Duration, rate float64, commands []string,
+	kept []int, sampled []int, limited []int, peers []int) *DroppedRecord {
+	record := &DroppedRecord{
+		Record: Record{
+			stamp: time.Now(),
+			cmd:   "dropped",
+		},
+
+		period:   period,
+		rate:     rate,
+		commands: commands,
+		kept:     kept,
+		sampled:  sampled,
+		limited:  limited,
+		peers:    peers,
+	}
+
+	return record
+}
+
+func (dr *DroppedRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(dr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(dr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(dr.period.Seconds(), 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(dr.rate, 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(len(dr.commands)), 10))
+
+	for i, command := range dr.commands {
+		buf.WriteString(Delimiter2)
+		buf.WriteString(command)
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatInt(int64(dr.kept[i]), 10))
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatInt(int64(dr.sampled[i]), 10))
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatInt(int64(dr.limited[i]), 10))
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatInt(int64(dr.peers[i]), 10))
+	}
+
+	return buf.String()
+}
@@ -47,6 +47,18 @@ func NewEntryRecord(na *wire.NetAddress) *EntryRecord {
 	return record
 }
 
+func (er *EntryRecord) Address() *net.TCPAddr {
+	return er.addr
+}
+
+func (er *EntryRecord) Timestamp() time.Time {
+	return er.stamp
+}
+
+func (er *EntryRecord) Services() uint64 {
+	return er.services
+}
+
 func (er *EntryRecord) String() string {
 	buf := new(bytes.Buffer)
 
@@ -57,5 +57,8 @@ func (fr *FilterLoadRecord) String() string {
 	buf.WriteString(Delimiter1)
 	buf.WriteString(fr.la.String())
 
+	buf.WriteString(fr.direction())
+	buf.WriteString(fr.location())
+
 	return buf.String()
 }
@@ -0,0 +1,92 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ForkRecord is emitted when a block is seen that builds on a block which
+// already has a child, creating competing tips at the same height.
+type ForkRecord struct {
+	Record
+
+	parent [32]byte
+	height int32
+	tips   []*TipRecord
+}
+
+func NewForkRecord(parent [32]byte, height int32, tips []*TipRecord,
+	ra *net.TCPAddr, la *net.TCPAddr) *ForkRecord {
+	record := &ForkRecord{
+		Record: Record{
+			stamp: time.Now(),
+			ra:    ra,
+			la:    la,
+			cmd:   "fork",
+		},
+
+		parent: parent,
+		height: height,
+		tips:   tips,
+	}
+
+	return record
+}
+
+func (fr *ForkRecord) Parent() [32]byte {
+	return fr.parent
+}
+
+func (fr *ForkRecord) Height() int32 {
+	return fr.height
+}
+
+func (fr *ForkRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(fr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(fr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(fr.ra.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(fr.la.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(hex.EncodeToString(fr.parent[:]))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(fr.height), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(len(fr.tips)), 10))
+
+	for _, tip := range fr.tips {
+		buf.WriteString(Delimiter2)
+		buf.WriteString(tip.String())
+	}
+
+	buf.WriteString(fr.location())
+
+	return buf.String()
+}
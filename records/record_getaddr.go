@@ -57,5 +57,8 @@ func (gr *GetAddrRecord) String() string {
 	buf.WriteString(Delimiter1)
 	buf.WriteString(gr.la.String())
 
+	buf.WriteString(gr.direction())
+	buf.WriteString(gr.location())
+
 	return buf.String()
 }
@@ -78,5 +78,8 @@ func (gr *GetBlocksRecord) String() string {
 		buf.WriteString(hex.EncodeToString(hash[:]))
 	}
 
+	buf.WriteString(gr.direction())
+	buf.WriteString(gr.location())
+
 	return buf.String()
 }
@@ -73,5 +73,8 @@ func (gr *GetDataRecord) String() string {
 		buf.WriteString(item.String())
 	}
 
+	buf.WriteString(gr.direction())
+	buf.WriteString(gr.location())
+
 	return buf.String()
 }
@@ -78,5 +78,8 @@ func (gr *GetHeadersRecord) String() string {
 		buf.WriteString(hex.EncodeToString(hash[:]))
 	}
 
+	buf.WriteString(gr.direction())
+	buf.WriteString(gr.location())
+
 	return buf.String()
 }
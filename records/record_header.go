@@ -55,6 +55,22 @@ func NewHeaderRecord(hdr *wire.BlockHeader) *HeaderRecord {
 	return record
 }
 
+func (hr *HeaderRecord) Hash() [32]byte {
+	return hr.block_hash
+}
+
+func (hr *HeaderRecord) PrevBlock() [32]byte {
+	return hr.prev_block
+}
+
+func (hr *HeaderRecord) BlockTime() time.Time {
+	return hr.timestamp
+}
+
+func (hr *HeaderRecord) Bits() uint32 {
+	return hr.bits
+}
+
 func (hr *HeaderRecord) String() string {
 	buf := new(bytes.Buffer)
 
@@ -55,6 +55,10 @@ func NewHeadersRecord(msg *wire.MsgHeaders, ra *net.TCPAddr,
 	return record
 }
 
+func (hr *HeadersRecord) Headers() []*HeaderRecord {
+	return hr.hdrs
+}
+
 func (hr *HeadersRecord) String() string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(hr.stamp.Format(time.RFC3339Nano))
@@ -72,5 +76,9 @@ func (hr *HeadersRecord) String() string {
 		buf.WriteString(hdr.String())
 	}
 
+	buf.WriteString(hr.direction())
+	buf.WriteString(hr.duplicates())
+	buf.WriteString(hr.location())
+
 	return buf.String()
 }
@@ -44,6 +44,14 @@ func NewInputRecord(txin *wire.TxIn) *InputRecord {
 	return ir
 }
 
+func (ir *InputRecord) Hash() [32]byte {
+	return ir.hash
+}
+
+func (ir *InputRecord) Index() uint32 {
+	return ir.index
+}
+
 func (ir *InputRecord) String() string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(hex.EncodeToString(ir.hash[:]))
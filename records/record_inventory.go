@@ -55,6 +55,10 @@ func NewInventoryRecord(msg *wire.MsgInv, ra *net.TCPAddr,
 	return ir
 }
 
+func (ir *InventoryRecord) Items() []*ItemRecord {
+	return ir.inv
+}
+
 func (ir *InventoryRecord) String() string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(ir.stamp.Format(time.RFC3339Nano))
@@ -72,5 +76,9 @@ func (ir *InventoryRecord) String() string {
 		buf.WriteString(item.String())
 	}
 
+	buf.WriteString(ir.direction())
+	buf.WriteString(ir.duplicates())
+	buf.WriteString(ir.location())
+
 	return buf.String()
 }
@@ -42,6 +42,14 @@ func NewItemRecord(vec *wire.InvVect) *ItemRecord {
 	return ir
 }
 
+func (ir *ItemRecord) Category() uint8 {
+	return ir.category
+}
+
+func (ir *ItemRecord) Hash() [32]byte {
+	return ir.hash
+}
+
 func (ir *ItemRecord) String() string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(strconv.FormatUint(uint64(ir.category), 10))
@@ -0,0 +1,109 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+)
+
+// LargeTxRecord is emitted when a transaction from the mempool or from a
+// block moves a value above a configured threshold. The input value is -1 if
+// it could not be determined. The class is the script class whose threshold
+// was exceeded, or empty for the general threshold.
+type LargeTxRecord struct {
+	Record
+
+	details *DetailsRecord
+	out     int64
+	in      int64
+	class   string
+	source  string
+}
+
+func NewLargeTxRecord(details *DetailsRecord, out int64, in int64,
+	class string, source string, ra *net.TCPAddr,
+	la *net.TCPAddr) *LargeTxRecord {
+	record := &LargeTxRecord{
+		Record: Record{
+			stamp: time.Now(),
+			ra:    ra,
+			la:    la,
+			cmd:   "largetx",
+		},
+
+		details: details,
+		out:     out,
+		in:      in,
+		class:   class,
+		source:  source,
+	}
+
+	return record
+}
+
+func (lr *LargeTxRecord) Details() *DetailsRecord {
+	return lr.details
+}
+
+func (lr *LargeTxRecord) OutputValue() int64 {
+	return lr.out
+}
+
+func (lr *LargeTxRecord) InputValue() int64 {
+	return lr.in
+}
+
+func (lr *LargeTxRecord) Class() string {
+	return lr.class
+}
+
+func (lr *LargeTxRecord) Source() string {
+	return lr.source
+}
+
+func (lr *LargeTxRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(lr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.ra.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.la.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.source)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.class)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(lr.out, 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(lr.in, 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.details.String())
+
+	buf.WriteString(lr.location())
+
+	return buf.String()
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+)
+
+// LatencyRecord holds the round-trip time of one ping to a peer, measured
+// from sending the ping until receiving the matching pong, together with the
+// minimum and average round-trip time and the number of pings answered on the
+// connection so far.
+type LatencyRecord struct {
+	Record
+
+	rtt   time.Duration
+	min   time.Duration
+	avg   time.Duration
+	count int
+}
+
+func NewLatencyRecord(rtt time.Duration, min time.Duration, avg time.Duration,
+	count int, ra *net.TCPAddr, la *net.TCPAddr) *LatencyRecord {
+	record := &LatencyRecord{
+		Record: Record{
+			stamp: time.Now(),
+			ra:    ra,
+			la:    la,
+			cmd:   "latency",
+		},
+
+		rtt:   rtt,
+		min:   min,
+		avg:   avg,
+		count: count,
+	}
+
+	return record
+}
+
+func (lr *LatencyRecord) RTT() time.Duration {
+	return lr.rtt
+}
+
+func (lr *LatencyRecord) Min() time.Duration {
+	return lr.min
+}
+
+func (lr *LatencyRecord) Avg() time.Duration {
+	return lr.avg
+}
+
+func (lr *LatencyRecord) Count() int {
+	return lr.count
+}
+
+func (lr *LatencyRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(lr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.ra.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(lr.la.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(lr.rtt.Seconds(), 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(lr.min.Seconds(), 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(lr.avg.Seconds(), 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(lr.count), 10))
+
+	buf.WriteString(lr.location())
+
+	return buf.String()
+}
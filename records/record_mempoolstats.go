@@ -0,0 +1,93 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// MempoolStatsRecord describes the state of the approximate mempool that we
+// maintain from observed transactions. The histogram buckets hold the number
+// and total size of transactions with a fee rate (in satoshi per byte) of at
+// least the bucket limit and below the next one. Transactions with unknown
+// fees are only part of the totals.
+type MempoolStatsRecord struct {
+	Record
+
+	count  int
+	size   int
+	known  int
+	fees   int64
+	limits []int64
+	counts []int
+	sizes  []int
+}
+
+func NewMempoolStatsRecord(count int, size int, known int, fees int64,
+	limits []int64, counts []int, sizes []int) *MempoolStatsRecord {
+	record := &MempoolStatsRecord{
+		Record: Record{
+			stamp: time.Now(),
+			cmd:   "mempoolstats",
+		},
+
+		count:  count,
+		size:   size,
+		known:  known,
+		fees:   fees,
+		limits: limits,
+		counts: counts,
+		sizes:  sizes,
+	}
+
+	return record
+}
+
+func (mr *MempoolStatsRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(mr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(mr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(mr.count), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(mr.size), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(mr.known), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(mr.fees, 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(len(mr.limits)), 10))
+
+	for i, limit := range mr.limits {
+		buf.WriteString(Delimiter2)
+		buf.WriteString(strconv.FormatInt(limit, 10))
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatInt(int64(mr.counts[i]), 10))
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatInt(int64(mr.sizes[i]), 10))
+	}
+
+	return buf.String()
+}
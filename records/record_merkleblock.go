@@ -56,5 +56,8 @@ func (mr *MerkleBlockRecord) String() string {
 	buf.WriteString(Delimiter1)
 	buf.WriteString(mr.la.String())
 
+	buf.WriteString(mr.direction())
+	buf.WriteString(mr.location())
+
 	return buf.String()
 }
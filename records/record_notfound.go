@@ -72,5 +72,8 @@ func (nr *NotFoundRecord) String() string {
 		buf.WriteString(item.String())
 	}
 
+	buf.WriteString(nr.direction())
+	buf.WriteString(nr.location())
+
 	return buf.String()
 }
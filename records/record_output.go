@@ -36,6 +36,7 @@ type OutputRecord struct {
 	class uint8
 	sigs  uint8
 	addrs []btcutil.Address
+	data  []byte
 }
 
 func NewOutputRecord(txout *wire.TxOut) *OutputRecord {
@@ -49,9 +50,37 @@ func NewOutputRecord(txout *wire.TxOut) *OutputRecord {
 		addrs: addrs,
 	}
 
+	// keep the data carried by null data outputs
+	if class == txscript.NullDataTy {
+		pushes, err := txscript.PushedData(txout.PkScript)
+		if err == nil {
+			for _, push := range pushes {
+				record.data = append(record.data, push...)
+			}
+		}
+	}
+
 	return record
 }
 
+func (or *OutputRecord) Value() int64 {
+	return or.value
+}
+
+func (or *OutputRecord) Class() uint8 {
+	return or.class
+}
+
+func (or *OutputRecord) Addresses() []btcutil.Address {
+	return or.addrs
+}
+
+// Data returns the data pushed by a null data output, or nil for other
+// classes of output scripts.
+func (or *OutputRecord) Data() []byte {
+	return or.data
+}
+
 func (or *OutputRecord) String() string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(strconv.FormatInt(or.value, 10))
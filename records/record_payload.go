@@ -0,0 +1,92 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PayloadRecord describes the data carried by a null data output, as hex and
+// as best-effort text, and the protocol it was identified as, if any.
+type PayloadRecord struct {
+	index    uint32
+	protocol string
+	data     []byte
+}
+
+func NewPayloadRecord(index uint32, protocol string,
+	data []byte) *PayloadRecord {
+	record := &PayloadRecord{
+		index:    index,
+		protocol: protocol,
+		data:     data,
+	}
+
+	return record
+}
+
+func (pr *PayloadRecord) Protocol() string {
+	return pr.protocol
+}
+
+func (pr *PayloadRecord) Data() []byte {
+	return pr.data
+}
+
+// Text returns the payload as text, replacing non-printable characters and
+// our delimiters with dots.
+func (pr *PayloadRecord) Text() string {
+	buf := new(bytes.Buffer)
+	data := pr.data
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+
+		if r == utf8.RuneError || !unicode.IsPrint(r) ||
+			string(r) == Delimiter1 || string(r) == Delimiter2 ||
+			string(r) == Delimiter3 {
+			buf.WriteByte('.')
+			continue
+		}
+
+		buf.WriteRune(r)
+	}
+
+	return buf.String()
+}
+
+func (pr *PayloadRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(strconv.FormatUint(uint64(pr.index), 10))
+	buf.WriteString(Delimiter3)
+	buf.WriteString(pr.protocol)
+	buf.WriteString(Delimiter3)
+	buf.WriteString(hex.EncodeToString(pr.data))
+	buf.WriteString(Delimiter3)
+	buf.WriteString(pr.Text())
+
+	return buf.String()
+}
@@ -63,5 +63,8 @@ func (pr *PongRecord) String() string {
 	buf.WriteString(Delimiter1)
 	buf.WriteString(strconv.FormatUint(pr.nonce, 10))
 
+	buf.WriteString(pr.direction())
+	buf.WriteString(pr.location())
+
 	return buf.String()
 }
@@ -0,0 +1,116 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+)
+
+// PropagationRecord describes how a block propagated across our peers. The
+// remote address is the one of the first peer to announce the block, and the
+// peers are listed in the order they announced it, with their delay.
+type PropagationRecord struct {
+	Record
+
+	hash   [32]byte
+	height int32
+	size   int
+	txs    int
+	likely bool
+	p50    time.Duration
+	p90    time.Duration
+	peers  []string
+	delays []time.Duration
+}
+
+func NewPropagationRecord(hash [32]byte, height int32, size int, txs int,
+	likely bool, p50 time.Duration, p90 time.Duration, peers []string,
+	delays []time.Duration, first time.Time, ra *net.TCPAddr,
+	la *net.TCPAddr) *PropagationRecord {
+	record := &PropagationRecord{
+		Record: Record{
+			stamp: first,
+			ra:    ra,
+			la:    la,
+			cmd:   "propagation",
+		},
+
+		hash:   hash,
+		height: height,
+		size:   size,
+		txs:    txs,
+		likely: likely,
+		p50:    p50,
+		p90:    p90,
+		peers:  peers,
+		delays: delays,
+	}
+
+	return record
+}
+
+func (pr *PropagationRecord) Hash() [32]byte {
+	return pr.hash
+}
+
+func (pr *PropagationRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(pr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(pr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(pr.ra.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(pr.la.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(hex.EncodeToString(pr.hash[:]))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(pr.height), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(pr.size), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(pr.txs), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatBool(pr.likely))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(pr.p50.Seconds(), 'f', 3, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(pr.p90.Seconds(), 'f', 3, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(len(pr.peers)), 10))
+
+	for i, peer := range pr.peers {
+		buf.WriteString(Delimiter2)
+		buf.WriteString(peer)
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatFloat(pr.delays[i].Seconds(), 'f', 3,
+			64))
+	}
+
+	buf.WriteString(pr.location())
+
+	return buf.String()
+}
@@ -76,5 +76,8 @@ func (rr *RejectRecord) String() string {
 	buf.WriteString(Delimiter1)
 	buf.WriteString(rr.reason)
 
+	buf.WriteString(rr.direction())
+	buf.WriteString(rr.location())
+
 	return buf.String()
 }
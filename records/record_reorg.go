@@ -0,0 +1,106 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ReorgRecord is emitted when the best chain switches to a branch that does
+// not extend the previous best tip. The blocks that were disconnected from the
+// best chain are listed as stale.
+type ReorgRecord struct {
+	Record
+
+	fork     [32]byte
+	depth    int32
+	duration time.Duration
+	from     *TipRecord
+	to       *TipRecord
+	stale    [][32]byte
+}
+
+func NewReorgRecord(fork [32]byte, depth int32, duration time.Duration,
+	from *TipRecord, to *TipRecord, stale [][32]byte, ra *net.TCPAddr,
+	la *net.TCPAddr) *ReorgRecord {
+	record := &ReorgRecord{
+		Record: Record{
+			stamp: time.Now(),
+			ra:    ra,
+			la:    la,
+			cmd:   "reorg",
+		},
+
+		fork:     fork,
+		depth:    depth,
+		duration: duration,
+		from:     from,
+		to:       to,
+		stale:    stale,
+	}
+
+	return record
+}
+
+func (rr *ReorgRecord) Depth() int32 {
+	return rr.depth
+}
+
+func (rr *ReorgRecord) Stale() [][32]byte {
+	return rr.stale
+}
+
+func (rr *ReorgRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(rr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(rr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(rr.ra.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(rr.la.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(hex.EncodeToString(rr.fork[:]))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(rr.depth), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(rr.duration.Seconds(), 'f', 3, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(rr.from.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(rr.to.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(len(rr.stale)), 10))
+
+	for _, hash := range rr.stale {
+		buf.WriteString(Delimiter2)
+		buf.WriteString(hex.EncodeToString(hash[:]))
+	}
+
+	buf.WriteString(rr.location())
+
+	return buf.String()
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	SessionAttempt    = "attempt"
+	SessionConnect    = "connect"
+	SessionHandshake  = "handshake"
+	SessionDisconnect = "disconnect"
+)
+
+const (
+	ReasonOutgoing  = "outgoing"
+	ReasonIncoming  = "incoming"
+	ReasonDial      = "dial"
+	ReasonTimeout   = "timeout"
+	ReasonProtocol  = "protocol"
+	ReasonSelf      = "self"
+	ReasonObsolete  = "obsolete"
+	ReasonSend      = "send"
+	ReasonReceive   = "receive"
+	ReasonPolled    = "polled"
+	ReasonLimit     = "limit"
+	ReasonUnmanaged = "unmanaged"
+	ReasonStopped   = "stopped"
+)
+
+// SessionRecord describes a lifecycle event of the connection to a peer: us
+// attempting to connect, the TCP connection being established, the protocol
+// handshake being completed or the connection ending. The duration is the time
+// it took to connect for connect events, zero for attempts and the time since
+// the connection was established otherwise. Connect events carry whether we
+// dialed or accepted the connection, disconnect events the reason the
+// connection ended; connection attempts that fail end with a disconnect event
+// for the dial reason. All events carry
+// the number of messages and bytes exchanged so far, as well as the minimum,
+// average and last ping round-trip time, which are zero until the peer
+// answered a ping.
+type SessionRecord struct {
+	Record
+
+	event    string
+	reason   string
+	duration time.Duration
+	msgsIn   uint64
+	bytesIn  uint64
+	msgsOut  uint64
+	bytesOut uint64
+	rttMin   time.Duration
+	rttAvg   time.Duration
+	rttLast  time.Duration
+}
+
+func NewSessionRecord(event string, reason string, duration time.Duration,
+	ra *net.TCPAddr, la *net.TCPAddr, msgsIn uint64, bytesIn uint64,
+	msgsOut uint64, bytesOut uint64) *SessionRecord {
+	record := &SessionRecord{
+		Record: Record{
+			stamp: time.Now(),
+			ra:    ra,
+			la:    la,
+			cmd:   "session",
+		},
+
+		event:    event,
+		reason:   reason,
+		duration: duration,
+		msgsIn:   msgsIn,
+		bytesIn:  bytesIn,
+		msgsOut:  msgsOut,
+		bytesOut: bytesOut,
+	}
+
+	return record
+}
+
+func (sr *SessionRecord) Event() string {
+	return sr.event
+}
+
+func (sr *SessionRecord) Reason() string {
+	return sr.reason
+}
+
+func (sr *SessionRecord) Duration() time.Duration {
+	return sr.duration
+}
+
+func (sr *SessionRecord) MessagesIn() uint64 {
+	return sr.msgsIn
+}
+
+func (sr *SessionRecord) BytesIn() uint64 {
+	return sr.bytesIn
+}
+
+func (sr *SessionRecord) MessagesOut() uint64 {
+	return sr.msgsOut
+}
+
+func (sr *SessionRecord) BytesOut() uint64 {
+	return sr.bytesOut
+}
+
+// SetLatency sets the ping round-trip time statistics of the connection.
+func (sr *SessionRecord) SetLatency(min time.Duration, avg time.Duration,
+	last time.Duration) {
+	sr.rttMin = min
+	sr.rttAvg = avg
+	sr.rttLast = last
+}
+
+func (sr *SessionRecord) LatencyMin() time.Duration {
+	return sr.rttMin
+}
+
+func (sr *SessionRecord) LatencyAvg() time.Duration {
+	return sr.rttAvg
+}
+
+func (sr *SessionRecord) LatencyLast() time.Duration {
+	return sr.rttLast
+}
+
+func (sr *SessionRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(sr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(sr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(sr.ra.String())
+	buf.WriteString(Delimiter1)
+	if sr.la != nil {
+		buf.WriteString(sr.la.String())
+	}
+	buf.WriteString(Delimiter1)
+	buf.WriteString(sr.event)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(sr.duration.Seconds(), 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatUint(sr.msgsIn, 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatUint(sr.bytesIn, 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatUint(sr.msgsOut, 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatUint(sr.bytesOut, 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(sr.reason)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(sr.rttMin.Seconds(), 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(sr.rttAvg.Seconds(), 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(sr.rttLast.Seconds(), 'f', -1, 64))
+
+	buf.WriteString(sr.location())
+
+	return buf.String()
+}
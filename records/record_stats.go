@@ -0,0 +1,133 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsRecord holds the aggregated counts for one time window. For each group
+// of records, identified by the values of the grouping keys, it holds the
+// number of messages, their size on the wire and the number of distinct
+// peers that sent them.
+type StatsRecord struct {
+	Record
+
+	start    time.Time
+	window   time.Duration
+	keys     []string
+	messages int
+	size     int
+	peers    int
+	groups   [][]string
+	counts   []int
+	sizes    []int
+	uniques  []int
+}
+
+func NewStatsRecord(start time.Time, window time.Duration, keys []string,
+	messages int, size int, peers int) *StatsRecord {
+	record := &StatsRecord{
+		Record: Record{
+			stamp: time.Now(),
+			cmd:   "stats",
+		},
+
+		start:    start,
+		window:   window,
+		keys:     keys,
+		messages: messages,
+		size:     size,
+		peers:    peers,
+		groups:   make([][]string, 0),
+		counts:   make([]int, 0),
+		sizes:    make([]int, 0),
+		uniques:  make([]int, 0),
+	}
+
+	return record
+}
+
+// AddGroup adds the counts for one group, given by the values of the keys in
+// the same order as the keys of the record.
+func (sr *StatsRecord) AddGroup(values []string, messages int, size int,
+	peers int) {
+	sr.groups = append(sr.groups, values)
+	sr.counts = append(sr.counts, messages)
+	sr.sizes = append(sr.sizes, size)
+	sr.uniques = append(sr.uniques, peers)
+}
+
+func (sr *StatsRecord) Start() time.Time {
+	return sr.start
+}
+
+func (sr *StatsRecord) Window() time.Duration {
+	return sr.window
+}
+
+func (sr *StatsRecord) Keys() []string {
+	return sr.keys
+}
+
+func (sr *StatsRecord) Messages() int {
+	return sr.messages
+}
+
+func (sr *StatsRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(sr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(sr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(sr.start.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatFloat(sr.window.Seconds(), 'f', -1, 64))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strings.Join(sr.keys, "+"))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(sr.messages), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(sr.size), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(sr.peers), 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(len(sr.groups)), 10))
+
+	for i, values := range sr.groups {
+		buf.WriteString(Delimiter2)
+		for _, value := range values {
+			buf.WriteString(value)
+			buf.WriteString(Delimiter3)
+		}
+		buf.WriteString(strconv.FormatInt(int64(sr.counts[i]), 10))
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatInt(int64(sr.sizes[i]), 10))
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatInt(int64(sr.uniques[i]), 10))
+	}
+
+	return buf.String()
+}
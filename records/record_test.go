@@ -0,0 +1,63 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecordColumns(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     string
+		dups    int
+		country string
+		city    string
+		asn     uint32
+		columns string
+	}{
+		{"unset", "", 0, "", "", 0, "|||||"},
+		{"received", DirectionIn, 0, "", "", 0, "|in||||"},
+		{"sent", DirectionOut, 0, "", "", 0, "|out||||"},
+		{"duplicates", "", 4, "", "", 0, "||4|||"},
+		{"located", "", 0, "LU", "Luxembourg", 6661, "|||LU|Luxembourg|6661"},
+		{"country only", DirectionIn, 2, "DE", "", 0, "|in|2|DE||"},
+	}
+
+	for _, test := range tests {
+		r := &Record{}
+		r.SetDirection(test.dir)
+		r.SetDuplicates(test.dups)
+		r.SetLocation(test.country, test.city, test.asn)
+
+		columns := r.direction() + r.duplicates() + r.location()
+		if columns != test.columns {
+			t.Errorf("%v: columns are %q, want %q", test.name, columns,
+				test.columns)
+		}
+
+		if strings.Count(columns, Delimiter1) != 5 {
+			t.Errorf("%v: %q does not have five columns", test.name,
+				columns)
+		}
+	}
+}
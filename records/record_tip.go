@@ -0,0 +1,80 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// TipRecord describes one tip of the block chain, as well as the peers that
+// were on it and for how long.
+type TipRecord struct {
+	hash      [32]byte
+	height    int32
+	seen      time.Time
+	peers     []string
+	durations []time.Duration
+}
+
+// NewTipRecord creates a new tip description for the block with the given
+// hash, relative height and time it was first seen.
+func NewTipRecord(hash [32]byte, height int32, seen time.Time) *TipRecord {
+	record := &TipRecord{
+		hash:      hash,
+		height:    height,
+		seen:      seen,
+		peers:     make([]string, 0),
+		durations: make([]time.Duration, 0),
+	}
+
+	return record
+}
+
+// AddPeer adds a peer that was on this tip for the given duration.
+func (tr *TipRecord) AddPeer(addr string, duration time.Duration) {
+	tr.peers = append(tr.peers, addr)
+	tr.durations = append(tr.durations, duration)
+}
+
+func (tr *TipRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(hex.EncodeToString(tr.hash[:]))
+	buf.WriteString(Delimiter3)
+	buf.WriteString(strconv.FormatInt(int64(tr.height), 10))
+	buf.WriteString(Delimiter3)
+	buf.WriteString(strconv.FormatInt(tr.seen.Unix(), 10))
+	buf.WriteString(Delimiter3)
+	buf.WriteString(strconv.FormatInt(int64(len(tr.peers)), 10))
+
+	for i, peer := range tr.peers {
+		buf.WriteString(Delimiter2)
+		buf.WriteString(peer)
+		buf.WriteString(Delimiter3)
+		buf.WriteString(strconv.FormatFloat(tr.durations[i].Seconds(), 'f', 3,
+			64))
+	}
+
+	return buf.String()
+}
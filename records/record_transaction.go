@@ -23,6 +23,7 @@ package records
 import (
 	"bytes"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/btcsuite/btcd/wire"
@@ -31,7 +32,9 @@ import (
 type TransactionRecord struct {
 	Record
 
-	details *DetailsRecord
+	msg      *wire.MsgTx
+	details  *DetailsRecord
+	payloads []*PayloadRecord
 }
 
 func NewTransactionRecord(msg *wire.MsgTx, ra *net.TCPAddr,
@@ -44,12 +47,36 @@ func NewTransactionRecord(msg *wire.MsgTx, ra *net.TCPAddr,
 			cmd:   msg.Command(),
 		},
 
+		msg:     msg,
 		details: NewDetailsRecord(msg),
 	}
 
 	return record
 }
 
+func (tr *TransactionRecord) Details() *DetailsRecord {
+	return tr.details
+}
+
+// Raw returns the serialized transaction as it was received.
+func (tr *TransactionRecord) Raw() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, tr.msg.SerializeSize()))
+	tr.msg.Serialize(buf)
+
+	return buf.Bytes()
+}
+
+// SetPayloads attaches the decoded null data payloads of the transaction. The
+// string representation always holds the number of payloads, followed by the
+// payloads themselves.
+func (tr *TransactionRecord) SetPayloads(payloads []*PayloadRecord) {
+	tr.payloads = payloads
+}
+
+func (tr *TransactionRecord) Payloads() []*PayloadRecord {
+	return tr.payloads
+}
+
 func (tr *TransactionRecord) String() string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(tr.stamp.Format(time.RFC3339Nano))
@@ -62,6 +89,17 @@ func (tr *TransactionRecord) String() string {
 	buf.WriteString(Delimiter1)
 	buf.WriteString(tr.details.String())
 
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(int64(len(tr.payloads)), 10))
+	for _, payload := range tr.payloads {
+		buf.WriteString(Delimiter2)
+		buf.WriteString(payload.String())
+	}
+
+	buf.WriteString(tr.direction())
+	buf.WriteString(tr.duplicates())
+	buf.WriteString(tr.location())
+
 	return buf.String()
 }
 
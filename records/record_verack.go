@@ -56,5 +56,8 @@ func (vr *VerAckRecord) String() string {
 	buf.WriteString(Delimiter1)
 	buf.WriteString(vr.la.String())
 
+	buf.WriteString(vr.direction())
+	buf.WriteString(vr.location())
+
 	return buf.String()
 }
@@ -69,6 +69,34 @@ func NewVersionRecord(msg *wire.MsgVersion, ra *net.TCPAddr,
 	return vr
 }
 
+func (vr *VersionRecord) Version() int32 {
+	return vr.version
+}
+
+func (vr *VersionRecord) Services() uint64 {
+	return vr.services
+}
+
+func (vr *VersionRecord) AddrYou() *net.TCPAddr {
+	return vr.raddr
+}
+
+func (vr *VersionRecord) AddrMe() *net.TCPAddr {
+	return vr.laddr
+}
+
+func (vr *VersionRecord) Agent() string {
+	return vr.agent
+}
+
+func (vr *VersionRecord) StartHeight() int32 {
+	return vr.block
+}
+
+func (vr *VersionRecord) Nonce() uint64 {
+	return vr.nonce
+}
+
 func (vr *VersionRecord) String() string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(vr.stamp.Format(time.RFC3339Nano))
@@ -97,5 +125,8 @@ func (vr *VersionRecord) String() string {
 	buf.WriteString(Delimiter1)
 	buf.WriteString(vr.agent)
 
+	buf.WriteString(vr.direction())
+	buf.WriteString(vr.location())
+
 	return buf.String()
 }
@@ -0,0 +1,106 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package records
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+)
+
+// WatchHitRecord is emitted when a transaction pays to or spends from an
+// address on the watchlist. The direction is "in" for payments to the address
+// and "out" for spends from it, while the source tells whether we saw the
+// transaction in the mempool or in a block.
+type WatchHitRecord struct {
+	Record
+
+	address   string
+	direction string
+	amount    int64
+	hash      [32]byte
+	source    string
+}
+
+func NewWatchHitRecord(address string, direction string, amount int64,
+	hash [32]byte, source string, ra *net.TCPAddr,
+	la *net.TCPAddr) *WatchHitRecord {
+	record := &WatchHitRecord{
+		Record: Record{
+			stamp: time.Now(),
+			ra:    ra,
+			la:    la,
+			cmd:   "watchhit",
+		},
+
+		address:   address,
+		direction: direction,
+		amount:    amount,
+		hash:      hash,
+		source:    source,
+	}
+
+	return record
+}
+
+func (wr *WatchHitRecord) Address() string {
+	return wr.address
+}
+
+func (wr *WatchHitRecord) Direction() string {
+	return wr.direction
+}
+
+func (wr *WatchHitRecord) Amount() int64 {
+	return wr.amount
+}
+
+func (wr *WatchHitRecord) Source() string {
+	return wr.source
+}
+
+func (wr *WatchHitRecord) String() string {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(wr.stamp.Format(time.RFC3339Nano))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(wr.cmd)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(wr.ra.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(wr.la.String())
+	buf.WriteString(Delimiter1)
+	buf.WriteString(wr.address)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(wr.direction)
+	buf.WriteString(Delimiter1)
+	buf.WriteString(strconv.FormatInt(wr.amount, 10))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(hex.EncodeToString(wr.hash[:]))
+	buf.WriteString(Delimiter1)
+	buf.WriteString(wr.source)
+
+	buf.WriteString(wr.location())
+
+	return buf.String()
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package repository
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/CIRCL/pbtc/iptree"
+)
+
+const (
+	mrtTableDumpV2   = 13
+	mrtRIBIPv4       = 2
+	mrtRIBIPv6       = 4
+	bgpAttrASPath    = 2
+	bgpAttrExtLength = 0x10
+	bgpASSequence    = 2
+)
+
+// loadASN loads a prefix to autonomous system mapping from the file at the
+// given path. Files ending in .csv or .txt are read as text with one prefix
+// and AS number per line, separated by a comma or whitespace. All other files
+// are parsed as MRT TABLE_DUMP_V2 RIB dumps. Gzip and bzip2 compressed files
+// are decompressed transparently.
+func loadASN(path string) (*iptree.IPTree, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	name := path
+	var reader io.Reader = file
+
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		reader = gz
+		name = strings.TrimSuffix(name, ".gz")
+
+	case strings.HasSuffix(name, ".bz2"):
+		reader = bzip2.NewReader(file)
+		name = strings.TrimSuffix(name, ".bz2")
+	}
+
+	tree := iptree.New()
+
+	if strings.HasSuffix(name, ".csv") || strings.HasSuffix(name, ".txt") {
+		err = loadASNText(reader, tree)
+	} else {
+		err = loadASNMRT(reader, tree)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// loadASNText reads lines of the form "1.2.0.0/16,1234" or "1.2.0.0/16 1234".
+// Empty lines and lines starting with a hash are ignored, as are AS numbers
+// prefixed with "AS".
+func loadASNText(reader io.Reader, tree *iptree.IPTree) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) < 2 {
+			continue
+		}
+
+		ipnet, err := iptree.ParseNetwork(fields[0])
+		if err != nil {
+			continue
+		}
+
+		asn, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "AS"), 10,
+			32)
+		if err != nil {
+			continue
+		}
+
+		tree.Insert(ipnet, uint32(asn))
+	}
+
+	return scanner.Err()
+}
+
+// loadASNMRT reads an MRT TABLE_DUMP_V2 file as defined in RFC6396 and maps
+// each announced prefix to the origin AS of its first RIB entry.
+func loadASNMRT(reader io.Reader, tree *iptree.IPTree) error {
+	buffered := bufio.NewReader(reader)
+	hdr := make([]byte, 12)
+
+	for {
+		_, err := io.ReadFull(buffered, hdr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		mrtType := binary.BigEndian.Uint16(hdr[4:6])
+		subtype := binary.BigEndian.Uint16(hdr[6:8])
+		length := binary.BigEndian.Uint32(hdr[8:12])
+
+		body := make([]byte, length)
+		_, err = io.ReadFull(buffered, body)
+		if err != nil {
+			return err
+		}
+
+		if mrtType != mrtTableDumpV2 {
+			continue
+		}
+
+		var size int
+		switch subtype {
+		case mrtRIBIPv4:
+			size = net.IPv4len
+
+		case mrtRIBIPv6:
+			size = net.IPv6len
+
+		default:
+			continue
+		}
+
+		ipnet, asn, err := parseRIB(body, size)
+		if err != nil {
+			continue
+		}
+
+		tree.Insert(ipnet, asn)
+	}
+}
+
+// parseRIB parses a single RIB entry record and returns the prefix and the
+// origin AS of its first entry.
+func parseRIB(body []byte, size int) (*net.IPNet, uint32, error) {
+	errShort := errors.New("short RIB entry")
+
+	// skip the sequence number
+	if len(body) < 5 {
+		return nil, 0, errShort
+	}
+
+	bits := int(body[4])
+	if bits > size*8 {
+		return nil, 0, errors.New("invalid prefix length")
+	}
+
+	num := (bits + 7) / 8
+	if len(body) < 5+num+2 {
+		return nil, 0, errShort
+	}
+
+	ip := make(net.IP, size)
+	copy(ip, body[5:5+num])
+	ipnet := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, size*8)}
+
+	pos := 5 + num
+	count := binary.BigEndian.Uint16(body[pos : pos+2])
+	pos += 2
+	if count == 0 {
+		return nil, 0, errors.New("no RIB entries")
+	}
+
+	// peer index (2), originated time (4), attribute length (2)
+	if len(body) < pos+8 {
+		return nil, 0, errShort
+	}
+
+	attrLen := int(binary.BigEndian.Uint16(body[pos+6 : pos+8]))
+	pos += 8
+	if len(body) < pos+attrLen {
+		return nil, 0, errShort
+	}
+
+	asn, err := parseOrigin(body[pos : pos+attrLen])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ipnet, asn, nil
+}
+
+// parseOrigin goes through the BGP path attributes and returns the last AS of
+// the last AS_SEQUENCE segment of the AS_PATH attribute.
+func parseOrigin(attrs []byte) (uint32, error) {
+	for len(attrs) >= 3 {
+		flags := attrs[0]
+		code := attrs[1]
+
+		var length, offset int
+		if flags&bgpAttrExtLength != 0 {
+			if len(attrs) < 4 {
+				break
+			}
+
+			length = int(binary.BigEndian.Uint16(attrs[2:4]))
+			offset = 4
+		} else {
+			length = int(attrs[2])
+			offset = 3
+		}
+
+		if len(attrs) < offset+length {
+			break
+		}
+
+		value := attrs[offset : offset+length]
+		attrs = attrs[offset+length:]
+
+		if code != bgpAttrASPath {
+			continue
+		}
+
+		// TABLE_DUMP_V2 always uses four byte AS numbers
+		var origin uint32
+		found := false
+		for len(value) >= 2 {
+			segType := value[0]
+			segLen := int(value[1])
+			value = value[2:]
+			if len(value) < segLen*4 {
+				break
+			}
+
+			if segType == bgpASSequence && segLen > 0 {
+				origin = binary.BigEndian.Uint32(value[(segLen-1)*4:])
+				found = true
+			}
+
+			value = value[segLen*4:]
+		}
+
+		if found {
+			return origin, nil
+		}
+	}
+
+	return 0, errors.New("no origin AS found")
+}
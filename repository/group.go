@@ -0,0 +1,114 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package repository
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// group clusters the nodes of one network region together, so that we can
+// spread our connections across different hosting providers and networks.
+// Depending on whether an ASN table is available, a group is either an
+// autonomous system or an IP prefix.
+type group struct {
+	key          string
+	nodes        map[string]*node
+	numRetrieved uint32
+	numAttempted uint32
+	numConnected uint32
+	numSucceeded uint32
+}
+
+func newGroup(key string) *group {
+	g := &group{
+		key:   key,
+		nodes: make(map[string]*node),
+	}
+
+	return g
+}
+
+func (g *group) String() string {
+	return g.key
+}
+
+// latency returns the mean of the average ping round-trip times of the nodes
+// in the group, ignoring nodes that never answered a ping.
+func (g *group) latency() time.Duration {
+	var sum time.Duration
+	count := 0
+	for _, n := range g.nodes {
+		if n.latencyAvg == 0 {
+			continue
+		}
+
+		sum += n.latencyAvg
+		count++
+	}
+
+	if count == 0 {
+		return 0
+	}
+
+	return sum / time.Duration(count)
+}
+
+// byRetrieved allows us to sort groups so that the groups we retrieved the
+// least nodes from come first.
+type byRetrieved []*group
+
+func (groups byRetrieved) Len() int {
+	return len(groups)
+}
+
+func (groups byRetrieved) Swap(i, j int) {
+	groups[i], groups[j] = groups[j], groups[i]
+}
+
+func (groups byRetrieved) Less(i, j int) bool {
+	return groups[i].numRetrieved < groups[j].numRetrieved
+}
+
+// groupKey returns the key of the group an IP belongs to. If we have an ASN
+// table and it contains the IP, the group is the autonomous system. If not,
+// we fall back to the AS number provided by the locator, if any. Otherwise,
+// we use the /16 prefix for IPv4 and the /32 prefix for IPv6.
+func (repo *Repository) groupKey(ip net.IP, asn uint32) string {
+	if repo.asnTree != nil {
+		value, ok := repo.asnTree.Lookup(ip)
+		if ok {
+			asn = value.(uint32)
+		}
+	}
+
+	if asn != 0 {
+		return "AS" + strconv.FormatUint(uint64(asn), 10)
+	}
+
+	ip4 := ip.To4()
+	if ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String() + "/16"
+	}
+
+	return ip.Mask(net.CIDRMask(32, 128)).String() + "/32"
+}
@@ -34,6 +34,13 @@ type node struct {
 	lastAttempted time.Time
 	lastConnected time.Time
 	lastSucceeded time.Time
+	latencyMin    time.Duration
+	latencyAvg    time.Duration
+	latencyLast   time.Duration
+	group         *group
+	country       string
+	city          string
+	asn           uint32
 }
 
 func newNode(addr *net.TCPAddr) *node {
@@ -21,15 +21,31 @@
 package repository
 
 import (
+	"bytes"
 	"encoding/gob"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/wire"
+
 	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/iptree"
 )
 
+// measurement holds the ping round-trip times measured for a node.
+type measurement struct {
+	addr *net.TCPAddr
+	min  time.Duration
+	avg  time.Duration
+	last time.Duration
+}
+
 // Repository is the default implementation of the repository interface of the
 // Manager module. It creates a simply in-repoory mapping for known nodes and
 // regularly save them on the disk.
@@ -39,21 +55,28 @@ type Repository struct {
 	addrAttempted  chan *net.TCPAddr
 	addrConnected  chan *net.TCPAddr
 	addrSucceeded  chan *net.TCPAddr
+	addrMeasured   chan *measurement
 	addrRetrieve   chan chan<- *net.TCPAddr
 	sigAddr        chan struct{}
 	sigRetrieval   chan struct{}
 	tickerBackup   *time.Ticker
 	tickerPoll     *time.Ticker
+	mutex          *sync.Mutex
 	nodeIndex      map[string]*node
+	groupIndex     map[string]*group
+	asnTree        *iptree.IPTree
 	file           *os.File
 
 	log adaptor.Log
+	loc adaptor.Locator
 
 	seedsList  []string
 	seedsPort  uint16
 	backupPath string
 	backupRate time.Duration
 	nodeLimit  uint32
+	asnPath    string
+	groupsPath string
 
 	invalidRange []*ipRange
 }
@@ -63,11 +86,14 @@ type Repository struct {
 func New(options ...func(repo *Repository)) (*Repository, error) {
 	repo := &Repository{
 		wg:             &sync.WaitGroup{},
+		mutex:          &sync.Mutex{},
 		nodeIndex:      make(map[string]*node),
+		groupIndex:     make(map[string]*group),
 		addrDiscovered: make(chan *net.TCPAddr, 1),
 		addrAttempted:  make(chan *net.TCPAddr, 1),
 		addrConnected:  make(chan *net.TCPAddr, 1),
 		addrSucceeded:  make(chan *net.TCPAddr, 1),
+		addrMeasured:   make(chan *measurement, 1),
 		addrRetrieve:   make(chan chan<- *net.TCPAddr, 1),
 		sigAddr:        make(chan struct{}),
 		sigRetrieval:   make(chan struct{}),
@@ -92,6 +118,15 @@ func New(options ...func(repo *Repository)) (*Repository, error) {
 	}
 	repo.file = file
 
+	if repo.asnPath != "" {
+		tree, err := loadASN(repo.asnPath)
+		if err != nil {
+			return nil, err
+		}
+
+		repo.asnTree = tree
+	}
+
 	repo.addRange(newIPRange("0.0.0.0", "0.255.255.255"))       // RFC1700
 	repo.addRange(newIPRange("10.0.0.0", "10.255.255.255"))     // RFC1918
 	repo.addRange(newIPRange("100.64.0.0", "100.127.255.255"))  // RFC6598
@@ -145,6 +180,23 @@ func SetNodeLimit(limit uint32) func(*Repository) {
 	}
 }
 
+// SetASNPath sets the path of a file mapping IP prefixes to autonomous systems.
+// It can be an MRT RIB dump or a text file with one prefix and AS per line. If
+// it is provided, nodes will be grouped by autonomous system.
+func SetASNPath(path string) func(*Repository) {
+	return func(repo *Repository) {
+		repo.asnPath = path
+	}
+}
+
+// SetGroupsPath sets the path of the file to which the statistics of all node
+// groups are exported on every backup.
+func SetGroupsPath(path string) func(*Repository) {
+	return func(repo *Repository) {
+		repo.groupsPath = path
+	}
+}
+
 func (repo *Repository) Start() {
 	repo.log.Info("[REP] Start: begin")
 
@@ -171,6 +223,7 @@ func (repo *Repository) Stop() {
 	repo.log.Info("[REP] Stop: saving node information")
 
 	repo.save()
+	repo.export()
 
 	repo.log.Info("[REP] Stop: completed")
 }
@@ -179,6 +232,12 @@ func (repo *Repository) SetLog(log adaptor.Log) {
 	repo.log = log
 }
 
+// SetLocator injects the locator used to attach geolocation information to
+// newly discovered nodes.
+func (repo *Repository) SetLocator(loc adaptor.Locator) {
+	repo.loc = loc
+}
+
 // Discovered will submit an address that has been discovered on the Bitcoin
 // network.
 func (repo *Repository) Discovered(addr *net.TCPAddr) {
@@ -210,6 +269,15 @@ func (repo *Repository) Succeeded(addr *net.TCPAddr) {
 	repo.addrSucceeded <- addr
 }
 
+// Measured will update the minimum, average and last ping round-trip time
+// measured on the current connection to an address.
+func (repo *Repository) Measured(addr *net.TCPAddr, min time.Duration,
+	avg time.Duration, last time.Duration) {
+	repo.log.Debug("[REP] Measured: %v (%v)", addr, last)
+
+	repo.addrMeasured <- &measurement{addr: addr, min: min, avg: avg, last: last}
+}
+
 // Retrieve will send a good candidate address for connecting on the given
 // channel.
 func (repo *Repository) Retrieve(c chan<- *net.TCPAddr) {
@@ -218,6 +286,41 @@ func (repo *Repository) Retrieve(c chan<- *net.TCPAddr) {
 	repo.addrRetrieve <- c
 }
 
+// Sample returns up to the given number of randomly chosen addresses of nodes
+// that we successfully completed a handshake with during the last day. The
+// timestamp of each address is set to the time of the last handshake.
+func (repo *Repository) Sample(max int) []*wire.NetAddress {
+	repo.log.Debug("[REP] Sample: requested %v", max)
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	cutoff := time.Now().Add(-24 * time.Hour)
+	good := make([]*node, 0, len(repo.nodeIndex))
+	for _, n := range repo.nodeIndex {
+		if n.lastSucceeded.Before(cutoff) {
+			continue
+		}
+
+		good = append(good, n)
+	}
+
+	if max > len(good) {
+		max = len(good)
+	}
+
+	addrs := make([]*wire.NetAddress, 0, max)
+	for _, i := range rand.Perm(len(good))[:max] {
+		n := good[i]
+		na := wire.NewNetAddressIPPort(n.addr.IP, uint16(n.addr.Port),
+			wire.SFNodeNetwork)
+		na.Timestamp = n.lastSucceeded
+		addrs = append(addrs, na)
+	}
+
+	return addrs
+}
+
 // bootstrap will use a number of dns seeds to discover nodes.
 func (repo *Repository) bootstrap() {
 	repo.log.Info("[REP] Bootstrap: getting IPs from %v seeds",
@@ -248,6 +351,9 @@ func (repo *Repository) save() {
 		return
 	}
 
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
 	//
 	err := repo.file.Truncate(0)
 	if err != nil {
@@ -281,18 +387,132 @@ func (repo *Repository) restore() {
 		return
 	}
 
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
 	// decode the entire index using gob reading from the file
 	dec := gob.NewDecoder(repo.file)
 	err = dec.Decode(&repo.nodeIndex)
 	if err != nil {
 		return
 	}
+
+	// groups are not saved, so we need to rebuild them from the nodes
+	for _, n := range repo.nodeIndex {
+		repo.assign(n)
+	}
+}
+
+// export will write the statistics of all node groups to a CSV file on disk.
+// The latency is the mean of the average ping round-trip times of the nodes in
+// the group that answered our pings, in milliseconds.
+func (repo *Repository) export() {
+	if repo.groupsPath == "" {
+		return
+	}
+
+	repo.mutex.Lock()
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("group,nodes,retrieved,attempted,connected,succeeded,latency_ms\n")
+	for _, g := range repo.groupIndex {
+		buf.WriteString(g.key)
+		buf.WriteString(",")
+		buf.WriteString(strconv.FormatInt(int64(len(g.nodes)), 10))
+		buf.WriteString(",")
+		buf.WriteString(strconv.FormatUint(uint64(g.numRetrieved), 10))
+		buf.WriteString(",")
+		buf.WriteString(strconv.FormatUint(uint64(g.numAttempted), 10))
+		buf.WriteString(",")
+		buf.WriteString(strconv.FormatUint(uint64(g.numConnected), 10))
+		buf.WriteString(",")
+		buf.WriteString(strconv.FormatUint(uint64(g.numSucceeded), 10))
+		buf.WriteString(",")
+		buf.WriteString(strconv.FormatInt(int64(g.latency()/time.Millisecond), 10))
+		buf.WriteString("\n")
+	}
+
+	repo.mutex.Unlock()
+
+	err := ioutil.WriteFile(repo.groupsPath, buf.Bytes(), 0644)
+	if err != nil {
+		repo.log.Error("failed to export group statistics (%v)", err)
+		return
+	}
 }
 
 func (repo *Repository) addRange(ipRange *ipRange) {
 	repo.invalidRange = append(repo.invalidRange, ipRange)
 }
 
+// assign locates a node and adds it to the group its address belongs to,
+// creating the group if it doesn't exist yet. The caller needs to hold the
+// mutex.
+func (repo *Repository) assign(n *node) {
+	if repo.loc != nil {
+		n.country, n.city, n.asn = repo.loc.Locate(n.addr.IP)
+	}
+
+	key := repo.groupKey(n.addr.IP, n.asn)
+	g, ok := repo.groupIndex[key]
+	if !ok {
+		g = newGroup(key)
+		repo.groupIndex[key] = g
+	}
+
+	n.group = g
+	g.nodes[n.addr.String()] = n
+}
+
+// eligible checks whether a node is a good candidate for a new connection.
+func (repo *Repository) eligible(node *node) bool {
+	if node.numAttempts >= 1 {
+		return false
+	}
+
+	if node.lastAttempted.Add(time.Minute * 5).After(time.Now()) {
+		return false
+	}
+
+	if node.lastConnected.Before(node.lastSucceeded) {
+		return false
+	}
+
+	if node.lastSucceeded.Add(time.Minute * 15).After(time.Now()) {
+		return false
+	}
+
+	return true
+}
+
+// retrieve returns a candidate node for a new connection. In order to spread
+// our connections over as many networks as possible, we go through the
+// groups starting with the one we retrieved the least nodes from.
+func (repo *Repository) retrieve() *node {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	groups := make([]*group, 0, len(repo.groupIndex))
+	for _, g := range repo.groupIndex {
+		groups = append(groups, g)
+	}
+
+	sort.Sort(byRetrieved(groups))
+
+	for _, g := range groups {
+		for _, node := range g.nodes {
+			if !repo.eligible(node) {
+				continue
+			}
+
+			g.numRetrieved++
+			return node
+		}
+	}
+
+	return nil
+}
+
 func (repo *Repository) goRetrieval() {
 	defer repo.wg.Done()
 
@@ -305,27 +525,13 @@ retrievalLoop:
 			}
 
 		case c := <-repo.addrRetrieve:
-			for _, node := range repo.nodeIndex {
-				if node.numAttempts >= 1 {
-					continue
-				}
-
-				if node.lastAttempted.Add(time.Minute * 5).After(time.Now()) {
-					continue
-				}
-
-				if node.lastConnected.Before(node.lastSucceeded) {
-					continue
-				}
-
-				if node.lastSucceeded.Add(time.Minute * 15).After(time.Now()) {
-					continue
-				}
-
-				repo.log.Debug("[REP] %v retrieved", node)
-				c <- node.addr
-				continue retrievalLoop
+			node := repo.retrieve()
+			if node == nil {
+				continue
 			}
+
+			repo.log.Debug("[REP] %v retrieved from %v", node, node.group)
+			c <- node.addr
 		}
 	}
 }
@@ -344,15 +550,20 @@ addrLoop:
 		case <-repo.tickerBackup.C:
 			repo.log.Info("[REP] Saving node index")
 			go repo.save()
+			go repo.export()
 
 		case <-repo.tickerPoll.C:
 			repo.log.Info("[REP] Polling DNS seeds")
 			go repo.bootstrap()
 
 		case addr := <-repo.addrDiscovered:
+			repo.mutex.Lock()
 			n, ok := repo.nodeIndex[addr.String()]
 			if ok {
 				n.numSeen++
+			}
+			repo.mutex.Unlock()
+			if ok {
 				continue
 			}
 
@@ -369,13 +580,20 @@ addrLoop:
 				}
 			}
 
-			repo.log.Debug("[REP] %v discovered", addr)
+			repo.mutex.Lock()
 			n = newNode(addr)
 			repo.nodeIndex[addr.String()] = n
+			repo.assign(n)
+			repo.mutex.Unlock()
+
+			repo.log.Debug("[REP] %v discovered in %v (%v)", addr, n.group,
+				n.country)
 
 		case addr := <-repo.addrAttempted:
+			repo.mutex.Lock()
 			n, ok := repo.nodeIndex[addr.String()]
 			if !ok {
+				repo.mutex.Unlock()
 				repo.log.Warning("[REP] %v attempted unknown", addr)
 				continue
 			}
@@ -383,20 +601,28 @@ addrLoop:
 			repo.log.Debug("[REP] %v attempted", addr)
 			n.numAttempts++
 			n.lastAttempted = time.Now()
+			n.group.numAttempted++
+			repo.mutex.Unlock()
 
 		case addr := <-repo.addrConnected:
+			repo.mutex.Lock()
 			n, ok := repo.nodeIndex[addr.String()]
 			if !ok {
+				repo.mutex.Unlock()
 				repo.log.Warning("[REP] %v connected unknown", addr)
 				continue
 			}
 
 			repo.log.Debug("[REP] %v connected", addr)
 			n.lastConnected = time.Now()
+			n.group.numConnected++
+			repo.mutex.Unlock()
 
 		case addr := <-repo.addrSucceeded:
+			repo.mutex.Lock()
 			n, ok := repo.nodeIndex[addr.String()]
 			if !ok {
+				repo.mutex.Unlock()
 				repo.log.Warning("[REP] %v succeeded unknown", addr)
 				continue
 			}
@@ -404,6 +630,23 @@ addrLoop:
 			repo.log.Debug("[REP] %v succeeded", addr)
 			n.numAttempts = 0
 			n.lastSucceeded = time.Now()
+			n.group.numSucceeded++
+			repo.mutex.Unlock()
+
+		case m := <-repo.addrMeasured:
+			repo.mutex.Lock()
+			n, ok := repo.nodeIndex[m.addr.String()]
+			if !ok {
+				repo.mutex.Unlock()
+				repo.log.Warning("[REP] %v measured unknown", m.addr)
+				continue
+			}
+
+			repo.log.Debug("[REP] %v measured", m.addr)
+			n.latencyMin = m.min
+			n.latencyAvg = m.avg
+			n.latencyLast = m.last
+			repo.mutex.Unlock()
 		}
 	}
 }
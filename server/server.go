@@ -28,7 +28,6 @@ import (
 	"sync"
 
 	"github.com/CIRCL/pbtc/adaptor"
-	"github.com/CIRCL/pbtc/peer"
 )
 
 type Server struct {
@@ -108,6 +107,7 @@ func (server *Server) goListen() {
 	}
 
 	server.listener = listener
+	server.mgr.Listening(addr)
 
 	for {
 		conn, err := listener.AcceptTCP()
@@ -122,14 +122,7 @@ func (server *Server) goListen() {
 			break
 		}
 
-		// we submit the connection for peer creation
-		p, err := peer.New(
-			peer.SetConnection(conn),
-		)
-		if err != nil {
-			server.log.Warning("%v", err)
-		}
-
-		server.mgr.Incoming(p)
+		// we submit the connection to the manager for peer creation
+		server.mgr.Incoming(conn)
 	}
 }
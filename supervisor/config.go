@@ -25,6 +25,7 @@ type Config struct {
 	Logger     map[string]*LoggerConfig
 	Repository map[string]*RepositoryConfig
 	Tracker    map[string]*TrackerConfig
+	Locator    map[string]*LocatorConfig
 	Server     map[string]*ServerConfig
 	Processor  map[string]*ProcessorConfig
 	Manager    map[string]*ManagerConfig
@@ -45,6 +46,22 @@ type ManagerConfig struct {
 	Connection_rate  int
 	Connection_limit int
 	Ticker_interval  int
+	Manager_mode     string
+	Poll_timeout     int
+	Snapshot_path    string
+	Snapshot_format  string
+	Snapshot_rate    int
+	Snapshot_window  int
+	Address_relay    bool
+	Address_sample   int
+	Announce_rate    int
+	Honest_mode      bool
+	Message_capture  bool
+	Record_sent      bool
+	Record_session   bool
+	Record_latency   bool
+	Ping_rate        int
+	Import_path      []string
 }
 
 type LoggerConfig struct {
@@ -60,12 +77,15 @@ type LoggerConfig struct {
 
 type RepositoryConfig struct {
 	Logger      string
+	Locator     string
 	Log_level   string
 	Seeds_list  []string
 	Seeds_port  uint16
 	Backup_rate uint32
 	Backup_path string
 	Node_limit  uint32
+	Asn_path    string
+	Groups_path string
 }
 
 type TrackerConfig struct {
@@ -73,6 +93,13 @@ type TrackerConfig struct {
 	Log_level string
 }
 
+type LocatorConfig struct {
+	Logger        string
+	Log_level     string
+	Database_path []string
+	Cache_size    int
+}
+
 type ServerConfig struct {
 	Logger       string
 	Manager      string
@@ -81,22 +108,80 @@ type ServerConfig struct {
 }
 
 type ProcessorConfig struct {
-	Logger           string
-	Next             []string
-	Log_level        string
-	Processor_type   string
-	Address_list     []string
-	IP_list          []string
-	Command_list     []string
-	File_path        string
-	File_prefix      string
-	File_name        string
-	File_suffix      string
-	File_compression string
-	File_sizelimit   int64
-	File_agelimit    int
-	Redis_host       string
-	Redis_password   string
-	Redis_database   int64
-	Zeromq_host      string
+	Logger             string
+	Locator            string
+	Next               []string
+	Log_level          string
+	Processor_type     string
+	Address_list       []string
+	IP_list            []string
+	IP_path            []string
+	Port_list          []int
+	Match_target       string
+	Exclude_mode       bool
+	Command_list       []string
+	Country_list       []string
+	Filter_expression  string
+	Dedup_window       int
+	Dedup_limit        int
+	Dedup_annotation   bool
+	Sample_rate        float64
+	Sample_mode        string
+	Command_limit      []string
+	Peer_rate          float64
+	Peer_burst         int
+	Drop_rate          int
+	Class_list         []string
+	Protocol_list      []string
+	Prefix_list        []string
+	Payload_extraction bool
+	Value_threshold    int64
+	Class_threshold    []string
+	Value_alerts       bool
+	Alert_limit        int
+	Chain_depth        int
+	Propagation_window int
+	Relay_blocks       int
+	Relay_share        float64
+	Anomaly_window     int
+	Cluster_size       int
+	Prevout_url        string
+	Prevout_budget     int
+	Cache_size         int
+	Stats_rate         int
+	Mempool_expiry     int
+	Watchlist_path     string
+	Watch_limit        int
+	Watch_state        string
+	Group_keys         []string
+	Stats_window       int
+	Stats_slide        int
+	Stats_top          int
+	Stats_only         bool
+	Route              []string
+	Route_report       int
+	File_path          string
+	File_prefix        string
+	File_name          string
+	File_suffix        string
+	File_compression   string
+	File_sizelimit     int64
+	File_agelimit      int
+	Redis_host         string
+	Redis_password     string
+	Redis_database     int64
+	Redis_target       []string
+	Redis_channel      string
+	Redis_list         string
+	Redis_listlimit    int64
+	Redis_stream       string
+	Redis_streamlimit  int64
+	Redis_store        string
+	Redis_expiry       int
+	Redis_batch        int
+	Redis_flush        int
+	Zeromq_host        string
+	Zeromq_socket      string
+	Zeromq_connect     bool
+	Zeromq_format      []string
 }
@@ -22,6 +22,9 @@ package supervisor
 
 import (
 	"errors"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"code.google.com/p/gcfg"
@@ -29,6 +32,7 @@ import (
 	"github.com/op/go-logging"
 
 	"github.com/CIRCL/pbtc/adaptor"
+	"github.com/CIRCL/pbtc/locator"
 	"github.com/CIRCL/pbtc/logger"
 	"github.com/CIRCL/pbtc/manager"
 	"github.com/CIRCL/pbtc/processor"
@@ -37,13 +41,20 @@ import (
 	"github.com/CIRCL/pbtc/tracker"
 )
 
+// locatable is implemented by processors that need a locator.
+type locatable interface {
+	SetLocator(adaptor.Locator)
+}
+
 type Supervisor struct {
 	logr    map[string]adaptor.Logger
 	repo    map[string]adaptor.Repository
 	tkr     map[string]adaptor.Tracker
+	loc     map[string]adaptor.Locator
 	svr     map[string]adaptor.Server
 	pro     map[string]adaptor.Processor
 	mgr     map[string]adaptor.Manager
+	order   []string
 	log     adaptor.Log
 	options []interface{}
 }
@@ -61,6 +72,7 @@ func New() (*Supervisor, error) {
 		logr: make(map[string]adaptor.Logger),
 		repo: make(map[string]adaptor.Repository),
 		tkr:  make(map[string]adaptor.Tracker),
+		loc:  make(map[string]adaptor.Locator),
 		svr:  make(map[string]adaptor.Server),
 		pro:  make(map[string]adaptor.Processor),
 		mgr:  make(map[string]adaptor.Manager),
@@ -130,8 +142,15 @@ func New() (*Supervisor, error) {
 		supervisor.repo[name] = repo
 	}
 
+	// trackers root their header chain at the genesis block of the network
+	// used by their managers
+	networks, err := trackerNetworks(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	for name, tkr_cfg := range cfg.Tracker {
-		tkr, err := initTracker(tkr_cfg)
+		tkr, err := initTracker(tkr_cfg, networks[name])
 		if err != nil {
 			supervisor.log.Warning("[SUP] Init: tracker init failed (%v)", err)
 			continue
@@ -140,6 +159,16 @@ func New() (*Supervisor, error) {
 		supervisor.tkr[name] = tkr
 	}
 
+	for name, loc_cfg := range cfg.Locator {
+		loc, err := initLocator(loc_cfg)
+		if err != nil {
+			supervisor.log.Warning("[SUP] Init: locator init failed (%v)", err)
+			continue
+		}
+
+		supervisor.loc[name] = loc
+	}
+
 	for name, svr_cfg := range cfg.Server {
 		svr, err := initServer(svr_cfg)
 		if err != nil {
@@ -150,8 +179,10 @@ func New() (*Supervisor, error) {
 		supervisor.svr[name] = svr
 	}
 
+	// processors with the same prevout url and cache size share one cache
+	caches := make(map[string]*processor.UTXOCache)
 	for name, pro_cfg := range cfg.Processor {
-		pro, err := initProcessor(pro_cfg)
+		pro, err := initProcessor(pro_cfg, caches)
 		if err != nil {
 			supervisor.log.Warning("[SUP] Init: proc init failed (%v)", err)
 			continue
@@ -185,7 +216,13 @@ func New() (*Supervisor, error) {
 
 	if len(supervisor.tkr) == 0 {
 		supervisor.log.Warning("[SUP] Init: missing tracker module")
-		tkr, err := tracker.New()
+		options := make([]func(*tracker.Tracker), 0)
+		for _, network := range networks {
+			options = append(options, tracker.SetNetwork(network))
+			break
+		}
+
+		tkr, err := tracker.New(options...)
 		if err != nil {
 			return nil, err
 		}
@@ -203,6 +240,10 @@ func New() (*Supervisor, error) {
 		supervisor.mgr["default"] = mgr
 	}
 
+	if len(supervisor.loc) == 0 {
+		supervisor.log.Notice("[SUP] Init: no locator module")
+	}
+
 	if len(supervisor.svr) == 0 {
 		supervisor.log.Notice("[SUP] Init: no server module")
 	}
@@ -272,6 +313,27 @@ func New() (*Supervisor, error) {
 		logr.SetLevel(log, level)
 	}
 
+	for key, loc := range supervisor.loc {
+		loc_cfg, ok := cfg.Locator[key]
+		if !ok {
+			continue
+		}
+
+		logr, ok := supervisor.logr[loc_cfg.Logger]
+		if !ok {
+			logr = supervisor.logr[""]
+		}
+
+		level, err := logger.ParseLevel(loc_cfg.Log_level)
+		if err != nil {
+			level = logging.CRITICAL
+		}
+
+		log := "loc___" + key
+		loc.SetLog(logr.GetLog(log))
+		logr.SetLevel(log, level)
+	}
+
 	for key, svr := range supervisor.svr {
 		svr_cfg, ok := cfg.Server[key]
 		if !ok {
@@ -355,6 +417,55 @@ func New() (*Supervisor, error) {
 		svr.SetManager(mgr)
 	}
 
+	// inject locator into repository
+	for key, repo := range supervisor.repo {
+		repo_cfg, ok := cfg.Repository[key]
+		if !ok {
+			continue
+		}
+
+		loc, ok := supervisor.loc[repo_cfg.Locator]
+		if !ok {
+			for _, def := range supervisor.loc {
+				loc = def
+				break
+			}
+		}
+
+		if loc == nil {
+			continue
+		}
+
+		repo.SetLocator(loc)
+	}
+
+	// inject locator into processors that use geolocation
+	for key, pro := range supervisor.pro {
+		pro_cfg, ok := cfg.Processor[key]
+		if !ok {
+			continue
+		}
+
+		geo, ok := pro.(locatable)
+		if !ok {
+			continue
+		}
+
+		loc, ok := supervisor.loc[pro_cfg.Locator]
+		if !ok {
+			for _, def := range supervisor.loc {
+				loc = def
+				break
+			}
+		}
+
+		if loc == nil {
+			continue
+		}
+
+		geo.SetLocator(loc)
+	}
+
 	// inject repository into manager
 	for key, mgr := range supervisor.mgr {
 		mgr_cfg, ok := cfg.Manager[key]
@@ -388,6 +499,11 @@ func New() (*Supervisor, error) {
 			}
 		}
 
+		if tkr.Network() != managerNetwork(mgr_cfg) {
+			return nil, errors.New("tracker network differs for manager: " +
+				key)
+		}
+
 		mgr.SetTracker(tkr)
 	}
 
@@ -408,7 +524,9 @@ func New() (*Supervisor, error) {
 		}
 	}
 
-	// inject processors into processors
+	// inject processors into processors, remembering the links so we can
+	// stop them in order
+	links := make(map[string][]string)
 	for key, pro := range supervisor.pro {
 		pro_cfg, ok := cfg.Processor[key]
 		if !ok {
@@ -422,6 +540,54 @@ func New() (*Supervisor, error) {
 			}
 
 			pro.AddNext(next)
+			links[key] = append(links[key], name)
+		}
+	}
+
+	// inject routes into routers
+	for key, pro := range supervisor.pro {
+		router, ok := pro.(*processor.Router)
+		if !ok {
+			continue
+		}
+
+		pro_cfg, ok := cfg.Processor[key]
+		if !ok {
+			continue
+		}
+
+		for _, entry := range pro_cfg.Route {
+			parts := strings.SplitN(entry, ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("invalid route: " + entry)
+			}
+
+			next, ok := supervisor.pro[parts[1]]
+			if !ok {
+				return nil, errors.New("invalid route processor: " + parts[1])
+			}
+
+			router.AddRoute(parts[0], next)
+			links[key] = append(links[key], parts[1])
+		}
+	}
+
+	supervisor.order = upstreamOrder(supervisor.pro, links)
+
+	// the propagation analyzer tells answers to our requests apart from
+	// announcements using the records of the requests we sent
+	for key := range supervisor.mgr {
+		mgr_cfg, ok := cfg.Manager[key]
+		if !ok || mgr_cfg.Record_sent {
+			continue
+		}
+
+		for name := range downstream(mgr_cfg.Processor, links) {
+			_, ok := supervisor.pro[name].(*processor.PropagationAnalyzer)
+			if ok {
+				supervisor.log.Warning("[SUP] Init: manager %v feeds "+
+					"propagation analyzer %v without record-sent", key, name)
+			}
 		}
 	}
 
@@ -430,6 +596,66 @@ func New() (*Supervisor, error) {
 	return supervisor, nil
 }
 
+// upstreamOrder returns the names of the processors in an order where each one
+// comes before the processors it forwards records to. Cycles are broken
+// arbitrarily.
+func upstreamOrder(pros map[string]adaptor.Processor,
+	links map[string][]string) []string {
+	names := make([]string, 0, len(pros))
+	for name := range pros {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	// a depth-first search adds each processor after all processors it
+	// forwards to, so we reverse the result at the end
+	order := make([]string, 0, len(names))
+	visited := make(map[string]bool)
+	var visit func(string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+
+		visited[name] = true
+		for _, next := range links[name] {
+			visit(next)
+		}
+
+		order = append(order, name)
+	}
+
+	for _, name := range names {
+		visit(name)
+	}
+
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+
+	return order
+}
+
+// downstream returns the names of the given processors and all processors
+// they forward records to, directly or indirectly.
+func downstream(names []string, links map[string][]string) map[string]bool {
+	reached := make(map[string]bool)
+	queue := append([]string(nil), names...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if reached[name] {
+			continue
+		}
+
+		reached[name] = true
+		queue = append(queue, links[name]...)
+	}
+
+	return reached
+}
+
 func initLogger(lgr_cfg *LoggerConfig) (adaptor.Logger, error) {
 	options := make([]func(*logger.GologgingLogger), 0)
 
@@ -514,15 +740,74 @@ func initRepository(repo_cfg *RepositoryConfig) (adaptor.Repository, error) {
 		}
 	}
 
+	if repo_cfg.Asn_path != "" {
+		path := repo_cfg.Asn_path
+		options = append(options, repository.SetASNPath(path))
+	}
+
+	if repo_cfg.Groups_path != "" {
+		path := repo_cfg.Groups_path
+		options = append(options, repository.SetGroupsPath(path))
+	}
+
 	return repository.New(options...)
 }
 
-func initTracker(tkr_cfg *TrackerConfig) (adaptor.Tracker, error) {
+func initTracker(tkr_cfg *TrackerConfig,
+	network wire.BitcoinNet) (adaptor.Tracker, error) {
 	options := make([]func(*tracker.Tracker), 0)
 
+	if network != 0 {
+		options = append(options, tracker.SetNetwork(network))
+	}
+
 	return tracker.New(options...)
 }
 
+// trackerNetworks returns the network of the managers using each tracker, as
+// a tracker can only follow the header chain of one network.
+func trackerNetworks(cfg *Config) (map[string]wire.BitcoinNet, error) {
+	networks := make(map[string]wire.BitcoinNet)
+	for _, mgr_cfg := range cfg.Manager {
+		network := managerNetwork(mgr_cfg)
+		other, ok := networks[mgr_cfg.Tracker]
+		if ok && other != network {
+			return nil, errors.New("managers on different networks share " +
+				"tracker: " + mgr_cfg.Tracker)
+		}
+
+		networks[mgr_cfg.Tracker] = network
+	}
+
+	return networks, nil
+}
+
+// managerNetwork returns the network a manager is configured for; like the
+// manager itself, we default to testnet.
+func managerNetwork(mgr_cfg *ManagerConfig) wire.BitcoinNet {
+	if mgr_cfg.Protocol_magic == 0 {
+		return wire.TestNet3
+	}
+
+	return wire.BitcoinNet(mgr_cfg.Protocol_magic)
+}
+
+func initLocator(loc_cfg *LocatorConfig) (adaptor.Locator, error) {
+	options := make([]func(*locator.Locator), 0)
+
+	if len(loc_cfg.Database_path) > 0 {
+		paths := loc_cfg.Database_path
+		options = append(options, locator.SetDatabasePaths(paths...))
+	}
+
+	if loc_cfg.Cache_size != 0 {
+		size := loc_cfg.Cache_size
+		options = append(options, locator.SetCacheSize(size))
+	}
+
+	return locator.New(options...)
+}
+
 func initServer(svr_cfg *ServerConfig) (adaptor.Server, error) {
 	options := make([]func(*server.Server), 0)
 
@@ -534,7 +819,8 @@ func initServer(svr_cfg *ServerConfig) (adaptor.Server, error) {
 	return server.New(options...)
 }
 
-func initProcessor(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+func initProcessor(pro_cfg *ProcessorConfig,
+	caches map[string]*processor.UTXOCache) (adaptor.Processor, error) {
 	pType, err := processor.ParseType(pro_cfg.Processor_type)
 	if err != nil {
 		return nil, err
@@ -559,6 +845,54 @@ func initProcessor(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
 	case processor.ZeroMQWriterType:
 		return initZeroMQWriter(pro_cfg)
 
+	case processor.GeoEnricherType:
+		return processor.NewGeoEnricher()
+
+	case processor.GeoFilterType:
+		return initGeoFilter(pro_cfg)
+
+	case processor.ChainAnalyzerType:
+		return initChainAnalyzer(pro_cfg)
+
+	case processor.PropagationAnalyzerType:
+		return initPropagationAnalyzer(pro_cfg)
+
+	case processor.FingerprintAnalyzerType:
+		return initFingerprintAnalyzer(pro_cfg)
+
+	case processor.MempoolAnalyzerType:
+		return initMempoolAnalyzer(pro_cfg, caches)
+
+	case processor.WatchlistAnalyzerType:
+		return initWatchlistAnalyzer(pro_cfg)
+
+	case processor.ScriptFilterType:
+		return initScriptFilter(pro_cfg)
+
+	case processor.ValueFilterType:
+		return initValueFilter(pro_cfg, caches)
+
+	case processor.ExpressionFilterType:
+		return initExpressionFilter(pro_cfg)
+
+	case processor.DedupFilterType:
+		return initDedupFilter(pro_cfg)
+
+	case processor.SampleFilterType:
+		return initSampleFilter(pro_cfg)
+
+	case processor.StatsAnalyzerType:
+		return initStatsAnalyzer(pro_cfg)
+
+	case processor.RouterType:
+		return initRouter(pro_cfg)
+
+	case processor.CaptureWriterType:
+		return initCaptureWriter(pro_cfg)
+
+	case processor.PcapWriterType:
+		return initPcapWriter(pro_cfg)
+
 	default:
 		return nil, errors.New("invalid processor type")
 	}
@@ -594,9 +928,368 @@ func initIPFilter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
 		options = append(options, processor.SetIPs(ips...))
 	}
 
+	if len(pro_cfg.IP_path) > 0 {
+		paths := pro_cfg.IP_path
+		options = append(options, processor.SetIPPaths(paths...))
+	}
+
+	if len(pro_cfg.Port_list) > 0 {
+		ports := pro_cfg.Port_list
+		options = append(options, processor.SetPorts(ports...))
+	}
+
+	if pro_cfg.Match_target != "" {
+		target := pro_cfg.Match_target
+		options = append(options, processor.SetMatchTarget(target))
+	}
+
+	if pro_cfg.Exclude_mode {
+		options = append(options, processor.SetExcludeMode(true))
+	}
+
 	return processor.NewIPFilter(options...)
 }
 
+func initExpressionFilter(pro_cfg *ProcessorConfig) (adaptor.Processor,
+	error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if pro_cfg.Filter_expression != "" {
+		src := pro_cfg.Filter_expression
+		options = append(options, processor.SetExpression(src))
+	}
+
+	return processor.NewExpressionFilter(options...)
+}
+
+func initDedupFilter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if len(pro_cfg.Command_list) > 0 {
+		commands := pro_cfg.Command_list
+		options = append(options, processor.SetDedupCommands(commands...))
+	}
+
+	if pro_cfg.Dedup_window != 0 {
+		window := time.Duration(pro_cfg.Dedup_window) * time.Second
+		options = append(options, processor.SetDedupWindow(window))
+	}
+
+	if pro_cfg.Dedup_limit != 0 {
+		limit := pro_cfg.Dedup_limit
+		options = append(options, processor.SetDedupLimit(limit))
+	}
+
+	if pro_cfg.Dedup_annotation {
+		options = append(options, processor.SetAnnotation(true))
+	}
+
+	return processor.NewDedupFilter(options...)
+}
+
+func initSampleFilter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if len(pro_cfg.Command_list) > 0 {
+		commands := pro_cfg.Command_list
+		options = append(options, processor.SetSampleCommands(commands...))
+	}
+
+	if pro_cfg.Sample_rate != 0 {
+		rate := pro_cfg.Sample_rate
+		options = append(options, processor.SetSampleRate(rate))
+	}
+
+	if pro_cfg.Sample_mode != "" {
+		mode := pro_cfg.Sample_mode
+		options = append(options, processor.SetSampleMode(mode))
+	}
+
+	for _, entry := range pro_cfg.Command_limit {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 {
+			return nil, errors.New("invalid command limit: " + entry)
+		}
+
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, err
+		}
+
+		burst := 0
+		if len(parts) == 3 {
+			burst, err = strconv.Atoi(parts[2])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		options = append(options,
+			processor.SetCommandLimit(parts[0], rate, burst))
+	}
+
+	if pro_cfg.Peer_rate != 0 {
+		rate := pro_cfg.Peer_rate
+		burst := pro_cfg.Peer_burst
+		options = append(options, processor.SetPeerLimit(rate, burst))
+	}
+
+	if pro_cfg.Drop_rate != 0 {
+		interval := time.Duration(pro_cfg.Drop_rate) * time.Second
+		options = append(options, processor.SetDropRate(interval))
+	}
+
+	return processor.NewSampleFilter(options...)
+}
+
+func initGeoFilter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if len(pro_cfg.Country_list) > 0 {
+		countries := pro_cfg.Country_list
+		options = append(options, processor.SetCountries(countries...))
+	}
+
+	return processor.NewGeoFilter(options...)
+}
+
+func initScriptFilter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if len(pro_cfg.Class_list) > 0 {
+		classes := pro_cfg.Class_list
+		options = append(options, processor.SetClasses(classes...))
+	}
+
+	if len(pro_cfg.Protocol_list) > 0 {
+		protocols := pro_cfg.Protocol_list
+		options = append(options, processor.SetProtocols(protocols...))
+	}
+
+	if len(pro_cfg.Prefix_list) > 0 {
+		prefixes := pro_cfg.Prefix_list
+		options = append(options, processor.SetPrefixes(prefixes...))
+	}
+
+	if pro_cfg.Payload_extraction {
+		options = append(options, processor.SetExtraction(true))
+	}
+
+	return processor.NewScriptFilter(options...)
+}
+
+// prevoutCache returns the cache for the prevout url and cache size of a
+// processor, creating it and its REST source the first time they are used.
+func prevoutCache(pro_cfg *ProcessorConfig,
+	caches map[string]*processor.UTXOCache) *processor.UTXOCache {
+	key := pro_cfg.Prevout_url + " " + strconv.Itoa(pro_cfg.Cache_size)
+	cache, ok := caches[key]
+	if ok {
+		return cache
+	}
+
+	var source processor.PrevoutSource
+	if pro_cfg.Prevout_url != "" {
+		source = processor.NewRESTSource(pro_cfg.Prevout_url)
+	}
+
+	cache = processor.NewUTXOCache(pro_cfg.Cache_size, source)
+	caches[key] = cache
+
+	return cache
+}
+
+func initValueFilter(pro_cfg *ProcessorConfig,
+	caches map[string]*processor.UTXOCache) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	cache := prevoutCache(pro_cfg, caches)
+	options = append(options, processor.SetUTXOCache(cache))
+
+	if pro_cfg.Prevout_budget != 0 {
+		budget := time.Duration(pro_cfg.Prevout_budget) * time.Millisecond
+		options = append(options, processor.SetPrevoutBudget(budget))
+	}
+
+	if pro_cfg.Value_threshold != 0 {
+		threshold := pro_cfg.Value_threshold
+		options = append(options, processor.SetValueThreshold(threshold))
+	}
+
+	for _, entry := range pro_cfg.Class_threshold {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid class threshold: " + entry)
+		}
+
+		threshold, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options,
+			processor.SetClassThreshold(parts[0], threshold))
+	}
+
+	if pro_cfg.Value_alerts {
+		options = append(options, processor.SetValueAlerts(true))
+	}
+
+	if pro_cfg.Alert_limit != 0 {
+		limit := pro_cfg.Alert_limit
+		options = append(options, processor.SetAlertLimit(limit))
+	}
+
+	return processor.NewValueFilter(options...)
+}
+
+func initChainAnalyzer(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if pro_cfg.Chain_depth != 0 {
+		depth := pro_cfg.Chain_depth
+		options = append(options, processor.SetChainDepth(depth))
+	}
+
+	return processor.NewChainAnalyzer(options...)
+}
+
+func initPropagationAnalyzer(pro_cfg *ProcessorConfig) (adaptor.Processor,
+	error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if pro_cfg.Propagation_window != 0 {
+		window := time.Duration(pro_cfg.Propagation_window) * time.Second
+		options = append(options, processor.SetPropagationWindow(window))
+	}
+
+	if pro_cfg.Relay_blocks != 0 || pro_cfg.Relay_share != 0 {
+		blocks := pro_cfg.Relay_blocks
+		if blocks == 0 {
+			blocks = 10
+		}
+
+		share := pro_cfg.Relay_share
+		if share == 0 {
+			share = 0.5
+		}
+
+		options = append(options, processor.SetRelayThreshold(blocks, share))
+	}
+
+	return processor.NewPropagationAnalyzer(options...)
+}
+
+func initFingerprintAnalyzer(pro_cfg *ProcessorConfig) (adaptor.Processor,
+	error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if pro_cfg.Anomaly_window != 0 {
+		window := time.Duration(pro_cfg.Anomaly_window) * time.Second
+		options = append(options, processor.SetAnomalyWindow(window))
+	}
+
+	if pro_cfg.Cluster_size != 0 {
+		size := pro_cfg.Cluster_size
+		options = append(options, processor.SetClusterSize(size))
+	}
+
+	return processor.NewFingerprintAnalyzer(options...)
+}
+
+func initMempoolAnalyzer(pro_cfg *ProcessorConfig,
+	caches map[string]*processor.UTXOCache) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	cache := prevoutCache(pro_cfg, caches)
+	options = append(options, processor.SetUTXOCache(cache))
+
+	if pro_cfg.Prevout_budget != 0 {
+		budget := time.Duration(pro_cfg.Prevout_budget) * time.Millisecond
+		options = append(options, processor.SetPrevoutBudget(budget))
+	}
+
+	if pro_cfg.Stats_rate != 0 {
+		rate := time.Duration(pro_cfg.Stats_rate) * time.Second
+		options = append(options, processor.SetStatsRate(rate))
+	}
+
+	if pro_cfg.Mempool_expiry != 0 {
+		expiry := time.Duration(pro_cfg.Mempool_expiry) * time.Second
+		options = append(options, processor.SetMempoolExpiry(expiry))
+	}
+
+	return processor.NewMempoolAnalyzer(options...)
+}
+
+func initWatchlistAnalyzer(pro_cfg *ProcessorConfig) (adaptor.Processor,
+	error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if pro_cfg.Watchlist_path != "" {
+		path := pro_cfg.Watchlist_path
+		options = append(options, processor.SetWatchlistPath(path))
+	}
+
+	if len(pro_cfg.Address_list) > 0 {
+		addresses := pro_cfg.Address_list
+		options = append(options, processor.SetWatchedAddresses(addresses...))
+	}
+
+	if pro_cfg.Watch_limit != 0 {
+		limit := pro_cfg.Watch_limit
+		options = append(options, processor.SetWatchLimit(limit))
+	}
+
+	if pro_cfg.Watch_state != "" {
+		path := pro_cfg.Watch_state
+		options = append(options, processor.SetWatchState(path))
+	}
+
+	return processor.NewWatchlistAnalyzer(options...)
+}
+
+func initStatsAnalyzer(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if len(pro_cfg.Group_keys) > 0 {
+		keys := pro_cfg.Group_keys
+		options = append(options, processor.SetGroupKeys(keys...))
+	}
+
+	if pro_cfg.Stats_window != 0 {
+		window := time.Duration(pro_cfg.Stats_window) * time.Second
+		options = append(options, processor.SetStatsWindow(window))
+	}
+
+	if pro_cfg.Stats_slide != 0 {
+		slide := time.Duration(pro_cfg.Stats_slide) * time.Second
+		options = append(options, processor.SetStatsSlide(slide))
+	}
+
+	if pro_cfg.Stats_top != 0 {
+		top := pro_cfg.Stats_top
+		options = append(options, processor.SetStatsTop(top))
+	}
+
+	if pro_cfg.Stats_only {
+		options = append(options, processor.SetStatsOnly(true))
+	}
+
+	return processor.NewStatsAnalyzer(options...)
+}
+
+func initRouter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if pro_cfg.Route_report != 0 {
+		rate := time.Duration(pro_cfg.Route_report) * time.Second
+		options = append(options, processor.SetRouteReport(rate))
+	}
+
+	return processor.NewRouter(options...)
+}
+
 func initFileWriter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
 	options := make([]func(adaptor.Processor), 0)
 
@@ -633,6 +1326,68 @@ func initFileWriter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
 	return processor.NewFileWriter(options...)
 }
 
+func initCaptureWriter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if pro_cfg.File_path != "" {
+		path := pro_cfg.File_path
+		options = append(options, processor.SetCapturePath(path))
+	}
+
+	if pro_cfg.File_prefix != "" {
+		prefix := pro_cfg.File_prefix
+		options = append(options, processor.SetCapturePrefix(prefix))
+	}
+
+	if pro_cfg.File_name != "" {
+		name := pro_cfg.File_name
+		options = append(options, processor.SetCaptureName(name))
+	}
+
+	if pro_cfg.File_sizelimit != 0 {
+		sizelimit := pro_cfg.File_sizelimit
+		options = append(options, processor.SetCaptureSizelimit(sizelimit))
+	}
+
+	if pro_cfg.File_agelimit != 0 {
+		agelimit := time.Duration(pro_cfg.File_agelimit) * time.Second
+		options = append(options, processor.SetCaptureAgelimit(agelimit))
+	}
+
+	return processor.NewCaptureWriter(options...)
+}
+
+func initPcapWriter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
+	options := make([]func(adaptor.Processor), 0)
+
+	if pro_cfg.File_path != "" {
+		path := pro_cfg.File_path
+		options = append(options, processor.SetPcapPath(path))
+	}
+
+	if pro_cfg.File_prefix != "" {
+		prefix := pro_cfg.File_prefix
+		options = append(options, processor.SetPcapPrefix(prefix))
+	}
+
+	if pro_cfg.File_name != "" {
+		name := pro_cfg.File_name
+		options = append(options, processor.SetPcapName(name))
+	}
+
+	if pro_cfg.File_sizelimit != 0 {
+		sizelimit := pro_cfg.File_sizelimit
+		options = append(options, processor.SetPcapSizelimit(sizelimit))
+	}
+
+	if pro_cfg.File_agelimit != 0 {
+		agelimit := time.Duration(pro_cfg.File_agelimit) * time.Second
+		options = append(options, processor.SetPcapAgelimit(agelimit))
+	}
+
+	return processor.NewPcapWriter(options...)
+}
+
 func initRedisWriter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
 	options := make([]func(adaptor.Processor), 0)
 
@@ -651,6 +1406,56 @@ func initRedisWriter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
 		options = append(options, processor.SetRedisDatabase(database))
 	}
 
+	if len(pro_cfg.Redis_target) > 0 {
+		targets := pro_cfg.Redis_target
+		options = append(options, processor.SetRedisTargets(targets...))
+	}
+
+	if pro_cfg.Redis_channel != "" {
+		channel := pro_cfg.Redis_channel
+		options = append(options, processor.SetRedisChannel(channel))
+	}
+
+	if pro_cfg.Redis_list != "" {
+		list := pro_cfg.Redis_list
+		options = append(options, processor.SetRedisList(list))
+	}
+
+	if pro_cfg.Redis_listlimit != 0 {
+		limit := pro_cfg.Redis_listlimit
+		options = append(options, processor.SetRedisListLimit(limit))
+	}
+
+	if pro_cfg.Redis_stream != "" {
+		stream := pro_cfg.Redis_stream
+		options = append(options, processor.SetRedisStream(stream))
+	}
+
+	if pro_cfg.Redis_streamlimit != 0 {
+		limit := pro_cfg.Redis_streamlimit
+		options = append(options, processor.SetRedisStreamLimit(limit))
+	}
+
+	if pro_cfg.Redis_store != "" {
+		store := pro_cfg.Redis_store
+		options = append(options, processor.SetRedisStore(store))
+	}
+
+	if pro_cfg.Redis_expiry != 0 {
+		expiry := time.Duration(pro_cfg.Redis_expiry) * time.Second
+		options = append(options, processor.SetRedisExpiry(expiry))
+	}
+
+	if pro_cfg.Redis_batch != 0 {
+		batch := pro_cfg.Redis_batch
+		options = append(options, processor.SetRedisBatch(batch))
+	}
+
+	if pro_cfg.Redis_flush != 0 {
+		flush := time.Duration(pro_cfg.Redis_flush) * time.Millisecond
+		options = append(options, processor.SetRedisFlush(flush))
+	}
+
 	return processor.NewRedisWriter(options...)
 }
 
@@ -662,6 +1467,20 @@ func initZeroMQWriter(pro_cfg *ProcessorConfig) (adaptor.Processor, error) {
 		options = append(options, processor.SetZeromqHost(host))
 	}
 
+	if pro_cfg.Zeromq_socket != "" {
+		socket := pro_cfg.Zeromq_socket
+		options = append(options, processor.SetZeromqSocket(socket))
+	}
+
+	if pro_cfg.Zeromq_connect {
+		options = append(options, processor.SetZeromqConnect(true))
+	}
+
+	if len(pro_cfg.Zeromq_format) > 0 {
+		formats := pro_cfg.Zeromq_format
+		options = append(options, processor.SetZeromqFormats(formats...))
+	}
+
 	return processor.NewZeroMQWriter(options...)
 }
 
@@ -693,6 +1512,93 @@ func initManager(mgr_cfg *ManagerConfig) (adaptor.Manager, error) {
 		options = append(options, manager.SetTickerInterval(interval))
 	}
 
+	if mgr_cfg.Manager_mode != "" {
+		mode, err := manager.ParseMode(mgr_cfg.Manager_mode)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, manager.SetMode(mode))
+	}
+
+	if mgr_cfg.Poll_timeout != 0 {
+		timeout := time.Second * time.Duration(mgr_cfg.Poll_timeout)
+		options = append(options, manager.SetPollTimeout(timeout))
+	}
+
+	if mgr_cfg.Snapshot_path != "" {
+		path := mgr_cfg.Snapshot_path
+		options = append(options, manager.SetSnapshotPath(path))
+	}
+
+	if mgr_cfg.Snapshot_format != "" {
+		format, err := manager.ParseSnapshotFormat(mgr_cfg.Snapshot_format)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, manager.SetSnapshotFormat(format))
+	}
+
+	if mgr_cfg.Snapshot_rate != 0 {
+		rate := time.Second * time.Duration(mgr_cfg.Snapshot_rate)
+		options = append(options, manager.SetSnapshotRate(rate))
+	}
+
+	if mgr_cfg.Snapshot_window != 0 {
+		window := time.Second * time.Duration(mgr_cfg.Snapshot_window)
+		options = append(options, manager.SetSnapshotWindow(window))
+	}
+
+	if mgr_cfg.Address_relay {
+		options = append(options, manager.SetAddressRelay(true))
+	}
+
+	if mgr_cfg.Address_sample != 0 {
+		options = append(options,
+			manager.SetAddressSample(mgr_cfg.Address_sample))
+	}
+
+	if mgr_cfg.Announce_rate != 0 {
+		rate := time.Second * time.Duration(mgr_cfg.Announce_rate)
+		options = append(options, manager.SetAnnounceRate(rate))
+	}
+
+	if mgr_cfg.Honest_mode {
+		options = append(options, manager.SetHonest(true))
+	}
+
+	if mgr_cfg.Message_capture {
+		options = append(options, manager.SetCapture(true))
+	}
+
+	if mgr_cfg.Record_sent {
+		options = append(options, manager.SetRecordSent(true))
+	}
+
+	if mgr_cfg.Record_session {
+		options = append(options, manager.SetRecordSession(true))
+	}
+
+	if mgr_cfg.Record_latency {
+		options = append(options, manager.SetRecordLatency(true))
+	}
+
+	if mgr_cfg.Ping_rate < 0 {
+		return nil, errors.New("invalid ping rate: " +
+			strconv.Itoa(mgr_cfg.Ping_rate))
+	}
+
+	if mgr_cfg.Ping_rate != 0 {
+		rate := time.Second * time.Duration(mgr_cfg.Ping_rate)
+		options = append(options, manager.SetPingRate(rate))
+	}
+
+	if len(mgr_cfg.Import_path) > 0 {
+		paths := mgr_cfg.Import_path
+		options = append(options, manager.SetImportPaths(paths...))
+	}
+
 	return manager.New(options...)
 }
 
@@ -717,6 +1623,12 @@ func (supervisor *Supervisor) Start() {
 		tkr.Start()
 	}
 
+	supervisor.log.Info("[SUP] Start: starting locators")
+
+	for _, loc := range supervisor.loc {
+		loc.Start()
+	}
+
 	supervisor.log.Info("[SUP] Start: starting servers")
 
 	for _, svr := range supervisor.svr {
@@ -749,8 +1661,10 @@ func (supervisor *Supervisor) Stop() {
 
 	supervisor.log.Info("[SUP] Stop: stopping processors")
 
-	for _, pro := range supervisor.pro {
-		pro.Stop()
+	// processors may forward records when they stop, so the processors they
+	// forward to are only stopped after them
+	for _, name := range supervisor.order {
+		supervisor.pro[name].Stop()
 	}
 
 	supervisor.log.Info("[SUP] Stop: stopping servers")
@@ -759,6 +1673,12 @@ func (supervisor *Supervisor) Stop() {
 		svr.Stop()
 	}
 
+	supervisor.log.Info("[SUP] Stop: stopping locators")
+
+	for _, loc := range supervisor.loc {
+		loc.Stop()
+	}
+
 	supervisor.log.Info("[SUP] Stop: stopping trackers")
 
 	for _, tkr := range supervisor.tkr {
@@ -779,3 +1699,18 @@ func (supervisor *Supervisor) Stop() {
 
 	supervisor.log.Info("[SUP] Stop: completed")
 }
+
+// Reload reloads the external data used by modules, such as the geolocation
+// databases, without interrupting execution.
+func (supervisor *Supervisor) Reload() {
+	supervisor.log.Info("[SUP] Reload: begin")
+
+	for _, loc := range supervisor.loc {
+		err := loc.Reload()
+		if err != nil {
+			supervisor.log.Warning("[SUP] Reload: locator failed (%v)", err)
+		}
+	}
+
+	supervisor.log.Info("[SUP] Reload: completed")
+}
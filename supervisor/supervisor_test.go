@@ -0,0 +1,141 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package supervisor
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestTrackerNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		managers map[string]*ManagerConfig
+		networks map[string]wire.BitcoinNet
+		valid    bool
+	}{
+		{
+			"default network",
+			map[string]*ManagerConfig{"a": {}},
+			map[string]wire.BitcoinNet{"": wire.TestNet3},
+			true,
+		},
+		{
+			"main network",
+			map[string]*ManagerConfig{
+				"a": {Tracker: "main", Protocol_magic: uint32(wire.MainNet)},
+			},
+			map[string]wire.BitcoinNet{"main": wire.MainNet},
+			true,
+		},
+		{
+			"separate trackers",
+			map[string]*ManagerConfig{
+				"a": {Tracker: "main", Protocol_magic: uint32(wire.MainNet)},
+				"b": {Tracker: "test"},
+			},
+			map[string]wire.BitcoinNet{
+				"main": wire.MainNet,
+				"test": wire.TestNet3,
+			},
+			true,
+		},
+		{
+			"shared tracker",
+			map[string]*ManagerConfig{
+				"a": {Tracker: "main", Protocol_magic: uint32(wire.MainNet)},
+				"b": {Tracker: "main", Protocol_magic: uint32(wire.MainNet)},
+			},
+			map[string]wire.BitcoinNet{"main": wire.MainNet},
+			true,
+		},
+		{
+			"conflicting networks",
+			map[string]*ManagerConfig{
+				"a": {Tracker: "main", Protocol_magic: uint32(wire.MainNet)},
+				"b": {Tracker: "main"},
+			},
+			nil,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		networks, err := trackerNetworks(&Config{Manager: test.managers})
+		if (err == nil) != test.valid {
+			t.Errorf("%v: unexpected error state (%v)", test.name, err)
+			continue
+		}
+
+		if !test.valid {
+			continue
+		}
+
+		if len(networks) != len(test.networks) {
+			t.Errorf("%v: networks are %v, want %v", test.name, networks,
+				test.networks)
+			continue
+		}
+
+		for name, network := range test.networks {
+			if networks[name] != network {
+				t.Errorf("%v: tracker %q on %v, want %v", test.name, name,
+					networks[name], network)
+			}
+		}
+	}
+}
+
+func TestDownstream(t *testing.T) {
+	links := map[string][]string{
+		"filter": {"analyzer", "writer"},
+		"router": {"filter", "router"},
+		"other":  {"writer"},
+	}
+
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{nil, []string{}},
+		{[]string{"writer"}, []string{"writer"}},
+		{[]string{"filter"}, []string{"analyzer", "filter", "writer"}},
+		{[]string{"router"},
+			[]string{"analyzer", "filter", "router", "writer"}},
+		{[]string{"other", "missing"}, []string{"missing", "other", "writer"}},
+	}
+
+	for _, test := range tests {
+		reached := downstream(test.names, links)
+		names := make([]string, 0, len(reached))
+		for name := range reached {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%v: reached %v, want %v", test.names, names, test.want)
+		}
+	}
+}
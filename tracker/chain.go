@@ -0,0 +1,268 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package tracker
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/util"
+)
+
+const (
+	// maxForkDepth is how far below the tip of our best chain a header may
+	// fork off; deeper forks are rejected and side branches that fall further
+	// behind are pruned.
+	maxForkDepth = 144
+
+	// maxSideHeaders is the number of headers off our best chain we keep
+	// before pruning the ones that fell behind.
+	maxSideHeaders = 10000
+)
+
+// header is a block header in the tree of headers we received, together with
+// its height and the total work of the chain up to and including it.
+type header struct {
+	hdr    wire.BlockHeader
+	height int
+	work   *big.Int
+}
+
+// params returns the chain parameters of the given network, or nil if we
+// don't know its genesis block.
+func params(network wire.BitcoinNet) *chaincfg.Params {
+	switch network {
+	case wire.MainNet:
+		return &chaincfg.MainNetParams
+
+	case wire.TestNet:
+		return &chaincfg.RegressionNetParams
+
+	case wire.TestNet3:
+		return &chaincfg.TestNet3Params
+
+	case wire.SimNet:
+		return &chaincfg.SimNetParams
+
+	default:
+		return nil
+	}
+}
+
+// root starts the header tree at the genesis block of the network.
+func (tracker *Tracker) root() {
+	genesis := tracker.params.GenesisBlock.Header
+	hash := genesis.BlockSha()
+	target := util.CompactToBig(genesis.Bits)
+
+	tracker.headers = make(map[wire.ShaHash]*header)
+	tracker.headers[hash] = &header{
+		hdr:    genesis,
+		height: 0,
+		work:   util.CalcWork(target),
+	}
+	tracker.chain = []wire.ShaHash{hash}
+}
+
+// AddHeader adds a block header to the header tree, which starts at the genesis
+// block of our network. Headers are only accepted if they connect to a known
+// header, their hash meets the target given by their bits and the target does
+// not exceed the proof-of-work limit of the network. Headers forking off more
+// than a day of blocks below our tip are rejected. The best chain is the one
+// with the most total work. If the header is not accepted, false is returned,
+// so the caller can ask for the headers in between.
+func (tracker *Tracker) AddHeader(hdr *wire.BlockHeader) bool {
+	hash := hdr.BlockSha()
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	_, ok := tracker.headers[hash]
+	if ok {
+		return true
+	}
+
+	prev, ok := tracker.headers[hdr.PrevBlock]
+	if !ok {
+		return false
+	}
+
+	tip := len(tracker.chain) - 1
+	if prev.height < tip-maxForkDepth {
+		return false
+	}
+
+	target := util.CompactToBig(hdr.Bits)
+	if target.Sign() <= 0 || target.Cmp(tracker.params.PowLimit) > 0 ||
+		util.HashToBig(&hash).Cmp(target) > 0 {
+		return false
+	}
+
+	h := &header{
+		hdr:    *hdr,
+		height: prev.height + 1,
+		work:   new(big.Int).Add(prev.work, util.CalcWork(target)),
+	}
+
+	tracker.headers[hash] = h
+
+	// if this header does not make a chain with more work, we are done
+	best := tracker.headers[tracker.chain[tip]]
+	if h.work.Cmp(best.work) <= 0 {
+		tracker.prune()
+		return true
+	}
+
+	// otherwise, walk back until we meet the best chain and switch over
+	if h.height+1 < len(tracker.chain) {
+		tracker.chain = tracker.chain[:h.height+1]
+	}
+
+	for len(tracker.chain) < h.height+1 {
+		tracker.chain = append(tracker.chain, wire.ShaHash{})
+	}
+
+	for height := h.height; height >= 0; height-- {
+		if tracker.chain[height] == hash {
+			break
+		}
+
+		tracker.chain[height] = hash
+		hash = tracker.headers[hash].hdr.PrevBlock
+	}
+
+	tracker.prune()
+
+	return true
+}
+
+// prune removes the headers off our best chain that fell too far behind the
+// tip, once there are too many of them, together with all headers building on
+// them. The caller needs to hold the mutex.
+func (tracker *Tracker) prune() {
+	if len(tracker.headers)-len(tracker.chain) <= maxSideHeaders {
+		return
+	}
+
+	side := make([]*header, 0, len(tracker.headers)-len(tracker.chain))
+	for hash, h := range tracker.headers {
+		if h.height < len(tracker.chain) && tracker.chain[h.height] == hash {
+			continue
+		}
+
+		side = append(side, h)
+	}
+
+	// we go through the side headers from the lowest up, so that the parent of
+	// a header is always handled before the header itself
+	sort.Sort(byHeight(side))
+
+	cutoff := len(tracker.chain) - 1 - maxForkDepth
+	for _, h := range side {
+		_, ok := tracker.headers[h.hdr.PrevBlock]
+		if h.height < cutoff || !ok {
+			delete(tracker.headers, h.hdr.BlockSha())
+		}
+	}
+}
+
+// byHeight allows us to sort headers by ascending height.
+type byHeight []*header
+
+func (hdrs byHeight) Len() int {
+	return len(hdrs)
+}
+
+func (hdrs byHeight) Swap(i, j int) {
+	hdrs[i], hdrs[j] = hdrs[j], hdrs[i]
+}
+
+func (hdrs byHeight) Less(i, j int) bool {
+	return hdrs[i].height < hdrs[j].height
+}
+
+// Locator returns a block locator for our best chain: the ten most recent
+// hashes, followed by hashes at exponentially growing distances, and the root.
+func (tracker *Tracker) Locator() []*wire.ShaHash {
+	tracker.mutex.RLock()
+	defer tracker.mutex.RUnlock()
+
+	locator := make([]*wire.ShaHash, 0, wire.MaxBlockLocatorsPerMsg)
+	step := 1
+	for i := len(tracker.chain) - 1; i >= 0; i -= step {
+		hash := tracker.chain[i]
+		locator = append(locator, &hash)
+
+		if len(locator) >= 10 {
+			step *= 2
+		}
+
+		if len(locator) == wire.MaxBlockLocatorsPerMsg-1 {
+			break
+		}
+	}
+
+	if len(tracker.chain) > 0 && len(locator) > 0 &&
+		*locator[len(locator)-1] != tracker.chain[0] {
+		root := tracker.chain[0]
+		locator = append(locator, &root)
+	}
+
+	return locator
+}
+
+// Headers returns the headers of our best chain following the first hash of
+// the locator that is on it, up to and including the stop hash or until the
+// maximum number of headers is reached. If none of the locator hashes are
+// known, we start after the genesis block, like a normal node.
+func (tracker *Tracker) Headers(locator []*wire.ShaHash, stop *wire.ShaHash,
+	max int) []*wire.BlockHeader {
+	tracker.mutex.RLock()
+	defer tracker.mutex.RUnlock()
+
+	start := 1
+	for _, hash := range locator {
+		h, ok := tracker.headers[*hash]
+		if !ok || h.height >= len(tracker.chain) ||
+			tracker.chain[h.height] != *hash {
+			continue
+		}
+
+		start = h.height + 1
+		break
+	}
+
+	hdrs := make([]*wire.BlockHeader, 0, max)
+	for i := start; i < len(tracker.chain) && len(hdrs) < max; i++ {
+		hash := tracker.chain[i]
+		hdr := tracker.headers[hash].hdr
+		hdrs = append(hdrs, &hdr)
+
+		if stop != nil && hash == *stop {
+			break
+		}
+	}
+
+	return hdrs
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/CIRCL/pbtc/util"
+)
+
+const (
+	// easyBits is the proof-of-work limit of the simulation network.
+	easyBits = 0x207fffff
+
+	// hardBits is a target that needs about 512 hashes.
+	hardBits = 0x1f7fffff
+
+	// tooEasyBits is a target above the proof-of-work limit.
+	tooEasyBits = 0x217fffff
+)
+
+// mineHeader returns a header on top of the given block. If mined is set, the
+// nonce is chosen so that the hash meets the target, otherwise so that it
+// doesn't. The salt makes headers with the same parent distinct.
+func mineHeader(prev wire.ShaHash, bits uint32, salt string,
+	mined bool) *wire.BlockHeader {
+	hdr := &wire.BlockHeader{
+		Version:   2,
+		PrevBlock: prev,
+		Timestamp: time.Unix(1400000000, 0),
+		Bits:      bits,
+	}
+	copy(hdr.MerkleRoot[:], salt)
+
+	target := util.CompactToBig(bits)
+	for {
+		hash := hdr.BlockSha()
+		if (util.HashToBig(&hash).Cmp(target) <= 0) == mined {
+			return hdr
+		}
+
+		hdr.Nonce++
+	}
+}
+
+// newSimTracker returns a tracker rooted at the simulation network genesis.
+func newSimTracker(t *testing.T) *Tracker {
+	tracker, err := New(SetNetwork(wire.SimNet))
+	if err != nil {
+		t.Fatalf("could not create tracker (%v)", err)
+	}
+
+	return tracker
+}
+
+// extend mines a number of easy headers on top of the given one and adds them
+// to the tracker, returning their hashes.
+func extend(t *testing.T, tracker *Tracker, prev wire.ShaHash, count int,
+	salt string) []wire.ShaHash {
+	hashes := make([]wire.ShaHash, 0, count)
+	for i := 0; i < count; i++ {
+		hdr := mineHeader(prev, easyBits, salt, true)
+		if !tracker.AddHeader(hdr) {
+			t.Fatalf("header %v on %v rejected", i, salt)
+		}
+
+		prev = hdr.BlockSha()
+		hashes = append(hashes, prev)
+	}
+
+	return hashes
+}
+
+func TestAddHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		parent   string
+		bits     uint32
+		mined    bool
+		accepted bool
+		tip      string
+	}{
+		{"a", "genesis", easyBits, true, true, "a"},
+		{"b", "a", easyBits, true, true, "b"},
+		{"orphan", "unknown", easyBits, true, false, "b"},
+		{"unmined", "b", easyBits, false, false, "b"},
+		{"too easy", "b", tooEasyBits, true, false, "b"},
+		{"c", "b", easyBits, true, true, "c"},
+		{"side", "a", easyBits, true, true, "c"},
+		{"heavy", "a", hardBits, true, true, "heavy"},
+		{"d", "c", easyBits, true, true, "heavy"},
+		{"e", "d", hardBits, true, true, "e"},
+	}
+
+	tracker := newSimTracker(t)
+	hashes := map[string]wire.ShaHash{
+		"genesis": *chaincfg.SimNetParams.GenesisHash,
+		"unknown": {1},
+	}
+
+	for _, test := range tests {
+		hdr := mineHeader(hashes[test.parent], test.bits, test.name,
+			test.mined)
+		hashes[test.name] = hdr.BlockSha()
+
+		if tracker.AddHeader(hdr) != test.accepted {
+			t.Errorf("%v: accepted is %v, want %v", test.name, !test.accepted,
+				test.accepted)
+		}
+
+		tip := tracker.chain[len(tracker.chain)-1]
+		if tip != hashes[test.tip] {
+			t.Errorf("%v: tip is %v, want %v", test.name, tip, test.tip)
+		}
+
+		if !tracker.AddHeader(hdr) && test.accepted {
+			t.Errorf("%v: known header rejected", test.name)
+		}
+	}
+
+	// the best chain is linked back to the genesis block
+	for height := len(tracker.chain) - 1; height > 0; height-- {
+		h := tracker.headers[tracker.chain[height]]
+		if h.height != height || h.hdr.PrevBlock != tracker.chain[height-1] {
+			t.Fatalf("best chain broken at height %v", height)
+		}
+	}
+}
+
+func TestAddHeaderDepth(t *testing.T) {
+	tracker := newSimTracker(t)
+	genesis := *chaincfg.SimNetParams.GenesisHash
+	hashes := extend(t, tracker, genesis, maxForkDepth+10, "main")
+
+	tests := []struct {
+		name     string
+		parent   wire.ShaHash
+		accepted bool
+	}{
+		{"shallow fork", hashes[len(hashes)-5], true},
+		{"deepest fork", hashes[len(hashes)-1-maxForkDepth], true},
+		{"too deep fork", hashes[len(hashes)-2-maxForkDepth], false},
+		{"genesis", genesis, false},
+		{"tip", hashes[len(hashes)-1], true},
+	}
+
+	for _, test := range tests {
+		hdr := mineHeader(test.parent, easyBits, test.name, true)
+		if tracker.AddHeader(hdr) != test.accepted {
+			t.Errorf("%v: accepted is %v, want %v", test.name, !test.accepted,
+				test.accepted)
+		}
+	}
+}
+
+func TestLocator(t *testing.T) {
+	tests := []struct {
+		count int
+		size  int
+	}{
+		{0, 1},
+		{5, 6},
+		{10, 11},
+		{30, 14},
+		{1000, 19},
+	}
+
+	for _, test := range tests {
+		tracker := newSimTracker(t)
+		genesis := *chaincfg.SimNetParams.GenesisHash
+		extend(t, tracker, genesis, test.count, "main")
+
+		locator := tracker.Locator()
+		if len(locator) != test.size {
+			t.Errorf("%v headers: locator has %v hashes, want %v", test.count,
+				len(locator), test.size)
+			continue
+		}
+
+		tip := tracker.chain[len(tracker.chain)-1]
+		if *locator[0] != tip || *locator[len(locator)-1] != genesis {
+			t.Errorf("%v headers: locator does not span the chain",
+				test.count)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	tracker := newSimTracker(t)
+	genesis := *chaincfg.SimNetParams.GenesisHash
+	hashes := extend(t, tracker, genesis, 20, "main")
+	side := extend(t, tracker, hashes[4], 1, "side")
+
+	unknown := wire.ShaHash{1}
+	none := wire.ShaHash{}
+
+	tests := []struct {
+		name    string
+		locator []*wire.ShaHash
+		stop    *wire.ShaHash
+		max     int
+		first   int
+		count   int
+	}{
+		{"empty locator", nil, nil, 2000, 0, 20},
+		{"unknown locator", []*wire.ShaHash{&unknown}, nil, 2000, 0, 20},
+		{"from height 5", []*wire.ShaHash{&hashes[4]}, nil, 2000, 5, 15},
+		{"first known", []*wire.ShaHash{&unknown, &hashes[9], &hashes[4]},
+			nil, 2000, 10, 10},
+		{"side chain", []*wire.ShaHash{&side[0], &hashes[2]}, nil, 2000, 3,
+			17},
+		{"up to stop", []*wire.ShaHash{&hashes[4]}, &hashes[7], 2000, 5, 3},
+		{"zero stop", []*wire.ShaHash{&hashes[4]}, &none, 2000, 5, 15},
+		{"limited", []*wire.ShaHash{&genesis}, nil, 4, 0, 4},
+		{"at the tip", []*wire.ShaHash{&hashes[19]}, nil, 2000, 0, 0},
+	}
+
+	for _, test := range tests {
+		hdrs := tracker.Headers(test.locator, test.stop, test.max)
+		if len(hdrs) != test.count {
+			t.Errorf("%v: got %v headers, want %v", test.name, len(hdrs),
+				test.count)
+			continue
+		}
+
+		for i, hdr := range hdrs {
+			if hdr.BlockSha() != hashes[test.first+i] {
+				t.Errorf("%v: header %v is not at height %v", test.name, i,
+					test.first+i+1)
+				break
+			}
+		}
+	}
+}
@@ -21,6 +21,10 @@
 package tracker
 
 import (
+	"errors"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/wire"
 
 	"github.com/CIRCL/pbtc/adaptor"
@@ -31,21 +35,49 @@ type Tracker struct {
 	blocks *parmap.ParMap
 	txs    *parmap.ParMap
 	log    adaptor.Log
+
+	mutex   *sync.RWMutex
+	params  *chaincfg.Params
+	headers map[wire.ShaHash]*header
+	chain   []wire.ShaHash
 }
 
 func New(options ...func(*Tracker)) (*Tracker, error) {
 	tracker := &Tracker{
 		blocks: parmap.New(),
 		txs:    parmap.New(),
+
+		mutex:  &sync.RWMutex{},
+		params: params(wire.TestNet3),
 	}
 
 	for _, option := range options {
 		option(tracker)
 	}
 
+	if tracker.params == nil {
+		return nil, errors.New("unknown tracker network")
+	}
+
+	tracker.root()
+
 	return tracker, nil
 }
 
+// SetNetwork sets the network whose genesis block is the root of our header
+// chain and whose proof-of-work limit headers are checked against.
+func SetNetwork(network wire.BitcoinNet) func(*Tracker) {
+	return func(tracker *Tracker) {
+		tracker.params = params(network)
+	}
+}
+
+// Network returns the network whose genesis block is the root of our header
+// chain.
+func (tracker *Tracker) Network() wire.BitcoinNet {
+	return tracker.params.Net
+}
+
 func (tracker *Tracker) Start() {
 	tracker.log.Info("[TKR] Start: begin")
 
@@ -0,0 +1,70 @@
+// Copyright (c) 2015 Max Wolter
+// Copyright (c) 2015 CIRCL - Computer Incident Response Center Luxembourg
+//                           (c/o smile, security made in Lëtzebuerg, Groupement
+//                           d'Intérêt Economique)
+//
+// This file is part of PBTC.
+//
+// PBTC is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// PBTC is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with PBTC.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"math/big"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// CompactToBig converts the compact representation of a target, as used in the
+// bits field of block headers, to a big integer.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if negative {
+		target = target.Neg(target)
+	}
+
+	return target
+}
+
+// HashToBig interprets a block hash as a little-endian 256 bit integer, so it
+// can be compared to the target.
+func HashToBig(hash *wire.ShaHash) *big.Int {
+	buf := *hash
+	for i := 0; i < wire.HashSize/2; i++ {
+		buf[i], buf[wire.HashSize-1-i] = buf[wire.HashSize-1-i], buf[i]
+	}
+
+	return new(big.Int).SetBytes(buf[:])
+}
+
+// CalcWork returns the expected number of hashes needed to find a block with
+// the given target: 2^256 / (target + 1).
+func CalcWork(target *big.Int) *big.Int {
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	return numerator.Div(numerator, denominator)
+}